@@ -0,0 +1,488 @@
+package inetdata
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+
+	mtbl "github.com/hdm/golang-mtbl"
+)
+
+// ARIN record types, as emitted by inetdata-arin-xml2json
+const ARINTypeOrg = "org"
+const ARINTypeNet = "net"
+const ARINTypePOC = "poc"
+const ARINTypeASN = "asn"
+
+// Index keys of an ARIN MTBL, next to the records stored under "<type>:<handle>"
+const arinKeyOrgNets = "org-nets:"
+const arinKeyOrgASNs = "org-asns:"
+const arinKeyCIDR = "cidr:"
+const arinKeyASNumber = "asnum:"
+
+const arinMaxASNumber = 1<<32 - 1
+
+// MatchASNumber matches an AS number with an optional AS prefix
+var MatchASNumber = regexp.MustCompile(`^(?i:as)?([0-9]{1,10})$`)
+
+// ARINPocLink refers to a POC from an org or ASN record
+type ARINPocLink struct {
+	Description string `json:"Description,omitempty"`
+	Function    string `json:"Function,omitempty"`
+	Handle      string `json:"Handle,omitempty"`
+}
+
+// ARINRecord holds the fields of an ARIN record that link it to other records,
+// along with the record itself
+type ARINRecord struct {
+	Type          string          `json:"-"`
+	Raw           json.RawMessage `json:"-"`
+	Class         string          `json:"class"`
+	Handle        string          `json:"handle"`
+	OrgHandle     string          `json:"orgHandle"`
+	StartAddress  string          `json:"startAddress"`
+	EndAddress    string          `json:"endAddress"`
+	StartAsNumber string          `json:"startAsNumber"`
+	EndAsNumber   string          `json:"endAsNumber"`
+	IsRoleAccount string          `json:"isRoleAccount"`
+	PocLinks      *struct {
+		PocLink []ARINPocLink `json:"pocLink"`
+	} `json:"pocLinks"`
+}
+
+// ParseARINRecord decodes a line of inetdata-arin-xml2json or inetdata-rpsl2json
+// output. ARIN records do not name their type, so it is inferred from the fields
+// present, while RPSL records are typed by class. RPSL classes without an ARIN
+// record type, such as routes, return a nil record.
+func ParseARINRecord(data []byte) (*ARINRecord, error) {
+	rec := &ARINRecord{}
+	if err := json.Unmarshal(data, rec); err != nil {
+		return nil, err
+	}
+
+	if len(rec.Handle) == 0 {
+		return nil, fmt.Errorf("record has no handle")
+	}
+
+	switch {
+	case len(rec.Class) > 0:
+		t, ok := RPSLClassTypes[rec.Class]
+		if !ok && RPSLClasses[rec.Class] {
+			return nil, nil
+		}
+		if !ok {
+			return nil, fmt.Errorf("unsupported record class %s", rec.Class)
+		}
+		rec.Type = t
+	case len(rec.StartAsNumber) > 0:
+		rec.Type = ARINTypeASN
+	case len(rec.StartAddress) > 0:
+		rec.Type = ARINTypeNet
+	case len(rec.IsRoleAccount) > 0:
+		rec.Type = ARINTypePOC
+	default:
+		rec.Type = ARINTypeOrg
+	}
+
+	rec.Raw = append(json.RawMessage{}, data...)
+	return rec, nil
+}
+
+// Links returns the POC links of the record
+func (rec *ARINRecord) Links() []ARINPocLink {
+	if rec.PocLinks == nil {
+		return nil
+	}
+	return rec.PocLinks.PocLink
+}
+
+// CIDRs returns the networks covered by a net record
+func (rec *ARINRecord) CIDRs() ([]string, error) {
+	return arinRangeCIDRs(rec.StartAddress, rec.EndAddress)
+}
+
+// ARINNet is a net record from the ARIN bulk XML, including every network block
+type ARINNet struct {
+	Handle           string         `xml:"handle"`
+	Name             string         `xml:"name"`
+	OrgHandle        string         `xml:"orgHandle"`
+	CustomerHandle   string         `xml:"customerHandle"`
+	ParentNetHandle  string         `xml:"parentNetHandle"`
+	StartAddress     string         `xml:"startAddress"`
+	EndAddress       string         `xml:"endAddress"`
+	Version          string         `xml:"version"`
+	RegistrationDate string         `xml:"registrationDate"`
+	UpdateDate       string         `xml:"updateDate"`
+	NetBlocks        []ARINNetBlock `xml:"netBlocks>netBlock"`
+}
+
+// ARINNetBlock is a single network block of a net
+type ARINNetBlock struct {
+	StartAddress string `xml:"startAddress"`
+	EndAddress   string `xml:"endAddress"`
+	CidrLength   string `xml:"cidrLength"`
+	Type         string `xml:"type"`
+}
+
+// Owner returns the handle of the org or customer holding the net
+func (n *ARINNet) Owner() string {
+	if len(n.OrgHandle) > 0 {
+		return n.OrgHandle
+	}
+	return n.CustomerHandle
+}
+
+// CIDRs returns the network blocks of the net, falling back to the address
+// range when no blocks are listed
+func (n *ARINNet) CIDRs() ([]string, error) {
+	if len(n.NetBlocks) == 0 {
+		return arinRangeCIDRs(n.StartAddress, n.EndAddress)
+	}
+
+	cidrs := []string{}
+	for _, nb := range n.NetBlocks {
+		if len(nb.CidrLength) == 0 {
+			more, err := arinRangeCIDRs(nb.StartAddress, nb.EndAddress)
+			if err != nil {
+				return cidrs, err
+			}
+			cidrs = append(cidrs, more...)
+			continue
+		}
+		cidrs = append(cidrs, NormalizeARINAddress(nb.StartAddress)+"/"+nb.CidrLength)
+	}
+	return cidrs, nil
+}
+
+// ReadARINNets calls fn for each net record in ARIN bulk XML
+func ReadARINNets(r io.Reader, fn func(*ARINNet)) error {
+	decoder := xml.NewDecoder(r)
+	for {
+		t, err := decoder.Token()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		se, ok := t.(xml.StartElement)
+		if !ok || se.Name.Local != "net" {
+			continue
+		}
+
+		n := &ARINNet{}
+		if err := decoder.DecodeElement(n, &se); err != nil {
+			return err
+		}
+		if len(n.Handle) > 0 {
+			fn(n)
+		}
+	}
+}
+
+// NormalizeARINAddress converts the zero-padded addresses of the ARIN bulk data
+// ("008.008.008.000", "2001:0DB8:0000:...") to the usual form. Other strings are
+// returned as-is.
+func NormalizeARINAddress(addr string) string {
+	if strings.Contains(addr, ":") {
+		if ip := net.ParseIP(addr); ip != nil {
+			return ip.String()
+		}
+		return addr
+	}
+
+	octets := strings.Split(addr, ".")
+	if len(octets) != 4 {
+		return addr
+	}
+
+	for i := range octets {
+		v, err := strconv.ParseUint(octets[i], 10, 8)
+		if err != nil {
+			return addr
+		}
+		octets[i] = strconv.FormatUint(v, 10)
+	}
+	return strings.Join(octets, ".")
+}
+
+func arinRangeCIDRs(start string, end string) ([]string, error) {
+	start, end = NormalizeARINAddress(start), NormalizeARINAddress(end)
+	if strings.Contains(start, ":") {
+		return IPv6Range2CIDRs(start, end)
+	}
+	return IPv4Range2CIDRs(start, end)
+}
+
+// AddARINRecord stores a record along with the index entries used by
+// LookupARINWhois. The builder should merge with MTBLMergeAuto, so that index
+// entries from several records are combined.
+func AddARINRecord(b *MTBLBuilder, rec *ARINRecord) error {
+	if err := b.Add(arinHandleKey(rec.Type, rec.Handle), rec.Raw); err != nil {
+		return err
+	}
+
+	ref, err := json.Marshal([][]string{{rec.Type, strings.ToUpper(rec.Handle)}})
+	if err != nil {
+		return err
+	}
+
+	switch rec.Type {
+	case ARINTypeNet:
+		if len(rec.OrgHandle) > 0 {
+			if err := b.Add(arinHandleKey(arinKeyOrgNets, rec.OrgHandle), ref); err != nil {
+				return err
+			}
+		}
+
+		cidrs, err := rec.CIDRs()
+		if err != nil {
+			return fmt.Errorf("net %s has an invalid range: %s", rec.Handle, err)
+		}
+		for _, cidr := range cidrs {
+			_, ipnet, err := net.ParseCIDR(cidr)
+			if err != nil {
+				continue
+			}
+			if err := b.Add(arinCIDRKey(ipnet), ref); err != nil {
+				return err
+			}
+		}
+
+	case ARINTypeASN:
+		if len(rec.OrgHandle) > 0 {
+			if err := b.Add(arinHandleKey(arinKeyOrgASNs, rec.OrgHandle), ref); err != nil {
+				return err
+			}
+		}
+
+		// Ranges do not overlap, so the first range ending at or after a number
+		// is the only one that can contain it
+		end, err := strconv.ParseUint(rec.EndAsNumber, 10, 32)
+		if err != nil {
+			return fmt.Errorf("asn %s has an invalid end number: %s", rec.Handle, rec.EndAsNumber)
+		}
+		if err := b.Add(arinASNumberKey(uint32(end)), ref); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ARINWhois is the result of a whois lookup, with the matched record joined to
+// its org, the nets and ASNs of the org, and the POCs they link to
+type ARINWhois struct {
+	Query     string            `json:"query"`
+	Type      string            `json:"type"`
+	Match     json.RawMessage   `json:"match"`
+	Org       json.RawMessage   `json:"org,omitempty"`
+	Nets      []json.RawMessage `json:"nets,omitempty"`
+	ASNs      []json.RawMessage `json:"asns,omitempty"`
+	POCs      []ARINWhoisPOC    `json:"pocs,omitempty"`
+	Truncated bool              `json:"truncated,omitempty"`
+}
+
+// ARINWhoisPOC is a POC along with the role it was linked with
+type ARINWhoisPOC struct {
+	Handle      string          `json:"handle"`
+	Function    string          `json:"function,omitempty"`
+	Description string          `json:"description,omitempty"`
+	POC         json.RawMessage `json:"poc,omitempty"`
+}
+
+// LookupARINWhois finds a record in an ARIN MTBL by IP address (the most
+// specific net), by handle, or by AS number, and joins it to the related
+// records. At most limit nets and ASNs of the org are included.
+func LookupARINWhois(src mtbl.Source, query string, limit int) (*ARINWhois, bool) {
+	rec := lookupARINRecord(src, query)
+	if rec == nil {
+		return nil, false
+	}
+
+	res := &ARINWhois{Query: query, Type: rec.Type, Match: rec.Raw}
+	links := rec.Links()
+
+	org := rec
+	if rec.Type == ARINTypeNet || rec.Type == ARINTypeASN {
+		org = getARINRecord(src, ARINTypeOrg, rec.OrgHandle)
+	}
+
+	if org != nil && org.Type == ARINTypeOrg {
+		res.Org = org.Raw
+		links = append(links, org.Links()...)
+
+		for _, h := range arinRefs(src, arinHandleKey(arinKeyOrgNets, org.Handle)) {
+			if len(res.Nets) >= limit {
+				res.Truncated = true
+				break
+			}
+			if n := getARINRecord(src, ARINTypeNet, h); n != nil {
+				res.Nets = append(res.Nets, n.Raw)
+			}
+		}
+
+		for _, h := range arinRefs(src, arinHandleKey(arinKeyOrgASNs, org.Handle)) {
+			if len(res.ASNs) >= limit {
+				res.Truncated = true
+				break
+			}
+			if asn := getARINRecord(src, ARINTypeASN, h); asn != nil {
+				res.ASNs = append(res.ASNs, asn.Raw)
+			}
+		}
+	}
+
+	seen := make(map[ARINPocLink]bool)
+	for _, l := range links {
+		if len(l.Handle) == 0 || seen[l] {
+			continue
+		}
+		seen[l] = true
+
+		p := ARINWhoisPOC{Handle: l.Handle, Function: l.Function, Description: l.Description}
+		if poc := getARINRecord(src, ARINTypePOC, l.Handle); poc != nil {
+			p.POC = poc.Raw
+		}
+		res.POCs = append(res.POCs, p)
+	}
+
+	return res, true
+}
+
+// lookupARINRecord finds the record matching a whois query
+func lookupARINRecord(src mtbl.Source, query string) *ARINRecord {
+	if ip := net.ParseIP(query); ip != nil {
+		for _, h := range lookupARINNets(src, query) {
+			if rec := getARINRecord(src, ARINTypeNet, h); rec != nil {
+				return rec
+			}
+		}
+		return nil
+	}
+
+	for _, t := range []string{ARINTypeOrg, ARINTypeNet, ARINTypeASN, ARINTypePOC} {
+		if rec := getARINRecord(src, t, query); rec != nil {
+			return rec
+		}
+	}
+
+	m := MatchASNumber.FindStringSubmatch(query)
+	if m == nil {
+		return nil
+	}
+
+	num, err := strconv.ParseUint(m[1], 10, 32)
+	if err != nil {
+		return nil
+	}
+
+	it := mtbl.IterRange(src, arinASNumberKey(uint32(num)), arinASNumberKey(arinMaxASNumber))
+	defer it.Destroy()
+
+	key, _, ok := it.Next()
+	if !ok {
+		return nil
+	}
+
+	for _, h := range arinRefs(src, key) {
+		rec := getARINRecord(src, ARINTypeASN, h)
+		if rec == nil {
+			continue
+		}
+		start, err := strconv.ParseUint(rec.StartAsNumber, 10, 32)
+		if err == nil && start <= num {
+			return rec
+		}
+	}
+	return nil
+}
+
+// lookupARINNets returns the handles of the nets with the most specific block
+// containing an address
+func lookupARINNets(src mtbl.Source, ips string) []string {
+	key, ok := EncodeIPKey(ips)
+	if !ok {
+		return nil
+	}
+
+	ip := net.IP(key[1:])
+	bits := len(ip) * 8
+
+	for ones := bits; ones >= 0; ones-- {
+		ipnet := &net.IPNet{IP: ip, Mask: net.CIDRMask(ones, bits)}
+		if refs := arinRefs(src, arinCIDRKey(ipnet)); len(refs) > 0 {
+			return refs
+		}
+	}
+	return nil
+}
+
+func getARINRecord(src mtbl.Source, t string, handle string) *ARINRecord {
+	if len(handle) == 0 {
+		return nil
+	}
+
+	val, ok := mtbl.Get(src, arinHandleKey(t, handle))
+	if !ok {
+		return nil
+	}
+
+	rec, err := ParseARINRecord(val)
+	if err != nil || rec == nil {
+		return nil
+	}
+	rec.Type = t
+	return rec
+}
+
+// arinRefs returns the handles stored in an index entry
+func arinRefs(src mtbl.Source, key []byte) []string {
+	val, ok := mtbl.Get(src, key)
+	if !ok {
+		return nil
+	}
+
+	var refs [][]string
+	if err := json.Unmarshal(val, &refs); err != nil {
+		return nil
+	}
+
+	handles := []string{}
+	for _, r := range refs {
+		if len(r) == 2 {
+			handles = append(handles, r[1])
+		}
+	}
+	return handles
+}
+
+// arinHandleKey returns the key of a record or handle index, handles are case
+// insensitive
+func arinHandleKey(prefix string, handle string) []byte {
+	if !strings.HasSuffix(prefix, ":") {
+		prefix += ":"
+	}
+	return []byte(prefix + strings.ToUpper(handle))
+}
+
+// arinCIDRKey returns the key of a network block, the binary-encoded network
+// address followed by the prefix length
+func arinCIDRKey(ipnet *net.IPNet) []byte {
+	first, _ := IPKeyRange(ipnet)
+	ones, _ := ipnet.Mask.Size()
+
+	key := append([]byte(arinKeyCIDR), first...)
+	return append(key, byte(ones))
+}
+
+// arinASNumberKey returns the key of an AS number range, by its last number
+func arinASNumberKey(num uint32) []byte {
+	return []byte(fmt.Sprintf("%s%010d", arinKeyASNumber, num))
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"runtime"
+
+	"github.com/hdm/inetdata-parsers"
+)
+
+func usage() {
+	fmt.Println("Usage: " + os.Args[0] + " [options] <output.mtbl>")
+	fmt.Println("")
+	fmt.Println("Creates a MTBL database from the JSON output of inetdata-arin-xml2json or")
+	fmt.Println("inetdata-rpsl2json. Records are stored by handle and indexed by network block, AS")
+	fmt.Println("number, and org, for the mapi whois endpoint. RPSL routes and maintainers are skipped.")
+	fmt.Println("")
+	fmt.Println("Options:")
+	flag.PrintDefaults()
+}
+
+func main() {
+
+	runtime.GOMAXPROCS(runtime.NumCPU())
+	os.Setenv("LC_ALL", "C")
+
+	flag.Usage = func() { usage() }
+
+	compression := flag.String("c", "snappy", "The compression type to use (none, snappy, zlib, lz4, lz4hc)")
+	sort_tmp := flag.String("t", "", "The temporary directory to use for the sorting phase")
+	sort_mem := flag.Uint64("m", 1, "The maximum amount of memory to use, in gigabytes, for the sorting phase")
+	version := flag.Bool("version", false, "Show the version and build timestamp")
+
+	flag.Parse()
+
+	if *version {
+		inetdata.PrintVersion("inetdata-arin-json2mtbl")
+		os.Exit(0)
+	}
+
+	if len(flag.Args()) != 1 {
+		usage()
+		os.Exit(1)
+	}
+
+	fname := flag.Args()[0]
+
+	// Index entries of the same org or network block are combined
+	b, be := inetdata.NewMTBLBuilder(fname, inetdata.MTBLBuilderOptions{
+		Compression: *compression,
+		TempDir:     *sort_tmp,
+		MaxMemory:   *sort_mem * 1000000000,
+		Merge:       inetdata.MTBLMergeAuto,
+		Progress:    inetdata.MTBLProgressPrinter("inetdata-arin-json2mtbl"),
+	})
+	if be != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", be)
+		os.Exit(1)
+	}
+
+	scanner := bufio.NewScanner(os.Stdin)
+	buf := make([]byte, 0, 1024*1024*8)
+	scanner.Buffer(buf, 1024*1024*8)
+
+	for scanner.Scan() {
+		raw := scanner.Bytes()
+		if len(raw) == 0 {
+			continue
+		}
+
+		b.CountInput()
+
+		rec, e := inetdata.ParseARINRecord(raw)
+		if e != nil {
+			fmt.Fprintf(os.Stderr, "[-] Invalid record: %v -> %v\n", e, string(raw))
+			b.CountInvalid()
+			continue
+		}
+
+		// Routes and maintainers from RPSL dumps are not indexed
+		if rec == nil {
+			continue
+		}
+
+		if e := inetdata.AddARINRecord(b, rec); e != nil {
+			fmt.Fprintf(os.Stderr, "[-] Failed to add %s %s: %v\n", rec.Type, rec.Handle, e)
+		}
+	}
+
+	if e := scanner.Err(); e != nil {
+		fmt.Fprintf(os.Stderr, "Error reading input: %s\n", e)
+	}
+
+	if e := b.Close(); e != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", e)
+		os.Exit(1)
+	}
+
+	// Entries are merged as the sorter writes them out
+	stats := b.Stats()
+	fmt.Fprintf(os.Stderr, "[*] Read %d records and wrote %d entries (merged: %d, invalid: %d)\n",
+		stats.Input, stats.Output-stats.Merged, stats.Merged, stats.Invalid)
+}
@@ -1,14 +1,19 @@
 package main
 
 import (
+	"bufio"
 	"encoding/json"
+	"flag"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/url"
 	"os"
+	"path/filepath"
 	"regexp"
 	"strings"
+
+	"github.com/hdm/inetdata-parsers"
 )
 
 var IsCustomerHandle = regexp.MustCompile(`^C[A-F0-9]{8}$`)
@@ -185,6 +190,16 @@ type ARIN_Net struct {
 	} `json:"net"`
 }
 
+// OrgNet is a net of an org in the JSON output
+type OrgNet struct {
+	Org              string   `json:"org"`
+	Handle           string   `json:"handle"`
+	Name             string   `json:"name,omitempty"`
+	RegistrationDate string   `json:"registration_date,omitempty"`
+	UpdateDate       string   `json:"update_date,omitempty"`
+	CIDRs            []string `json:"cidrs"`
+}
+
 func LookupOrgNets(org string) ([]string, error) {
 	handles := []string{}
 
@@ -196,26 +211,12 @@ func LookupOrgNets(org string) ([]string, error) {
 	// determines which API endpoint to use. Fortunately we can tell
 	// which one is what based on the naming convention.
 	if IsCustomerHandle.Match([]byte(org)) {
-		u = fmt.Sprintf("http://whois.arin.net/rest/customer/%s/nets", safe_org)
+		u = fmt.Sprintf("https://whois.arin.net/rest/customer/%s/nets", safe_org)
 	} else {
-		u = fmt.Sprintf("http://whois.arin.net/rest/org/%s/nets", safe_org)
+		u = fmt.Sprintf("https://whois.arin.net/rest/org/%s/nets", safe_org)
 	}
 
-	req, err := http.NewRequest("GET", u, nil)
-	if err != nil {
-		return handles, err
-	}
-	req.Header.Set("Accept", "application/json")
-
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		return handles, err
-	}
-
-	defer resp.Body.Close()
-
-	content, err := ioutil.ReadAll(resp.Body)
+	content, err := fetchJSON(u)
 	if err != nil {
 		return handles, err
 	}
@@ -244,70 +245,227 @@ func LookupOrgNets(org string) ([]string, error) {
 	return handles, nil
 }
 
-func LookupNetCidrs(handle string) ([]string, error) {
-	cidrs := []string{}
-
+func LookupNet(handle string) (*inetdata.ARINNet, error) {
 	safe_handle := url.QueryEscape(handle)
-	u := fmt.Sprintf("http://whois.arin.net/rest/net/%s", safe_handle)
+	u := fmt.Sprintf("https://whois.arin.net/rest/net/%s", safe_handle)
+
+	content, err := fetchJSON(u)
+	if err != nil {
+		return nil, err
+	}
+
+	n := &inetdata.ARINNet{}
+
+	var nets ARIN_Nets
+
+	if err := json.Unmarshal(content, &nets); err == nil {
+		for i := range nets.Net.NetBlocks.NetBlock {
+			n.NetBlocks = append(n.NetBlocks, inetdata.ARINNetBlock{
+				StartAddress: nets.Net.NetBlocks.NetBlock[i].StartAddress.Value,
+				EndAddress:   nets.Net.NetBlocks.NetBlock[i].EndAddress.Value,
+				CidrLength:   nets.Net.NetBlocks.NetBlock[i].CidrLength.Value,
+				Type:         nets.Net.NetBlocks.NetBlock[i].Type.Value,
+			})
+		}
+		n.Handle = nets.Net.Handle.Value
+		n.Name = nets.Net.Name.Value
+		n.OrgHandle = nets.Net.OrgRef.Handle
+		n.RegistrationDate = nets.Net.RegistrationDate.Value
+		n.UpdateDate = nets.Net.UpdateDate.Value
+	} else {
+		// Try to decode as a single-block network
+		var net ARIN_Net
+		if err := json.Unmarshal(content, &net); err != nil {
+			return nil, err
+		}
+		n.NetBlocks = append(n.NetBlocks, inetdata.ARINNetBlock{
+			StartAddress: net.Net.NetBlocks.NetBlock.StartAddress.Value,
+			EndAddress:   net.Net.NetBlocks.NetBlock.EndAddress.Value,
+			CidrLength:   net.Net.NetBlocks.NetBlock.CidrLength.Value,
+			Type:         net.Net.NetBlocks.NetBlock.Type.Value,
+		})
+		n.Handle = net.Net.Handle.Value
+		n.Name = net.Net.Name.Value
+		n.OrgHandle = net.Net.OrgRef.Handle
+		n.RegistrationDate = net.Net.RegistrationDate.Value
+		n.UpdateDate = net.Net.UpdateDate.Value
+	}
+
+	if len(n.Handle) == 0 {
+		n.Handle = handle
+	}
+
+	return n, nil
+}
 
+func fetchJSON(u string) ([]byte, error) {
 	req, err := http.NewRequest("GET", u, nil)
 	if err != nil {
-		return cidrs, err
+		return nil, err
 	}
 	req.Header.Set("Accept", "application/json")
 
 	client := &http.Client{}
 	resp, err := client.Do(req)
 	if err != nil {
-		return cidrs, err
+		return nil, err
 	}
 
 	defer resp.Body.Close()
 
-	content, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return cidrs, err
+	return ioutil.ReadAll(resp.Body)
+}
+
+// LoadOfflineNets reads the nets of the given orgs from the ARIN bulk XML files
+// in a directory. Org handles are matched case-insensitively.
+func LoadOfflineNets(dir string, orgs []string) (map[string][]*inetdata.ARINNet, error) {
+	wanted := make(map[string]bool)
+	for _, org := range orgs {
+		wanted[strings.ToUpper(org)] = true
 	}
 
-	var nets ARIN_Nets
+	paths, err := filepath.Glob(filepath.Join(dir, "*.xml"))
+	if err != nil {
+		return nil, err
+	}
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("no XML files found in %s", dir)
+	}
 
-	if err := json.Unmarshal(content, &nets); err == nil {
-		for i := range nets.Net.NetBlocks.NetBlock {
-			cidrs = append(cidrs, fmt.Sprintf("%s/%s", nets.Net.NetBlocks.NetBlock[i].StartAddress.Value, nets.Net.NetBlocks.NetBlock[i].CidrLength.Value))
+	found := make(map[string][]*inetdata.ARINNet)
+	for _, path := range paths {
+		fd, err := os.Open(path)
+		if err != nil {
+			return nil, err
 		}
-	} else {
-		// Try to decode as a single-block network
-		var net ARIN_Net
-		if err := json.Unmarshal(content, &net); err != nil {
-			return cidrs, err
+
+		err = inetdata.ReadARINNets(fd, func(n *inetdata.ARINNet) {
+			owner := strings.ToUpper(n.Owner())
+			if wanted[owner] {
+				found[owner] = append(found[owner], n)
+			}
+		})
+		fd.Close()
+
+		if err != nil {
+			return nil, fmt.Errorf("could not parse %s: %s", path, err)
 		}
-		cidrs = append(cidrs, fmt.Sprintf("%s/%s", net.Net.NetBlocks.NetBlock.StartAddress.Value, net.Net.NetBlocks.NetBlock.CidrLength.Value))
 	}
 
-	return cidrs, nil
+	return found, nil
 }
 
-func main() {
+func usage() {
+	fmt.Println("Usage: " + os.Args[0] + " [options] [<org-handle> ...]")
+	fmt.Println("")
+	fmt.Println("Lists the CIDRs of the networks held by ARIN org or customer handles, read from")
+	fmt.Println("standard input when none are given. Handles are looked up through the ARIN REST")
+	fmt.Println("API, or in the bulk XML files of a directory with -offline.")
+	fmt.Println("")
+	fmt.Println("Options:")
+	flag.PrintDefaults()
+}
 
-	if len(os.Args) != 2 {
-		fmt.Println("Usage: inetdata-arin-org2nets <org-handle>")
-		os.Exit(1)
+func readOrgs() []string {
+	if len(flag.Args()) > 0 {
+		return flag.Args()
 	}
 
-	org := os.Args[1]
+	orgs := []string{}
+	scanner := bufio.NewScanner(os.Stdin)
+	for scanner.Scan() {
+		org := strings.TrimSpace(scanner.Text())
+		if len(org) == 0 || strings.HasPrefix(org, "#") {
+			continue
+		}
+		orgs = append(orgs, org)
+	}
+	return orgs
+}
+
+func main() {
+
+	flag.Usage = func() { usage() }
+
+	offline := flag.String("offline", "", "Read networks from the ARIN bulk XML files in this directory instead of the REST API")
+	json_output := flag.Bool("j", false, "Print each network as a line of JSON with its handle, name, and dates")
+	version := flag.Bool("version", false, "Show the version and build timestamp")
+
+	flag.Parse()
 
-	handles, e := LookupOrgNets(org)
-	if e != nil {
-		fmt.Fprintf(os.Stderr, "Could not list network handles: %s", e.Error())
+	if *version {
+		inetdata.PrintVersion("inetdata-arin-org2cidrs")
+		os.Exit(0)
+	}
+
+	orgs := readOrgs()
+	if len(orgs) == 0 {
+		usage()
 		os.Exit(1)
 	}
 
-	for i := range handles {
-		cidrs, e := LookupNetCidrs(handles[i])
+	var offline_nets map[string][]*inetdata.ARINNet
+	if len(*offline) > 0 {
+		var e error
+		offline_nets, e = LoadOfflineNets(*offline, orgs)
 		if e != nil {
-			fmt.Fprintf(os.Stderr, "Could not list CIDRs for %s: %s", handles[i], e.Error())
+			fmt.Fprintf(os.Stderr, "Error: %s\n", e)
+			os.Exit(1)
+		}
+	}
+
+	for _, org := range orgs {
+		var nets []*inetdata.ARINNet
+
+		if offline_nets != nil {
+			nets = offline_nets[strings.ToUpper(org)]
+		} else {
+			handles, e := LookupOrgNets(org)
+			if e != nil {
+				fmt.Fprintf(os.Stderr, "Could not list network handles for %s: %s\n", org, e.Error())
+				continue
+			}
+
+			for i := range handles {
+				n, e := LookupNet(handles[i])
+				if e != nil {
+					fmt.Fprintf(os.Stderr, "Could not list CIDRs for %s: %s\n", handles[i], e.Error())
+					continue
+				}
+				nets = append(nets, n)
+			}
+		}
+
+		if len(nets) == 0 {
+			fmt.Fprintf(os.Stderr, "[-] No networks found for %s\n", org)
 			continue
 		}
-		fmt.Println(strings.Join(cidrs, "\n"))
+
+		for _, n := range nets {
+			cidrs, e := n.CIDRs()
+			if e != nil {
+				fmt.Fprintf(os.Stderr, "Could not list CIDRs for %s: %s\n", n.Handle, e.Error())
+				continue
+			}
+
+			if !*json_output {
+				fmt.Println(strings.Join(cidrs, "\n"))
+				continue
+			}
+
+			b, e := json.Marshal(OrgNet{
+				Org:              org,
+				Handle:           n.Handle,
+				Name:             n.Name,
+				RegistrationDate: n.RegistrationDate,
+				UpdateDate:       n.UpdateDate,
+				CIDRs:            cidrs,
+			})
+			if e != nil {
+				fmt.Fprintf(os.Stderr, "Could not marshal %s: %s\n", n.Handle, e.Error())
+				continue
+			}
+			fmt.Println(string(b))
+		}
 	}
 }
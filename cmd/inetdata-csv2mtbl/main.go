@@ -8,7 +8,6 @@ import (
 	"runtime"
 	"strings"
 
-	mtbl "github.com/hdm/golang-mtbl"
 	"github.com/hdm/inetdata-parsers"
 )
 
@@ -21,8 +20,20 @@ func usage() {
 	flag.PrintDefaults()
 }
 
-func mergeFunc(key []byte, val0 []byte, val1 []byte) (mergedVal []byte) {
-	return []byte(string(val0) + " " + string(val1))
+// keyFunc encodes IP address keys and reverses any others as requested
+func keyFunc(ipEncode bool, reverseKey bool) inetdata.MTBLKeyFunc {
+	return func(key []byte) []byte {
+		if ipEncode {
+			if ekey, ok := inetdata.EncodeIPKey(string(key)); ok {
+				return ekey
+			}
+		}
+
+		if reverseKey {
+			return inetdata.ReverseKeyBytes(key)
+		}
+		return key
+	}
 }
 
 func main() {
@@ -41,6 +52,7 @@ func main() {
 	sortSkip := flag.Bool("S", false, "Skip the sorting phase and assume keys are in pre-sorted order")
 	sortTmp := flag.String("t", "", "The temporary directory to use for the sorting phase")
 	sortMem := flag.Uint64("m", 1, "The maximum amount of memory to use, in gigabytes, for the sorting phase")
+	ipEncode := flag.Bool("ip-encode", false, "Store IP address keys in binary form for fast CIDR range lookups")
 
 	version := flag.Bool("version", false, "Show the version and build timestamp")
 
@@ -56,28 +68,24 @@ func main() {
 		os.Exit(1)
 	}
 
-	fname := flag.Args()[0]
-
-	sortOpt := mtbl.SorterOptions{Merge: mergeFunc, MaxMemory: 1000000000}
-	sortOpt.MaxMemory *= *sortMem
-	if len(*sortTmp) > 0 {
-		sortOpt.TempDir = *sortTmp
-	}
-
-	compAlg, ok := inetdata.MTBLCompressionTypes[*compression]
-	if !ok {
-		fmt.Fprintf(os.Stderr, "Invalid compression algorithm: %s\n", *compression)
+	// Binary keys do not sort in the same order as the text input
+	if *ipEncode && *sortSkip {
+		fmt.Fprintf(os.Stderr, "Error: -ip-encode cannot be used with -S\n")
 		os.Exit(1)
 	}
 
-	s := mtbl.SorterInit(&sortOpt)
-	defer s.Destroy()
-
-	w, we := mtbl.WriterInit(fname, &mtbl.WriterOptions{Compression: compAlg})
-	defer w.Destroy()
+	fname := flag.Args()[0]
 
-	if we != nil {
-		fmt.Fprintf(os.Stderr, "Error: %s\n", we)
+	b, be := inetdata.NewMTBLBuilder(fname, inetdata.MTBLBuilderOptions{
+		Compression: *compression,
+		TempDir:     *sortTmp,
+		MaxMemory:   *sortMem * 1000000000,
+		Merge:       inetdata.MTBLMergeAppend(" "),
+		Key:         keyFunc(*ipEncode, *reverseKey),
+		Presorted:   *sortSkip,
+	})
+	if be != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", be)
 		os.Exit(1)
 	}
 
@@ -118,23 +126,8 @@ func main() {
 			continue
 		}
 
-		if *reverseKey {
-			kstr = inetdata.ReverseKey(kstr)
-		}
-
-		if len(kstr) > inetdata.MTBL_KEY_LIMIT || len(vstr) > inetdata.MTBL_VAL_LIMIT {
-			fmt.Printf("Failed to add entry with long key or value\n")
-			continue
-		}
-
-		if *sortSkip {
-			if e := w.Add([]byte(kstr), []byte(vstr)); e != nil {
-				fmt.Printf("Failed to add %v -> %v: %v\n", kstr, vstr, e)
-			}
-		} else {
-			if e := s.Add([]byte(kstr), []byte(vstr)); e != nil {
-				fmt.Printf("Failed to add %v -> %v: %v\n", kstr, vstr, e)
-			}
+		if e := b.Add([]byte(kstr), []byte(vstr)); e != nil {
+			fmt.Printf("Failed to add %v -> %v: %v\n", kstr, vstr, e)
 		}
 	}
 
@@ -143,10 +136,8 @@ func main() {
 		os.Exit(1)
 	}
 
-	if !*sortSkip {
-		if e := s.Write(w); e != nil {
-			fmt.Fprintf(os.Stderr, "Error: %s\n", e)
-			os.Exit(1)
-		}
+	if e := b.Close(); e != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", e)
+		os.Exit(1)
 	}
 }
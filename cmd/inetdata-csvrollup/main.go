@@ -95,20 +95,6 @@ func mergeAndEmit(c chan OutputKey, o chan string) {
 	wg.Done()
 }
 
-// allowedIdentical checks to see if the record type is one of the few
-// DNS record types allowed to point to itself (name=value)
-func allowedIdentical(record_type string) bool {
-	switch record_type {
-	case
-		"ns",
-		"r-ns",
-		"mx",
-		"r-mx":
-		return true
-	}
-	return false
-}
-
 func inputParser(c <-chan string, outc chan<- OutputKey) {
 
 	// Track current key and value array
@@ -154,30 +140,8 @@ func inputParser(c <-chan string, outc chan<- OutputKey) {
 		}
 
 		// Cleanup common scan artifacts, not comprehensive
-
-		// Ignore any records where key is empty or identical to the value
-		// (with the exception of certain types)
-		if len(val) >= len(key) {
-			parts := strings.SplitN(val, ",", 2)
-			if len(parts) == 2 && !allowedIdentical(parts[0]) {
-				if len(parts[1]) == 0 || key == parts[1] {
-					continue
-				}
-			}
-		}
-
-		// TXT records start with an erroneous pipe character
-		if len(val) > 5 && val[0:5] == "txt,|" {
-			val = "txt," + val[5:]
-		}
-
-		// DNSSEC-related TXT records often have trailing bytes
-		if len(val) >= 38 && (val[0:6] == "txt,31" || val[0:6] == "txt,00" || val[0:6] == "txt,aa") {
-			val = val[0:38]
-		}
-
-		// Mangled TXT value, ignore
-		if len(val) >= 5 && len(val) <= 10 && val[0:5] == "txt,~" {
+		val, ok := inetdata.CleanRollupValue(key, val)
+		if !ok {
 			continue
 		}
 
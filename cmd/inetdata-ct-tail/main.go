@@ -1,26 +1,39 @@
 package main
 
 import (
+	"bytes"
+	"compress/gzip"
+	"crypto"
 	"crypto/sha1"
+	"crypto/sha256"
 	"crypto/tls"
+	"encoding/base64"
 	"encoding/hex"
 	"encoding/json"
+	"encoding/pem"
 	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"math/rand"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"path/filepath"
 	"regexp"
 	"runtime"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
+	"syscall"
 	"time"
 
 	ct "github.com/google/certificate-transparency-go"
-	ct_tls "github.com/google/certificate-transparency-go/tls"
 	"github.com/google/certificate-transparency-go/x509"
+	"github.com/hdm/inetdata-parsers"
 	"golang.org/x/net/publicsuffix"
 )
 
@@ -78,167 +91,1187 @@ var output_count int64 = 0
 var input_count int64 = 0
 var number *int
 var follow *bool
+var from_start *bool
+var from_index *int64
+
+var http_client = newHTTPClient(false)
+
+var log_trackers = map[string]*logTracker{}
+var log_backends = map[string]ctBackend{}
+var log_verifiers = map[string]*ct.SignatureVerifier{}
+var verify_failed int32
+var download_failed int32
+
+var batch_size *int
+var workers *int
+var max_retries *int
+var retry_backoff *time.Duration
+var interval *time.Duration
+var output_format *string
 
 var wd sync.WaitGroup
 var wi sync.WaitGroup
 var wo sync.WaitGroup
 
-type CTEntry struct {
-	LeafInput []byte `json:"leaf_input"`
-	ExtraData []byte `json:"extra_data"`
+type CTEntry struct {
+	LeafInput []byte `json:"leaf_input"`
+	ExtraData []byte `json:"extra_data"`
+	Log       string `json:"-"`
+	Index     int64  `json:"-"`
+}
+
+type CTOutput struct {
+	Log   string
+	Index int64
+	Lines []string
+}
+
+type CTEntries struct {
+	Entries []CTEntry `json:"entries"`
+}
+
+type CTEntriesError struct {
+	ErrorMessage string `json:"error_message"`
+	Success      bool   `json:"success"`
+}
+
+type CTHead struct {
+	TreeSize          int64  `json:"tree_size"`
+	Timestamp         int64  `json:"timestamp"`
+	SHA256RootHash    string `json:"sha256_root_hash"`
+	TreeHeadSignature string `json:"tree_head_signature"`
+}
+
+type CTConsistency struct {
+	Consistency [][]byte `json:"consistency"`
+}
+
+type CTEntryAndProof struct {
+	LeafInput []byte   `json:"leaf_input"`
+	ExtraData []byte   `json:"extra_data"`
+	AuditPath [][]byte `json:"audit_path"`
+}
+
+func usage() {
+	fmt.Println("Usage: " + os.Args[0] + " [options]")
+	fmt.Println("")
+	fmt.Println("Synchronizes data from one or more CT logs and extract hostnames")
+	fmt.Println("")
+	fmt.Println("Options:")
+	flag.PrintDefaults()
+}
+
+func scrubX509Value(bit string) string {
+	bit = strings.Replace(bit, "\x00", "[0x00]", -1)
+	bit = strings.Replace(bit, " ", "_", -1)
+	return bit
+}
+
+// newHTTPClient returns the client used for every log. With local_files set it
+// also accepts file:// URLs, so that a tile tree on local disk can be read
+// directly. Redirects to a different scheme are refused, so a remote log can not
+// point the client at local files.
+func newHTTPClient(local_files bool) *http.Client {
+	tr := &http.Transport{
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	}
+	if local_files {
+		tr.RegisterProtocol("file", http.NewFileTransport(http.Dir("/")))
+	}
+
+	check := func(req *http.Request, via []*http.Request) error {
+		if len(via) >= 10 {
+			return errors.New("stopped after 10 redirects")
+		}
+		if req.URL.Scheme != via[0].URL.Scheme {
+			return fmt.Errorf("refusing redirect from %s to %s", via[0].URL.Scheme, req.URL.Scheme)
+		}
+		return nil
+	}
+
+	return &http.Client{Transport: tr, CheckRedirect: check, Timeout: time.Duration(2) * time.Minute}
+}
+
+// httpError is a response from a log with a status other than 200
+type httpError struct {
+	Status     int
+	RetryAfter time.Duration
+	Message    string
+}
+
+func (e *httpError) Error() string {
+	if len(e.Message) == 0 {
+		return fmt.Sprintf("HTTP %d", e.Status)
+	}
+	return fmt.Sprintf("HTTP %d: %s", e.Status, e.Message)
+}
+
+// parseRetryAfter converts a Retry-After header in seconds or as a date to a duration
+func parseRetryAfter(value string) time.Duration {
+	if secs, err := strconv.Atoi(strings.TrimSpace(value)); err == nil && secs > 0 {
+		return time.Duration(secs) * time.Second
+	}
+
+	if ts, err := http.ParseTime(value); err == nil {
+		if d := time.Until(ts); d > 0 {
+			return d
+		}
+	}
+	return 0
+}
+
+// download fetches a URL, treating any status other than 200 as an error
+func download(url string, accept string) ([]byte, error) {
+
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return []byte{}, err
+	}
+
+	if len(accept) > 0 {
+		req.Header.Set("Accept", accept)
+	}
+
+	resp, err := http_client.Do(req)
+	if err != nil {
+		return []byte{}, err
+	}
+
+	defer resp.Body.Close()
+
+	content, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return []byte{}, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		msg := strings.TrimSpace(string(content))
+		if len(msg) > 200 {
+			msg = msg[0:200]
+		}
+		return []byte{}, &httpError{Status: resp.StatusCode, RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After")), Message: msg}
+	}
+
+	return content, nil
+}
+
+func downloadJSON(url string) ([]byte, error) {
+	return download(url, "application/json")
+}
+
+// downloadBytes fetches a static resource
+func downloadBytes(url string) ([]byte, error) {
+	return download(url, "")
+}
+
+func downloadSTH(logurl string) (CTHead, error) {
+	var sth CTHead
+	url := fmt.Sprintf("%s/ct/v1/get-sth", logurl)
+	data, err := downloadJSON(url)
+	if err != nil {
+		return sth, err
+	}
+
+	err = json.Unmarshal(data, &sth)
+	return sth, err
+}
+
+func downloadEntries(logurl string, start_index int64, stop_index int64) (CTEntries, error) {
+	var entries CTEntries
+	var entries_error CTEntriesError
+
+	url := fmt.Sprintf("%s/ct/v1/get-entries?start=%d&end=%d", logurl, start_index, stop_index)
+	data, err := downloadJSON(url)
+	if err != nil {
+		return entries, err
+	}
+
+	if strings.Contains(string(data), "\"error_message\":") {
+		err = json.Unmarshal(data, &entries_error)
+		if err != nil {
+			return entries, err
+		}
+		return entries, errors.New(entries_error.ErrorMessage)
+	}
+
+	err = json.Unmarshal(data, &entries)
+	return entries, err
+}
+
+// downloadLogJSON fetches a log API response and decodes it into v
+func downloadLogJSON(url string, v interface{}) error {
+	var entries_error CTEntriesError
+
+	data, err := downloadJSON(url)
+	if err != nil {
+		return err
+	}
+
+	if strings.Contains(string(data), "\"error_message\":") {
+		err = json.Unmarshal(data, &entries_error)
+		if err != nil {
+			return err
+		}
+		return errors.New(entries_error.ErrorMessage)
+	}
+
+	return json.Unmarshal(data, v)
+}
+
+func downloadConsistency(logurl string, first int64, second int64) ([][]byte, error) {
+	var proof CTConsistency
+	url := fmt.Sprintf("%s/ct/v1/get-sth-consistency?first=%d&second=%d", logurl, first, second)
+	err := downloadLogJSON(url, &proof)
+	return proof.Consistency, err
+}
+
+func downloadEntryAndProof(logurl string, index int64, tree_size int64) (CTEntryAndProof, error) {
+	var proof CTEntryAndProof
+	url := fmt.Sprintf("%s/ct/v1/get-entry-and-proof?leaf_index=%d&tree_size=%d", logurl, index, tree_size)
+	err := downloadLogJSON(url, &proof)
+	return proof, err
+}
+
+// sthRoot decodes the root hash of a tree head
+func sthRoot(sth CTHead) ([]byte, error) {
+	root, err := base64.StdEncoding.DecodeString(sth.SHA256RootHash)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(root) != sha256.Size {
+		return nil, fmt.Errorf("invalid root hash length %d", len(root))
+	}
+	return root, nil
+}
+
+// verifySTH checks the signature of a tree head against the log's public key
+func verifySTH(verifier *ct.SignatureVerifier, sth CTHead) error {
+	root, err := sthRoot(sth)
+	if err != nil {
+		return err
+	}
+
+	if sth.TreeSize < 0 || sth.Timestamp < 0 {
+		return errors.New("invalid tree size or timestamp")
+	}
+
+	signed := ct.SignedTreeHead{
+		Version:   ct.V1,
+		TreeSize:  uint64(sth.TreeSize),
+		Timestamp: uint64(sth.Timestamp),
+	}
+	copy(signed.SHA256RootHash[:], root)
+
+	if err := signed.TreeHeadSignature.FromBase64String(sth.TreeHeadSignature); err != nil {
+		return err
+	}
+
+	return verifier.VerifySTHSignature(signed)
+}
+
+// verifySTHConsistency checks that two tree heads describe the same append-only log
+func verifySTHConsistency(logurl string, a CTHead, b CTHead) error {
+	if a.TreeSize > b.TreeSize {
+		a, b = b, a
+	}
+
+	a_root, err := sthRoot(a)
+	if err != nil {
+		return err
+	}
+
+	b_root, err := sthRoot(b)
+	if err != nil {
+		return err
+	}
+
+	proof := [][]byte{}
+	if a.TreeSize > 0 && a.TreeSize < b.TreeSize {
+		proof, err = downloadConsistency(logurl, a.TreeSize, b.TreeSize)
+		if err != nil {
+			return err
+		}
+	}
+
+	return inetdata.VerifyMerkleConsistency(uint64(a.TreeSize), uint64(b.TreeSize), a_root, b_root, proof)
+}
+
+// seedFrontier builds the frontier of the entries before index from an inclusion proof
+func seedFrontier(logurl string, index int64, sth CTHead) (*inetdata.MerkleFrontier, error) {
+	if index == 0 {
+		return &inetdata.MerkleFrontier{}, nil
+	}
+
+	root, err := sthRoot(sth)
+	if err != nil {
+		return nil, err
+	}
+
+	proof, err := downloadEntryAndProof(logurl, index, sth.TreeSize)
+	if err != nil {
+		return nil, err
+	}
+
+	return inetdata.MerkleFrontierFromProof(uint64(index), uint64(sth.TreeSize), inetdata.MerkleLeafHash(proof.LeafInput), root, proof.AuditPath)
+}
+
+// verifyFrontier checks that the downloaded entries are a prefix of the tree head
+func verifyFrontier(logurl string, frontier *inetdata.MerkleFrontier, sth CTHead) error {
+	root, err := sthRoot(sth)
+	if err != nil {
+		return err
+	}
+
+	proof := [][]byte{}
+	if frontier.Size > 0 && int64(frontier.Size) < sth.TreeSize {
+		proof, err = downloadConsistency(logurl, int64(frontier.Size), sth.TreeSize)
+		if err != nil {
+			return err
+		}
+	}
+
+	return inetdata.VerifyMerkleConsistency(frontier.Size, uint64(sth.TreeSize), frontier.Root(), root, proof)
+}
+
+// ctBackend reads tree heads and entries from a log and proves that entries
+// belong to a tree head
+type ctBackend interface {
+	// TreeHead returns the latest signed tree head
+	TreeHead() (CTHead, error)
+	// Entries returns the entries from start to at most stop, possibly fewer
+	Entries(start int64, stop int64, sth CTHead) ([]CTEntry, error)
+	// Frontier returns the verified frontier of the entries before index
+	Frontier(index int64, sth CTHead) (*inetdata.MerkleFrontier, error)
+	// VerifyFrontier checks that the frontier is a prefix of the tree head
+	VerifyFrontier(frontier *inetdata.MerkleFrontier, sth CTHead) error
+	// VerifyConsistency checks that two tree heads describe the same log
+	VerifyConsistency(first CTHead, second CTHead) error
+}
+
+// rfc6962Backend reads a log using the RFC 6962 JSON API
+type rfc6962Backend struct {
+	url string
+}
+
+func (b *rfc6962Backend) TreeHead() (CTHead, error) {
+	return downloadSTH(b.url)
+}
+
+func (b *rfc6962Backend) Entries(start int64, stop int64, sth CTHead) ([]CTEntry, error) {
+	entries, err := downloadEntries(b.url, start, stop)
+	return entries.Entries, err
+}
+
+func (b *rfc6962Backend) Frontier(index int64, sth CTHead) (*inetdata.MerkleFrontier, error) {
+	return seedFrontier(b.url, index, sth)
+}
+
+func (b *rfc6962Backend) VerifyFrontier(frontier *inetdata.MerkleFrontier, sth CTHead) error {
+	return verifyFrontier(b.url, frontier, sth)
+}
+
+func (b *rfc6962Backend) VerifyConsistency(first CTHead, second CTHead) error {
+	return verifySTHConsistency(b.url, first, second)
+}
+
+// tiledBackend reads a log using the static CT API checkpoint and tiles. Proofs
+// are computed locally from the hash tiles.
+type tiledBackend struct {
+	url     string
+	mu      sync.Mutex
+	tiles   map[string][][]byte
+	issuers map[string][]byte
+}
+
+func newTiledBackend(url string) *tiledBackend {
+	return &tiledBackend{
+		url:     strings.TrimSuffix(url, "/"),
+		tiles:   make(map[string][][]byte),
+		issuers: make(map[string][]byte),
+	}
+}
+
+// TreeHead converts the checkpoint to a tree head. The log's own signature is
+// named after the checkpoint origin and carries the RFC 6962 tree head signature.
+func (b *tiledBackend) TreeHead() (CTHead, error) {
+	var sth CTHead
+
+	data, err := downloadBytes(b.url + "/checkpoint")
+	if err != nil {
+		return sth, err
+	}
+
+	cp, err := inetdata.ParseCTCheckpoint(data)
+	if err != nil {
+		return sth, err
+	}
+
+	for _, sig := range cp.Signatures {
+		if sig.Name != cp.Origin || len(sig.Signature) == 0 {
+			continue
+		}
+
+		sth.TreeSize = cp.TreeSize
+		sth.Timestamp = int64(sig.Timestamp)
+		sth.SHA256RootHash = base64.StdEncoding.EncodeToString(cp.RootHash)
+		sth.TreeHeadSignature = base64.StdEncoding.EncodeToString(sig.Signature)
+		return sth, nil
+	}
+
+	return sth, fmt.Errorf("checkpoint has no tree head signature from %s", cp.Origin)
+}
+
+// tileWidth returns the number of items in a tile of a level with count items
+func tileWidth(index int64, count int64) int {
+	width := count - index*inetdata.CTTileWidth
+	if width > inetdata.CTTileWidth {
+		width = inetdata.CTTileWidth
+	}
+	return int(width)
+}
+
+// Entries returns the entries from start to stop, reading as many data tiles as needed
+func (b *tiledBackend) Entries(start int64, stop int64, sth CTHead) ([]CTEntry, error) {
+	if stop >= sth.TreeSize {
+		stop = sth.TreeSize - 1
+	}
+
+	entries := []CTEntry{}
+	for next := start; next <= stop; next = start + int64(len(entries)) {
+		batch, err := b.tileEntries(next, stop, sth)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, batch...)
+	}
+	return entries, nil
+}
+
+// tileEntries returns the entries from start to stop or the end of its data tile
+func (b *tiledBackend) tileEntries(start int64, stop int64, sth CTHead) ([]CTEntry, error) {
+	tile := start / inetdata.CTTileWidth
+	width := tileWidth(tile, sth.TreeSize)
+
+	data, err := downloadBytes(b.url + "/" + inetdata.CTDataTilePath(tile, width))
+	if err != nil {
+		return nil, err
+	}
+
+	// Data tiles may be stored compressed
+	if len(data) > 2 && data[0] == 0x1f && data[1] == 0x8b {
+		r, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		if data, err = ioutil.ReadAll(r); err != nil {
+			return nil, err
+		}
+	}
+
+	leaves, err := inetdata.ParseCTDataTile(data)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(leaves) != width {
+		return nil, fmt.Errorf("data tile %d has %d entries, expected %d", tile, len(leaves), width)
+	}
+
+	entries := []CTEntry{}
+	for index := start; index <= stop && index < tile*inetdata.CTTileWidth+int64(width); index++ {
+		leaf := leaves[index-tile*inetdata.CTTileWidth]
+
+		chain := [][]byte{}
+		for _, fp := range leaf.Chain {
+			issuer, err := b.issuer(fp)
+			if err != nil {
+				return nil, err
+			}
+			chain = append(chain, issuer)
+		}
+
+		extra, err := inetdata.CTExtraData(leaf, chain)
+		if err != nil {
+			return nil, err
+		}
+
+		entries = append(entries, CTEntry{LeafInput: leaf.LeafInput, ExtraData: extra})
+	}
+
+	return entries, nil
+}
+
+// issuer fetches an issuer certificate by its SHA-256 fingerprint
+func (b *tiledBackend) issuer(fp []byte) ([]byte, error) {
+	name := hex.EncodeToString(fp)
+
+	b.mu.Lock()
+	cert, ok := b.issuers[name]
+	b.mu.Unlock()
+	if ok {
+		return cert, nil
+	}
+
+	cert, err := downloadBytes(b.url + "/issuer/" + name)
+	if err != nil {
+		return nil, err
+	}
+
+	if sum := sha256.Sum256(cert); !bytes.Equal(sum[:], fp) {
+		return nil, fmt.Errorf("issuer %s does not match its fingerprint", name)
+	}
+
+	b.mu.Lock()
+	b.issuers[name] = cert
+	b.mu.Unlock()
+	return cert, nil
+}
+
+// hashTile fetches a hash tile, caching recent tiles since neighbouring
+// subtrees are usually read from the same tile
+func (b *tiledBackend) hashTile(level int, index int64, width int) ([][]byte, error) {
+	path := inetdata.CTTilePath(level, index, width)
+
+	b.mu.Lock()
+	hashes, ok := b.tiles[path]
+	b.mu.Unlock()
+	if ok {
+		return hashes, nil
+	}
+
+	data, err := downloadBytes(b.url + "/" + path)
+	if err != nil {
+		return nil, err
+	}
+
+	hashes, err = inetdata.CTTileHashes(data)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(hashes) != width {
+		return nil, fmt.Errorf("hash tile %s has %d hashes, expected %d", path, len(hashes), width)
+	}
+
+	b.mu.Lock()
+	if len(b.tiles) > 1024 {
+		b.tiles = make(map[string][][]byte)
+	}
+	b.tiles[path] = hashes
+	b.mu.Unlock()
+	return hashes, nil
+}
+
+// nodeHash returns the hash of the perfect subtree at level and index in a tree
+// of the given size. Every eighth level is stored in tiles, the levels between
+// are computed from their children.
+func (b *tiledBackend) nodeHash(level uint, index uint64, size int64) ([]byte, error) {
+	if level%inetdata.CTTileHeight != 0 {
+		left, err := b.nodeHash(level-1, index*2, size)
+		if err != nil {
+			return nil, err
+		}
+		right, err := b.nodeHash(level-1, index*2+1, size)
+		if err != nil {
+			return nil, err
+		}
+		return inetdata.MerkleNodeHash(left, right), nil
+	}
+
+	tile := int64(index / inetdata.CTTileWidth)
+	hashes, err := b.hashTile(int(level/inetdata.CTTileHeight), tile, tileWidth(tile, size>>level))
+	if err != nil {
+		return nil, err
+	}
+	return hashes[index%inetdata.CTTileWidth], nil
+}
+
+// extend grows the frontier to the size of the tree head and checks its root hash
+func (b *tiledBackend) extend(frontier *inetdata.MerkleFrontier, sth CTHead) error {
+	root, err := sthRoot(sth)
+	if err != nil {
+		return err
+	}
+
+	err = inetdata.ExtendMerkleFrontier(frontier, uint64(sth.TreeSize), func(level uint, index uint64) ([]byte, error) {
+		return b.nodeHash(level, index, sth.TreeSize)
+	})
+	if err != nil {
+		return err
+	}
+
+	if !bytes.Equal(frontier.Root(), root) {
+		return errors.New("tiles do not match the root hash")
+	}
+	return nil
+}
+
+func (b *tiledBackend) Frontier(index int64, sth CTHead) (*inetdata.MerkleFrontier, error) {
+	frontier := &inetdata.MerkleFrontier{}
+
+	// Check the tiles against the tree head before trusting any of them
+	if err := b.extend(frontier.Clone(), sth); err != nil {
+		return nil, err
+	}
+
+	err := inetdata.ExtendMerkleFrontier(frontier, uint64(index), func(level uint, i uint64) ([]byte, error) {
+		return b.nodeHash(level, i, sth.TreeSize)
+	})
+	return frontier, err
+}
+
+func (b *tiledBackend) VerifyFrontier(frontier *inetdata.MerkleFrontier, sth CTHead) error {
+	return b.extend(frontier.Clone(), sth)
+}
+
+func (b *tiledBackend) VerifyConsistency(first CTHead, second CTHead) error {
+	if first.TreeSize > second.TreeSize {
+		first, second = second, first
+	}
+
+	first_root, err := sthRoot(first)
+	if err != nil {
+		return err
+	}
+
+	// Build the older tree from the tiles of the newer one
+	frontier, err := b.Frontier(first.TreeSize, second)
+	if err != nil {
+		return err
+	}
+
+	if !bytes.Equal(frontier.Root(), first_root) {
+		return fmt.Errorf("tree of size %d does not match the root hash", first.TreeSize)
+	}
+	return nil
+}
+
+// logFetcher issues requests to a single log, retrying failures with backoff and
+// spacing requests out when the log asks clients to slow down
+type logFetcher struct {
+	log     string
+	backend ctBackend
+	mu      sync.Mutex
+	delay   time.Duration
+	next    time.Time
+	batch   int64
+}
+
+func newLogFetcher(log string, backend ctBackend) *logFetcher {
+	return &logFetcher{log: log, backend: backend, batch: int64(*batch_size)}
+}
+
+// ctBatch is a range of entries downloaded by a fetch worker
+type ctBatch struct {
+	Start   int64
+	Entries []CTEntry
+	Err     error
+}
+
+// retryable checks whether a request failed for a reason that may go away
+func retryable(err error) bool {
+	switch e := err.(type) {
+	case *httpError:
+		return e.Status == http.StatusTooManyRequests || e.Status >= 500
+	case net.Error:
+		return true
+	}
+	return err == io.ErrUnexpectedEOF
+}
+
+// wait blocks until the next request to the log is allowed
+func (f *logFetcher) wait() {
+	f.mu.Lock()
+	now := time.Now()
+	at := f.next
+	if at.Before(now) {
+		at = now
+	}
+	f.next = at.Add(f.delay)
+	f.mu.Unlock()
+
+	time.Sleep(at.Sub(now))
+}
+
+// throttled doubles the spacing between requests and pauses all workers
+func (f *logFetcher) throttled(pause time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.delay *= 2
+	if f.delay < time.Duration(100)*time.Millisecond {
+		f.delay = time.Duration(100) * time.Millisecond
+	}
+	if f.delay > time.Duration(10)*time.Second {
+		f.delay = time.Duration(10) * time.Second
+	}
+
+	if at := time.Now().Add(pause); at.After(f.next) {
+		f.next = at
+	}
+}
+
+// succeeded slowly reduces the spacing between requests
+func (f *logFetcher) succeeded() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.delay -= f.delay / 10
+	if f.delay < time.Duration(10)*time.Millisecond {
+		f.delay = 0
+	}
+}
+
+// Do runs a request, retrying network errors, server errors and rate limiting
+// with exponential backoff
+func (f *logFetcher) Do(req func() error) error {
+	backoff := *retry_backoff
+
+	for attempt := 0; ; attempt++ {
+		f.wait()
+
+		err := req()
+		if err == nil {
+			f.succeeded()
+			return nil
+		}
+
+		if !retryable(err) || attempt >= *max_retries {
+			return err
+		}
+
+		// Add up to 50% jitter so that workers do not retry in lockstep
+		delay := backoff + time.Duration(rand.Int63n(int64(backoff)/2+1))
+
+		if e, ok := err.(*httpError); ok {
+			if e.Status == http.StatusTooManyRequests {
+				f.throttled(e.RetryAfter)
+			}
+			if e.RetryAfter > delay {
+				delay = e.RetryAfter
+			}
+		}
+
+		fmt.Fprintf(os.Stderr, "[-] Request to %s failed: %s, retrying in %s\n", f.log, err, delay.Round(time.Millisecond))
+		time.Sleep(delay)
+
+		backoff *= 2
+		if backoff > time.Duration(5)*time.Minute {
+			backoff = time.Duration(5) * time.Minute
+		}
+	}
+}
+
+// Batch returns the number of entries to ask for in each request
+func (f *logFetcher) Batch() int64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.batch
+}
+
+// Range downloads the entries from start to stop, issuing more requests when the
+// log returns fewer entries than asked for
+func (f *logFetcher) Range(start int64, stop int64, sth CTHead) ([]CTEntry, error) {
+	entries := []CTEntry{}
+
+	for next := start; next <= stop; next = start + int64(len(entries)) {
+		var batch []CTEntry
+		err := f.Do(func() (err error) {
+			batch, err = f.backend.Entries(next, stop, sth)
+			return err
+		})
+		if err != nil {
+			return entries, err
+		}
+
+		if len(batch) == 0 {
+			return entries, errors.New("no entries returned")
+		}
+
+		if int64(len(batch)) > stop-next+1 {
+			batch = batch[0 : stop-next+1]
+		}
+
+		// A short response reveals the largest batch the log will return
+		f.mu.Lock()
+		if int64(len(batch)) < stop-next+1 && int64(len(batch)) < f.batch {
+			f.batch = int64(len(batch))
+			fmt.Fprintf(os.Stderr, "[*] Using a batch size of %d for %s\n", f.batch, f.log)
+		}
+		f.mu.Unlock()
+
+		entries = append(entries, batch...)
+	}
+	return entries, nil
 }
 
-type CTEntries struct {
-	Entries []CTEntry `json:"entries"`
-}
+// Batches downloads the entries from start to stop using concurrent workers. The
+// returned channel yields one channel per batch in log order, and closing done
+// stops any further downloads.
+func (f *logFetcher) Batches(start int64, stop int64, sth CTHead, done <-chan struct{}) <-chan chan ctBatch {
+	ordered := make(chan chan ctBatch, *workers)
+	running := make(chan struct{}, *workers)
 
-type CTEntriesError struct {
-	ErrorMessage string `json:"error_message"`
-	Success      bool   `json:"success"`
-}
+	go func() {
+		defer close(ordered)
 
-type CTHead struct {
-	TreeSize          int64  `json:"tree_size"`
-	Timestamp         int64  `json:"timestamp"`
-	SHA256RootHash    string `json:"sha256_root_hash"`
-	TreeHeadSignature string `json:"tree_head_signature"`
+		for start <= stop {
+			end := start + f.Batch() - 1
+			if end > stop {
+				end = stop
+			}
+
+			select {
+			case running <- struct{}{}:
+			case <-done:
+				return
+			}
+
+			c := make(chan ctBatch, 1)
+			select {
+			case ordered <- c:
+			case <-done:
+				return
+			}
+
+			go func(start int64, end int64) {
+				entries, err := f.Range(start, end, sth)
+				<-running
+				c <- ctBatch{Start: start, Entries: entries, Err: err}
+			}(start, end)
+
+			start = end + 1
+		}
+	}()
+
+	return ordered
 }
 
-func usage() {
-	fmt.Println("Usage: " + os.Args[0] + " [options]")
-	fmt.Println("")
-	fmt.Println("Synchronizes data from one or more CT logs and extract hostnames")
-	fmt.Println("")
-	fmt.Println("Options:")
-	flag.PrintDefaults()
+func downloadFailed(logurl string, what string, err error) {
+	fmt.Fprintf(os.Stderr, "[-] Failed to download %s for %s: %s\n", what, logurl, err)
+	atomic.StoreInt32(&download_failed, 1)
 }
 
-func scrubX509Value(bit string) string {
-	bit = strings.Replace(bit, "\x00", "[0x00]", -1)
-	bit = strings.Replace(bit, " ", "_", -1)
-	return bit
+func verifyFailed(logurl string, what string, err error) {
+	fmt.Fprintf(os.Stderr, "[-] Failed to verify %s for %s: %s\n", what, logurl, err)
+	atomic.StoreInt32(&verify_failed, 1)
 }
 
-func downloadJSON(url string) ([]byte, error) {
+// loadPublicKey reads a log public key from a PEM or base64 file, or a base64 string
+func loadPublicKey(value string) (crypto.PublicKey, []byte, error) {
+	data, err := ioutil.ReadFile(value)
+	if err != nil {
+		data = []byte(value)
+	}
 
-	req, err := http.NewRequest("GET", url, nil)
+	if strings.Contains(string(data), "-----BEGIN") {
+		key, _, _, err := ct.PublicKeyFromPEM(data)
+		if err != nil {
+			return nil, nil, err
+		}
+		block, _ := pem.Decode(data)
+		return key, block.Bytes, nil
+	}
+
+	der, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
 	if err != nil {
-		return []byte{}, err
+		return nil, nil, fmt.Errorf("invalid public key: %s", err)
 	}
 
-	req.Header.Set("Accept", "application/json")
+	key, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return nil, nil, err
+	}
+	return key, der, nil
+}
 
-	tr := &http.Transport{
-		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+func logNameToPath(name string) string {
+	bits := strings.SplitN(name, "//", 2)
+	return strings.Replace(bits[1], "/", "_", -1)
+}
+
+// CTLogState is the resume point for a single log, stored as JSON in the state directory
+type CTLogState struct {
+	Log       string  `json:"log"`
+	LastIndex int64   `json:"last_index"`
+	Updated   int64   `json:"updated"`
+	TreeHead  *CTHead `json:"tree_head,omitempty"`
+}
+
+// logTracker records which entries of a log have been written out, since the
+// parsers can finish entries out of order
+type logTracker struct {
+	mu      sync.Mutex
+	log     string
+	path    string
+	next    int64
+	done    map[int64]bool
+	sth     *CTHead
+	loaded  bool
+	changed bool
+}
+
+func newLogTracker(log string, dir string) *logTracker {
+	t := &logTracker{log: log, done: make(map[int64]bool)}
+	if len(dir) == 0 {
+		return t
 	}
 
-	client := &http.Client{Transport: tr}
+	t.path = filepath.Join(dir, logNameToPath(log)+".json")
 
-	resp, err := client.Do(req)
+	data, err := ioutil.ReadFile(t.path)
 	if err != nil {
-		return []byte{}, err
+		if !os.IsNotExist(err) {
+			fmt.Fprintf(os.Stderr, "[-] Failed to read state for %s: %s\n", log, err)
+		}
+		return t
 	}
 
-	defer resp.Body.Close()
+	var state CTLogState
+	if err := json.Unmarshal(data, &state); err != nil {
+		fmt.Fprintf(os.Stderr, "[-] Failed to parse state for %s: %s\n", log, err)
+		return t
+	}
 
-	content, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return []byte{}, err
+	t.next = state.LastIndex + 1
+	t.sth = state.TreeHead
+	t.loaded = true
+	return t
+}
+
+// Resume returns the index after the last emitted entry and whether a saved state was found
+func (t *logTracker) Resume() (int64, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.next, t.loaded
+}
+
+// TreeHead returns the last verified tree head, if any
+func (t *logTracker) TreeHead() (CTHead, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.sth == nil {
+		return CTHead{}, false
 	}
+	return *t.sth, true
+}
 
-	return content, err
+// SetTreeHead records a verified tree head
+func (t *logTracker) SetTreeHead(sth CTHead) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.sth = &sth
+	t.changed = true
 }
 
-func downloadSTH(logurl string) (CTHead, error) {
-	var sth CTHead
-	url := fmt.Sprintf("%s/ct/v1/get-sth", logurl)
-	data, err := downloadJSON(url)
-	if err != nil {
-		return sth, err
+// Start resets the tracker to expect entries beginning at index
+func (t *logTracker) Start(index int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.next != index {
+		t.next = index
+		t.done = make(map[int64]bool)
+		t.changed = true
 	}
+}
 
-	err = json.Unmarshal(data, &sth)
-	return sth, err
+// Emitted marks an entry as written and advances past any contiguous completed entries
+func (t *logTracker) Emitted(index int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if index < t.next {
+		return
+	}
+
+	t.done[index] = true
+	for t.done[t.next] {
+		delete(t.done, t.next)
+		t.next++
+		t.changed = true
+	}
 }
 
-func downloadEntries(logurl string, start_index int64, stop_index int64) (CTEntries, error) {
-	var entries CTEntries
-	var entries_error CTEntriesError
+// Save atomically writes the state file if anything changed since the last save
+func (t *logTracker) Save() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
 
-	url := fmt.Sprintf("%s/ct/v1/get-entries?start=%d&end=%d", logurl, start_index, stop_index)
-	data, err := downloadJSON(url)
+	if len(t.path) == 0 || !t.changed {
+		return nil
+	}
+
+	data, err := json.Marshal(CTLogState{Log: t.log, LastIndex: t.next - 1, Updated: time.Now().Unix(), TreeHead: t.sth})
 	if err != nil {
-		return entries, err
+		return err
 	}
 
-	if strings.Contains(string(data), "\"error_message\":") {
-		err = json.Unmarshal(data, &entries_error)
-		if err != nil {
-			return entries, err
-		}
-		return entries, errors.New(entries_error.ErrorMessage)
+	tmp := t.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
 	}
 
-	err = json.Unmarshal(data, &entries)
-	return entries, err
+	if err := os.Rename(tmp, t.path); err != nil {
+		return err
+	}
+
+	t.changed = false
+	return nil
 }
 
-func logNameToPath(name string) string {
-	bits := strings.SplitN(name, "//", 2)
-	return strings.Replace(bits[1], "/", "_", -1)
+func saveStates() {
+	for _, t := range log_trackers {
+		if err := t.Save(); err != nil {
+			fmt.Fprintf(os.Stderr, "[-] Failed to save state for %s: %s\n", t.log, err)
+		}
+	}
+}
+
+// startIndex picks the first entry to download for a log
+func startIndex(t *logTracker, tree_size int64) int64 {
+	if *from_index >= 0 {
+		return *from_index
+	}
+
+	if *from_start {
+		return 0
+	}
+
+	if next, ok := t.Resume(); ok {
+		return next
+	}
+
+	start_index := tree_size - int64(*number)
+	if start_index < 0 {
+		start_index = 0
+	}
+	return start_index
 }
 
 func downloadLog(log string, c_inp chan<- CTEntry) {
 	var iteration int64 = 0
-	var current_index int64 = 0
+	var current_index int64 = -1
 
 	defer wd.Done()
 
+	tracker := log_trackers[log]
+	verifier := log_verifiers[log]
+	fetcher := newLogFetcher(log, log_backends[log])
+	backend := fetcher.backend
+
+	// The last verified tree head and the frontier of the downloaded entries
+	last_sth, has_sth := tracker.TreeHead()
+	var frontier *inetdata.MerkleFrontier
+
 	for {
 
 		if iteration > 0 {
-			fmt.Fprintf(os.Stderr, "[*] Sleeping for 10 seconds (%s) at index %d\n", log, current_index)
-			time.Sleep(time.Duration(10) * time.Second)
+			fmt.Fprintf(os.Stderr, "[*] Sleeping for %s (%s) at index %d\n", *interval, log, current_index)
+			time.Sleep(*interval)
 		}
+		iteration++
 
-		sth, sth_err := downloadSTH(log)
-		if sth_err != nil {
-			fmt.Fprintf(os.Stderr, "[-] Failed to download STH for %s: %s\n", log, sth_err)
+		var sth CTHead
+		err := fetcher.Do(func() (err error) {
+			sth, err = backend.TreeHead()
+			return err
+		})
+		if err != nil {
+			if !*follow {
+				downloadFailed(log, "STH", err)
+				break
+			}
+			fmt.Fprintf(os.Stderr, "[-] Failed to download STH for %s: %s\n", log, err)
+			continue
 		}
 
-		var start_index int64 = 0
-
-		if iteration == 0 {
-			start_index = sth.TreeSize - int64(*number)
-			if start_index < 0 {
-				start_index = 0
+		if verifier != nil {
+			if err := verifySTH(verifier, sth); err != nil {
+				verifyFailed(log, "STH signature", err)
+				return
 			}
-			current_index = start_index
-		} else {
-			start_index = current_index
-		}
 
-		var entry_count int64 = 1000
+			if has_sth {
+				err := fetcher.Do(func() error {
+					return backend.VerifyConsistency(last_sth, sth)
+				})
+				if err != nil {
+					verifyFailed(log, "STH consistency", err)
+					return
+				}
 
-		for index := start_index; index < sth.TreeSize; index += entry_count {
-			stop_index := index + entry_count - 1
-			if stop_index >= sth.TreeSize {
-				stop_index = sth.TreeSize - 1
+				// Keep working from the newest tree head
+				if sth.TreeSize < last_sth.TreeSize {
+					sth = last_sth
+				}
 			}
 
-			entries, err := downloadEntries(log, index, stop_index)
+			last_sth = sth
+			has_sth = true
+			tracker.SetTreeHead(sth)
+		}
+
+		if current_index < 0 {
+			current_index = startIndex(tracker, sth.TreeSize)
+			tracker.Start(current_index)
+		}
+
+		// Seed the frontier with an inclusion proof for the first entry
+		if verifier != nil && frontier == nil && current_index < sth.TreeSize {
+			err := fetcher.Do(func() (err error) {
+				frontier, err = backend.Frontier(current_index, sth)
+				return err
+			})
 			if err != nil {
-				fmt.Fprintf(os.Stderr, "[-] Failed to download entries for %s: index %d -> %s\n", log, index, err)
+				verifyFailed(log, "inclusion proof", err)
 				return
 			}
-			for entry_index := range entries.Entries {
-				c_inp <- entries.Entries[entry_index]
+		}
+
+		done := make(chan struct{})
+		var fetch_err error
+
+		for c := range fetcher.Batches(current_index, sth.TreeSize-1, sth, done) {
+			batch := <-c
+
+			// Entries are only emitted once they are proven to be part of the tree
+			if verifier != nil && len(batch.Entries) > 0 {
+				for entry_index := range batch.Entries {
+					frontier.Append(inetdata.MerkleLeafHash(batch.Entries[entry_index].LeafInput))
+				}
+				err := fetcher.Do(func() error {
+					return backend.VerifyFrontier(frontier, sth)
+				})
+				if err != nil {
+					close(done)
+					verifyFailed(log, fmt.Sprintf("entries %d-%d", current_index, frontier.Size-1), err)
+					return
+				}
+			}
+
+			for entry_index := range batch.Entries {
+				entry := batch.Entries[entry_index]
+				entry.Log = log
+				entry.Index = current_index + int64(entry_index)
+				c_inp <- entry
+			}
+			current_index += int64(len(batch.Entries))
+
+			if batch.Err != nil {
+				fetch_err = batch.Err
+				break
 			}
 		}
+		close(done)
 
-		// Move our index to the end of the last tree
-		current_index = sth.TreeSize
-		iteration++
+		if fetch_err != nil {
+			if !*follow {
+				downloadFailed(log, fmt.Sprintf("entries at index %d", current_index), fetch_err)
+				return
+			}
+			fmt.Fprintf(os.Stderr, "[-] Failed to download entries for %s: index %d -> %s\n", log, current_index, fetch_err)
+		}
 
 		// Break after one loop unless we are in follow mode
 		if !*follow {
@@ -248,113 +1281,194 @@ func downloadLog(log string, c_inp chan<- CTEntry) {
 	}
 }
 
-func outputWriter(o <-chan string) {
-	for name := range o {
-		fmt.Print(name)
-		atomic.AddInt64(&output_count, 1)
+func outputWriter(o <-chan CTOutput) {
+	for out := range o {
+		for _, line := range out.Lines {
+			fmt.Print(line)
+			atomic.AddInt64(&output_count, 1)
+		}
+		log_trackers[out.Log].Emitted(out.Index)
 	}
 	wo.Done()
 }
 
-func inputParser(c <-chan CTEntry, o chan<- string) {
+// parseEntry extracts the output lines for a single log entry
+func parseEntry(entry CTEntry) []string {
+	lines := []string{}
 
-	for entry := range c {
+	leaf, cert, err := inetdata.ParseCTEntry(entry.LeafInput)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "[-] Failed to parse entry %d from %s: %s\n", entry.Index, entry.Log, err)
+		return lines
+	}
 
-		var leaf ct.MerkleTreeLeaf
+	// Valid input
+	atomic.AddInt64(&input_count, 1)
 
-		if rest, err := ct_tls.Unmarshal(entry.LeafInput, &leaf); err != nil {
-			fmt.Fprintf(os.Stderr, "[-] Failed to unmarshal MerkleTreeLeaf: %v (%v)", err, entry)
-			continue
-		} else if len(rest) > 0 {
-			fmt.Fprintf(os.Stderr, "[-] Trailing data (%d bytes) after MerkleTreeLeaf: %q", len(rest), rest)
-			continue
+	chain, err := inetdata.ParseCTChain(leaf, entry.ExtraData)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "[-] Failed to parse the chain of entry %d from %s: %s\n", entry.Index, entry.Log, err)
+	}
+	issuer_hash, root_hash := inetdata.CTChainFingerprints(chain)
+
+	if *output_format == "jsonl" {
+		index := entry.Index
+		record := inetdata.NewCTCertRecord(leaf, cert)
+		record.Log = entry.Log
+		record.Index = &index
+		record.SetChain(chain)
+
+		data, err := json.Marshal(record)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "[-] Failed to marshal entry %d from %s: %s\n", entry.Index, entry.Log, err)
+			return lines
 		}
+		return append(lines, string(data)+"\n")
+	}
 
-		var cert *x509.Certificate
-		var err error
+	var names = make(map[string]struct{})
 
-		switch leaf.TimestampedEntry.EntryType {
-		case ct.X509LogEntryType:
+	if _, err := publicsuffix.EffectiveTLDPlusOne(cert.Subject.CommonName); err == nil {
+		// Make sure this looks like an actual hostname or IP address
+		if !(MatchIPv4.Match([]byte(cert.Subject.CommonName)) ||
+			MatchIPv6.Match([]byte(cert.Subject.CommonName))) &&
+			(strings.Contains(cert.Subject.CommonName, " ") ||
+				strings.Contains(cert.Subject.CommonName, ":")) {
+			return lines
+		}
+		names[strings.ToLower(cert.Subject.CommonName)] = struct{}{}
+	}
 
-			cert, err = x509.ParseCertificate(leaf.TimestampedEntry.X509Entry.Data)
-			if err != nil && !strings.Contains(err.Error(), "NonFatalErrors:") {
-				fmt.Fprintf(os.Stderr, "[-] Failed to parse cert: %s\n", err.Error())
+	for _, alt := range cert.DNSNames {
+		if _, err := publicsuffix.EffectiveTLDPlusOne(alt); err == nil {
+			// Make sure this looks like an actual hostname or IP address
+			if !(MatchIPv4.Match([]byte(cert.Subject.CommonName)) ||
+				MatchIPv6.Match([]byte(cert.Subject.CommonName))) &&
+				(strings.Contains(alt, " ") ||
+					strings.Contains(alt, ":")) {
 				continue
 			}
+			names[strings.ToLower(alt)] = struct{}{}
+		}
+	}
 
-		case ct.PrecertLogEntryType:
+	sha1hash := ""
 
-			cert, err = x509.ParseTBSCertificate(leaf.TimestampedEntry.PrecertEntry.TBSCertificate)
-			if err != nil && !strings.Contains(err.Error(), "NonFatalErrors:") {
-				fmt.Fprintf(os.Stderr, "[-] Failed to parse precert: %s\n", err.Error())
-				continue
-			}
+	// Write the names to the output channel
+	for n := range names {
+		if len(sha1hash) == 0 {
+			sha1 := sha1.Sum(cert.Raw)
+			sha1hash = hex.EncodeToString(sha1[:])
+		}
 
-		default:
-			fmt.Fprintf(os.Stderr, "[-] Unknown entry type: %v (%v)", leaf.TimestampedEntry.EntryType, entry)
-			continue
+		// Dump associated email addresses if available
+		for _, extra := range cert.EmailAddresses {
+			lines = append(lines, fmt.Sprintf("%s,email,%s\n", n, strings.ToLower(scrubX509Value(extra))))
 		}
 
-		// Valid input
-		atomic.AddInt64(&input_count, 1)
+		// Dump associated IP addresses if we have at least one name
+		for _, extra := range cert.IPAddresses {
+			lines = append(lines, fmt.Sprintf("%s,ip,%s\n", n, extra))
+		}
 
-		var names = make(map[string]struct{})
+		lines = append(lines, fmt.Sprintf("%s,ts,%d\n", n, leaf.TimestampedEntry.Timestamp))
+		lines = append(lines, fmt.Sprintf("%s,cn,%s\n", n, strings.ToLower(scrubX509Value(cert.Subject.CommonName))))
+		lines = append(lines, fmt.Sprintf("%s,sha1,%s\n", n, sha1hash))
 
-		if _, err := publicsuffix.EffectiveTLDPlusOne(cert.Subject.CommonName); err == nil {
-			// Make sure this looks like an actual hostname or IP address
-			if !(MatchIPv4.Match([]byte(cert.Subject.CommonName)) ||
-				MatchIPv6.Match([]byte(cert.Subject.CommonName))) &&
-				(strings.Contains(cert.Subject.CommonName, " ") ||
-					strings.Contains(cert.Subject.CommonName, ":")) {
-				continue
-			}
-			names[strings.ToLower(cert.Subject.CommonName)] = struct{}{}
+		// Dump the fingerprints of the issuer and root from the chain
+		if len(issuer_hash) > 0 {
+			lines = append(lines, fmt.Sprintf("%s,issuer_sha256,%s\n", n, issuer_hash))
+			lines = append(lines, fmt.Sprintf("%s,root_sha256,%s\n", n, root_hash))
 		}
 
-		for _, alt := range cert.DNSNames {
-			if _, err := publicsuffix.EffectiveTLDPlusOne(alt); err == nil {
-				// Make sure this looks like an actual hostname or IP address
-				if !(MatchIPv4.Match([]byte(cert.Subject.CommonName)) ||
-					MatchIPv6.Match([]byte(cert.Subject.CommonName))) &&
-					(strings.Contains(alt, " ") ||
-						strings.Contains(alt, ":")) {
-					continue
-				}
-				names[strings.ToLower(alt)] = struct{}{}
-			}
+		// Dump associated SANs
+		for _, extra := range cert.DNSNames {
+			lines = append(lines, fmt.Sprintf("%s,dns,%s\n", strings.ToLower(extra), n))
 		}
+	}
 
-		sha1hash := ""
+	return lines
+}
 
-		// Write the names to the output channel
-		for n := range names {
-			if len(sha1hash) == 0 {
-				sha1 := sha1.Sum(cert.Raw)
-				sha1hash = hex.EncodeToString(sha1[:])
-			}
+func inputParser(c <-chan CTEntry, o chan<- CTOutput) {
+	for entry := range c {
+		// Every entry is sent, even without output, so that progress can be tracked
+		o <- CTOutput{Log: entry.Log, Index: entry.Index, Lines: parseEntry(entry)}
+	}
+	wi.Done()
+}
 
-			// Dump associated email addresses if available
-			for _, extra := range cert.EmailAddresses {
-				o <- fmt.Sprintf("%s,email,%s\n", n, strings.ToLower(scrubX509Value(extra)))
-			}
+// logVerifier creates a signature verifier from the log list entry or the
+// -pubkey option, checking the key against the log ID when one is listed
+func logVerifier(info inetdata.CTLogInfo, pubkey string) (*ct.SignatureVerifier, error) {
+	value := info.Key
+	if len(value) == 0 {
+		value = pubkey
+	}
 
-			// Dump associated IP addresses if we have at least one name
-			for _, extra := range cert.IPAddresses {
-				o <- fmt.Sprintf("%s,ip,%s\n", n, extra)
-			}
+	if len(value) == 0 {
+		return nil, errors.New("no public key available")
+	}
 
-			o <- fmt.Sprintf("%s,ts,%d\n", n, leaf.TimestampedEntry.Timestamp)
-			o <- fmt.Sprintf("%s,cn,%s\n", n, strings.ToLower(scrubX509Value(cert.Subject.CommonName)))
-			o <- fmt.Sprintf("%s,sha1,%s\n", n, sha1hash)
+	key, der, err := loadPublicKey(value)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(info.LogID) > 0 {
+		id := sha256.Sum256(der)
+		if base64.StdEncoding.EncodeToString(id[:]) != info.LogID {
+			return nil, errors.New("public key does not match the log ID")
+		}
+	}
+
+	return ct.NewSignatureVerifier(key)
+}
+
+// parseLogFilter converts the log list command-line options to a filter
+func parseLogFilter(states string, operators string, date string) (inetdata.CTLogFilter, error) {
+	filter := inetdata.CTLogFilter{}
 
-			// Dump associated SANs
-			for _, extra := range cert.DNSNames {
-				o <- fmt.Sprintf("%s,dns,%s\n", strings.ToLower(extra), n)
+	for _, state := range strings.Split(states, ",") {
+		state = strings.ToLower(strings.TrimSpace(state))
+		if len(state) == 0 {
+			continue
+		}
+
+		valid := false
+		for _, name := range inetdata.CTLogStateNames {
+			if state == name {
+				valid = true
+				break
 			}
 		}
+
+		if !valid {
+			return filter, fmt.Errorf("invalid log state: %s", state)
+		}
+		filter.States = append(filter.States, state)
 	}
 
-	wi.Done()
+	for _, op := range strings.Split(operators, ",") {
+		op = strings.TrimSpace(op)
+		if len(op) > 0 {
+			filter.Operators = append(filter.Operators, op)
+		}
+	}
+
+	switch date {
+	case "":
+	case "now":
+		filter.Date = time.Now()
+	default:
+		ts, err := time.Parse("2006-01-02", date)
+		if err != nil {
+			return filter, fmt.Errorf("invalid shard date: %s", date)
+		}
+		filter.Date = ts
+	}
+
+	return filter, nil
 }
 
 func main() {
@@ -364,25 +1478,157 @@ func main() {
 
 	flag.Usage = func() { usage() }
 	logurl := flag.String("logurl", "", "Only read from the specified CT log url")
+	tiled := flag.Bool("tiled", false, "Treat -logurl as the monitoring prefix of a static CT API (tiled) log, file:// URLs are supported")
 	number = flag.Int("n", 100, "The number of entries from the end to start from")
 	follow = flag.Bool("f", false, "Follow the tail of the CT log")
+	from_start = flag.Bool("from-start", false, "Start from the first entry of each log")
+	from_index = flag.Int64("from-index", -1, "Start from the specified entry index of each log")
+	state_dir := flag.String("state-dir", "", "The directory used to save and resume the position in each log")
+	loglist := flag.String("loglist", "", "Read the logs from a log list file in the v3 JSON format")
+	log_states := flag.String("log-state", "usable,readonly", "The log states to select from the log list (pending, qualified, usable, readonly, retired, rejected)")
+	operators := flag.String("operator", "", "Only select logs from the log list run by these operators (comma-separated)")
+	pubkey := flag.String("pubkey", "", "The public key of -logurl (PEM or base64 DER file, or base64 string), enables verification of that log")
+	no_verify := flag.Bool("no-verify", false, "Skip verification of tree head signatures and consistency proofs for logs from -loglist")
+	batch_size = flag.Int("batch", 1000, "The number of entries to request at once, reduced automatically if the log returns fewer")
+	workers = flag.Int("workers", 1, "The number of concurrent download workers per log")
+	max_retries = flag.Int("retries", 10, "The number of times to retry a failed request before giving up")
+	retry_backoff = flag.Duration("backoff", time.Duration(1)*time.Second, "The initial delay before retrying a failed request, doubled after each attempt")
+	interval = flag.Duration("interval", time.Duration(10)*time.Second, "The delay between checks for new entries in follow mode")
+	output_format = flag.String("format", "csv", "The output format: csv (name,type,value lines) or jsonl (one certificate record per entry)")
+	shard_date := flag.String("shard-date", "", "Only select shards from the log list that accept certificates expiring on this date (YYYY-MM-DD or now)")
 
 	flag.Parse()
 
+	if *from_start && *from_index >= 0 {
+		fmt.Fprintf(os.Stderr, "Error: Only one of -from-start or -from-index can be specified\n")
+		usage()
+		os.Exit(1)
+	}
+
+	if *output_format != "csv" && *output_format != "jsonl" {
+		fmt.Fprintf(os.Stderr, "Error: Invalid output format specified: %s\n", *output_format)
+		usage()
+		os.Exit(1)
+	}
+
+	if *batch_size < 1 || *workers < 1 || *max_retries < 0 || *retry_backoff <= 0 {
+		fmt.Fprintf(os.Stderr, "Error: -batch, -workers and -backoff must be positive and -retries can not be negative\n")
+		usage()
+		os.Exit(1)
+	}
+
+	if len(*state_dir) > 0 {
+		if err := os.MkdirAll(*state_dir, 0755); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: failed to create state directory %s: %s\n", *state_dir, err)
+			os.Exit(1)
+		}
+	}
+
+	if len(*pubkey) > 0 && len(*logurl) == 0 {
+		fmt.Fprintf(os.Stderr, "Error: -pubkey can only be used with -logurl\n")
+		usage()
+		os.Exit(1)
+	}
+
+	// Logs are verified when a key is available, which is only the case for
+	// -logurl with -pubkey and for log lists. The built-in logs are not verified.
+	verify := false
+
 	logs := []string{}
+	log_keys := map[string]inetdata.CTLogInfo{}
+	tiled_logs := map[string]bool{}
 	if len(*logurl) > 0 {
+		// Local files are only readable when the log itself is on local disk
+		if strings.HasPrefix(*logurl, "file://") {
+			http_client = newHTTPClient(true)
+		}
 		logs = append(logs, *logurl)
+		tiled_logs[*logurl] = *tiled
+		verify = len(*pubkey) > 0 && !*no_verify
+	} else if len(*loglist) > 0 {
+		filter, err := parseLogFilter(*log_states, *operators, *shard_date)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+			usage()
+			os.Exit(1)
+		}
+
+		list, err := inetdata.LoadCTLogList(*loglist)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: failed to load log list %s: %s\n", *loglist, err)
+			os.Exit(1)
+		}
+
+		for _, log := range list.SelectLogs(filter) {
+			logs = append(logs, log.ReadURL())
+			log_keys[log.ReadURL()] = log.CTLogInfo
+			tiled_logs[log.ReadURL()] = log.Tiled
+		}
+
+		fmt.Fprintf(os.Stderr, "[*] Selected %d logs from %s\n", len(logs), *loglist)
+		verify = !*no_verify
 	} else {
 		for idx := range CTLogs {
 			logs = append(logs, CTLogs[idx])
 		}
 	}
 
+	if verify {
+		verified := []string{}
+		for idx := range logs {
+			// The -pubkey option only applies to -logurl
+			key := ""
+			if logs[idx] == *logurl {
+				key = *pubkey
+			}
+
+			v, err := logVerifier(log_keys[logs[idx]], key)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "[-] Skipping %s: %s\n", logs[idx], err)
+				continue
+			}
+			log_verifiers[logs[idx]] = v
+			verified = append(verified, logs[idx])
+		}
+
+		if len(verified) == 0 {
+			fmt.Fprintf(os.Stderr, "Error: no logs with a usable public key, use -no-verify to skip verification\n")
+			os.Exit(1)
+		}
+		logs = verified
+	}
+
+	for idx := range logs {
+		log_trackers[logs[idx]] = newLogTracker(logs[idx], *state_dir)
+		if tiled_logs[logs[idx]] {
+			log_backends[logs[idx]] = newTiledBackend(logs[idx])
+		} else {
+			log_backends[logs[idx]] = &rfc6962Backend{url: logs[idx]}
+		}
+	}
+
+	// Save state periodically and on exit
+	go func() {
+		for {
+			time.Sleep(time.Duration(10) * time.Second)
+			saveStates()
+		}
+	}()
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-sigs
+		fmt.Fprintf(os.Stderr, "[*] Received %s, saving state\n", sig)
+		saveStates()
+		os.Exit(1)
+	}()
+
 	// Input
 	c_inp := make(chan CTEntry)
 
 	// Output
-	c_out := make(chan string)
+	c_out := make(chan CTOutput)
 
 	// Launch one input parser per core
 	for i := 0; i < runtime.NumCPU(); i++ {
@@ -412,4 +1658,10 @@ func main() {
 
 	// Wait for the output goroutine
 	wo.Wait()
+
+	saveStates()
+
+	if atomic.LoadInt32(&verify_failed) != 0 || atomic.LoadInt32(&download_failed) != 0 {
+		os.Exit(1)
+	}
 }
@@ -0,0 +1,398 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	ct "github.com/google/certificate-transparency-go"
+	cttls "github.com/google/certificate-transparency-go/tls"
+	"github.com/hdm/inetdata-parsers"
+)
+
+const tiledTestOrigin = "log.example.com/test"
+
+// tiledTestLog is a static CT API log written to a directory
+type tiledTestLog struct {
+	dir     string
+	leaves  [][]byte
+	chains  [][][]byte
+	precert [][]byte
+	levels  [][][]byte
+}
+
+func writeTiledTestFile(t *testing.T, dir string, path string, data []byte) {
+	name := filepath.Join(dir, filepath.FromSlash(path))
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(name, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// newTiledTestLog writes the checkpoint, data tiles, hash tiles, and issuers of
+// a log with size entries. Every third entry is a precertificate, and the last
+// data tile is compressed.
+func newTiledTestLog(t *testing.T, size int) *tiledTestLog {
+	dir, err := ioutil.TempDir("", "ct-tiles-")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l := &tiledTestLog{dir: dir}
+
+	issuers := [][]byte{[]byte("intermediate certificate"), []byte("root certificate")}
+	for _, cert := range issuers {
+		fp := sha256.Sum256(cert)
+		writeTiledTestFile(t, dir, "issuer/"+hex.EncodeToString(fp[:]), cert)
+	}
+
+	tiles := [][]byte{}
+	for i := 0; i < size; i++ {
+		entry := ct.TimestampedEntry{Timestamp: uint64(1700000000000 + i)}
+		var pre []byte
+		if i%3 == 0 {
+			pre = []byte(fmt.Sprintf("precertificate %d", i))
+			entry.EntryType = ct.PrecertLogEntryType
+			entry.PrecertEntry = &ct.PreCert{TBSCertificate: []byte(fmt.Sprintf("tbs %d", i))}
+		} else {
+			entry.EntryType = ct.X509LogEntryType
+			entry.X509Entry = &ct.ASN1Cert{Data: []byte(fmt.Sprintf("certificate %d", i))}
+		}
+
+		raw, err := cttls.Marshal(entry)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Alternate between one and two issuers
+		chain := issuers[0 : 1+i%2]
+		fps := []byte{}
+		for _, cert := range chain {
+			fp := sha256.Sum256(cert)
+			fps = append(fps, fp[:]...)
+		}
+
+		if i%inetdata.CTTileWidth == 0 {
+			tiles = append(tiles, []byte{})
+		}
+		tile := append(tiles[len(tiles)-1], raw...)
+		if pre != nil {
+			tile = append(tile, byte(len(pre)>>16), byte(len(pre)>>8), byte(len(pre)))
+			tile = append(tile, pre...)
+		}
+		tile = append(tile, byte(len(fps)>>8), byte(len(fps)))
+		tiles[len(tiles)-1] = append(tile, fps...)
+
+		l.leaves = append(l.leaves, append([]byte{byte(ct.V1), byte(ct.TimestampedEntryLeafType)}, raw...))
+		l.chains = append(l.chains, chain)
+		l.precert = append(l.precert, pre)
+	}
+
+	for i, tile := range tiles {
+		if i == len(tiles)-1 {
+			var buf bytes.Buffer
+			gz := gzip.NewWriter(&buf)
+			gz.Write(tile)
+			gz.Close()
+			tile = buf.Bytes()
+		}
+		writeTiledTestFile(t, dir, inetdata.CTDataTilePath(int64(i), tileWidth(int64(i), int64(size))), tile)
+	}
+
+	// Hashes of every level, each node covering 2^level leaves
+	hashes := [][]byte{}
+	for _, leaf := range l.leaves {
+		hashes = append(hashes, inetdata.MerkleLeafHash(leaf))
+	}
+	for len(hashes) > 0 {
+		l.levels = append(l.levels, hashes)
+		next := [][]byte{}
+		for i := 0; i+1 < len(hashes); i += 2 {
+			next = append(next, inetdata.MerkleNodeHash(hashes[i], hashes[i+1]))
+		}
+		hashes = next
+	}
+
+	// Every eighth level is stored in hash tiles
+	for level := 0; level < len(l.levels); level += inetdata.CTTileHeight {
+		nodes := l.levels[level]
+		for i := 0; i*inetdata.CTTileWidth < len(nodes); i++ {
+			width := tileWidth(int64(i), int64(len(nodes)))
+			data := bytes.Join(nodes[i*inetdata.CTTileWidth:i*inetdata.CTTileWidth+width], nil)
+			writeTiledTestFile(t, dir, inetdata.CTTilePath(level/inetdata.CTTileHeight, int64(i), width), data)
+		}
+	}
+
+	sig := append([]byte{0xde, 0xad, 0xbe, 0xef}, make([]byte, 8)...)
+	binary.BigEndian.PutUint64(sig[4:12], 1700000001000)
+	sig = append(sig, "tree head signature"...)
+
+	checkpoint := fmt.Sprintf("%s\n%d\n%s\n\n— witness.example.com %s\n— %s %s\n",
+		tiledTestOrigin, size, base64.StdEncoding.EncodeToString(l.root(size)),
+		base64.StdEncoding.EncodeToString([]byte("witness cosignature")),
+		tiledTestOrigin, base64.StdEncoding.EncodeToString(sig))
+	writeTiledTestFile(t, dir, "checkpoint", []byte(checkpoint))
+
+	return l
+}
+
+// root returns the RFC 6962 root hash of the first size entries
+func (l *tiledTestLog) root(size int) []byte {
+	f := &inetdata.MerkleFrontier{}
+	for _, leaf := range l.leaves[0:size] {
+		f.Append(inetdata.MerkleLeafHash(leaf))
+	}
+	return f.Root()
+}
+
+func (l *tiledTestLog) head(size int) CTHead {
+	return CTHead{TreeSize: int64(size), SHA256RootHash: base64.StdEncoding.EncodeToString(l.root(size))}
+}
+
+func startTiledTestLog(t *testing.T, size int) (*tiledTestLog, *httptest.Server) {
+	l := newTiledTestLog(t, size)
+	return l, httptest.NewServer(http.FileServer(http.Dir(l.dir)))
+}
+
+func TestTiledBackendTreeHead(t *testing.T) {
+	l, srv := startTiledTestLog(t, 600)
+	defer os.RemoveAll(l.dir)
+	defer srv.Close()
+
+	sth, err := newTiledBackend(srv.URL + "/").TreeHead()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exp := CTHead{
+		TreeSize:          600,
+		Timestamp:         1700000001000,
+		SHA256RootHash:    base64.StdEncoding.EncodeToString(l.root(600)),
+		TreeHeadSignature: base64.StdEncoding.EncodeToString([]byte("tree head signature")),
+	}
+	if sth != exp {
+		t.Fatalf("tree head is %+v, expected %+v", sth, exp)
+	}
+
+	// A checkpoint with only cosignatures has no tree head
+	writeTiledTestFile(t, l.dir, "checkpoint", []byte(fmt.Sprintf("%s\n600\n%s\n\n— witness.example.com %s\n",
+		tiledTestOrigin, exp.SHA256RootHash, base64.StdEncoding.EncodeToString([]byte("witness cosignature")))))
+
+	if _, err := newTiledBackend(srv.URL).TreeHead(); err == nil || !strings.Contains(err.Error(), "no tree head signature") {
+		t.Fatalf("expected a missing signature error, got %v", err)
+	}
+}
+
+func TestTiledBackendEntries(t *testing.T) {
+	l, srv := startTiledTestLog(t, 600)
+	defer os.RemoveAll(l.dir)
+	defer srv.Close()
+
+	b := newTiledBackend(srv.URL)
+
+	// Read across the last full tile into the compressed partial tile, with the
+	// stop index past the end of the tree
+	entries, err := b.Entries(500, 700, l.head(600))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 100 {
+		t.Fatalf("read %d entries, expected 100", len(entries))
+	}
+
+	for i, e := range entries {
+		index := 500 + i
+		if !bytes.Equal(e.LeafInput, l.leaves[index]) {
+			t.Fatalf("entry %d has the wrong leaf input", index)
+		}
+
+		var certs []ct.ASN1Cert
+		if l.precert[index] != nil {
+			var pre ct.PrecertChainEntry
+			if _, err := cttls.Unmarshal(e.ExtraData, &pre); err != nil {
+				t.Fatalf("entry %d: %s", index, err)
+			}
+			if !bytes.Equal(pre.PreCertificate.Data, l.precert[index]) {
+				t.Fatalf("entry %d has precertificate %q", index, pre.PreCertificate.Data)
+			}
+			certs = pre.CertificateChain
+		} else {
+			var chain ct.CertificateChain
+			if _, err := cttls.Unmarshal(e.ExtraData, &chain); err != nil {
+				t.Fatalf("entry %d: %s", index, err)
+			}
+			certs = chain.Entries
+		}
+
+		if len(certs) != len(l.chains[index]) {
+			t.Fatalf("entry %d has %d issuers, expected %d", index, len(certs), len(l.chains[index]))
+		}
+		for j := range certs {
+			if !bytes.Equal(certs[j].Data, l.chains[index][j]) {
+				t.Fatalf("entry %d issuer %d is %q", index, j, certs[j].Data)
+			}
+		}
+
+		// The extra data parses as a real log entry
+		leaf := ct.LeafEntry{LeafInput: e.LeafInput, ExtraData: e.ExtraData}
+		if _, err := ct.RawLogEntryFromLeaf(int64(index), &leaf); err != nil {
+			t.Fatalf("entry %d: %s", index, err)
+		}
+	}
+
+	// An older tree head reads a partial tile that the log no longer serves
+	if _, err := b.Entries(0, 10, l.head(200)); err == nil {
+		t.Fatal("expected an error for a missing partial tile")
+	}
+
+	// Issuers must match their fingerprints
+	fp := sha256.Sum256([]byte("root certificate"))
+	writeTiledTestFile(t, l.dir, "issuer/"+hex.EncodeToString(fp[:]), []byte("another certificate"))
+	if _, err := newTiledBackend(srv.URL).Entries(1, 1, l.head(600)); err == nil {
+		t.Fatal("expected an error for an issuer that does not match its fingerprint")
+	}
+}
+
+func TestTiledBackendNodeHash(t *testing.T) {
+	l, srv := startTiledTestLog(t, 600)
+	defer os.RemoveAll(l.dir)
+	defer srv.Close()
+
+	b := newTiledBackend(srv.URL)
+
+	// Levels 0 and 8 are read from full and partial tiles, the levels between
+	// are computed from the level 0 tiles
+	tests := []struct {
+		level uint
+		index uint64
+	}{
+		{0, 0}, {0, 255}, {0, 256}, {0, 599},
+		{1, 0}, {1, 299},
+		{3, 74},
+		{7, 0}, {7, 3},
+		{8, 0}, {8, 1},
+		{9, 0},
+	}
+
+	for _, tt := range tests {
+		h, err := b.nodeHash(tt.level, tt.index, 600)
+		if err != nil {
+			t.Fatalf("nodeHash(%d, %d): %s", tt.level, tt.index, err)
+		}
+		if !bytes.Equal(h, l.levels[tt.level][tt.index]) {
+			t.Fatalf("nodeHash(%d, %d) does not match", tt.level, tt.index)
+		}
+	}
+
+	// The level 0 tiles of a smaller tree have a different partial width
+	if _, err := b.nodeHash(0, 520, 530); err == nil {
+		t.Fatal("expected an error for a missing partial tile")
+	}
+
+	// Tiles with the wrong number of hashes are rejected
+	writeTiledTestFile(t, l.dir, inetdata.CTTilePath(1, 0, 2), make([]byte, 32*3))
+	if _, err := newTiledBackend(srv.URL).nodeHash(8, 0, 600); err == nil {
+		t.Fatal("expected an error for a hash tile of the wrong width")
+	}
+}
+
+func TestTiledBackendFrontier(t *testing.T) {
+	l, srv := startTiledTestLog(t, 600)
+	defer os.RemoveAll(l.dir)
+	defer srv.Close()
+
+	b := newTiledBackend(srv.URL)
+	sth := l.head(600)
+
+	for _, index := range []int{0, 1, 255, 256, 257, 511, 512, 513, 599, 600} {
+		f, err := b.Frontier(int64(index), sth)
+		if err != nil {
+			t.Fatalf("Frontier(%d): %s", index, err)
+		}
+		if f.Size != uint64(index) || !bytes.Equal(f.Root(), l.root(index)) {
+			t.Fatalf("Frontier(%d) has the wrong root", index)
+		}
+	}
+
+	// A frontier built from downloaded entries is a prefix of the tree head
+	f := &inetdata.MerkleFrontier{}
+	for _, leaf := range l.leaves[0:300] {
+		f.Append(inetdata.MerkleLeafHash(leaf))
+	}
+	if err := b.VerifyFrontier(f, sth); err != nil {
+		t.Fatal(err)
+	}
+
+	f.Append(inetdata.MerkleLeafHash([]byte("forged entry")))
+	if err := b.VerifyFrontier(f, sth); err == nil {
+		t.Fatal("expected an error for a frontier with a forged entry")
+	}
+
+	if err := b.VerifyConsistency(l.head(300), sth); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.VerifyConsistency(sth, l.head(37)); err != nil {
+		t.Fatal(err)
+	}
+
+	bad := l.head(300)
+	bad.SHA256RootHash = sth.SHA256RootHash
+	if err := b.VerifyConsistency(bad, sth); err == nil {
+		t.Fatal("expected an error for inconsistent tree heads")
+	}
+
+	// Tiles that do not match the tree head are never trusted
+	bad = sth
+	bad.SHA256RootHash = l.head(599).SHA256RootHash
+	if _, err := b.Frontier(10, bad); err == nil {
+		t.Fatal("expected an error for tiles that do not match the root hash")
+	}
+}
+
+func TestHTTPClientLocalFiles(t *testing.T) {
+	l := newTiledTestLog(t, 10)
+	defer os.RemoveAll(l.dir)
+
+	// A remote log can not redirect to local files
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "file://"+l.dir+"/checkpoint", http.StatusFound)
+	}))
+	defer srv.Close()
+
+	for _, local_files := range []bool{false, true} {
+		http_client = newHTTPClient(local_files)
+		if _, err := downloadBytes(srv.URL + "/checkpoint"); err == nil || !strings.Contains(err.Error(), "refusing redirect") {
+			t.Fatalf("expected a refused redirect, got %v", err)
+		}
+	}
+
+	// Local files are only read when enabled for a file:// log
+	http_client = newHTTPClient(false)
+	if _, err := downloadBytes("file://" + l.dir + "/checkpoint"); err == nil {
+		t.Fatal("expected an error for a file:// URL")
+	}
+
+	http_client = newHTTPClient(true)
+	defer func() { http_client = newHTTPClient(false) }()
+
+	sth, err := newTiledBackend("file://" + l.dir).TreeHead()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sth.TreeSize != 10 {
+		t.Fatalf("tree head has size %d, expected 10", sth.TreeSize)
+	}
+}
@@ -45,6 +45,8 @@ type ParsedCTEntry struct {
 	DNS        []string `json:"dns,omitempty"`
 	IP         []net.IP `json:"ip,omitempty"`
 	Email      []string `json:"email,omitempty"`
+	Issuer     string   `json:"issuer,omitempty"`
+	Root       string   `json:"root,omitempty"`
 }
 
 type ParsedCTEntryOutput struct {
@@ -171,6 +173,21 @@ func parsedCTWriter(o <-chan string, fd io.WriteCloser) {
 	wg_parsed_ct_writer.Done()
 }
 
+// parsedCTSorter queues parsed entries for the built-in sorter. After a failure the
+// error is sent to main and the remaining entries are discarded, so the parsers never block.
+func parsedCTSorter(o <-chan string, s *inetdata.ExternalSort, errs chan error) {
+	var err error
+	for r := range o {
+		if err != nil {
+			continue
+		}
+		if err = s.Add(r); err != nil {
+			errs <- err
+		}
+	}
+	wg_parsed_ct_writer.Done()
+}
+
 func rawCTReader(c <-chan string, o chan<- string) {
 
 	for r := range c {
@@ -249,6 +266,12 @@ func rawCTReader(c <-chan string, o chan<- string) {
 			names[fmt.Sprintf("%s", alt)] = struct{}{}
 		}
 
+		chain, err := inetdata.ParseCTChain(&leaf, entry.ExtraData)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to parse chain: %s\n", err)
+		}
+		issuer_hash, root_hash := inetdata.CTChainFingerprints(chain)
+
 		sha1 := sha1.Sum(cert.Raw)
 		sha1hash := hex.EncodeToString(sha1[:])
 		wrote_hash := false
@@ -258,6 +281,8 @@ func rawCTReader(c <-chan string, o chan<- string) {
 
 			info := ParsedCTEntry{Sha1Hash: sha1hash, Timestamp: leaf.TimestampedEntry.Timestamp}
 			info.CommonName = scrubX509Value(cert.Subject.CommonName)
+			info.Issuer = issuer_hash
+			info.Root = root_hash
 
 			// Dump associated email addresses if available
 			for _, extra := range cert.EmailAddresses {
@@ -292,39 +317,10 @@ func rawCTReader(c <-chan string, o chan<- string) {
 	wg_raw_ct_input.Done()
 }
 
-func main() {
-
-	runtime.GOMAXPROCS(runtime.NumCPU())
-	os.Setenv("LC_ALL", "C")
-
-	flag.Usage = func() { usage() }
-	sort_tmp := flag.String("t", "", "The temporary directory to use for the sorting phase")
-	sort_mem := flag.Uint64("m", 1, "The maximum amount of memory to use, in gigabytes, for the sorting phases")
-	version := flag.Bool("version", false, "Show the version and build timestamp")
-
-	flag.Parse()
-
-	if *version {
-		inetdata.PrintVersion("inetdata-ct2csv")
-		os.Exit(0)
-	}
-
-	if len(*sort_tmp) == 0 {
-		*sort_tmp = os.Getenv("HOME")
-	}
-
-	if len(*sort_tmp) == 0 {
-		flag.Usage()
-		os.Exit(1)
-	}
-
-	jsonl_writer_ch := make(chan NewRecord, 1)
-	jsonl_writer_done := make(chan bool, 1)
-
-	// Read from the jsonl_writer_ch for NewRecords and write to the CSV writer
-	go writeToOutput(jsonl_writer_ch, jsonl_writer_done)
-
-	// Create the sort and rollup pipeline
+// startSystemSort creates a sort, inetdata-csvrollup, and sort pipeline using
+// external commands, sends the merged output to the out channel, and returns the
+// pipeline input
+func startSystemSort(sort_tmp string, sort_mem uint64, out chan string) (io.WriteCloser, []*exec.Cmd) {
 	subprocs := []*exec.Cmd{}
 
 	// Create a sort process
@@ -335,8 +331,8 @@ func main() {
 		"--field-separator=,",
 		"--compress-program=pigz",
 		fmt.Sprintf("--parallel=%d", runtime.NumCPU()),
-		fmt.Sprintf("--temporary-directory=%s", *sort_tmp),
-		fmt.Sprintf("--buffer-size=%dG", *sort_mem))
+		fmt.Sprintf("--temporary-directory=%s", sort_tmp),
+		fmt.Sprintf("--buffer-size=%dG", sort_mem))
 
 	// Configure stdio
 	sort_stdin, sie := sort_proc.StdinPipe()
@@ -388,8 +384,8 @@ func main() {
 		"--field-separator=,",
 		"--compress-program=pigz",
 		fmt.Sprintf("--parallel=%d", runtime.NumCPU()),
-		fmt.Sprintf("--temporary-directory=%s", *sort_tmp),
-		fmt.Sprintf("--buffer-size=%dG", *sort_mem))
+		fmt.Sprintf("--temporary-directory=%s", sort_tmp),
+		fmt.Sprintf("--buffer-size=%dG", sort_mem))
 
 	sort2_stdout, ssoe := sort2_proc.StdoutPipe()
 	if ssoe != nil {
@@ -407,15 +403,10 @@ func main() {
 		os.Exit(1)
 	}
 
-	// Read rollup entries, convert to json, send to the CSV writer
-	c_ct_sorted_output := make(chan string)
-	wg_sorted_ct_parser.Add(1)
-	go sortedCTParser(c_ct_sorted_output, jsonl_writer_ch)
-
 	wg_sort_reader.Add(1)
 	go func() {
 		// Read rollup entries from the sort pipe and send to the parser
-		e := inetdata.ReadLinesFromReader(sort2_stdout, c_ct_sorted_output)
+		e := inetdata.ReadLinesFromReader(sort2_stdout, out)
 		if e != nil {
 			fmt.Fprintf(os.Stderr, "Error reading sort 2 input: %s\n", e)
 			os.Exit(1)
@@ -423,6 +414,68 @@ func main() {
 		wg_sort_reader.Done()
 	}()
 
+	return sort_stdin, subprocs
+}
+
+func main() {
+
+	runtime.GOMAXPROCS(runtime.NumCPU())
+	os.Setenv("LC_ALL", "C")
+
+	flag.Usage = func() { usage() }
+	sort_tmp := flag.String("t", "", "The temporary directory to use for the sorting phase")
+	sort_mem := flag.Uint64("m", 1, "The maximum amount of memory to use, in gigabytes, for the sorting phases")
+	system_sort := flag.Bool("system-sort", false, "Use the external sort, pigz, and inetdata-csvrollup commands instead of the built-in sorter")
+	version := flag.Bool("version", false, "Show the version and build timestamp")
+
+	flag.Parse()
+
+	if *version {
+		inetdata.PrintVersion("inetdata-ct2csv")
+		os.Exit(0)
+	}
+
+	if len(*sort_tmp) == 0 {
+		*sort_tmp = os.Getenv("HOME")
+	}
+
+	if len(*sort_tmp) == 0 {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	jsonl_writer_ch := make(chan NewRecord, 1)
+	jsonl_writer_done := make(chan bool, 1)
+
+	// Read from the jsonl_writer_ch for NewRecords and write to the CSV writer
+	go writeToOutput(jsonl_writer_ch, jsonl_writer_done)
+
+	// Read rollup entries, convert to json, send to the CSV writer
+	c_ct_sorted_output := make(chan string)
+	wg_sorted_ct_parser.Add(1)
+	go sortedCTParser(c_ct_sorted_output, jsonl_writer_ch)
+
+	// Create the sort and rollup pipeline
+	var sort_stdin io.WriteCloser
+	var sorter *inetdata.ExternalSort
+	sort_errors := make(chan error, 1)
+	subprocs := []*exec.Cmd{}
+
+	if *system_sort {
+		sort_stdin, subprocs = startSystemSort(*sort_tmp, *sort_mem, c_ct_sorted_output)
+	} else {
+		var se error
+		sorter, se = inetdata.NewExternalSort(inetdata.SortOptions{
+			TempDir:   *sort_tmp,
+			MaxMemory: *sort_mem * 1024 * 1024 * 1024,
+			Unique:    true,
+		})
+		if se != nil {
+			fmt.Fprintf(os.Stderr, "Error: failed to create sorter: %s\n", se)
+			os.Exit(1)
+		}
+	}
+
 	// Start the progress tracker
 	quit := make(chan int)
 	go showProgress(quit)
@@ -439,14 +492,30 @@ func main() {
 		go rawCTReader(c_ct_raw_input, c_ct_parsed_output)
 	}
 
-	// Launch a writer that feeds parsed entries into the sort input pipe
+	// Launch a writer that feeds parsed entries into the sorter
 	wg_parsed_ct_writer.Add(1)
-	go parsedCTWriter(c_ct_parsed_output, sort_stdin)
+	if *system_sort {
+		go parsedCTWriter(c_ct_parsed_output, sort_stdin)
+	} else {
+		go parsedCTSorter(c_ct_parsed_output, sorter, sort_errors)
+	}
 
 	// Read CT JSON from stdin, parse, and send to sort
-	e := inetdata.ReadLines(os.Stdin, c_ct_raw_input)
-	if e != nil {
-		fmt.Fprintf(os.Stderr, "Error reading input: %s\n", e)
+	read_done := make(chan error, 1)
+	go func() {
+		read_done <- inetdata.ReadLines(os.Stdin, c_ct_raw_input)
+	}()
+
+	// Stop early if the sorter fails, removing its temporary files first
+	select {
+	case e := <-read_done:
+		if e != nil {
+			fmt.Fprintf(os.Stderr, "Error reading input: %s\n", e)
+		}
+	case e := <-sort_errors:
+		fmt.Fprintf(os.Stderr, "Error: failed to sort parsed entry: %s\n", e)
+		sorter.Close()
+		os.Exit(1)
 	}
 
 	// Wait for the input parsers
@@ -458,15 +527,36 @@ func main() {
 	// Wait for the output goroutine
 	wg_parsed_ct_writer.Wait()
 
-	// Close the sort 1 input pipe
-	sort_stdin.Close()
+	select {
+	case e := <-sort_errors:
+		fmt.Fprintf(os.Stderr, "Error: failed to sort parsed entry: %s\n", e)
+		sorter.Close()
+		os.Exit(1)
+	default:
+	}
 
-	// Wait for the sort reader
-	wg_sort_reader.Wait()
+	if *system_sort {
+		// Close the sort 1 input pipe
+		sort_stdin.Close()
 
-	// Wait for subproceses to complete
-	for i := range subprocs {
-		subprocs[i].Wait()
+		// Wait for the sort reader
+		wg_sort_reader.Wait()
+
+		// Wait for subproceses to complete
+		for i := range subprocs {
+			if e := subprocs[i].Wait(); e != nil {
+				fmt.Fprintf(os.Stderr, "Error: %s failed: %s\n", strings.Join(subprocs[i].Args, " "), e)
+				os.Exit(1)
+			}
+		}
+	} else {
+		// Sort and merge the parsed entries and send them to the parser
+		e := sorter.SortRollup(c_ct_sorted_output)
+		sorter.Close()
+		if e != nil {
+			fmt.Fprintf(os.Stderr, "Error: failed to sort parsed entries: %s\n", e)
+			os.Exit(1)
+		}
 	}
 
 	// Wait for the sortedCT processor
@@ -2,6 +2,7 @@ package main
 
 import (
 	"crypto/sha1"
+	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
 	"flag"
@@ -11,15 +12,11 @@ import (
 	"os/exec"
 	"runtime"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
-	"sync/atomic"
-	"time"
 
 	ct "github.com/google/certificate-transparency-go"
-	"github.com/google/certificate-transparency-go/tls"
-	"github.com/google/certificate-transparency-go/x509"
-	mtbl "github.com/hdm/golang-mtbl"
 	"github.com/hdm/inetdata-parsers"
 	"golang.org/x/net/publicsuffix"
 )
@@ -27,23 +24,18 @@ import (
 const MERGE_MODE_COMBINE = 0
 const MERGE_MODE_FIRST = 1
 const MERGE_MODE_LAST = 2
+const MERGE_MODE_TIMELINE = 3
 
 var merge_mode = MERGE_MODE_COMBINE
 
-var compression_types = map[string]int{
-	"none":   mtbl.COMPRESSION_NONE,
-	"snappy": mtbl.COMPRESSION_SNAPPY,
-	"zlib":   mtbl.COMPRESSION_ZLIB,
-	"lz4":    mtbl.COMPRESSION_LZ4,
-	"lz4hc":  mtbl.COMPRESSION_LZ4HC,
-}
+var output_mtbl *inetdata.MTBLBuilder
+var issuer_mtbl *inetdata.MTBLBuilder
+var seen_issuers sync.Map
 
-var merge_count int64 = 0
-var output_count int64 = 0
-var input_count int64 = 0
-var invalid_count int64 = 0
 var timestamps *bool
 
+var prefix_table *inetdata.PrefixTable
+
 var wg_raw_ct_input sync.WaitGroup
 var wg_parsed_ct_writer sync.WaitGroup
 var wg_sorted_ct_parser sync.WaitGroup
@@ -52,11 +44,8 @@ var wg_sort_reader sync.WaitGroup
 type CTEntry struct {
 	LeafInput []byte `json:"leaf_input"`
 	ExtraData []byte `json:"extra_data"`
-}
-
-type NewRecord struct {
-	Key []byte
-	Val []byte
+	Log       string `json:"log"`
+	Index     *int64 `json:"index"`
 }
 
 func usage() {
@@ -68,116 +57,13 @@ func usage() {
 	flag.PrintDefaults()
 }
 
-func showProgress(quit chan int) {
-	start := time.Now()
-	for {
-		select {
-		case <-quit:
-			return
-		case <-time.After(time.Second * 1):
-			icount := atomic.LoadInt64(&input_count)
-			ocount := atomic.LoadInt64(&output_count)
-			mcount := atomic.LoadInt64(&merge_count)
-			ecount := atomic.LoadInt64(&invalid_count)
-
-			if icount == 0 && ocount == 0 {
-				// Reset start, so that we show stats only from our first input
-				start = time.Now()
-				continue
-			}
-			elapsed := time.Since(start)
-			if elapsed.Seconds() > 1.0 {
-				fmt.Fprintf(os.Stderr, "[*] [inetdata-ct2mtbl] Read %d and wrote %d records in %d seconds (%d/s in, %d/s out) (merged: %d, invalid: %d)\n",
-					icount,
-					ocount,
-					int(elapsed.Seconds()),
-					int(float64(icount)/elapsed.Seconds()),
-					int(float64(ocount)/elapsed.Seconds()),
-					mcount, ecount)
-			}
-		}
-	}
-}
-
 func scrubX509Value(bit string) string {
 	bit = strings.Replace(bit, "\x00", "[0x00]", -1)
 	bit = strings.Replace(bit, " ", "_", -1)
 	return bit
 }
 
-func mergeFunc(key []byte, val0 []byte, val1 []byte) (mergedVal []byte) {
-
-	atomic.AddInt64(&merge_count, 1)
-
-	if merge_mode == MERGE_MODE_FIRST {
-		return val0
-	}
-
-	if merge_mode == MERGE_MODE_LAST {
-		return val1
-	}
-
-	// MERGE_MODE_COMBINE
-	var unique = make(map[string]bool)
-	var v0, v1, m [][]string
-
-	// fmt.Fprintf(os.Stderr, "MERGE[%v]     %v    ->    %v\n", string(key), string(val0), string(val1))
-
-	if e := json.Unmarshal(val0, &v0); e != nil {
-		return val1
-	}
-
-	if e := json.Unmarshal(val1, &v1); e != nil {
-		return val0
-	}
-
-	for i := range v0 {
-		if len(v0[i]) == 0 {
-			continue
-		}
-		unique[strings.Join(v0[i], "\x00")] = true
-	}
-
-	for i := range v1 {
-		if len(v1[i]) == 0 {
-			continue
-		}
-		unique[strings.Join(v1[i], "\x00")] = true
-	}
-
-	for i := range unique {
-		m = append(m, strings.SplitN(i, "\x00", 2))
-	}
-
-	d, e := json.Marshal(m)
-	if e != nil {
-		fmt.Fprintf(os.Stderr, "JSON merge error: %v -> %v + %v\n", e, val0, val1)
-		return val0
-	}
-
-	return d
-}
-
-func writeToMtbl(s *mtbl.Sorter, c chan NewRecord, d chan bool) {
-	for r := range c {
-		if len(r.Key) > inetdata.MTBL_KEY_LIMIT {
-			fmt.Fprintf(os.Stderr, "[-] Failed to add key larger than %d: %s... (%d bytes)", inetdata.MTBL_KEY_LIMIT, string(r.Key[0:1024]), len(r.Key))
-			continue
-		}
-		if len(r.Val) > inetdata.MTBL_VAL_LIMIT {
-			fmt.Fprintf(os.Stderr, "[-] Failed to add value larger than %d for key %s: %s... (%d bytes)", inetdata.MTBL_VAL_LIMIT, string(r.Key), string(r.Val[0:1024]), len(r.Val))
-			continue
-		}
-		if e := s.Add(r.Key, r.Val); e != nil {
-			fmt.Fprintf(os.Stderr, "[-] Failed to add key=%v (%v): %v\n", r.Key, r.Val, e)
-			continue
-		}
-		atomic.AddInt64(&output_count, 1)
-	}
-	d <- true
-}
-
-func sortedCTParser(d chan string, c chan NewRecord) {
+func sortedCTParser(d chan string) {
 
 	for raw := range d {
 
@@ -191,11 +77,21 @@ func sortedCTParser(d chan string, c chan NewRecord) {
 		data := bits[1]
 
 		if len(name) == 0 || len(data) == 0 {
-			atomic.AddInt64(&invalid_count, 1)
+			output_mtbl.CountInvalid()
 			continue
 		}
 		vals := strings.SplitN(data, "\x00", -1)
 
+		if merge_mode == MERGE_MODE_TIMELINE {
+			json, e := json.Marshal(inetdata.TimelineFromValues(vals))
+			if e != nil {
+				fmt.Fprintf(os.Stderr, "[-] Could not marshal %v: %s\n", vals, e)
+				continue
+			}
+			addRecord(output_mtbl, []byte(name), json)
+			continue
+		}
+
 		outm := make(map[string][]string)
 		for i := range vals {
 			info := strings.SplitN(vals[i], ",", 2)
@@ -231,19 +127,19 @@ func sortedCTParser(d chan string, c chan NewRecord) {
 			continue
 		}
 
-		// Reverse the key unless its an IP address
-		if !(inetdata.MatchIPv4.Match([]byte(name)) || inetdata.MatchIPv6.Match([]byte(name))) {
-			name = inetdata.ReverseKey(name)
-		}
-
-		c <- NewRecord{Key: []byte(name), Val: json}
+		addRecord(output_mtbl, []byte(name), json)
 	}
 
-	close(c)
-
 	wg_sorted_ct_parser.Done()
 }
 
+// addRecord stores a record, reporting any that are rejected
+func addRecord(b *inetdata.MTBLBuilder, key []byte, val []byte) {
+	if e := b.Add(key, val); e != nil {
+		fmt.Fprintf(os.Stderr, "[-] Failed to add key=%s: %s\n", key, e)
+	}
+}
+
 func parsedCTWriter(o <-chan string, fd io.WriteCloser) {
 	for r := range o {
 		fd.Write([]byte(r))
@@ -251,6 +147,21 @@ func parsedCTWriter(o <-chan string, fd io.WriteCloser) {
 	wg_parsed_ct_writer.Done()
 }
 
+// parsedCTSorter queues parsed entries for the built-in sorter. After a failure the
+// error is sent to main and the remaining entries are discarded, so the parsers never block.
+func parsedCTSorter(o <-chan string, s *inetdata.ExternalSort, errs chan error) {
+	var err error
+	for r := range o {
+		if err != nil {
+			continue
+		}
+		if err = s.Add(r); err != nil {
+			errs <- err
+		}
+	}
+	wg_parsed_ct_writer.Done()
+}
+
 func rawCTReader(c <-chan string, o chan<- string) {
 
 	for r := range c {
@@ -261,43 +172,16 @@ func rawCTReader(c <-chan string, o chan<- string) {
 			continue
 		}
 
-		var leaf ct.MerkleTreeLeaf
-
-		if rest, err := tls.Unmarshal(entry.LeafInput, &leaf); err != nil {
-			fmt.Fprintf(os.Stderr, "Failed to unmarshal MerkleTreeLeaf: %v (%s)", err, r)
-			continue
-		} else if len(rest) > 0 {
-			fmt.Fprintf(os.Stderr, "Trailing data (%d bytes) after MerkleTreeLeaf: %q", len(rest), rest)
-			continue
-		}
-
-		var cert *x509.Certificate
-		var err error
-
-		switch leaf.TimestampedEntry.EntryType {
-		case ct.X509LogEntryType:
-
-			cert, err = x509.ParseCertificate(leaf.TimestampedEntry.X509Entry.Data)
-			if err != nil && !strings.Contains(err.Error(), "NonFatalErrors:") {
-				fmt.Fprintf(os.Stderr, "Failed to parse cert: %s\n", err.Error())
-				continue
-			}
-
-		case ct.PrecertLogEntryType:
-
-			cert, err = x509.ParseTBSCertificate(leaf.TimestampedEntry.PrecertEntry.TBSCertificate)
-			if err != nil && !strings.Contains(err.Error(), "NonFatalErrors:") {
-				fmt.Fprintf(os.Stderr, "Failed to parse precert: %s\n", err.Error())
-				continue
-			}
-
-		default:
-			fmt.Fprintf(os.Stderr, "Unknown entry type: %v (%s)", leaf.TimestampedEntry.EntryType, r)
+		leaf, cert, err := inetdata.ParseCTEntry(entry.LeafInput)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to parse entry: %s\n", err)
 			continue
 		}
 
 		// Valid input
-		atomic.AddInt64(&input_count, 1)
+		output_mtbl.CountInput()
+
+		issuer_hash, root_hash := inetdata.CTChainFingerprints(parseChain(leaf, entry))
 
 		var names = make(map[string]struct{})
 
@@ -327,6 +211,12 @@ func rawCTReader(c <-chan string, o chan<- string) {
 
 		sha1hash := ""
 
+		// Timeline merges track the log timestamp of each value instead of a ts field
+		suffix := ""
+		if merge_mode == MERGE_MODE_TIMELINE {
+			suffix = inetdata.TimelineSep + strconv.FormatUint(leaf.TimestampedEntry.Timestamp/1000, 10)
+		}
+
 		// Write the names to the output channel
 		for n := range names {
 			if len(sha1hash) == 0 {
@@ -336,21 +226,35 @@ func rawCTReader(c <-chan string, o chan<- string) {
 
 			// Dump associated email addresses if available
 			for _, extra := range cert.EmailAddresses {
-				o <- fmt.Sprintf("%s,email,%s\n", n, strings.ToLower(scrubX509Value(extra)))
+				o <- fmt.Sprintf("%s,email,%s%s\n", n, strings.ToLower(scrubX509Value(extra)), suffix)
 			}
 
 			// Dump associated IP addresses if we have at least one name
 			for _, extra := range cert.IPAddresses {
-				o <- fmt.Sprintf("%s,ip,%s\n", n, extra)
+				o <- fmt.Sprintf("%s,ip,%s%s\n", n, extra, suffix)
+
+				if prefix_table != nil {
+					for _, p := range prefix_table.Pairs(extra.String()) {
+						o <- fmt.Sprintf("%s,%s,%s%s\n", n, p[0], p[1], suffix)
+					}
+				}
 			}
 
-			o <- fmt.Sprintf("%s,ts,%d\n", n, leaf.TimestampedEntry.Timestamp)
-			o <- fmt.Sprintf("%s,cn,%s\n", n, strings.ToLower(scrubX509Value(cert.Subject.CommonName)))
-			o <- fmt.Sprintf("%s,sha1,%s\n", n, sha1hash)
+			if merge_mode != MERGE_MODE_TIMELINE {
+				o <- fmt.Sprintf("%s,ts,%d\n", n, leaf.TimestampedEntry.Timestamp)
+			}
+			o <- fmt.Sprintf("%s,cn,%s%s\n", n, strings.ToLower(scrubX509Value(cert.Subject.CommonName)), suffix)
+			o <- fmt.Sprintf("%s,sha1,%s%s\n", n, sha1hash, suffix)
+
+			// Dump the fingerprints of the issuer and root from the chain
+			if len(issuer_hash) > 0 {
+				o <- fmt.Sprintf("%s,issuer_sha256,%s%s\n", n, issuer_hash, suffix)
+				o <- fmt.Sprintf("%s,root_sha256,%s%s\n", n, root_hash, suffix)
+			}
 
 			// Dump associated SANs (overkill, but saves a second lookup)
 			for _, extra := range cert.DNSNames {
-				o <- fmt.Sprintf("%s,dns,%s\n", n, strings.ToLower(extra))
+				o <- fmt.Sprintf("%s,dns,%s%s\n", n, strings.ToLower(extra), suffix)
 			}
 		}
 	}
@@ -358,87 +262,88 @@ func rawCTReader(c <-chan string, o chan<- string) {
 	wg_raw_ct_input.Done()
 }
 
-func main() {
+// parseChain decodes the certificate chain of an entry and queues any new issuers
+// for the issuer MTBL
+func parseChain(leaf *ct.MerkleTreeLeaf, entry CTEntry) [][]byte {
+	chain, err := inetdata.ParseCTChain(leaf, entry.ExtraData)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to parse chain: %s\n", err)
+		return chain
+	}
 
-	runtime.GOMAXPROCS(runtime.NumCPU())
-	os.Setenv("LC_ALL", "C")
+	if issuer_mtbl == nil {
+		return chain
+	}
 
-	flag.Usage = func() { usage() }
-	compression := flag.String("c", "snappy", "The compression type to use (none, snappy, zlib, lz4, lz4hc)")
-	sort_tmp := flag.String("t", "", "The temporary directory to use for the sorting phase")
-	sort_mem := flag.Uint64("m", 1, "The maximum amount of memory to use, in gigabytes, for the sorting phases")
-	selected_merge_mode := flag.String("M", "combine", "The merge mode: combine, first, or last")
-	version := flag.Bool("version", false, "Show the version and build timestamp")
+	for i := range chain {
+		hash := sha256.Sum256(chain[i])
+		key := hex.EncodeToString(hash[:])
 
-	flag.Parse()
+		// Issuers repeat across most entries, only the first copy is sent
+		if _, seen := seen_issuers.LoadOrStore(key, true); seen {
+			continue
+		}
 
-	if *version {
-		inetdata.PrintVersion("inetdata-ct2mtbl")
-		os.Exit(0)
-	}
+		record, err := inetdata.NewCTIssuerRecord(chain[i])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to parse issuer %s: %s\n", key, err)
+			continue
+		}
 
-	if len(*sort_tmp) == 0 {
-		*sort_tmp = os.Getenv("HOME")
-	}
+		data, err := json.Marshal(record)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "[-] Could not marshal issuer %s: %s\n", key, err)
+			continue
+		}
 
-	if len(*sort_tmp) == 0 {
-		flag.Usage()
-		os.Exit(1)
+		addRecord(issuer_mtbl, []byte(key), data)
 	}
 
-	// Configure the MTBL output
-
-	if len(flag.Args()) != 1 {
-		usage()
-		os.Exit(1)
-	}
+	return chain
+}
 
-	switch *selected_merge_mode {
-	case "combine":
-		merge_mode = MERGE_MODE_COMBINE
-	case "first":
-		merge_mode = MERGE_MODE_FIRST
-	case "last":
-		merge_mode = MERGE_MODE_LAST
-	default:
-		fmt.Fprintf(os.Stderr, "Error: Invalid merge mode specified: %s\n", *selected_merge_mode)
-		usage()
-		os.Exit(1)
-	}
+// rawCTRecordReader converts each entry to a certificate record keyed by its
+// SHA-256 fingerprint
+func rawCTRecordReader(c <-chan string) {
 
-	fname := flag.Args()[0]
-	_ = os.Remove(fname)
+	for r := range c {
+		var entry CTEntry
 
-	sort_opt := mtbl.SorterOptions{Merge: mergeFunc, MaxMemory: 1024 * 1024}
-	sort_opt.MaxMemory *= (*sort_mem * 1024)
+		if err := json.Unmarshal([]byte(r), &entry); err != nil {
+			fmt.Fprintf(os.Stderr, "Error parsing input: %s\n", r)
+			continue
+		}
 
-	if len(*sort_tmp) > 0 {
-		sort_opt.TempDir = *sort_tmp
-	}
+		leaf, cert, err := inetdata.ParseCTEntry(entry.LeafInput)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to parse entry: %s\n", err)
+			continue
+		}
 
-	compression_alg, ok := inetdata.MTBLCompressionTypes[*compression]
-	if !ok {
-		fmt.Fprintf(os.Stderr, "[-] Invalid compression algorithm: %s\n", *compression)
-		os.Exit(1)
-	}
+		// Valid input
+		output_mtbl.CountInput()
 
-	mtbl_sorter := mtbl.SorterInit(&sort_opt)
-	mtbl_writer, w_e := mtbl.WriterInit(fname, &mtbl.WriterOptions{Compression: compression_alg})
-	if w_e != nil {
-		fmt.Fprintf(os.Stderr, "[-] Error: %s\n", w_e)
-		os.Exit(1)
-	}
+		record := inetdata.NewCTCertRecord(leaf, cert)
+		record.Log = entry.Log
+		record.Index = entry.Index
+		record.SetChain(parseChain(leaf, entry))
 
-	defer mtbl_sorter.Destroy()
-	defer mtbl_writer.Destroy()
+		data, err := json.Marshal(record)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "[-] Could not marshal %v: %s\n", record, err)
+			continue
+		}
 
-	mtbl_sorter_ch := make(chan NewRecord, 1)
-	mtbl_sorter_done := make(chan bool, 1)
+		addRecord(output_mtbl, []byte(record.SHA256), data)
+	}
 
-	// Read from the mtbl_sorter_ch for NewRecords and write to the MTBL sorter
-	go writeToMtbl(mtbl_sorter, mtbl_sorter_ch, mtbl_sorter_done)
+	wg_raw_ct_input.Done()
+}
 
-	// Create the sort and rollup pipeline
+// startSystemSort creates a sort, inetdata-csvrollup, and sort pipeline using
+// external commands, sends the merged output to the out channel, and returns the
+// pipeline input
+func startSystemSort(sort_tmp string, sort_mem uint64, out chan string) (io.WriteCloser, []*exec.Cmd) {
 	subprocs := []*exec.Cmd{}
 
 	// Create a sort process
@@ -449,8 +354,8 @@ func main() {
 		"--field-separator=,",
 		"--compress-program=pigz",
 		fmt.Sprintf("--parallel=%d", runtime.NumCPU()),
-		fmt.Sprintf("--temporary-directory=%s", *sort_tmp),
-		fmt.Sprintf("--buffer-size=%dG", *sort_mem))
+		fmt.Sprintf("--temporary-directory=%s", sort_tmp),
+		fmt.Sprintf("--buffer-size=%dG", sort_mem))
 
 	// Configure stdio
 	sort_stdin, sie := sort_proc.StdinPipe()
@@ -502,8 +407,8 @@ func main() {
 		"--field-separator=,",
 		"--compress-program=pigz",
 		fmt.Sprintf("--parallel=%d", runtime.NumCPU()),
-		fmt.Sprintf("--temporary-directory=%s", *sort_tmp),
-		fmt.Sprintf("--buffer-size=%dG", *sort_mem))
+		fmt.Sprintf("--temporary-directory=%s", sort_tmp),
+		fmt.Sprintf("--buffer-size=%dG", sort_mem))
 
 	sort2_stdout, ssoe := sort2_proc.StdoutPipe()
 	if ssoe != nil {
@@ -521,15 +426,10 @@ func main() {
 		os.Exit(1)
 	}
 
-	// Read rollup entries, convert to json, send to the MTBL writer
-	c_ct_sorted_output := make(chan string)
-	wg_sorted_ct_parser.Add(1)
-	go sortedCTParser(c_ct_sorted_output, mtbl_sorter_ch)
-
 	wg_sort_reader.Add(1)
 	go func() {
 		// Read rollup entries from the sort pipe and send to the parser
-		e := inetdata.ReadLinesFromReader(sort2_stdout, c_ct_sorted_output)
+		e := inetdata.ReadLinesFromReader(sort2_stdout, out)
 		if e != nil {
 			fmt.Fprintf(os.Stderr, "Error reading sort 2 input: %s\n", e)
 			os.Exit(1)
@@ -537,9 +437,203 @@ func main() {
 		wg_sort_reader.Done()
 	}()
 
-	// Start the progress tracker
-	quit := make(chan int)
-	go showProgress(quit)
+	return sort_stdin, subprocs
+}
+
+func main() {
+
+	runtime.GOMAXPROCS(runtime.NumCPU())
+	os.Setenv("LC_ALL", "C")
+
+	flag.Usage = func() { usage() }
+	compression := flag.String("c", "snappy", "The compression type to use (none, snappy, zlib, lz4, lz4hc)")
+	sort_tmp := flag.String("t", "", "The temporary directory to use for the sorting phase")
+	sort_mem := flag.Uint64("m", 1, "The maximum amount of memory to use, in gigabytes, for the sorting phases")
+	system_sort := flag.Bool("system-sort", false, "Use the external sort, pigz, and inetdata-csvrollup commands instead of the built-in sorter")
+	selected_merge_mode := flag.String("M", "combine", "The merge mode: combine, first, last, or timeline")
+	output_format := flag.String("format", "csv", "The record format: csv (values by hostname) or jsonl (one certificate record per SHA-256 fingerprint)")
+	issuers := flag.String("issuers", "", "Also write the issuer certificates from each chain to this MTBL, keyed by SHA-256")
+	selected_ip_encode := flag.Bool("ip-encode", false, "Store IP address keys in binary form for fast CIDR range lookups")
+	enrich_prefixes := flag.String("enrich-prefixes", "", "Add asn, prefix, and rir pairs for IP addresses using these comma-separated prefix files (MTBL or CSV)")
+	version := flag.Bool("version", false, "Show the version and build timestamp")
+
+	flag.Parse()
+
+	if *version {
+		inetdata.PrintVersion("inetdata-ct2mtbl")
+		os.Exit(0)
+	}
+
+	if len(*sort_tmp) == 0 {
+		*sort_tmp = os.Getenv("HOME")
+	}
+
+	if len(*sort_tmp) == 0 {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	// Configure the MTBL output
+
+	if len(flag.Args()) != 1 {
+		usage()
+		os.Exit(1)
+	}
+
+	merge_func := inetdata.MTBLMergePairs
+
+	switch *selected_merge_mode {
+	case "combine":
+		merge_mode = MERGE_MODE_COMBINE
+	case "first":
+		merge_mode = MERGE_MODE_FIRST
+		merge_func = inetdata.MTBLMergeFirst
+	case "last":
+		merge_mode = MERGE_MODE_LAST
+		merge_func = inetdata.MTBLMergeLast
+	case "timeline":
+		merge_mode = MERGE_MODE_TIMELINE
+		merge_func = inetdata.MTBLMergeTimeline
+	default:
+		fmt.Fprintf(os.Stderr, "Error: Invalid merge mode specified: %s\n", *selected_merge_mode)
+		usage()
+		os.Exit(1)
+	}
+
+	switch *output_format {
+	case "csv":
+	case "jsonl":
+		if merge_mode == MERGE_MODE_TIMELINE {
+			fmt.Fprintf(os.Stderr, "Error: The timeline merge mode requires the csv record format\n")
+			os.Exit(1)
+		}
+
+		if len(*enrich_prefixes) > 0 {
+			fmt.Fprintf(os.Stderr, "Error: Prefix enrichment requires the csv record format\n")
+			os.Exit(1)
+		}
+
+		// Certificate records can not be combined, keep the first copy of each
+		if merge_mode == MERGE_MODE_COMBINE {
+			merge_mode = MERGE_MODE_FIRST
+			merge_func = inetdata.MTBLMergeFirst
+		}
+	default:
+		fmt.Fprintf(os.Stderr, "Error: Invalid record format specified: %s\n", *output_format)
+		usage()
+		os.Exit(1)
+	}
+
+	if len(*enrich_prefixes) > 0 {
+		var e error
+		prefix_table, e = inetdata.LoadPrefixTable(strings.Split(*enrich_prefixes, ","))
+		if e != nil {
+			fmt.Fprintf(os.Stderr, "[-] Error: failed to load prefixes: %s\n", e)
+			os.Exit(1)
+		}
+		fmt.Fprintf(os.Stderr, "[*] Loaded %d prefixes from %s\n", prefix_table.Len(), *enrich_prefixes)
+	}
+
+	fname := flag.Args()[0]
+	_ = os.Remove(fname)
+
+	opts := inetdata.MTBLBuilderOptions{
+		Compression: *compression,
+		TempDir:     *sort_tmp,
+		MaxMemory:   *sort_mem * 1024 * 1024 * 1024,
+		Merge:       merge_func,
+		Progress:    inetdata.MTBLProgressPrinter("inetdata-ct2mtbl"),
+	}
+
+	// Hostnames are stored in reverse, certificate records by fingerprint
+	if *output_format == "csv" {
+		opts.Key = inetdata.MTBLHostnameKey(*selected_ip_encode)
+	}
+
+	var e error
+	output_mtbl, e = inetdata.NewMTBLBuilder(fname, opts)
+	if e != nil {
+		fmt.Fprintf(os.Stderr, "[-] Error: %s\n", e)
+		os.Exit(1)
+	}
+
+	// Optionally collect issuer certificates into a second MTBL
+	if len(*issuers) > 0 {
+		_ = os.Remove(*issuers)
+
+		issuer_mtbl, e = inetdata.NewMTBLBuilder(*issuers, inetdata.MTBLBuilderOptions{
+			Compression: *compression,
+			TempDir:     *sort_tmp,
+			MaxMemory:   opts.MaxMemory,
+			Merge:       inetdata.MTBLMergeFirst,
+		})
+		if e != nil {
+			fmt.Fprintf(os.Stderr, "[-] Error: %s\n", e)
+			os.Exit(1)
+		}
+	}
+
+	// writeIssuers finalizes the issuer MTBL once every reader has finished
+	writeIssuers := func() {
+		if issuer_mtbl == nil {
+			return
+		}
+
+		if e := issuer_mtbl.Close(); e != nil {
+			fmt.Fprintf(os.Stderr, "[-] Error writing issuer MTBL: %s\n", e)
+			os.Exit(1)
+		}
+	}
+
+	// Certificate records skip the sort and rollup pipeline, the MTBL sorter
+	// handles ordering and duplicates
+	if *output_format == "jsonl" {
+		c_ct_raw_input := make(chan string, 4096)
+
+		wg_raw_ct_input.Add(runtime.NumCPU())
+		for i := 0; i < runtime.NumCPU(); i++ {
+			go rawCTRecordReader(c_ct_raw_input)
+		}
+
+		if e := inetdata.ReadLines(os.Stdin, c_ct_raw_input); e != nil {
+			fmt.Fprintf(os.Stderr, "Error reading input: %s\n", e)
+		}
+
+		wg_raw_ct_input.Wait()
+		writeIssuers()
+
+		if e := output_mtbl.Close(); e != nil {
+			fmt.Fprintf(os.Stderr, "[-] Error writing MTBL: %s\n", e)
+			os.Exit(1)
+		}
+		return
+	}
+
+	// Read rollup entries, convert to json, send to the MTBL writer
+	c_ct_sorted_output := make(chan string)
+	wg_sorted_ct_parser.Add(1)
+	go sortedCTParser(c_ct_sorted_output)
+
+	// Create the sort and rollup pipeline
+	var sort_stdin io.WriteCloser
+	var sorter *inetdata.ExternalSort
+	sort_errors := make(chan error, 1)
+	subprocs := []*exec.Cmd{}
+
+	if *system_sort {
+		sort_stdin, subprocs = startSystemSort(*sort_tmp, *sort_mem, c_ct_sorted_output)
+	} else {
+		var se error
+		sorter, se = inetdata.NewExternalSort(inetdata.SortOptions{
+			TempDir:   *sort_tmp,
+			MaxMemory: *sort_mem * 1024 * 1024 * 1024,
+			Unique:    true,
+		})
+		if se != nil {
+			fmt.Fprintf(os.Stderr, "Error: failed to create sorter: %s\n", se)
+			os.Exit(1)
+		}
+	}
 
 	// Large channel buffer evens out spikey per-record processing time
 	c_ct_raw_input := make(chan string, 4096)
@@ -553,48 +647,81 @@ func main() {
 		go rawCTReader(c_ct_raw_input, c_ct_parsed_output)
 	}
 
-	// Launch a writer that feeds parsed entries into the sort input pipe
+	// Launch a writer that feeds parsed entries into the sorter
 	wg_parsed_ct_writer.Add(1)
-	go parsedCTWriter(c_ct_parsed_output, sort_stdin)
+	if *system_sort {
+		go parsedCTWriter(c_ct_parsed_output, sort_stdin)
+	} else {
+		go parsedCTSorter(c_ct_parsed_output, sorter, sort_errors)
+	}
 
 	// Read CT JSON from stdin, parse, and send to sort
-	e := inetdata.ReadLines(os.Stdin, c_ct_raw_input)
-	if e != nil {
-		fmt.Fprintf(os.Stderr, "Error reading input: %s\n", e)
+	read_done := make(chan error, 1)
+	go func() {
+		read_done <- inetdata.ReadLines(os.Stdin, c_ct_raw_input)
+	}()
+
+	// Stop early if the sorter fails, removing its temporary files first
+	select {
+	case e := <-read_done:
+		if e != nil {
+			fmt.Fprintf(os.Stderr, "Error reading input: %s\n", e)
+		}
+	case e := <-sort_errors:
+		fmt.Fprintf(os.Stderr, "Error: failed to sort parsed entry: %s\n", e)
+		sorter.Close()
+		os.Exit(1)
 	}
 
 	// Wait for the input parsers
 	wg_raw_ct_input.Wait()
 
+	writeIssuers()
+
 	// Close the output handle
 	close(c_ct_parsed_output)
 
 	// Wait for the output goroutine
 	wg_parsed_ct_writer.Wait()
 
-	// Close the sort 1 input pipe
-	sort_stdin.Close()
+	select {
+	case e := <-sort_errors:
+		fmt.Fprintf(os.Stderr, "Error: failed to sort parsed entry: %s\n", e)
+		sorter.Close()
+		os.Exit(1)
+	default:
+	}
+
+	if *system_sort {
+		// Close the sort 1 input pipe
+		sort_stdin.Close()
 
-	// Wait for the sort reader
-	wg_sort_reader.Wait()
+		// Wait for the sort reader
+		wg_sort_reader.Wait()
 
-	// Wait for subproceses to complete
-	for i := range subprocs {
-		subprocs[i].Wait()
+		// Wait for subproceses to complete
+		for i := range subprocs {
+			if e := subprocs[i].Wait(); e != nil {
+				fmt.Fprintf(os.Stderr, "Error: %s failed: %s\n", strings.Join(subprocs[i].Args, " "), e)
+				os.Exit(1)
+			}
+		}
+	} else {
+		// Sort and merge the parsed entries and send them to the parser
+		e := sorter.SortRollup(c_ct_sorted_output)
+		sorter.Close()
+		if e != nil {
+			fmt.Fprintf(os.Stderr, "Error: failed to sort parsed entries: %s\n", e)
+			os.Exit(1)
+		}
 	}
 
 	// Wait for the sortedCT processor
 	wg_sorted_ct_parser.Wait()
 
-	// Wait for the MTBL sorter to finish
-	<-mtbl_sorter_done
-
 	// Finalize the MTBL sorter with a write
-	if e = mtbl_sorter.Write(mtbl_writer); e != nil {
+	if e = output_mtbl.Close(); e != nil {
 		fmt.Fprintf(os.Stderr, "[-] Error writing MTBL: %s\n", e)
 		os.Exit(1)
 	}
-
-	// Stop the progress monitor
-	quit <- 0
 }
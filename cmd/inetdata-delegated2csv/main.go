@@ -0,0 +1,181 @@
+package main
+
+// Convert RIR delegated-extended statistics into CSV output
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/csv"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/hdm/inetdata-parsers"
+)
+
+var writer *csv.Writer
+
+var delegated_only *bool
+
+// Network blocks by registry and opaque-id, for the grouping output
+var groups = make(map[string]map[string]bool)
+
+func usage() {
+	fmt.Println("Usage: " + os.Args[0] + " [options] [<file> ...]")
+	fmt.Println("")
+	fmt.Println("Converts RIR delegated-extended statistics files into CSV records of cidr, registry,")
+	fmt.Println("cc, status, date, and opaque-id. Input is read from standard input when no files")
+	fmt.Println("are given, files ending in .gz are decompressed. ASN records are skipped.")
+	fmt.Println("")
+	fmt.Println("The output can be loaded with inetdata-csv2mtbl -M 2, which stores the remaining")
+	fmt.Println("columns under each CIDR. With -g, the blocks of each opaque-id across every input")
+	fmt.Println("file are also written as opaque-id, registry, and a space-separated list of CIDRs,")
+	fmt.Println("linking the blocks held by the same organization over the allocation history.")
+	fmt.Println("")
+	fmt.Println("Options:")
+	flag.PrintDefaults()
+}
+
+func processReader(r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	buf := make([]byte, 0, 1024*1024)
+	scanner.Buffer(buf, 1024*1024)
+
+	for scanner.Scan() {
+		raw := scanner.Text()
+
+		rec, e := inetdata.ParseDelegatedLine(raw)
+		if e != nil {
+			fmt.Fprintf(os.Stderr, "[-] Invalid line: %s -> %s\n", e, raw)
+			continue
+		}
+
+		if rec == nil || rec.Type == "asn" {
+			continue
+		}
+
+		if *delegated_only && rec.Status != "allocated" && rec.Status != "assigned" {
+			continue
+		}
+
+		cidrs, e := rec.CIDRs()
+		if e != nil {
+			fmt.Fprintf(os.Stderr, "[-] Invalid line: %s -> %s\n", e, raw)
+			continue
+		}
+
+		for _, cidr := range cidrs {
+			record := []string{cidr, rec.Registry, rec.CC, rec.Status, rec.Date, rec.OpaqueID}
+			if err := writer.Write(record); err != nil {
+				fmt.Fprintf(os.Stderr, "Could not write CSV: %v\n", record)
+			}
+
+			if len(rec.OpaqueID) == 0 {
+				continue
+			}
+
+			gkey := rec.OpaqueID + "," + rec.Registry
+			if _, ok := groups[gkey]; !ok {
+				groups[gkey] = make(map[string]bool)
+			}
+			groups[gkey][cidr] = true
+		}
+	}
+
+	return scanner.Err()
+}
+
+func processFile(name string) {
+	fd, err := os.Open(name)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not open file: %s\n", err.Error())
+		return
+	}
+	defer fd.Close()
+
+	var r io.Reader = fd
+	if strings.HasSuffix(name, ".gz") {
+		gz, err := gzip.NewReader(fd)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Could not decompress %s: %s\n", name, err.Error())
+			return
+		}
+		defer gz.Close()
+		r = gz
+	}
+
+	if err := processReader(r); err != nil {
+		fmt.Fprintf(os.Stderr, "Could not read %s: %s\n", name, err.Error())
+	}
+}
+
+func writeGroups(name string) error {
+	fd, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+
+	gkeys := make([]string, 0, len(groups))
+	for gkey := range groups {
+		gkeys = append(gkeys, gkey)
+	}
+	sort.Strings(gkeys)
+
+	w := csv.NewWriter(fd)
+	for _, gkey := range gkeys {
+		cidrs := make([]string, 0, len(groups[gkey]))
+		for cidr := range groups[gkey] {
+			cidrs = append(cidrs, cidr)
+		}
+		sort.Strings(cidrs)
+
+		bits := strings.SplitN(gkey, ",", 2)
+		w.Write([]string{bits[0], bits[1], strings.Join(cidrs, " ")})
+	}
+	w.Flush()
+
+	if err := w.Error(); err != nil {
+		fd.Close()
+		return err
+	}
+	return fd.Close()
+}
+
+func main() {
+	flag.Usage = func() { usage() }
+
+	group_file := flag.String("g", "", "Write the network blocks of each opaque-id to this file")
+	delegated_only = flag.Bool("delegated", false, "Only include allocated and assigned blocks")
+	version := flag.Bool("version", false, "Show the version and build timestamp")
+
+	flag.Parse()
+
+	if *version {
+		inetdata.PrintVersion("inetdata-delegated2csv")
+		os.Exit(0)
+	}
+
+	writer = csv.NewWriter(os.Stdout)
+
+	if len(flag.Args()) == 0 {
+		if err := processReader(os.Stdin); err != nil {
+			fmt.Fprintf(os.Stderr, "Could not read input: %s\n", err.Error())
+		}
+	}
+
+	for i := range flag.Args() {
+		processFile(flag.Args()[i])
+	}
+
+	writer.Flush()
+
+	if len(*group_file) > 0 {
+		if err := writeGroups(*group_file); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+			os.Exit(1)
+		}
+	}
+}
@@ -7,8 +7,8 @@ import (
 	"fmt"
 	"os"
 	"runtime"
+	"strconv"
 
-	mtbl "github.com/hdm/golang-mtbl"
 	"github.com/hdm/inetdata-parsers"
 	"github.com/peterbourgon/mergemap"
 )
@@ -16,6 +16,7 @@ import (
 const MERGE_MODE_COMBINE = 0
 const MERGE_MODE_FIRST = 1
 const MERGE_MODE_LAST = 2
+const MERGE_MODE_TIMELINE = 3
 
 var merge_mode = MERGE_MODE_COMBINE
 
@@ -28,17 +29,9 @@ func usage() {
 	flag.PrintDefaults()
 }
 
-func mergeFunc(key []byte, val0 []byte, val1 []byte) (mergedVal []byte) {
-
-	if merge_mode == MERGE_MODE_FIRST {
-		return val0
-	}
-
-	if merge_mode == MERGE_MODE_LAST {
-		return val1
-	}
-
-	// MERGE_MODE_COMBINE
+// mergeTimeline combines two records like MTBLMergeJSON, but widens the
+// observation window instead of keeping the latest value
+func mergeTimeline(key []byte, val0 []byte, val1 []byte) []byte {
 	var v0, v1 map[string]interface{}
 
 	if e := json.Unmarshal(val0, &v0); e != nil {
@@ -49,7 +42,12 @@ func mergeFunc(key []byte, val0 []byte, val1 []byte) (mergedVal []byte) {
 		return val0
 	}
 
+	t0, t1 := timelineFields(v0), timelineFields(v1)
+	t0.Merge(t1)
+
 	m := mergemap.Merge(v0, v1)
+	setTimelineFields(m, t0)
+
 	d, e := json.Marshal(m)
 	if e != nil {
 		fmt.Fprintf(os.Stderr, "JSON merge error: %v -> %v + %v\n", e, val0, val1)
@@ -59,6 +57,34 @@ func mergeFunc(key []byte, val0 []byte, val1 []byte) (mergedVal []byte) {
 	return d
 }
 
+// timelineFields reads the observation window of a record
+func timelineFields(v map[string]interface{}) inetdata.TimelineEntry {
+	return inetdata.TimelineEntry{
+		FirstSeen: jsonInt(v["first_seen"]),
+		LastSeen:  jsonInt(v["last_seen"]),
+		Count:     jsonInt(v["count"]),
+	}
+}
+
+func setTimelineFields(v map[string]interface{}, t inetdata.TimelineEntry) {
+	v["first_seen"] = t.FirstSeen
+	v["last_seen"] = t.LastSeen
+	v["count"] = t.Count
+}
+
+// jsonInt converts a JSON number or numeric string to an integer, returning zero
+// for anything else
+func jsonInt(v interface{}) int64 {
+	switch n := v.(type) {
+	case float64:
+		return int64(n)
+	case string:
+		i, _ := strconv.ParseInt(n, 10, 64)
+		return i
+	}
+	return 0
+}
+
 func main() {
 
 	runtime.GOMAXPROCS(runtime.NumCPU())
@@ -71,7 +97,8 @@ func main() {
 	compression := flag.String("c", "snappy", "The compression type to use (none, snappy, zlib, lz4, lz4hc)")
 	sort_tmp := flag.String("t", "", "The temporary directory to use for the sorting phase")
 	sort_mem := flag.Uint64("m", 1, "The maximum amount of memory to use, in gigabytes, for the sorting phase")
-	selected_merge_mode := flag.String("M", "combine", "The merge mode: combine, first, or last")
+	selected_merge_mode := flag.String("M", "combine", "The merge mode: combine, first, last, or timeline")
+	ts_name := flag.String("ts", "timestamp", "The field name to read observation times from in timeline mode")
 	version := flag.Bool("version", false, "Show the version and build timestamp")
 
 	flag.Parse()
@@ -94,39 +121,40 @@ func main() {
 
 	fname := flag.Args()[0]
 
+	merge_func := inetdata.MTBLMergeJSON
+
 	switch *selected_merge_mode {
 	case "combine":
 		merge_mode = MERGE_MODE_COMBINE
 	case "first":
 		merge_mode = MERGE_MODE_FIRST
+		merge_func = inetdata.MTBLMergeFirst
 	case "last":
 		merge_mode = MERGE_MODE_LAST
+		merge_func = inetdata.MTBLMergeLast
+	case "timeline":
+		merge_mode = MERGE_MODE_TIMELINE
+		merge_func = mergeTimeline
 	default:
 		fmt.Fprintf(os.Stderr, "Error: Invalid merge mode specified: %s\n", *selected_merge_mode)
 		usage()
 		os.Exit(1)
 	}
 
-	sort_opt := mtbl.SorterOptions{Merge: mergeFunc, MaxMemory: 1000000000}
-	sort_opt.MaxMemory *= *sort_mem
-	if len(*sort_tmp) > 0 {
-		sort_opt.TempDir = *sort_tmp
+	opts := inetdata.MTBLBuilderOptions{
+		Compression: *compression,
+		TempDir:     *sort_tmp,
+		MaxMemory:   *sort_mem * 1000000000,
+		Merge:       merge_func,
 	}
 
-	compression_alg, ok := inetdata.MTBLCompressionTypes[*compression]
-	if !ok {
-		fmt.Fprintf(os.Stderr, "Invalid compression algorithm: %s\n", *compression)
-		os.Exit(1)
+	if *reverse_key {
+		opts.Key = inetdata.MTBLReverseKey
 	}
 
-	s := mtbl.SorterInit(&sort_opt)
-	defer s.Destroy()
-
-	w, we := mtbl.WriterInit(fname, &mtbl.WriterOptions{Compression: compression_alg})
-	defer w.Destroy()
-
-	if we != nil {
-		fmt.Fprintf(os.Stderr, "Error: %s\n", we)
+	b, be := inetdata.NewMTBLBuilder(fname, opts)
+	if be != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", be)
 		os.Exit(1)
 	}
 
@@ -155,23 +183,26 @@ func main() {
 
 		kstr := kval.(string)
 
-		if *reverse_key {
-			kstr = inetdata.ReverseKey(kstr)
-		}
-
-		if len(kstr) > inetdata.MTBL_KEY_LIMIT || len(raw) > inetdata.MTBL_VAL_LIMIT {
-			fmt.Printf("Failed to entry with long key or value\n")
-			continue
+		// Each record starts out as a single observation
+		if merge_mode == MERGE_MODE_TIMELINE {
+			ts := jsonInt(v[*ts_name])
+			setTimelineFields(v, inetdata.TimelineEntry{FirstSeen: ts, LastSeen: ts, Count: 1})
+
+			d, e := json.Marshal(v)
+			if e != nil {
+				fmt.Fprintf(os.Stderr, "Invalid JSON: %v -> %v\n", e, string(raw))
+				continue
+			}
+			raw = d
 		}
 
-		if e := s.Add([]byte(kstr), []byte(raw)); e != nil {
-			fmt.Printf("Failed to add %v -> %v: %v\n", kstr, raw, e)
+		if e := b.Add([]byte(kstr), raw); e != nil {
+			fmt.Printf("Failed to add %v: %v\n", kstr, e)
 			continue
 		}
-
 	}
 
-	if e := s.Write(w); e != nil {
+	if e := b.Close(); e != nil {
 		fmt.Fprintf(os.Stderr, "Error: %s\n", e)
 		os.Exit(1)
 	}
@@ -6,15 +6,10 @@ import (
 	"fmt"
 	"os"
 	"runtime"
-	"time"
 
-	mtbl "github.com/hdm/golang-mtbl"
 	"github.com/hdm/inetdata-parsers"
 )
 
-var merge_count int64 = 0
-var input_count int64 = 0
-
 func usage() {
 	fmt.Println("Usage: " + os.Args[0] + " [options]")
 	fmt.Println("")
@@ -24,30 +19,6 @@ func usage() {
 	flag.PrintDefaults()
 }
 
-func showProgress(quit chan int) {
-	start := time.Now()
-	for {
-		select {
-		case <-quit:
-			return
-		case <-time.After(time.Second * 1):
-			elapsed := time.Since(start)
-			if elapsed.Seconds() > 1.0 {
-				fmt.Fprintf(os.Stderr, "[*] Processed %d records in %d seconds (%d/s) (merged: %d)\n",
-					input_count,
-					int(elapsed.Seconds()),
-					int(float64(input_count)/elapsed.Seconds()),
-					merge_count)
-			}
-		}
-	}
-}
-
-func mergeFunc(key []byte, val0 []byte, val1 []byte) (mergedVal []byte) {
-	merge_count++
-	return val0
-}
-
 func main() {
 
 	runtime.GOMAXPROCS(runtime.NumCPU())
@@ -76,68 +47,42 @@ func main() {
 
 	fname := flag.Args()[0]
 
-	sort_opt := mtbl.SorterOptions{Merge: mergeFunc, MaxMemory: 1000000000}
-	sort_opt.MaxMemory *= *sort_mem
-	if len(*sort_tmp) > 0 {
-		sort_opt.TempDir = *sort_tmp
+	opts := inetdata.MTBLBuilderOptions{
+		Compression: *compression,
+		TempDir:     *sort_tmp,
+		MaxMemory:   *sort_mem * 1000000000,
+		Merge:       inetdata.MTBLMergeFirst,
+		Presorted:   *sort_skip,
+		Progress:    inetdata.MTBLProgressPrinter("inetdata-lines2mtbl"),
 	}
 
-	compression_alg, ok := inetdata.MTBLCompressionTypes[*compression]
-	if !ok {
-		fmt.Fprintf(os.Stderr, "Invalid compression algorithm: %s\n", *compression)
-		os.Exit(1)
+	if *reverse_key {
+		opts.Key = inetdata.MTBLReverseKey
 	}
 
-	s := mtbl.SorterInit(&sort_opt)
-	defer s.Destroy()
-
-	w, we := mtbl.WriterInit(fname, &mtbl.WriterOptions{Compression: compression_alg})
-	defer w.Destroy()
-
-	if we != nil {
-		fmt.Fprintf(os.Stderr, "Error: %s\n", we)
+	b, be := inetdata.NewMTBLBuilder(fname, opts)
+	if be != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", be)
 		os.Exit(1)
 	}
 
-	quit := make(chan int)
-	go showProgress(quit)
-
 	vstr := "1"
 	scanner := bufio.NewScanner(os.Stdin)
 	for scanner.Scan() {
 		kstr := scanner.Text()
 
-		input_count++
+		b.CountInput()
 		if len(kstr) == 0 {
 			continue
 		}
 
-		if *reverse_key {
-			kstr = inetdata.ReverseKey(kstr)
-		}
-
-		if len(kstr) > inetdata.MTBL_KEY_LIMIT || len(vstr) > inetdata.MTBL_VAL_LIMIT {
-			fmt.Printf("Failed to entry with long key or value\n")
-			continue
-		}
-
-		if *sort_skip {
-			if e := w.Add([]byte(kstr), []byte(vstr)); e != nil {
-				fmt.Printf("Failed to add %v -> %v: %v\n", kstr, vstr, e)
-			}
-		} else {
-			if e := s.Add([]byte(kstr), []byte(vstr)); e != nil {
-				fmt.Printf("Failed to add %v -> %v: %v\n", kstr, vstr, e)
-			}
+		if e := b.Add([]byte(kstr), []byte(vstr)); e != nil {
+			fmt.Printf("Failed to add %v -> %v: %v\n", kstr, vstr, e)
 		}
 	}
 
-	if !*sort_skip {
-		if e := s.Write(w); e != nil {
-			fmt.Fprintf(os.Stderr, "Error: %s\n", e)
-			os.Exit(1)
-		}
+	if e := b.Close(); e != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", e)
+		os.Exit(1)
 	}
-
-	quit <- 1
 }
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"compress/bzip2"
+	"compress/gzip"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/hdm/inetdata-parsers"
+)
+
+var prefix_builder *inetdata.MTBLBuilder
+
+var include_multicast *bool
+
+// Prefixes originated by each AS, for the inverse table
+var asn_prefixes = make(map[uint32]map[string]bool)
+
+func usage() {
+	fmt.Println("Usage: " + os.Args[0] + " [options] <output.mtbl> [<rib> ...]")
+	fmt.Println("")
+	fmt.Println("Creates a MTBL database of prefixes from BGP RIB dumps in MRT TABLE_DUMP_V2 format,")
+	fmt.Println("as published by RouteViews and RIPE RIS. Each prefix is stored with its origin AS")
+	fmt.Println("numbers, the shortest and longest AS path, and the number of peers that announced")
+	fmt.Println("it. Input is read from standard input when no files are given, files ending in .gz")
+	fmt.Println("or .bz2 are decompressed.")
+	fmt.Println("")
+	fmt.Println("Dumps from multiple collectors are combined by adding their peer counts, so each")
+	fmt.Println("input must come from a different collector. With -multicast, routes from the")
+	fmt.Println("multicast RIB are stored under keys starting with \"" + inetdata.MRTMulticastKeyPrefix + "\".")
+	fmt.Println("")
+	fmt.Println("With -a, an inverse table is written that maps each origin AS number to the")
+	fmt.Println("prefixes it announces.")
+	fmt.Println("")
+	fmt.Println("Options:")
+	flag.PrintDefaults()
+}
+
+func processReader(r io.Reader) error {
+	m := inetdata.NewMRTReader(r)
+
+	for {
+		rib, err := m.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		prefix_builder.CountInput()
+
+		if rib.IsMulticast() && !*include_multicast {
+			continue
+		}
+
+		route := rib.Summary()
+		if len(route.Origins) == 0 {
+			prefix_builder.CountInvalid()
+			continue
+		}
+
+		val, err := json.Marshal(route)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "[-] Could not encode %s: %s\n", rib.Prefix, err)
+			continue
+		}
+
+		// Multicast routes are kept apart so their peers do not add to the unicast count
+		key := rib.Prefix.String()
+		if rib.IsMulticast() {
+			key = inetdata.MRTMulticastKeyPrefix + key
+		}
+
+		if err := prefix_builder.Add([]byte(key), val); err != nil {
+			fmt.Fprintf(os.Stderr, "[-] Failed to add %s: %s\n", key, err)
+		}
+
+		for _, asn := range route.Origins {
+			if _, ok := asn_prefixes[asn]; !ok {
+				asn_prefixes[asn] = make(map[string]bool)
+			}
+			asn_prefixes[asn][key] = true
+		}
+	}
+}
+
+func processFile(name string) {
+	fd, err := os.Open(name)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not open file: %s\n", err.Error())
+		return
+	}
+	defer fd.Close()
+
+	var r io.Reader = fd
+	switch {
+	case strings.HasSuffix(name, ".gz"):
+		gz, err := gzip.NewReader(fd)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Could not decompress %s: %s\n", name, err.Error())
+			return
+		}
+		defer gz.Close()
+		r = gz
+	case strings.HasSuffix(name, ".bz2"):
+		r = bzip2.NewReader(fd)
+	}
+
+	if err := processReader(r); err != nil {
+		fmt.Fprintf(os.Stderr, "Could not read %s: %s\n", name, err.Error())
+	}
+}
+
+// writeASNTable stores the prefixes of each AS as [["prefix", cidr], ...] pairs,
+// with a type of "multicast-prefix" for routes from the multicast RIB
+func writeASNTable(b *inetdata.MTBLBuilder) {
+	for asn, prefixes := range asn_prefixes {
+		b.CountInput()
+
+		keys := make([]string, 0, len(prefixes))
+		for key := range prefixes {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		pairs := make([][]string, 0, len(keys))
+		for _, key := range keys {
+			if strings.HasPrefix(key, inetdata.MRTMulticastKeyPrefix) {
+				pairs = append(pairs, []string{"multicast-prefix", strings.TrimPrefix(key, inetdata.MRTMulticastKeyPrefix)})
+			} else {
+				pairs = append(pairs, []string{"prefix", key})
+			}
+		}
+
+		val, err := json.Marshal(pairs)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "[-] Could not encode AS%d: %s\n", asn, err)
+			continue
+		}
+
+		key := strconv.FormatUint(uint64(asn), 10)
+		if err := b.Add([]byte(key), val); err != nil {
+			fmt.Fprintf(os.Stderr, "[-] Failed to add AS%d: %s\n", asn, err)
+		}
+	}
+}
+
+func main() {
+
+	runtime.GOMAXPROCS(runtime.NumCPU())
+	os.Setenv("LC_ALL", "C")
+
+	flag.Usage = func() { usage() }
+
+	asn_output := flag.String("a", "", "Write the inverse table of AS numbers to prefixes to this MTBL file")
+	include_multicast = flag.Bool("multicast", false, "Include routes from the multicast RIB, stored under separate keys")
+	compression := flag.String("c", "snappy", "The compression type to use (none, snappy, zlib, lz4, lz4hc)")
+	sort_tmp := flag.String("t", "", "The temporary directory to use for the sorting phase")
+	sort_mem := flag.Uint64("m", 1, "The maximum amount of memory to use, in gigabytes, for the sorting phase")
+	version := flag.Bool("version", false, "Show the version and build timestamp")
+
+	flag.Parse()
+
+	if *version {
+		inetdata.PrintVersion("inetdata-mrt2mtbl")
+		os.Exit(0)
+	}
+
+	if len(flag.Args()) < 1 {
+		usage()
+		os.Exit(1)
+	}
+
+	opts := inetdata.MTBLBuilderOptions{
+		Compression: *compression,
+		TempDir:     *sort_tmp,
+		MaxMemory:   *sort_mem * 1000000000,
+		Merge:       inetdata.MTBLMergePrefixRoutes,
+		Progress:    inetdata.MTBLProgressPrinter("inetdata-mrt2mtbl"),
+	}
+
+	var be error
+	prefix_builder, be = inetdata.NewMTBLBuilder(flag.Args()[0], opts)
+	if be != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", be)
+		os.Exit(1)
+	}
+
+	if len(flag.Args()) == 1 {
+		if err := processReader(os.Stdin); err != nil {
+			fmt.Fprintf(os.Stderr, "Could not read input: %s\n", err.Error())
+		}
+	}
+
+	for _, name := range flag.Args()[1:] {
+		processFile(name)
+	}
+
+	if e := prefix_builder.Close(); e != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", e)
+		os.Exit(1)
+	}
+
+	// Prefixes are merged as the sorted records are written
+	stats := prefix_builder.Stats()
+
+	fmt.Fprintf(os.Stderr, "[*] Read %d RIB records and wrote %d prefixes (merged: %d, invalid: %d)\n",
+		stats.Input, stats.Output-stats.Merged, stats.Merged, stats.Invalid)
+
+	if len(*asn_output) == 0 {
+		return
+	}
+
+	opts.Merge = inetdata.MTBLMergePairs
+	opts.Progress = nil
+
+	ab, be := inetdata.NewMTBLBuilder(*asn_output, opts)
+	if be != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", be)
+		os.Exit(1)
+	}
+
+	writeASNTable(ab)
+
+	if e := ab.Close(); e != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", e)
+		os.Exit(1)
+	}
+
+	fmt.Fprintf(os.Stderr, "[*] Wrote %d AS numbers to %s\n", len(asn_prefixes), *asn_output)
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"runtime"
+	"sort"
+
+	mtbl "github.com/hdm/golang-mtbl"
+	"github.com/hdm/inetdata-parsers"
+)
+
+const CHANGE_ADDED = "added"
+const CHANGE_REMOVED = "removed"
+const CHANGE_CHANGED = "changed"
+
+var added_count int64 = 0
+var removed_count int64 = 0
+var changed_count int64 = 0
+var same_count int64 = 0
+
+// Delta describes a key that differs between the two snapshots
+type Delta struct {
+	Key     string     `json:"key"`
+	Change  string     `json:"change"`
+	Added   [][]string `json:"added,omitempty"`
+	Removed [][]string `json:"removed,omitempty"`
+}
+
+func usage() {
+	fmt.Println("Usage: " + os.Args[0] + " [options] <old.mtbl> <new.mtbl>")
+	fmt.Println("")
+	fmt.Println("Compares two MTBL snapshots and reports added, removed, and changed keys along with")
+	fmt.Println("the [type, value] pairs that appeared or disappeared. Values that are not arrays of")
+	fmt.Println("pairs are compared as a whole.")
+	fmt.Println("")
+	fmt.Println("Options:")
+	flag.PrintDefaults()
+}
+
+// decodePairs parses a [][]string or timeline value into pairs, ignoring times
+func decodePairs(val []byte) ([][]string, bool) {
+	var entries []inetdata.TimelineEntry
+	if e := json.Unmarshal(val, &entries); e != nil {
+		return nil, false
+	}
+
+	pairs := [][]string{}
+	for _, e := range entries {
+		if len(e.Type) == 0 {
+			pairs = append(pairs, []string{e.Value})
+		} else {
+			pairs = append(pairs, []string{e.Type, e.Value})
+		}
+	}
+	return pairs, true
+}
+
+// subtractPairs returns the pairs of a that are not in b, sorted
+func subtractPairs(a [][]string, b [][]string) [][]string {
+	seen := make(map[string]bool)
+	for i := range b {
+		seen[pairKey(b[i])] = true
+	}
+
+	out := [][]string{}
+	for i := range a {
+		k := pairKey(a[i])
+		if seen[k] {
+			continue
+		}
+		seen[k] = true
+		out = append(out, a[i])
+	}
+
+	sort.Slice(out, func(i, j int) bool { return pairKey(out[i]) < pairKey(out[j]) })
+	return out
+}
+
+func pairKey(p []string) string {
+	return fmt.Sprintf("%q", p)
+}
+
+// compareValues returns the delta between two values of the same key, or nil if
+// the set of pairs is unchanged
+func compareValues(val0 []byte, val1 []byte) *Delta {
+	p0, ok0 := decodePairs(val0)
+	p1, ok1 := decodePairs(val1)
+
+	if !(ok0 && ok1) {
+		if bytes.Equal(val0, val1) {
+			return nil
+		}
+		return &Delta{Change: CHANGE_CHANGED}
+	}
+
+	d := &Delta{
+		Change:  CHANGE_CHANGED,
+		Added:   subtractPairs(p1, p0),
+		Removed: subtractPairs(p0, p1),
+	}
+
+	if len(d.Added) == 0 && len(d.Removed) == 0 {
+		return nil
+	}
+	return d
+}
+
+// keyOnly returns the delta for a key that exists in only one snapshot
+func keyOnly(change string, val []byte) *Delta {
+	d := &Delta{Change: change}
+	if pairs, ok := decodePairs(val); ok {
+		pairs = subtractPairs(pairs, nil)
+		if change == CHANGE_ADDED {
+			d.Added = pairs
+		} else {
+			d.Removed = pairs
+		}
+	}
+	return d
+}
+
+// deltaValue encodes a delta in the [][]string format read by mq, with each
+// pair prefixed by + or -
+func deltaValue(d *Delta) ([]byte, error) {
+	vals := [][]string{}
+	for _, p := range d.Added {
+		vals = append(vals, append([]string{"+"}, p...))
+	}
+	for _, p := range d.Removed {
+		vals = append(vals, append([]string{"-"}, p...))
+	}
+
+	// Values that are not pairs only record the kind of change
+	if len(vals) == 0 {
+		vals = append(vals, []string{d.Change})
+	}
+	return json.Marshal(vals)
+}
+
+func main() {
+
+	runtime.GOMAXPROCS(runtime.NumCPU())
+	os.Setenv("LC_ALL", "C")
+
+	flag.Usage = func() { usage() }
+
+	output := flag.String("o", "", "Write the deltas to this MTBL instead of JSONL on stdout")
+	compression := flag.String("c", "snappy", "The compression type to use for the output MTBL (none, snappy, zlib, lz4, lz4hc)")
+	rev_key := flag.Bool("R", false, "Display keys in reverse form in the JSONL output")
+	version := flag.Bool("version", false, "Show the version and build timestamp")
+
+	flag.Parse()
+
+	if *version {
+		inetdata.PrintVersion("inetdata-mtbl-diff")
+		os.Exit(0)
+	}
+
+	if len(flag.Args()) != 2 {
+		usage()
+		os.Exit(1)
+	}
+
+	readers := []*mtbl.Reader{}
+	for _, path := range flag.Args() {
+		r, e := mtbl.ReaderInit(path, &mtbl.ReaderOptions{VerifyChecksums: true})
+		if e != nil {
+			fmt.Fprintf(os.Stderr, "Error reading %s: %s\n", path, e)
+			os.Exit(1)
+		}
+		defer r.Destroy()
+		readers = append(readers, r)
+	}
+
+	var b *inetdata.MTBLBuilder
+	if len(*output) > 0 {
+		// Keys are visited in order, deltas are written as-is
+		var e error
+		b, e = inetdata.NewMTBLBuilder(*output, inetdata.MTBLBuilderOptions{
+			Compression: *compression,
+			Presorted:   true,
+		})
+		if e != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s\n", e)
+			os.Exit(1)
+		}
+	}
+
+	out := bufio.NewWriter(os.Stdout)
+	defer out.Flush()
+
+	emit := func(key []byte, d *Delta) {
+		switch d.Change {
+		case CHANGE_ADDED:
+			added_count++
+		case CHANGE_REMOVED:
+			removed_count++
+		default:
+			changed_count++
+		}
+
+		if b != nil {
+			val, e := deltaValue(d)
+			if e != nil {
+				fmt.Fprintf(os.Stderr, "[-] Could not marshal %v: %s\n", d, e)
+				return
+			}
+			if e := b.Add(key, val); e != nil {
+				fmt.Fprintf(os.Stderr, "[-] Failed to add key=%s: %s\n", key, e)
+			}
+			return
+		}
+
+		// Binary-encoded IP keys are converted back to text and never reversed
+		if ip, ok := inetdata.DecodeIPKey(key); ok {
+			d.Key = ip
+		} else if *rev_key {
+			d.Key = inetdata.ReverseKey(string(key))
+		} else {
+			d.Key = string(key)
+		}
+
+		data, e := json.Marshal(d)
+		if e != nil {
+			fmt.Fprintf(os.Stderr, "[-] Could not marshal %v: %s\n", d, e)
+			return
+		}
+		out.Write(data)
+		out.WriteString("\n")
+	}
+
+	it0 := mtbl.IterAll(readers[0])
+	it1 := mtbl.IterAll(readers[1])
+	defer it0.Destroy()
+	defer it1.Destroy()
+
+	k0, v0, ok0 := it0.Next()
+	k1, v1, ok1 := it1.Next()
+
+	// Both snapshots are sorted by key, walk them side by side
+	for ok0 || ok1 {
+		switch {
+		case !ok1 || (ok0 && bytes.Compare(k0, k1) < 0):
+			emit(k0, keyOnly(CHANGE_REMOVED, v0))
+			k0, v0, ok0 = it0.Next()
+
+		case !ok0 || bytes.Compare(k0, k1) > 0:
+			emit(k1, keyOnly(CHANGE_ADDED, v1))
+			k1, v1, ok1 = it1.Next()
+
+		default:
+			if d := compareValues(v0, v1); d != nil {
+				emit(k0, d)
+			} else {
+				same_count++
+			}
+			k0, v0, ok0 = it0.Next()
+			k1, v1, ok1 = it1.Next()
+		}
+	}
+
+	if b != nil {
+		if e := b.Close(); e != nil {
+			fmt.Fprintf(os.Stderr, "Error writing MTBL: %s\n", e)
+			os.Exit(1)
+		}
+	}
+
+	fmt.Fprintf(os.Stderr, "[*] Keys added: %d, removed: %d, changed: %d, unchanged: %d\n",
+		added_count, removed_count, changed_count, same_count)
+}
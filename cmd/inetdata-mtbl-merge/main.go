@@ -0,0 +1,168 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"runtime"
+	"sync"
+	"time"
+
+	mtbl "github.com/hdm/golang-mtbl"
+	"github.com/hdm/inetdata-parsers"
+)
+
+func usage() {
+	fmt.Println("Usage: " + os.Args[0] + " [options] <output.mtbl> <input.mtbl> ... <input.mtbl>")
+	fmt.Println("")
+	fmt.Println("Merges one or more MTBL databases into a new MTBL")
+	fmt.Println("")
+	fmt.Println("Options:")
+	flag.PrintDefaults()
+}
+
+func showProgress(stats inetdata.MTBLBuilderStats, elapsed time.Duration) {
+	if elapsed.Seconds() <= 1.0 {
+		return
+	}
+	fmt.Fprintf(os.Stderr, "[*] [inetdata-mtbl-merge] Wrote %d records in %d seconds (%d/s) (merged: %d)\n",
+		stats.Output,
+		int(elapsed.Seconds()),
+		int(float64(stats.Output)/elapsed.Seconds()),
+		stats.Merged)
+}
+
+// countRecords returns the number of records in each input
+func countRecords(readers []*mtbl.Reader) []int64 {
+	counts := make([]int64, len(readers))
+
+	var wg sync.WaitGroup
+	for i := range readers {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			it := mtbl.IterAll(readers[i])
+			defer it.Destroy()
+			for {
+				if _, _, ok := it.Next(); !ok {
+					break
+				}
+				counts[i]++
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	return counts
+}
+
+func main() {
+
+	runtime.GOMAXPROCS(runtime.NumCPU())
+	os.Setenv("LC_ALL", "C")
+
+	flag.Usage = func() { usage() }
+
+	compression := flag.String("c", "snappy", "The compression type to use (none, snappy, zlib, lz4, lz4hc)")
+	selected_merge_mode := flag.String("M", "combine", "The merge mode: combine, first, last, or timeline (first seen, last seen, and count of each value)")
+	version := flag.Bool("version", false, "Show the version and build timestamp")
+
+	flag.Parse()
+
+	if *version {
+		inetdata.PrintVersion("inetdata-mtbl-merge")
+		os.Exit(0)
+	}
+
+	if len(flag.Args()) < 2 {
+		usage()
+		os.Exit(1)
+	}
+
+	var merge_func inetdata.MTBLMergeFunc
+
+	switch *selected_merge_mode {
+	case "combine":
+		merge_func = inetdata.MTBLMergePairs
+	case "first":
+		merge_func = inetdata.MTBLMergeFirst
+	case "last":
+		merge_func = inetdata.MTBLMergeLast
+	case "timeline":
+		merge_func = inetdata.MTBLMergeTimeline
+	default:
+		fmt.Fprintf(os.Stderr, "Error: Invalid merge mode specified: %s\n", *selected_merge_mode)
+		usage()
+		os.Exit(1)
+	}
+
+	fname := flag.Args()[0]
+	paths := flag.Args()[1:]
+
+	// Never overwrite an existing file, it may be one of the inputs
+	if _, e := os.Stat(fname); e == nil {
+		fmt.Fprintf(os.Stderr, "Error: Output file %s already exists\n", fname)
+		os.Exit(1)
+	}
+
+	readers := []*mtbl.Reader{}
+	for _, path := range paths {
+		r, e := mtbl.ReaderInit(path, &mtbl.ReaderOptions{VerifyChecksums: true})
+		if e != nil {
+			fmt.Fprintf(os.Stderr, "Error reading %s: %s\n", path, e)
+			os.Exit(1)
+		}
+		defer r.Destroy()
+		readers = append(readers, r)
+	}
+
+	counts := countRecords(readers)
+
+	var total int64
+	for i := range paths {
+		fmt.Fprintf(os.Stderr, "[*] %s: %d records\n", paths[i], counts[i])
+		total += counts[i]
+	}
+
+	// Inputs are already sorted, the merger output is written as-is
+	b, e := inetdata.NewMTBLBuilder(fname, inetdata.MTBLBuilderOptions{
+		Compression: *compression,
+		Merge:       merge_func,
+		Presorted:   true,
+		Progress:    showProgress,
+	})
+	if e != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", e)
+		os.Exit(1)
+	}
+
+	m := mtbl.MergerInit(&mtbl.MergerOptions{Merge: mtbl.MergeFunc(b.MergeFunc())})
+	defer m.Destroy()
+
+	for i := range readers {
+		m.AddSource(readers[i])
+	}
+
+	it := mtbl.IterAll(m)
+	for {
+		key, val, ok := it.Next()
+		if !ok {
+			break
+		}
+
+		if e := b.Add(key, val); e != nil {
+			fmt.Fprintf(os.Stderr, "[-] Failed to add key=%s: %s\n", key, e)
+		}
+	}
+	it.Destroy()
+
+	stats := b.Stats()
+
+	if e := b.Close(); e != nil {
+		fmt.Fprintf(os.Stderr, "Error writing MTBL: %s\n", e)
+		os.Exit(1)
+	}
+
+	fmt.Fprintf(os.Stderr, "[*] Merged %d records from %d inputs into %d records (merged: %d)\n",
+		total, len(paths), stats.Output, stats.Merged)
+}
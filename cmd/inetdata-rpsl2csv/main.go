@@ -0,0 +1,107 @@
+package main
+
+// Convert RPSL database dumps into CSV output
+
+import (
+	"compress/gzip"
+	"encoding/csv"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/hdm/inetdata-parsers"
+)
+
+var writer *csv.Writer
+
+func usage() {
+	fmt.Println("Usage: " + os.Args[0] + " [options] [<file> ...]")
+	fmt.Println("")
+	fmt.Println("Converts RPSL database dumps from RIPE, APNIC, AFRINIC, and LACNIC into CSV with the")
+	fmt.Println("columns of inetdata-arin-xml2csv. Input is read from standard input when no files")
+	fmt.Println("are given, files ending in .gz are decompressed. Routes are written as prefix,")
+	fmt.Println("origin, name, maintainers, created, and updated columns. Maintainers and other")
+	fmt.Println("classes without an ARIN equivalent are skipped.")
+	fmt.Println("")
+	fmt.Println("Options:")
+	flag.PrintDefaults()
+}
+
+func escapeCell(s string) string {
+	return strings.Replace(s, "\\", "\\\\", -1)
+}
+
+func processReader(r io.Reader) error {
+	return inetdata.ReadRPSL(r, func(o *inetdata.RPSLObject) {
+		record, e := inetdata.RPSLCSVRecord(o)
+		if e != nil {
+			fmt.Fprintf(os.Stderr, "Could not convert %s %s: %s\n", o.Class, o.Key, e)
+			return
+		}
+		if record == nil {
+			return
+		}
+
+		// Sanitize the records
+		for i := range record {
+			record[i] = escapeCell(record[i])
+		}
+
+		if err := writer.Write(record); err != nil {
+			fmt.Fprintf(os.Stderr, "Could not write CSV: %v\n", record)
+		}
+	})
+}
+
+func processFile(name string) {
+	fd, err := os.Open(name)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not open file: %s\n", err.Error())
+		return
+	}
+	defer fd.Close()
+
+	var r io.Reader = fd
+	if strings.HasSuffix(name, ".gz") {
+		gz, err := gzip.NewReader(fd)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Could not decompress %s: %s\n", name, err.Error())
+			return
+		}
+		defer gz.Close()
+		r = gz
+	}
+
+	if err := processReader(r); err != nil {
+		fmt.Fprintf(os.Stderr, "Could not read %s: %s\n", name, err.Error())
+	}
+}
+
+func main() {
+	flag.Usage = func() { usage() }
+
+	version := flag.Bool("version", false, "Show the version and build timestamp")
+
+	flag.Parse()
+
+	if *version {
+		inetdata.PrintVersion("inetdata-rpsl2csv")
+		os.Exit(0)
+	}
+
+	writer = csv.NewWriter(os.Stdout)
+	defer writer.Flush()
+
+	if len(flag.Args()) == 0 {
+		if err := processReader(os.Stdin); err != nil {
+			fmt.Fprintf(os.Stderr, "Could not read input: %s\n", err.Error())
+		}
+		return
+	}
+
+	for i := range flag.Args() {
+		processFile(flag.Args()[i])
+	}
+}
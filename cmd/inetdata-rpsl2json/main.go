@@ -0,0 +1,104 @@
+package main
+
+// Convert RPSL database dumps into JSONL output
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/hdm/inetdata-parsers"
+)
+
+var source *string
+var out *bufio.Writer
+
+func usage() {
+	fmt.Println("Usage: " + os.Args[0] + " [options] [<file> ...]")
+	fmt.Println("")
+	fmt.Println("Converts RPSL database dumps from RIPE, APNIC, AFRINIC, and LACNIC into JSONL in")
+	fmt.Println("the shape of inetdata-arin-xml2json, with class and source fields added. Input is")
+	fmt.Println("read from standard input when no files are given, files ending in .gz are")
+	fmt.Println("decompressed. The inetnum, inet6num, aut-num, organisation, role, person, route,")
+	fmt.Println("route6, and mntner classes are converted, other objects are skipped.")
+	fmt.Println("")
+	fmt.Println("Options:")
+	flag.PrintDefaults()
+}
+
+func processReader(r io.Reader) error {
+	return inetdata.ReadRPSL(r, func(o *inetdata.RPSLObject) {
+		rec, e := inetdata.RPSLRecord(o, *source)
+		if e != nil {
+			fmt.Fprintf(os.Stderr, "Could not convert %s %s: %s\n", o.Class, o.Key, e)
+			return
+		}
+
+		b, e := json.Marshal(rec)
+		if e != nil {
+			fmt.Fprintf(os.Stderr, "Could not marshal type: %s\n", e.Error())
+			return
+		}
+		out.Write(b)
+		out.WriteString("\n")
+	})
+}
+
+func processFile(name string) {
+	fd, err := os.Open(name)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not open file: %s\n", err.Error())
+		return
+	}
+	defer fd.Close()
+
+	var r io.Reader = fd
+	if strings.HasSuffix(name, ".gz") {
+		gz, err := gzip.NewReader(fd)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Could not decompress %s: %s\n", name, err.Error())
+			return
+		}
+		defer gz.Close()
+		r = gz
+	}
+
+	if err := processReader(r); err != nil {
+		fmt.Fprintf(os.Stderr, "Could not read %s: %s\n", name, err.Error())
+	}
+}
+
+func main() {
+	flag.Usage = func() { usage() }
+
+	source = flag.String("source", "", "The registry name to use for objects without a source attribute")
+	version := flag.Bool("version", false, "Show the version and build timestamp")
+
+	flag.Parse()
+
+	if *version {
+		inetdata.PrintVersion("inetdata-rpsl2json")
+		os.Exit(0)
+	}
+
+	*source = strings.ToUpper(*source)
+
+	out = bufio.NewWriter(os.Stdout)
+	defer out.Flush()
+
+	if len(flag.Args()) == 0 {
+		if err := processReader(os.Stdin); err != nil {
+			fmt.Fprintf(os.Stderr, "Could not read input: %s\n", err.Error())
+		}
+		return
+	}
+
+	for i := range flag.Args() {
+		processFile(flag.Args()[i])
+	}
+}
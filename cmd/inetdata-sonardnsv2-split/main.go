@@ -1,6 +1,8 @@
 package main
 
 import (
+	"bufio"
+	"compress/gzip"
 	"encoding/json"
 	"flag"
 	"fmt"
@@ -8,6 +10,7 @@ import (
 	"os"
 	"os/exec"
 	"runtime"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -21,6 +24,8 @@ var input_count int64 = 0
 var stdout_lock sync.Mutex
 var wg1 sync.WaitGroup
 var wg2 sync.WaitGroup
+var add_timestamps = false
+var prefix_table *inetdata.PrefixTable
 
 type OutputKey struct {
 	Key  string
@@ -79,6 +84,42 @@ func outputWriter(fd io.WriteCloser, c chan string) {
 	wg1.Done()
 }
 
+// outputSorter queues records for the built-in sorter. After a failure the error
+// is sent to main and the remaining records are discarded, so the parsers never block.
+func outputSorter(s *inetdata.ExternalSort, c chan string, errs chan error) {
+	var err error
+	for r := range c {
+		if err != nil {
+			continue
+		}
+		if err = s.Add(r); err != nil {
+			errs <- err
+			continue
+		}
+		atomic.AddInt64(&output_count, 1)
+	}
+	wg1.Done()
+}
+
+// closeSorters removes the temporary files of the built-in sorters
+func closeSorters(sorters []*inetdata.ExternalSort) {
+	for i := range sorters {
+		sorters[i].Close()
+	}
+}
+
+// enrichPairs returns the network of whichever of name or value is an IP address
+// as [type, value] pairs
+func enrichPairs(name string, value string) [][]string {
+	if prefix_table == nil {
+		return nil
+	}
+	if pairs := prefix_table.Pairs(value); pairs != nil {
+		return pairs
+	}
+	return prefix_table.Pairs(name)
+}
+
 func inputParser(c chan string, c_names chan string, c_inverse chan string) {
 
 	for r := range c {
@@ -137,91 +178,65 @@ func inputParser(c chan string, c_names chan string, c_inverse chan string) {
 
 		atomic.AddInt64(&input_count, 1)
 
+		// Carry the observation time along with the value for timeline merges
+		suffix := ""
+		if add_timestamps {
+			if ts, err := strconv.ParseInt(rec.Timestamp, 10, 64); err == nil && ts > 0 {
+				suffix = inetdata.TimelineSep + strconv.FormatInt(ts, 10)
+			}
+		}
+
 		switch rec.Type {
 		case "a":
 			// Skip invalid IPv4 records (TODO: verify logic)
 			if !(inetdata.MatchIPv4.Match([]byte(rec.Value)) || inetdata.MatchIPv4.Match([]byte(rec.Name))) {
 				continue
 			}
-			c_names <- fmt.Sprintf("%s,%s,%s\n", rec.Name, rec.Type, rec.Value)
-			c_inverse <- fmt.Sprintf("%s,r-%s,%s\n", rec.Value, rec.Type, rec.Name)
+			c_names <- fmt.Sprintf("%s,%s,%s%s\n", rec.Name, rec.Type, rec.Value, suffix)
+			c_inverse <- fmt.Sprintf("%s,r-%s,%s%s\n", rec.Value, rec.Type, rec.Name, suffix)
+
+			for _, p := range enrichPairs(rec.Name, rec.Value) {
+				c_names <- fmt.Sprintf("%s,%s,%s%s\n", rec.Name, p[0], p[1], suffix)
+				c_inverse <- fmt.Sprintf("%s,%s,%s%s\n", rec.Value, p[0], p[1], suffix)
+			}
 
 		case "aaaa":
 			// Skip invalid IPv6 records (TODO: verify logic)
 			if !(inetdata.MatchIPv6.Match([]byte(rec.Value)) || inetdata.MatchIPv6.Match([]byte(rec.Name))) {
 				continue
 			}
-			c_names <- fmt.Sprintf("%s,%s,%s\n", rec.Name, rec.Type, rec.Value)
-			c_inverse <- fmt.Sprintf("%s,r-%s,%s\n", rec.Value, rec.Type, rec.Name)
+			c_names <- fmt.Sprintf("%s,%s,%s%s\n", rec.Name, rec.Type, rec.Value, suffix)
+			c_inverse <- fmt.Sprintf("%s,r-%s,%s%s\n", rec.Value, rec.Type, rec.Name, suffix)
+
+			for _, p := range enrichPairs(rec.Name, rec.Value) {
+				c_names <- fmt.Sprintf("%s,%s,%s%s\n", rec.Name, p[0], p[1], suffix)
+				c_inverse <- fmt.Sprintf("%s,%s,%s%s\n", rec.Value, p[0], p[1], suffix)
+			}
 
 		case "cname", "ns", "ptr":
-			c_names <- fmt.Sprintf("%s,%s,%s\n", rec.Name, rec.Type, rec.Value)
-			c_inverse <- fmt.Sprintf("%s,r-%s,%s\n", rec.Value, rec.Type, rec.Name)
+			c_names <- fmt.Sprintf("%s,%s,%s%s\n", rec.Name, rec.Type, rec.Value, suffix)
+			c_inverse <- fmt.Sprintf("%s,r-%s,%s%s\n", rec.Value, rec.Type, rec.Name, suffix)
 
 		case "mx":
 			parts := strings.SplitN(rec.Value, " ", 2)
 			if len(parts) != 2 || len(parts[1]) == 0 {
 				continue
 			}
-			c_names <- fmt.Sprintf("%s,%s,%s\n", rec.Name, rec.Type, parts[1])
-			c_inverse <- fmt.Sprintf("%s,r-%s,%s\n", parts[1], rec.Type, rec.Name)
+			c_names <- fmt.Sprintf("%s,%s,%s%s\n", rec.Name, rec.Type, parts[1], suffix)
+			c_inverse <- fmt.Sprintf("%s,r-%s,%s%s\n", parts[1], rec.Type, rec.Name, suffix)
 
 		default:
 			// No inverse output for other record types (TXT, DNSSEC, etc)
-			c_names <- fmt.Sprintf("%s,%s,%s\n", rec.Name, rec.Type, rec.Value)
+			c_names <- fmt.Sprintf("%s,%s,%s%s\n", rec.Name, rec.Type, rec.Value, suffix)
 		}
 	}
 	wg2.Done()
 }
 
-func main() {
-
-	runtime.GOMAXPROCS(runtime.NumCPU())
-	os.Setenv("LC_ALL", "C")
-
-	flag.Usage = func() { usage() }
-	sort_tmp := flag.String("t", "", "The temporary directory to use for the sorting phase")
-	sort_mem := flag.Uint64("m", 1, "The maximum amount of memory to use, in gigabytes, for each of the six sort processes")
-	version := flag.Bool("version", false, "Show the version and build timestamp")
-
-	flag.Parse()
-
-	if *version {
-		inetdata.PrintVersion("inetdata-sonardnsv2-split")
-		os.Exit(0)
-	}
-
-	if len(flag.Args()) != 1 {
-		flag.Usage()
-		os.Exit(1)
-	}
-
-	if len(*sort_tmp) == 0 {
-		*sort_tmp = os.Getenv("HOME")
-	}
-
-	if len(*sort_tmp) == 0 {
-		flag.Usage()
-		os.Exit(1)
-	}
-
-	// Output files
-	base := flag.Args()[0]
-	out_fds := []*os.File{}
-
-	suffix := []string{"-names.gz", "-names-inverse.gz"}
-	for i := range suffix {
-		fd, e := os.Create(base + suffix[i])
-		if e != nil {
-			fmt.Fprintf(os.Stderr, "Error: failed to create %s: %s\n", base+suffix[i], e)
-			os.Exit(1)
-		}
-		out_fds = append(out_fds, fd)
-		defer fd.Close()
-	}
-
-	// Sort and compression pipes
-	sort_input := [2]io.WriteCloser{}
+// startSystemSort creates a sort, inetdata-csvrollup, sort, and pigz pipeline for
+// each output file using external commands and returns the pipeline inputs
+func startSystemSort(out_fds []*os.File, sort_tmp string, sort_mem uint64) ([]io.WriteCloser, []*exec.Cmd) {
+	sort_input := []io.WriteCloser{}
 	subprocs := []*exec.Cmd{}
 
 	for i := range out_fds {
@@ -234,8 +249,8 @@ func main() {
 			"--field-separator=,",
 			"--compress-program=pigz",
 			fmt.Sprintf("--parallel=%d", runtime.NumCPU()),
-			fmt.Sprintf("--temporary-directory=%s", *sort_tmp),
-			fmt.Sprintf("--buffer-size=%dG", *sort_mem))
+			fmt.Sprintf("--temporary-directory=%s", sort_tmp),
+			fmt.Sprintf("--buffer-size=%dG", sort_mem))
 
 		// Configure stdio
 		sort_stdin, sie := sort_proc.StdinPipe()
@@ -251,7 +266,7 @@ func main() {
 		}
 
 		sort_proc.Stderr = os.Stderr
-		sort_input[i] = sort_stdin
+		sort_input = append(sort_input, sort_stdin)
 		subprocs = append(subprocs, sort_proc)
 
 		// Start the sort process
@@ -288,8 +303,8 @@ func main() {
 			"--field-separator=,",
 			"--compress-program=pigz",
 			fmt.Sprintf("--parallel=%d", runtime.NumCPU()),
-			fmt.Sprintf("--temporary-directory=%s", *sort_tmp),
-			fmt.Sprintf("--buffer-size=%dG", *sort_mem))
+			fmt.Sprintf("--temporary-directory=%s", sort_tmp),
+			fmt.Sprintf("--buffer-size=%dG", sort_mem))
 
 		sort2_stdout, ssoe := sort2_proc.StdoutPipe()
 		if ssoe != nil {
@@ -329,11 +344,137 @@ func main() {
 		subprocs = append(subprocs, pigz_proc)
 	}
 
+	return sort_input, subprocs
+}
+
+// writeSorted sorts and merges the queued records and writes them to a gzip file
+func writeSorted(s *inetdata.ExternalSort, fd *os.File) error {
+	gz := gzip.NewWriter(fd)
+	w := bufio.NewWriterSize(gz, 1024*1024)
+
+	c := make(chan string, 1000)
+	done := make(chan error, 1)
+
+	go func() {
+		done <- s.SortRollup(c)
+	}()
+
+	var werr error
+	for r := range c {
+		if werr != nil {
+			continue
+		}
+		if _, werr = w.WriteString(r); werr == nil {
+			werr = w.WriteByte('\n')
+		}
+	}
+
+	if e := <-done; e != nil {
+		return e
+	}
+
+	if werr != nil {
+		return werr
+	}
+
+	if e := w.Flush(); e != nil {
+		return e
+	}
+
+	return gz.Close()
+}
+
+func main() {
+
+	runtime.GOMAXPROCS(runtime.NumCPU())
+	os.Setenv("LC_ALL", "C")
+
+	flag.Usage = func() { usage() }
+	sort_tmp := flag.String("t", "", "The temporary directory to use for the sorting phase")
+	sort_mem := flag.Uint64("m", 1, "The maximum amount of memory to use, in gigabytes, for each of the sort phases")
+	system_sort := flag.Bool("system-sort", false, "Use the external sort, pigz, and inetdata-csvrollup commands instead of the built-in sorter")
+	timestamps := flag.Bool("timestamps", false, "Append the record timestamp to each value for use with inetdata-dns2mtbl -M timeline")
+	enrich_prefixes := flag.String("enrich-prefixes", "", "Add asn, prefix, and rir pairs for IP addresses using these comma-separated prefix files (MTBL or CSV)")
+	version := flag.Bool("version", false, "Show the version and build timestamp")
+
+	flag.Parse()
+
+	if *version {
+		inetdata.PrintVersion("inetdata-sonardnsv2-split")
+		os.Exit(0)
+	}
+
+	if len(flag.Args()) != 1 {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	add_timestamps = *timestamps
+
+	if len(*sort_tmp) == 0 {
+		*sort_tmp = os.Getenv("HOME")
+	}
+
+	if len(*sort_tmp) == 0 {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	if len(*enrich_prefixes) > 0 {
+		var e error
+		prefix_table, e = inetdata.LoadPrefixTable(strings.Split(*enrich_prefixes, ","))
+		if e != nil {
+			fmt.Fprintf(os.Stderr, "Error: failed to load prefixes: %s\n", e)
+			os.Exit(1)
+		}
+		fmt.Fprintf(os.Stderr, "[*] Loaded %d prefixes from %s\n", prefix_table.Len(), *enrich_prefixes)
+	}
+
+	// Output files
+	base := flag.Args()[0]
+	out_fds := []*os.File{}
+
+	suffix := []string{"-names.gz", "-names-inverse.gz"}
+	for i := range suffix {
+		fd, e := os.Create(base + suffix[i])
+		if e != nil {
+			fmt.Fprintf(os.Stderr, "Error: failed to create %s: %s\n", base+suffix[i], e)
+			os.Exit(1)
+		}
+		out_fds = append(out_fds, fd)
+		defer fd.Close()
+	}
+
 	c_names := make(chan string, 1000)
 	c_inverse := make(chan string, 1000)
 
-	go outputWriter(sort_input[0], c_names)
-	go outputWriter(sort_input[1], c_inverse)
+	// Sort and compression pipes
+	sort_input := []io.WriteCloser{}
+	sorters := []*inetdata.ExternalSort{}
+	sort_errors := make(chan error, 2)
+	subprocs := []*exec.Cmd{}
+
+	if *system_sort {
+		sort_input, subprocs = startSystemSort(out_fds, *sort_tmp, *sort_mem)
+		go outputWriter(sort_input[0], c_names)
+		go outputWriter(sort_input[1], c_inverse)
+	} else {
+		for range out_fds {
+			s, e := inetdata.NewExternalSort(inetdata.SortOptions{
+				TempDir:   *sort_tmp,
+				MaxMemory: *sort_mem * 1024 * 1024 * 1024,
+				Unique:    true,
+			})
+			if e != nil {
+				fmt.Fprintf(os.Stderr, "Error: failed to create sorter: %s\n", e)
+				closeSorters(sorters)
+				os.Exit(1)
+			}
+			sorters = append(sorters, s)
+		}
+		go outputSorter(sorters[0], c_names, sort_errors)
+		go outputSorter(sorters[1], c_inverse, sort_errors)
+	}
 	wg1.Add(2)
 
 	// Progress tracker
@@ -347,9 +488,21 @@ func main() {
 	wg2.Add(2)
 
 	// Reader closes c_inp on completion
-	e := inetdata.ReadLines(os.Stdin, c_inp)
-	if e != nil {
-		fmt.Fprintf(os.Stderr, "Error reading input: %s\n", e)
+	read_done := make(chan error, 1)
+	go func() {
+		read_done <- inetdata.ReadLines(os.Stdin, c_inp)
+	}()
+
+	// Stop early if a sorter fails, removing its temporary files first
+	select {
+	case e := <-read_done:
+		if e != nil {
+			fmt.Fprintf(os.Stderr, "Error reading input: %s\n", e)
+		}
+	case e := <-sort_errors:
+		fmt.Fprintf(os.Stderr, "Error: failed to sort output: %s\n", e)
+		closeSorters(sorters)
+		os.Exit(1)
 	}
 
 	// Wait for the input parsers to finish
@@ -361,6 +514,14 @@ func main() {
 	// Wait for the channel writers to finish
 	wg1.Wait()
 
+	select {
+	case e := <-sort_errors:
+		fmt.Fprintf(os.Stderr, "Error: failed to sort output: %s\n", e)
+		closeSorters(sorters)
+		os.Exit(1)
+	default:
+	}
+
 	for i := range sort_input {
 		sort_input[i].Close()
 	}
@@ -368,12 +529,42 @@ func main() {
 	// Stop the main process monitoring, since stats are now static
 	quit <- 0
 
+	exit_code := 0
+
 	// Wait for the downstream processes to complete
 	for i := range subprocs {
-		subprocs[i].Wait()
+		if e := subprocs[i].Wait(); e != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s failed: %s\n", strings.Join(subprocs[i].Args, " "), e)
+			exit_code = 1
+		}
+	}
+
+	// Sort, merge, and compress each output file
+	var wg_sort sync.WaitGroup
+	write_errors := make([]error, len(sorters))
+	for i := range sorters {
+		wg_sort.Add(1)
+		go func(i int) {
+			write_errors[i] = writeSorted(sorters[i], out_fds[i])
+			wg_sort.Done()
+		}(i)
+	}
+	wg_sort.Wait()
+
+	closeSorters(sorters)
+
+	for i := range write_errors {
+		if write_errors[i] != nil {
+			fmt.Fprintf(os.Stderr, "Error: failed to write %s: %s\n", out_fds[i].Name(), write_errors[i])
+			exit_code = 1
+		}
 	}
 
 	for i := range out_fds {
 		out_fds[i].Close()
 	}
+
+	if exit_code != 0 {
+		os.Exit(exit_code)
+	}
 }
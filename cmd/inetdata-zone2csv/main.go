@@ -7,6 +7,7 @@ import (
 	"os"
 	"regexp"
 	"runtime"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -23,6 +24,7 @@ const ZONE_MODE_CZDS = 5
 var zone_mode = 0
 var zone_name = ""
 var zone_matched = false
+var zone_suffix = ""
 
 var output_count int64 = 0
 var input_count int64 = 0
@@ -90,16 +92,16 @@ func outputWriter(fd *os.File, c chan string) {
 func writeRecord(c_names chan string, name string, rtype string, value string) {
 	switch rtype {
 	case "ns":
-		c_names <- fmt.Sprintf("%s,%s,%s\n", name, rtype, value)
+		c_names <- fmt.Sprintf("%s,%s,%s%s\n", name, rtype, value, zone_suffix)
 
 	case "a":
 		if inetdata.MatchIPv4.Match([]byte(value)) {
-			c_names <- fmt.Sprintf("%s,%s,%s\n", name, rtype, value)
+			c_names <- fmt.Sprintf("%s,%s,%s%s\n", name, rtype, value, zone_suffix)
 		}
 
 	case "aaaa":
 		if inetdata.MatchIPv6.Match([]byte(value)) {
-			c_names <- fmt.Sprintf("%s,%s,%s\n", name, rtype, value)
+			c_names <- fmt.Sprintf("%s,%s,%s%s\n", name, rtype, value, zone_suffix)
 		}
 	}
 }
@@ -322,6 +324,7 @@ func main() {
 	os.Setenv("LC_ALL", "C")
 
 	flag.Usage = func() { usage() }
+	zone_date := flag.String("date", "", "The date of the zone file (YYYY-MM-DD), appended to each value for use with inetdata-dns2mtbl -M timeline")
 	version := flag.Bool("version", false, "Show the version and build timestamp")
 
 	flag.Parse()
@@ -331,6 +334,15 @@ func main() {
 		os.Exit(0)
 	}
 
+	if len(*zone_date) > 0 {
+		ts, e := time.Parse("2006-01-02", *zone_date)
+		if e != nil {
+			fmt.Fprintf(os.Stderr, "Error: invalid zone date %s: %s\n", *zone_date, e)
+			os.Exit(1)
+		}
+		zone_suffix = inetdata.TimelineSep + strconv.FormatInt(ts.Unix(), 10)
+	}
+
 	// Progress tracker
 	quit := make(chan int)
 	go showProgress(quit)
@@ -2,11 +2,14 @@ package main
 
 import (
 	"bytes"
+	"encoding/base64"
 	"encoding/json"
+	"flag"
 	"fmt"
 	"github.com/gorilla/mux"
 	"github.com/hdm/golang-mtbl"
 	"github.com/hdm/inetdata-parsers"
+	"io/ioutil"
 	"log"
 	"math"
 	"net"
@@ -14,148 +17,859 @@ import (
 	"os"
 	"path/filepath"
 	"runtime"
+	"sort"
+	"strconv"
 	"strings"
-	s "strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 var prefix *string
 var domain *string
 var cidr *string
+var max_results *int
 
-func findPaths() []string {
-	pathS, err := os.Getwd()
+// Key kinds of a dataset, which decide the queries it can answer
+const KEY_HOSTNAME = "reversed-hostname"
+const KEY_IP = "ip"
+const KEY_SHA1 = "sha1"
+const KEY_RAW = "raw"
+const KEY_ARIN = "arin"
+
+// KEY_ANY is only used by the default dataset, which answers every query
+const KEY_ANY = ""
+
+// Value formats of a dataset, values are detected when no format is given
+const VALUE_PAIRS = "pairs"
+const VALUE_TIMELINE = "timeline"
+const VALUE_JSON = "json"
+const VALUE_TEXT = "text"
+
+// dataset is a set of MTBL files with the same key and value format
+type dataset struct {
+	Name  string `json:"name"`
+	Glob  string `json:"glob"`
+	Key   string `json:"key"`
+	Value string `json:"value,omitempty"`
+}
+
+// datasetConfig is the format of the -config file
+type datasetConfig struct {
+	Datasets []*dataset `json:"datasets"`
+}
+
+// defaultDataset is used without a config file, it covers every file and
+// answers every query the way mapi did before datasets existed
+var defaultDataset = &dataset{Name: "default", Key: KEY_ANY}
+
+// loadDatasets reads and validates the dataset config
+func loadDatasets(path string) ([]*dataset, error) {
+	data, err := ioutil.ReadFile(path)
 	if err != nil {
-		panic(err)
+		return nil, err
+	}
+
+	var conf datasetConfig
+	if err := json.Unmarshal(data, &conf); err != nil {
+		return nil, fmt.Errorf("invalid config %s: %s", path, err)
+	}
+
+	if len(conf.Datasets) == 0 {
+		return nil, fmt.Errorf("no datasets defined in %s", path)
+	}
+
+	names := make(map[string]bool)
+	for _, ds := range conf.Datasets {
+		switch ds.Name {
+		case "":
+			return nil, fmt.Errorf("dataset with glob %q has no name", ds.Glob)
+		case "domain", "ip", "key", "whois":
+			// These would clash with the fan-out routes
+			return nil, fmt.Errorf("dataset name %s is reserved", ds.Name)
+		}
+
+		if names[ds.Name] {
+			return nil, fmt.Errorf("dataset %s is defined more than once", ds.Name)
+		}
+		names[ds.Name] = true
+
+		if len(ds.Glob) == 0 {
+			return nil, fmt.Errorf("dataset %s has no glob", ds.Name)
+		}
+		if _, err := filepath.Match(ds.Glob, ""); err != nil {
+			return nil, fmt.Errorf("dataset %s has an invalid glob %q: %s", ds.Name, ds.Glob, err)
+		}
+
+		switch ds.Key {
+		case KEY_HOSTNAME, KEY_IP, KEY_SHA1, KEY_RAW, KEY_ARIN:
+		default:
+			return nil, fmt.Errorf("dataset %s has an invalid key kind %q", ds.Name, ds.Key)
+		}
+
+		switch ds.Value {
+		case "", VALUE_PAIRS, VALUE_TIMELINE, VALUE_JSON, VALUE_TEXT:
+		default:
+			return nil, fmt.Errorf("dataset %s has an invalid value format %q", ds.Name, ds.Value)
+		}
+	}
+
+	return conf.Datasets, nil
+}
+
+// matches returns true if a file, named relative to the data directory, belongs
+// to the dataset
+func (ds *dataset) matches(name string) bool {
+	if len(ds.Glob) == 0 {
+		return true
+	}
+	ok, _ := filepath.Match(ds.Glob, filepath.ToSlash(name))
+	return ok
+}
+
+// supports returns true if the dataset has one of the key kinds
+func (ds *dataset) supports(kinds []string) bool {
+	if ds.Key == KEY_ANY {
+		return true
+	}
+	for _, k := range kinds {
+		if ds.Key == k {
+			return true
+		}
+	}
+	return false
+}
+
+// mtblFile is an open MTBL shared by every query until it is replaced or removed
+type mtblFile struct {
+	Name     string
+	Path     string
+	Dataset  *dataset
+	Size     int64
+	Modified time.Time
+	Loaded   time.Time
+	reader   *mtbl.Reader
+	encoded  bool
+	entries  int64
+	refs     int64
+	retired  int32
+	destroy  sync.Once
+}
+
+// datasetStatus describes a dataset and its files for the status endpoint
+type datasetStatus struct {
+	*dataset
+	Files []mtblFileStatus `json:"files"`
+}
+
+// mtblFileStatus describes a loaded file for the status endpoint
+type mtblFileStatus struct {
+	Name     string    `json:"name"`
+	Size     int64     `json:"size"`
+	Modified time.Time `json:"modified"`
+	Loaded   time.Time `json:"loaded"`
+	Entries  *int64    `json:"entries"`
+}
+
+// release drops a query reference, closing the reader if the file was retired
+func (f *mtblFile) release() {
+	if atomic.AddInt64(&f.refs, -1) == 0 && atomic.LoadInt32(&f.retired) == 1 {
+		f.close()
+	}
+}
+
+// retire closes the reader once the last query using it has finished
+func (f *mtblFile) retire() {
+	atomic.StoreInt32(&f.retired, 1)
+	if atomic.LoadInt64(&f.refs) == 0 {
+		f.close()
+	}
+}
+
+func (f *mtblFile) close() {
+	f.destroy.Do(func() { f.reader.Destroy() })
+}
+
+// countEntries walks the file in the background to fill in the entry count
+func (f *mtblFile) countEntries() {
+	var n int64
+	it := mtbl.IterAll(f.reader)
+	for {
+		if _, _, ok := it.Next(); !ok {
+			break
+		}
+		n++
+	}
+	it.Destroy()
+	atomic.StoreInt64(&f.entries, n)
+	f.release()
+}
+
+// mtblRegistry keeps every MTBL under the data directory open, polling for new,
+// replaced, and removed files
+type mtblRegistry struct {
+	dir      string
+	datasets []*dataset
+	ignored  map[string]bool
+	mu       sync.RWMutex
+	scanMu   sync.Mutex
+	files    []*mtblFile
+}
+
+func newMTBLRegistry(dir string, datasets []*dataset) *mtblRegistry {
+	reg := &mtblRegistry{dir: dir, datasets: datasets, ignored: make(map[string]bool)}
+	reg.scan()
+	return reg
+}
+
+// dataset returns the named dataset, or nil if there is none
+func (reg *mtblRegistry) dataset(name string) *dataset {
+	for _, ds := range reg.datasets {
+		if ds.Name == name {
+			return ds
+		}
+	}
+	return nil
+}
+
+// match returns the first dataset a file belongs to, or nil if there is none
+func (reg *mtblRegistry) match(name string) *dataset {
+	for _, ds := range reg.datasets {
+		if ds.matches(name) {
+			return ds
+		}
+	}
+	return nil
+}
+
+// acquire returns the current files sorted by name, each must be released
+func (reg *mtblRegistry) acquire() []*mtblFile {
+	reg.mu.RLock()
+	defer reg.mu.RUnlock()
+
+	files := make([]*mtblFile, len(reg.files))
+	copy(files, reg.files)
+	for _, f := range files {
+		atomic.AddInt64(&f.refs, 1)
+	}
+	return files
+}
+
+func (reg *mtblRegistry) release(files []*mtblFile) {
+	for _, f := range files {
+		f.release()
+	}
+}
+
+// watch rescans the data directory until the process exits
+func (reg *mtblRegistry) watch(interval time.Duration) {
+	for range time.Tick(interval) {
+		reg.scan()
 	}
-	var paths []string
+}
+
+// scan opens new and replaced files and swaps them in. Queries that are already
+// running keep using the readers they started with.
+func (reg *mtblRegistry) scan() {
+	reg.scanMu.Lock()
+	defer reg.scanMu.Unlock()
 
-	filepath.Walk(pathS, func(path string, f os.FileInfo, _ error) error {
-		if !f.IsDir() && s.HasSuffix(f.Name(), ".mtbl") {
-			paths = append(paths, path)
+	found := make(map[string]os.FileInfo)
+	filepath.Walk(reg.dir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() && strings.HasSuffix(info.Name(), ".mtbl") {
+			found[path] = info
 		}
 		return nil
 	})
-	return paths
+
+	reg.mu.RLock()
+	current := make(map[string]*mtblFile)
+	for _, f := range reg.files {
+		current[f.Path] = f
+	}
+	reg.mu.RUnlock()
+
+	files := []*mtblFile{}
+	for path, info := range found {
+		old := current[path]
+		if old != nil && old.Size == info.Size() && old.Modified.Equal(info.ModTime()) {
+			files = append(files, old)
+			continue
+		}
+
+		name, e := filepath.Rel(reg.dir, path)
+		if e != nil {
+			name = path
+		}
+
+		ds := reg.match(name)
+		if ds == nil {
+			if !reg.ignored[path] {
+				fmt.Fprintf(os.Stderr, "[-] Ignoring %s, it does not belong to any dataset\n", name)
+				reg.ignored[path] = true
+			}
+			continue
+		}
+
+		r, e := mtbl.ReaderInit(path, &mtbl.ReaderOptions{VerifyChecksums: true})
+		if e != nil {
+			// Files that are still being written fail to open, try again later
+			fmt.Fprintf(os.Stderr, "[-] Failed to load %s: %s\n", path, e)
+			if old != nil {
+				files = append(files, old)
+			}
+			continue
+		}
+
+		f := &mtblFile{
+			Name:     name,
+			Path:     path,
+			Dataset:  ds,
+			Size:     info.Size(),
+			Modified: info.ModTime(),
+			Loaded:   time.Now(),
+			reader:   r,
+			encoded:  inetdata.HasEncodedIPKeys(r),
+			entries:  -1,
+			refs:     1,
+		}
+		go f.countEntries()
+
+		files = append(files, f)
+		fmt.Fprintf(os.Stderr, "[*] Loaded %s into %s (%d bytes)\n", name, ds.Name, f.Size)
+	}
+
+	sort.Slice(files, func(i, j int) bool { return files[i].Name < files[j].Name })
+
+	reg.mu.Lock()
+	old := reg.files
+	reg.files = files
+	reg.mu.Unlock()
+
+	kept := make(map[*mtblFile]bool)
+	for _, f := range files {
+		kept[f] = true
+	}
+
+	for _, f := range old {
+		if !kept[f] {
+			fmt.Fprintf(os.Stderr, "[*] Unloaded %s\n", f.Name)
+			f.retire()
+		}
+	}
+}
+
+// status lists the datasets and their loaded files, entry counts are null until
+// they are known
+func (reg *mtblRegistry) status() []datasetStatus {
+	files := reg.acquire()
+	defer reg.release(files)
+
+	out := []datasetStatus{}
+	for _, ds := range reg.datasets {
+		dst := datasetStatus{dataset: ds, Files: []mtblFileStatus{}}
+		for _, f := range files {
+			if f.Dataset != ds {
+				continue
+			}
+			st := mtblFileStatus{Name: f.Name, Size: f.Size, Modified: f.Modified, Loaded: f.Loaded}
+			if n := atomic.LoadInt64(&f.entries); n >= 0 {
+				st.Entries = &n
+			}
+			dst.Files = append(dst.Files, st)
+		}
+		out = append(out, dst)
+	}
+	return out
 }
 
-var paths = findPaths()
+var registry *mtblRegistry
 
-func writeOutputR(key_bytes []byte, val_bytes []byte, w http.ResponseWriter) {
+// queryCursor marks the last record returned from a query, so that the next
+// page can resume after it
+type queryCursor struct {
+	File string `json:"f"`
+	Key  []byte `json:"k"`
+}
 
-	key := string(key_bytes)
-	val := string(val_bytes)
+// queryResult is a single record, values are decoded based on the value format
+// of the dataset. Fan-out queries label each record with its dataset.
+type queryResult struct {
+	Dataset string      `json:"dataset,omitempty"`
+	Key     string      `json:"key"`
+	Val     interface{} `json:"val"`
+}
 
-	key = inetdata.ReverseKey(key)
+// queryEnvelope wraps the results of a query in the JSON envelope format
+type queryEnvelope struct {
+	Results    []queryResult `json:"results"`
+	Count      int           `json:"count"`
+	Truncated  bool          `json:"truncated"`
+	NextCursor string        `json:"next_cursor,omitempty"`
+}
 
-	o := make(map[string]interface{})
-	v := make([][]string, 1)
+// resultWriter sends matching records to the client, stopping at the result
+// limit and resuming after the request cursor
+type resultWriter struct {
+	w         http.ResponseWriter
+	enc       *json.Encoder
+	envelope  bool
+	limit     int
+	count     int
+	file      string
+	dataset   *dataset
+	label     bool
+	resume    *queryCursor
+	seek      []byte
+	skip      []byte
+	last      queryCursor
+	done      bool
+	truncated bool
+	results   []queryResult
+}
 
-	if de := json.Unmarshal([]byte(val), &v); de != nil {
-		fmt.Fprintf(os.Stderr, "Could not unmarshal %s -> %s as json: %s\n", key, val, de)
-		o["key"] = string(key)
-		o["val"] = string(val)
-		json.NewEncoder(w).Encode(o)
-		return
+func newResultWriter(w http.ResponseWriter, req *http.Request) (*resultWriter, error) {
+	q := req.URL.Query()
+	rw := &resultWriter{w: w, limit: *max_results}
+
+	if v := q.Get("limit"); len(v) > 0 {
+		limit, e := strconv.Atoi(v)
+		if e != nil || limit < 1 {
+			return nil, fmt.Errorf("invalid limit: %s", v)
+		}
+		if limit < rw.limit {
+			rw.limit = limit
+		}
 	}
 
-	o["key"] = string(key)
-	o["val"] = v
+	if v := q.Get("cursor"); len(v) > 0 {
+		raw, e := base64.RawURLEncoding.DecodeString(v)
+		if e != nil {
+			return nil, fmt.Errorf("invalid cursor: %s", v)
+		}
+		rw.resume = &queryCursor{}
+		if e := json.Unmarshal(raw, rw.resume); e != nil {
+			return nil, fmt.Errorf("invalid cursor: %s", v)
+		}
+	}
+
+	switch q.Get("format") {
+	case "json":
+		rw.envelope = true
+	case "ndjson":
+	case "":
+		rw.envelope = strings.Contains(req.Header.Get("Accept"), "application/json")
+	default:
+		return nil, fmt.Errorf("invalid format: %s", q.Get("format"))
+	}
+
+	if rw.envelope {
+		w.Header().Set("Content-Type", "application/json")
+		rw.results = []queryResult{}
+	} else {
+		// Streams can not be framed, the paging state is sent as trailers
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.Header().Set("Trailer", "X-Truncated, X-Next-Cursor")
+		rw.enc = json.NewEncoder(w)
+	}
 
-	json.NewEncoder(w).Encode(o)
+	return rw, nil
 }
 
-func writeOutput(key_bytes []byte, val_bytes []byte, w http.ResponseWriter) {
+// openFile is called before each file is searched and returns false if the
+// file should be skipped. Files are searched in name order.
+func (rw *resultWriter) openFile(f *mtblFile) bool {
+	rw.file = f.Name
+	rw.dataset = f.Dataset
+	rw.seek = nil
+	rw.skip = nil
+
+	if rw.resume != nil {
+		if f.Name < rw.resume.File {
+			return false
+		}
+		// The search continues from the cursor key, if the cursor file is gone
+		// the data has changed since and the next file is searched in full
+		if f.Name == rw.resume.File {
+			rw.seek = rw.resume.Key
+			rw.skip = rw.resume.Key
+		}
+		rw.resume = nil
+	}
+
+	return !rw.done
+}
+
+// iterPrefix returns an iterator over the keys starting with the prefix. When
+// resuming, the iterator starts at the cursor key and may return the first key
+// past the prefix, callers stop at the first key without the prefix.
+func (rw *resultWriter) iterPrefix(r *mtbl.Reader, prefix []byte) *mtbl.Iter {
+	last := prefixLimit(prefix)
+	if rw.seek == nil || last == nil {
+		return mtbl.IterPrefix(r, prefix)
+	}
+	return rw.iterRange(r, prefix, last)
+}
+
+// iterRange returns an iterator over the keys from first to last, starting at
+// the cursor key instead when resuming past the first key
+func (rw *resultWriter) iterRange(r *mtbl.Reader, first []byte, last []byte) *mtbl.Iter {
+	if rw.seek != nil {
+		if bytes.Compare(rw.seek, first) > 0 {
+			first = rw.seek
+		}
+		rw.seek = nil
+	}
+	return mtbl.IterRange(r, first, last)
+}
+
+// prefixLimit returns the first key after all keys starting with the prefix, or
+// nil if the prefix has no upper bound
+func prefixLimit(prefix []byte) []byte {
+	for i := len(prefix) - 1; i >= 0; i-- {
+		if prefix[i] != 0xff {
+			last := append([]byte{}, prefix[:i+1]...)
+			last[i]++
+			return last
+		}
+	}
+	return nil
+}
+
+// add sends a record to the client and returns false once no more records
+// are wanted. Domain keys are reversed, binary IP keys are decoded.
+func (rw *resultWriter) add(key_bytes []byte, val_bytes []byte, reverse bool) bool {
+	if rw.done {
+		return false
+	}
+
+	// The cursor key was sent with the previous page
+	if rw.skip != nil {
+		skip := bytes.Equal(key_bytes, rw.skip)
+		rw.skip = nil
+		if skip {
+			return true
+		}
+	}
+
+	// One more record than the limit means the results were cut short
+	if rw.count >= rw.limit {
+		rw.truncated = true
+		rw.done = true
+		return false
+	}
 
 	key := string(key_bytes)
-	val := string(val_bytes)
+	if reverse {
+		key = inetdata.ReverseKey(key)
+	} else if ip, ok := inetdata.DecodeIPKey(key_bytes); ok {
+		key = ip
+	}
 
-	o := make(map[string]interface{})
-	v := make([][]string, 1)
+	o := queryResult{Key: key, Val: decodeValue(rw.dataset.Value, val_bytes)}
+	if rw.label {
+		o.Dataset = rw.dataset.Name
+	}
+
+	if rw.envelope {
+		rw.results = append(rw.results, o)
+	} else if e := rw.enc.Encode(o); e != nil {
+		// The client went away
+		rw.done = true
+		return false
+	}
 
-	if de := json.Unmarshal([]byte(val), &v); de != nil {
-		fmt.Fprintf(w, "%s\n", val)
+	rw.count++
+	rw.last = queryCursor{File: rw.file, Key: append([]byte{}, key_bytes...)}
+	return true
+}
+
+// decodeValue converts a value to its output form. Values that do not match the
+// format, or with no format given, are returned as [][]string arrays, raw JSON,
+// or strings, whichever fits first.
+func decodeValue(format string, val_bytes []byte) interface{} {
+	switch format {
+	case VALUE_TEXT:
+		return string(val_bytes)
+	case VALUE_JSON:
+		if json.Valid(val_bytes) {
+			return json.RawMessage(val_bytes)
+		}
+		return string(val_bytes)
+	case VALUE_TIMELINE:
+		if t, ok := timelineOutput(val_bytes); ok {
+			return t
+		}
+	}
+
+	var v [][]string
+	if de := json.Unmarshal(val_bytes, &v); de == nil {
+		return v
+	}
+	if json.Valid(val_bytes) {
+		return json.RawMessage(val_bytes)
+	}
+	return string(val_bytes)
+}
+
+// timelineOutput expands the entries of a timeline value into named fields
+func timelineOutput(val_bytes []byte) ([]map[string]interface{}, bool) {
+	var entries []inetdata.TimelineEntry
+	if e := json.Unmarshal(val_bytes, &entries); e != nil {
+		return nil, false
+	}
+
+	out := []map[string]interface{}{}
+	for _, e := range entries {
+		out = append(out, map[string]interface{}{
+			"type":       e.Type,
+			"value":      e.Value,
+			"first_seen": e.FirstSeen,
+			"last_seen":  e.LastSeen,
+			"count":      e.Count,
+		})
+	}
+	return out, true
+}
+
+// finish completes the response with the paging state
+func (rw *resultWriter) finish() {
+	cursor := ""
+	if rw.truncated {
+		raw, _ := json.Marshal(rw.last)
+		cursor = base64.RawURLEncoding.EncodeToString(raw)
+	}
+
+	if !rw.envelope {
+		rw.w.Header().Set("X-Truncated", strconv.FormatBool(rw.truncated))
+		rw.w.Header().Set("X-Next-Cursor", cursor)
 		return
 	}
 
-	o["key"] = string(key)
-	o["val"] = v
+	json.NewEncoder(rw.w).Encode(queryEnvelope{
+		Results:    rw.results,
+		Count:      rw.count,
+		Truncated:  rw.truncated,
+		NextCursor: cursor,
+	})
+}
 
-	json.NewEncoder(w).Encode(o)
+func showStatus(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"datasets": registry.status()})
 }
 
-func searchDomain(w http.ResponseWriter, req *http.Request) {
-	params := mux.Vars(req)
-	rdomain := []byte(inetdata.ReverseKey(params["id"]))
+// searchFunc runs a query against the selected files. An invalid query is
+// reported before any results are sent.
+type searchFunc func(rw *resultWriter, files []*mtblFile, params map[string]string) error
 
-	for i := range paths {
+// queryHandler serves a query against the dataset named in the route, or against
+// every dataset with one of the key kinds when no dataset is named
+func queryHandler(search searchFunc, label bool, kinds ...string) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		params := mux.Vars(req)
 
-		path := paths[i]
+		name, named := params["dataset"]
+		if named {
+			ds := registry.dataset(name)
+			if ds == nil {
+				http.Error(w, fmt.Sprintf("unknown dataset: %s", name), http.StatusNotFound)
+				return
+			}
+			if !ds.supports(kinds) {
+				http.Error(w, fmt.Sprintf("dataset %s has %s keys and does not support this query", name, ds.Key), http.StatusBadRequest)
+				return
+			}
+		}
 
-		r, e := mtbl.ReaderInit(path, &mtbl.ReaderOptions{VerifyChecksums: true})
+		files := registry.acquire()
+		defer registry.release(files)
+
+		selected := []*mtblFile{}
+		for _, f := range files {
+			if named && f.Dataset.Name == name || !named && f.Dataset.supports(kinds) {
+				selected = append(selected, f)
+			}
+		}
+
+		rw, e := newResultWriter(w, req)
 		if e != nil {
-			fmt.Fprintf(os.Stderr, "Error reading %s: %s\n", path, e)
+			http.Error(w, e.Error(), http.StatusBadRequest)
+			return
+		}
+		rw.label = label && !named
+
+		if e := search(rw, selected, params); e != nil {
+			http.Error(w, e.Error(), http.StatusBadRequest)
+			return
+		}
+		rw.finish()
+	}
+}
+
+func searchDomain(rw *resultWriter, files []*mtblFile, params map[string]string) error {
+	rdomain := []byte(inetdata.ReverseKey(params["id"]))
+
+	for _, f := range files {
+
+		if !rw.openFile(f) {
 			continue
 		}
-		defer r.Destroy()
+
+		r := f.reader
 
 		dot_rdomain := append(rdomain, '.')
-		it := mtbl.IterPrefix(r, rdomain)
+		it := rw.iterPrefix(r, rdomain)
 		for {
 			key_bytes, val_bytes, ok := it.Next()
-			if !ok {
+			if !ok || !bytes.HasPrefix(key_bytes, rdomain) {
 				break
 			}
 
 			if bytes.Compare(key_bytes, rdomain) == 0 ||
 				bytes.Compare(key_bytes[0:len(dot_rdomain)], dot_rdomain) == 0 {
-				writeOutputR(key_bytes, val_bytes, w)
+				if !rw.add(key_bytes, val_bytes, true) {
+					break
+				}
 			}
 		}
+		it.Destroy()
 	}
+	return nil
 }
 
-func searchPrefixIPv4(w http.ResponseWriter, req *http.Request) {
-	params := mux.Vars(req)
+func searchPrefixIPv4(rw *resultWriter, files []*mtblFile, params map[string]string) error {
 	prefix := []byte(params["ip"])
 
-	for i := range paths {
+	for _, f := range files {
 
-		path := paths[i]
+		if !rw.openFile(f) {
+			continue
+		}
 
-		r, e := mtbl.ReaderInit(path, &mtbl.ReaderOptions{VerifyChecksums: true})
-		if e != nil {
-			fmt.Fprintf(os.Stderr, "Error reading %s: %s\n", path, e)
+		r := f.reader
+
+		// Look up complete addresses directly when keys are binary-encoded
+		if f.encoded {
+			if ip_key, ok := inetdata.EncodeIPKey(string(prefix)); ok {
+				if val_bytes, found := mtbl.Get(r, ip_key); found {
+					rw.add(ip_key, val_bytes, false)
+				}
+				continue
+			}
+		}
+
+		it := rw.iterPrefix(r, prefix)
+		for {
+			key_bytes, val_bytes, ok := it.Next()
+			if !ok || !bytes.HasPrefix(key_bytes, prefix) {
+				break
+			}
+			if !rw.add(key_bytes, val_bytes, false) {
+				break
+			}
+		}
+		it.Destroy()
+	}
+	return nil
+}
+
+// searchKey returns the records with keys starting with the given prefix, SHA-1
+// fingerprints are matched in lowercase
+func searchKey(rw *resultWriter, files []*mtblFile, params map[string]string) error {
+	for _, f := range files {
+
+		if !rw.openFile(f) {
 			continue
 		}
-		defer r.Destroy()
 
-		it := mtbl.IterPrefix(r, []byte(prefix))
+		prefix := []byte(params["id"])
+		if f.Dataset.Key == KEY_SHA1 {
+			prefix = bytes.ToLower(prefix)
+		}
+
+		it := rw.iterPrefix(f.reader, prefix)
 		for {
 			key_bytes, val_bytes, ok := it.Next()
-			if !ok {
+			if !ok || !bytes.HasPrefix(key_bytes, prefix) {
+				break
+			}
+			if !rw.add(key_bytes, val_bytes, false) {
 				break
 			}
-			writeOutput(key_bytes, val_bytes, w)
 		}
+		it.Destroy()
 	}
+	return nil
 }
 
-func cidrPrefixIPv4(r *mtbl.Reader, prefix string, w http.ResponseWriter) {
-	it := mtbl.IterPrefix(r, []byte(prefix))
+// searchWhois looks up an ARIN handle, IP address, or AS number in MTBLs built
+// by inetdata-arin-json2mtbl, returning the joined records
+func searchWhois(rw *resultWriter, files []*mtblFile, params map[string]string) error {
+	query := params["id"]
+
+	for _, f := range files {
+
+		if !rw.openFile(f) {
+			continue
+		}
+
+		res, ok := inetdata.LookupARINWhois(f.reader, query, rw.limit)
+		if !ok {
+			continue
+		}
+
+		val_bytes, e := json.Marshal(res)
+		if e != nil {
+			fmt.Fprintf(os.Stderr, "[-] Could not marshal whois result for %s: %s\n", query, e)
+			continue
+		}
+
+		if !rw.add([]byte(query), val_bytes, false) {
+			break
+		}
+	}
+	return nil
+}
+
+func cidrPrefixIPv4(r *mtbl.Reader, prefix string, rw *resultWriter) bool {
+	it := rw.iterPrefix(r, []byte(prefix))
+	defer it.Destroy()
 	for {
 		key_bytes, val_bytes, ok := it.Next()
-		if !ok {
+		if !ok || !bytes.HasPrefix(key_bytes, []byte(prefix)) {
 			break
 		}
 
 		if inetdata.MatchIPv4.Match(key_bytes) {
-			writeOutput(key_bytes, val_bytes, w)
+			if !rw.add(key_bytes, val_bytes, false) {
+				return false
+			}
 		}
 	}
+	return true
 }
 
-func searchCIDR(w http.ResponseWriter, req *http.Request) {
-	params := mux.Vars(req)
+func cidrRangeEncoded(r *mtbl.Reader, ipnet *net.IPNet, rw *resultWriter) {
+	first, last := inetdata.IPKeyRange(ipnet)
+	if first == nil {
+		return
+	}
+
+	it := rw.iterRange(r, first, last)
+	defer it.Destroy()
+	for {
+		key_bytes, val_bytes, ok := it.Next()
+		if !ok {
+			break
+		}
+		if !rw.add(key_bytes, val_bytes, false) {
+			break
+		}
+	}
+}
+
+func searchCIDR(rw *resultWriter, files []*mtblFile, params map[string]string) error {
 	ip := string(params["ip"])
 	cidr := string(params["id"])
 	cidr = ip + "/" + cidr
@@ -163,21 +877,30 @@ func searchCIDR(w http.ResponseWriter, req *http.Request) {
 	// Parse CIDR into base address + mask
 	ip2, net2, err := net.ParseCIDR(cidr)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Invalid CIDR %s: %s\n", cidr, err.Error())
-		return
+		return fmt.Errorf("Invalid CIDR %s: %s", cidr, err.Error())
 	}
 
-	// Verify IPv4 for now
+	// IPv6 networks can only be searched with binary-encoded keys
 	ip4 := net2.IP.To4()
 	if ip4 == nil {
-		fmt.Fprintf(os.Stderr, "Invalid IPv4 CIDR %s\n", cidr)
-		return
+		for _, f := range files {
+
+			if !rw.openFile(f) {
+				continue
+			}
+
+			r := f.reader
+
+			if f.encoded {
+				cidrRangeEncoded(r, net2, rw)
+			}
+		}
+		return nil
 	}
 
 	net_base, err := inetdata.IPv42UInt(net2.IP.String())
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Invalid IPv4 Address %s: %s\n", ip2.String(), err.Error())
-		return
+		return fmt.Errorf("Invalid IPv4 Address %s: %s", ip2.String(), err.Error())
 	}
 
 	mask_ones, mask_total := net2.Mask.Size()
@@ -185,7 +908,6 @@ func searchCIDR(w http.ResponseWriter, req *http.Request) {
 	// Does not work for IPv6 due to cast to uint32
 	net_size := uint32(math.Pow(2, float64(mask_total-mask_ones)))
 
-	cur_base := net_base
 	end_base := net_base + net_size - 1
 
 	var ndots uint32 = 3
@@ -200,28 +922,47 @@ func searchCIDR(w http.ResponseWriter, req *http.Request) {
 		block_size = 256 * 256
 	}
 
-	for i := range paths {
+	for _, f := range files {
 
-		path := paths[i]
-		r, e := mtbl.ReaderInit(path, &mtbl.ReaderOptions{VerifyChecksums: true})
-		if e != nil {
-			fmt.Fprintf(os.Stderr, "Error reading %s: %s\n", path, e)
+		if !rw.openFile(f) {
+			continue
+		}
+
+		r := f.reader
+
+		// Binary-encoded keys can be scanned as a single range
+		if f.encoded {
+			cidrRangeEncoded(r, net2, rw)
 			continue
 		}
-		defer r.Destroy()
+
+		// Each file is searched from the start of the network, or from the block
+		// holding the cursor key when resuming
+		cur_base := net_base
+		if rw.seek != nil {
+			if seek_val, e := inetdata.IPv42UInt(string(rw.seek)); e == nil && seek_val > net_base && seek_val <= end_base {
+				cur_base += (seek_val - net_base) / block_size * block_size
+			}
+		}
+		more := true
+
 		// Iterate by block size
-		for ; (end_base - cur_base + 1) >= block_size; cur_base += block_size {
+		for ; more && (end_base-cur_base+1) >= block_size; cur_base += block_size {
 			ip_prefix := strings.Join(strings.SplitN(inetdata.UInt2IPv4(cur_base), ".", 4)[0:ndots], ".") + "."
-			cidrPrefixIPv4(r, ip_prefix, w)
+			more = cidrPrefixIPv4(r, ip_prefix, rw)
+		}
+
+		if !more {
+			continue
 		}
 
 		// Handle any leftovers by looking up a full /24 and ignoring stuff outside our range
 		ip_prefix := strings.Join(strings.SplitN(inetdata.UInt2IPv4(cur_base), ".", 4)[0:3], ".") + "."
 
-		it := mtbl.IterPrefix(r, []byte(ip_prefix))
+		it := rw.iterPrefix(r, []byte(ip_prefix))
 		for {
 			key_bytes, val_bytes, ok := it.Next()
-			if !ok {
+			if !ok || !bytes.HasPrefix(key_bytes, []byte(ip_prefix)) {
 				break
 			}
 
@@ -229,11 +970,51 @@ func searchCIDR(w http.ResponseWriter, req *http.Request) {
 			cur_val, _ := inetdata.IPv42UInt(string(key_bytes))
 			if cur_val >= cur_base && cur_val <= end_base {
 				if inetdata.MatchIPv4.Match(key_bytes) {
-					writeOutput(key_bytes, val_bytes, w)
+					if !rw.add(key_bytes, val_bytes, false) {
+						break
+					}
 				}
 			}
 		}
+		it.Destroy()
 	}
+	return nil
+}
+
+func usage() {
+	fmt.Println("Usage: " + os.Args[0] + " [options]")
+	fmt.Println("")
+	fmt.Println("Serves queries against the MTBL databases in the data directory over HTTP. Files are")
+	fmt.Println("opened once and the directory is rescanned to pick up new, replaced, and removed files.")
+	fmt.Println("A file should be written elsewhere and renamed into place once complete.")
+	fmt.Println("")
+	fmt.Println("Datasets are declared in the -config file, each with a glob matched against file names")
+	fmt.Println("relative to the data directory, a key kind (reversed-hostname, ip, sha1, raw, or arin), and")
+	fmt.Println("an optional value format (pairs, timeline, json, or text). Files belong to the first")
+	fmt.Println("dataset they match, other files are ignored. For example:")
+	fmt.Println("")
+	fmt.Println(`  {"datasets": [`)
+	fmt.Println(`    {"name": "fdns", "glob": "*-fdns.mtbl", "key": "reversed-hostname", "value": "pairs"},`)
+	fmt.Println(`    {"name": "rdns", "glob": "*-rdns.mtbl", "key": "ip", "value": "pairs"}`)
+	fmt.Println(`  ]}`)
+	fmt.Println("")
+	fmt.Println("Routes:")
+	fmt.Println("  /v1/{dataset}/domain/{domain}    /v1/domain/{domain}")
+	fmt.Println("  /v1/{dataset}/ip/{ip-prefix}     /v1/ip/{ip-prefix}")
+	fmt.Println("  /v1/{dataset}/ip/{ip}/{mask}     /v1/ip/{ip}/{mask}")
+	fmt.Println("  /v1/{dataset}/key/{key-prefix}   /v1/key/{key-prefix}")
+	fmt.Println("  /v1/{dataset}/whois/{query}      /v1/whois/{query}")
+	fmt.Println("  /status")
+	fmt.Println("")
+	fmt.Println("Routes without a dataset search every dataset with a compatible key kind and label each")
+	fmt.Println("result with its dataset.")
+	fmt.Println("")
+	fmt.Println("Queries accept limit and cursor parameters. Results are streamed as NDJSON, with")
+	fmt.Println("the X-Truncated and X-Next-Cursor trailers, or returned in a JSON envelope with")
+	fmt.Println("format=json or an Accept header of application/json.")
+	fmt.Println("")
+	fmt.Println("Options:")
+	flag.PrintDefaults()
 }
 
 func main() {
@@ -241,10 +1022,63 @@ func main() {
 	runtime.GOMAXPROCS(runtime.NumCPU())
 	os.Setenv("LC_ALL", "C")
 
+	flag.Usage = func() { usage() }
+
+	max_results = flag.Int("max-results", 10000, "The maximum number of results returned by a single query")
+	data_dir := flag.String("d", ".", "The directory containing the MTBL files to serve")
+	config := flag.String("config", "", "The JSON file declaring the datasets to serve (all files are served as one dataset by default)")
+	reload := flag.Duration("reload", 30*time.Second, "How often to rescan the data directory for changed files (0 to disable)")
+	version := flag.Bool("version", false, "Show the version and build timestamp")
+
+	flag.Parse()
+
+	if *version {
+		inetdata.PrintVersion("mapi")
+		os.Exit(0)
+	}
+
+	if *max_results < 1 {
+		fmt.Fprintf(os.Stderr, "Error: -max-results must be at least 1\n")
+		os.Exit(1)
+	}
+
+	datasets := []*dataset{defaultDataset}
+	if len(*config) > 0 {
+		var e error
+		datasets, e = loadDatasets(*config)
+		if e != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s\n", e)
+			os.Exit(1)
+		}
+	}
+
+	registry = newMTBLRegistry(*data_dir, datasets)
+	if *reload > 0 {
+		go registry.watch(*reload)
+	}
+
 	router := mux.NewRouter()
-	router.HandleFunc("/domain/{id}", searchDomain).Methods("GET")
-	router.HandleFunc("/ip/{ip}", searchPrefixIPv4).Methods("GET")
-	router.HandleFunc("/ip/{ip}/{id}", searchCIDR).Methods("GET")
-	// TODO: router.HandleFunc("/whois/{id}", searchAll).Methods("GET")
+	router.HandleFunc("/status", showStatus).Methods("GET")
+
+	// Dataset routes come first, so that a dataset named like an address is not
+	// mistaken for a CIDR query
+	router.HandleFunc("/v1/{dataset}/domain/{id}", queryHandler(searchDomain, true, KEY_HOSTNAME)).Methods("GET")
+	router.HandleFunc("/v1/{dataset}/ip/{ip}", queryHandler(searchPrefixIPv4, true, KEY_IP)).Methods("GET")
+	router.HandleFunc("/v1/{dataset}/ip/{ip}/{id}", queryHandler(searchCIDR, true, KEY_IP)).Methods("GET")
+	router.HandleFunc("/v1/{dataset}/key/{id}", queryHandler(searchKey, true, KEY_SHA1, KEY_RAW)).Methods("GET")
+	router.HandleFunc("/v1/{dataset}/whois/{id}", queryHandler(searchWhois, true, KEY_ARIN)).Methods("GET")
+
+	// Fan-out routes search every compatible dataset and label the results
+	router.HandleFunc("/v1/domain/{id}", queryHandler(searchDomain, true, KEY_HOSTNAME)).Methods("GET")
+	router.HandleFunc("/v1/ip/{ip}", queryHandler(searchPrefixIPv4, true, KEY_IP)).Methods("GET")
+	router.HandleFunc("/v1/ip/{ip}/{id}", queryHandler(searchCIDR, true, KEY_IP)).Methods("GET")
+	router.HandleFunc("/v1/key/{id}", queryHandler(searchKey, true, KEY_SHA1, KEY_RAW)).Methods("GET")
+	router.HandleFunc("/v1/whois/{id}", queryHandler(searchWhois, true, KEY_ARIN)).Methods("GET")
+
+	// Unversioned routes fan out without labels, as they did before datasets
+	router.HandleFunc("/domain/{id}", queryHandler(searchDomain, false, KEY_HOSTNAME)).Methods("GET")
+	router.HandleFunc("/ip/{ip}", queryHandler(searchPrefixIPv4, false, KEY_IP)).Methods("GET")
+	router.HandleFunc("/ip/{ip}/{id}", queryHandler(searchCIDR, false, KEY_IP)).Methods("GET")
+	router.HandleFunc("/whois/{id}", queryHandler(searchWhois, false, KEY_ARIN)).Methods("GET")
 	log.Fatal(http.ListenAndServe(":8091", router))
 }
@@ -9,6 +9,7 @@ import (
 	"github.com/hdm/inetdata-parsers"
 	"io/ioutil"
 	"math"
+	"math/big"
 	"net"
 	"os"
 	"runtime"
@@ -25,6 +26,7 @@ var as_json *bool
 var version *bool
 var domain *string
 var cidr *string
+var merge *bool
 
 func usage() {
 	fmt.Println("Usage: " + os.Args[0] + " [options] <mtbl> ... <mtbl>")
@@ -69,7 +71,10 @@ func writeOutput(key_bytes []byte, val_bytes []byte) {
 	key := string(key_bytes)
 	val := string(val_bytes)
 
-	if *rev_key {
+	// Binary-encoded IP keys are converted back to text and never reversed
+	if ip, ok := inetdata.DecodeIPKey(key_bytes); ok {
+		key = ip
+	} else if *rev_key {
 		key = inetdata.ReverseKey(key)
 	}
 
@@ -78,13 +83,18 @@ func writeOutput(key_bytes []byte, val_bytes []byte) {
 		v := make([][]string, 1)
 
 		if de := json.Unmarshal([]byte(val), &v); de != nil {
-			fmt.Fprintf(os.Stderr, "Could not unmarshal %s -> %s as json: %s\n", key, val, de)
-			return
+			t, ok := timelineOutput(val_bytes)
+			if !ok {
+				fmt.Fprintf(os.Stderr, "Could not unmarshal %s -> %s as json: %s\n", key, val, de)
+				return
+			}
+			o["key"] = string(key)
+			o["val"] = t
+		} else {
+			o["key"] = string(key)
+			o["val"] = v
 		}
 
-		o["key"] = string(key)
-		o["val"] = v
-
 		b, je := json.Marshal(o)
 		if je != nil {
 			fmt.Fprintf(os.Stderr, "Could not marshal %s -> %s as json: %s\n", key, val, je)
@@ -109,7 +119,27 @@ func writeOutput(key_bytes []byte, val_bytes []byte) {
 	}
 }
 
-func searchPrefix(r *mtbl.Reader, prefix string) {
+// timelineOutput expands the entries of a timeline value into named fields
+func timelineOutput(val_bytes []byte) ([]map[string]interface{}, bool) {
+	var entries []inetdata.TimelineEntry
+	if e := json.Unmarshal(val_bytes, &entries); e != nil {
+		return nil, false
+	}
+
+	out := []map[string]interface{}{}
+	for _, e := range entries {
+		out = append(out, map[string]interface{}{
+			"type":       e.Type,
+			"value":      e.Value,
+			"first_seen": e.FirstSeen,
+			"last_seen":  e.LastSeen,
+			"count":      e.Count,
+		})
+	}
+	return out, true
+}
+
+func searchPrefix(r mtbl.Source, prefix string) {
 	it := mtbl.IterPrefix(r, []byte(prefix))
 	for {
 		key_bytes, val_bytes, ok := it.Next()
@@ -120,7 +150,34 @@ func searchPrefix(r *mtbl.Reader, prefix string) {
 	}
 }
 
-func searchAll(r *mtbl.Reader) {
+// checkMergeKeys rejects merges of files with binary-encoded IP keys and files
+// with text keys, since IP searches use one key format for the whole merge and
+// the same address in both formats would never be combined. Empty files match
+// either format.
+func checkMergeKeys(readers []*mtbl.Reader, paths []string) error {
+	encoded, text := "", ""
+	for i := range readers {
+		it := mtbl.IterAll(readers[i])
+		_, _, ok := it.Next()
+		it.Destroy()
+		if !ok {
+			continue
+		}
+
+		if inetdata.HasEncodedIPKeys(readers[i]) {
+			encoded = paths[i]
+		} else {
+			text = paths[i]
+		}
+	}
+
+	if len(encoded) > 0 && len(text) > 0 {
+		return fmt.Errorf("-merge can not combine %s, which has binary-encoded IP keys, with %s, which has text keys", encoded, text)
+	}
+	return nil
+}
+
+func searchAll(r mtbl.Source) {
 	it := mtbl.IterAll(r)
 	for {
 		key_bytes, val_bytes, ok := it.Next()
@@ -131,7 +188,7 @@ func searchAll(r *mtbl.Reader) {
 	}
 }
 
-func searchDomain(r *mtbl.Reader, domain string) {
+func searchDomain(r mtbl.Source, domain string) {
 	rdomain := []byte(inetdata.ReverseKey(domain))
 
 	// Domain searches always use reversed keys
@@ -152,7 +209,7 @@ func searchDomain(r *mtbl.Reader, domain string) {
 	}
 }
 
-func searchPrefixIPv4(r *mtbl.Reader, prefix string) {
+func searchPrefixIPv4(r mtbl.Source, prefix string) {
 	it := mtbl.IterPrefix(r, []byte(prefix))
 	for {
 		key_bytes, val_bytes, ok := it.Next()
@@ -166,7 +223,7 @@ func searchPrefixIPv4(r *mtbl.Reader, prefix string) {
 	}
 }
 
-func searchCIDR(r *mtbl.Reader, cidr string) {
+func searchCIDR(r mtbl.Source, cidr string) {
 
 	if len(cidr) == 0 {
 		return
@@ -188,10 +245,16 @@ func searchCIDR(r *mtbl.Reader, cidr string) {
 		return
 	}
 
-	// Verify IPv4 for now
+	// Binary-encoded keys can be scanned as a single range
+	if inetdata.HasEncodedIPKeys(r) {
+		searchIPKeyRange(r, net)
+		return
+	}
+
+	// IPv6 networks are handled by a separate 128-bit range walk
 	ip4 := net.IP.To4()
 	if ip4 == nil {
-		fmt.Fprintf(os.Stderr, "Invalid IPv4 CIDR %s\n", cidr)
+		searchCIDR6(r, net)
 		return
 	}
 
@@ -247,6 +310,147 @@ func searchCIDR(r *mtbl.Reader, cidr string) {
 	}
 }
 
+func searchIPKeyRange(r mtbl.Source, ipnet *net.IPNet) {
+	first, last := inetdata.IPKeyRange(ipnet)
+	if first == nil {
+		return
+	}
+
+	it := mtbl.IterRange(r, first, last)
+	for {
+		key_bytes, val_bytes, ok := it.Next()
+		if !ok {
+			break
+		}
+		writeOutput(key_bytes, val_bytes)
+	}
+}
+
+func searchPrefixIPv6(r mtbl.Source, prefix string, ipnet *net.IPNet) {
+	var it *mtbl.Iter
+	if len(prefix) == 0 {
+		it = mtbl.IterAll(r)
+	} else {
+		it = mtbl.IterPrefix(r, []byte(prefix))
+	}
+
+	for {
+		key_bytes, val_bytes, ok := it.Next()
+		if !ok {
+			break
+		}
+
+		// Only print results that are valid IPv6 addresses within our CIDR range
+		if !inetdata.MatchIPv6.Match(key_bytes) {
+			continue
+		}
+
+		ip := net.ParseIP(string(key_bytes))
+		if ip != nil && ipnet.Contains(ip) {
+			writeOutput(key_bytes, val_bytes)
+		}
+	}
+}
+
+// ipv6Prefixes returns the textual key prefixes that cover every address in the
+// block starting at base that shares the first nhex hextets. IPv6 keys are stored
+// in compressed form, so the prefix stops at the first zero hextet, since that
+// hextet may have been folded into a "::" sequence.
+func ipv6Prefixes(base *big.Int, nhex int) []string {
+	ipb := make([]byte, 16)
+	b := base.Bytes()
+	copy(ipb[16-len(b):], b)
+
+	hextets := []string{}
+	for i := 0; i < nhex; i++ {
+		h := uint16(ipb[i*2])<<8 | uint16(ipb[i*2+1])
+		if h == 0 {
+			break
+		}
+		hextets = append(hextets, fmt.Sprintf("%x", h))
+	}
+
+	if len(hextets) == 0 {
+		if nhex == 0 {
+			return []string{""}
+		}
+		// A leading zero hextet is either compressed or written as a bare zero
+		return []string{"::", "0:"}
+	}
+
+	return []string{strings.Join(hextets, ":") + ":"}
+}
+
+func searchCIDR6(r mtbl.Source, ipnet *net.IPNet) {
+
+	mask_ones, mask_total := ipnet.Mask.Size()
+
+	// Search by the leading hextets that are fixed within each block, the final
+	// hextet is never included since a prefix must end with a separator
+	nhex := (mask_ones + 15) / 16
+	if nhex > 7 {
+		nhex = 7
+	}
+
+	block_size := new(big.Int).Lsh(big.NewInt(1), uint(mask_total-(nhex*16)))
+	net_size := new(big.Int).Lsh(big.NewInt(1), uint(mask_total-mask_ones))
+
+	cur_base := new(big.Int).SetBytes(ipnet.IP.To16())
+	end_base := new(big.Int).Add(cur_base, net_size)
+
+	// Track searched prefixes so that a shortened prefix is not searched twice,
+	// and longer prefixes already covered by a shortened one are skipped
+	searched := make(map[string]bool)
+
+	// Iterate by block size
+	for ; cur_base.Cmp(end_base) < 0; cur_base.Add(cur_base, block_size) {
+		for _, ip_prefix := range ipv6Prefixes(cur_base, nhex) {
+			if prefixSearched(searched, ip_prefix) {
+				continue
+			}
+			searched[ip_prefix] = true
+			searchPrefixIPv6(r, ip_prefix, ipnet)
+		}
+	}
+}
+
+func prefixSearched(searched map[string]bool, ip_prefix string) bool {
+	if searched[""] || searched[ip_prefix] {
+		return true
+	}
+	for i := range ip_prefix {
+		if ip_prefix[i] == ':' && searched[ip_prefix[0:i+1]] {
+			return true
+		}
+	}
+	return false
+}
+
+func search(r mtbl.Source) {
+	if len(*domain) > 0 {
+		searchDomain(r, *domain)
+		return
+	}
+
+	if len(*cidr) > 0 {
+		searchCIDR(r, *cidr)
+		return
+	}
+
+	if len(*prefix) > 0 {
+		searchPrefix(r, *prefix)
+		return
+	}
+
+	if len(*rev_prefix) > 0 {
+		p := inetdata.ReverseKey(*rev_prefix)
+		searchPrefix(r, p)
+		return
+	}
+
+	searchAll(r)
+}
+
 func main() {
 
 	runtime.GOMAXPROCS(runtime.NumCPU())
@@ -264,6 +468,7 @@ func main() {
 	version = flag.Bool("version", false, "Show the version and build timestamp")
 	domain = flag.String("domain", "", "Search for all matches for a specified domain")
 	cidr = flag.String("cidr", "", "Search for all matches for the specified CIDR")
+	merge = flag.Bool("merge", false, "Query all files as one, returning a single record per key with the values combined (files must share an IP key format)")
 
 	flag.Parse()
 
@@ -305,6 +510,8 @@ func main() {
 
 	exit_code := 0
 
+	readers := []*mtbl.Reader{}
+	reader_paths := []string{}
 	for i := range paths {
 
 		path := paths[i]
@@ -318,28 +525,30 @@ func main() {
 
 		defer r.Destroy()
 
-		if len(*domain) > 0 {
-			searchDomain(r, *domain)
+		if *merge {
+			readers = append(readers, r)
+			reader_paths = append(reader_paths, path)
 			continue
 		}
 
-		if len(*cidr) > 0 {
-			searchCIDR(r, *cidr)
-			continue
-		}
+		search(r)
+	}
 
-		if len(*prefix) > 0 {
-			searchPrefix(r, *prefix)
-			continue
+	// Query every file at once, combining the values of keys found in more than one
+	if *merge && len(readers) > 0 {
+		if e := checkMergeKeys(readers, reader_paths); e != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s\n", e)
+			os.Exit(1)
 		}
 
-		if len(*rev_prefix) > 0 {
-			p := inetdata.ReverseKey(*rev_prefix)
-			searchPrefix(r, p)
-			continue
+		m := mtbl.MergerInit(&mtbl.MergerOptions{Merge: inetdata.MTBLMergeAuto})
+		defer m.Destroy()
+
+		for i := range readers {
+			m.AddSource(readers[i])
 		}
 
-		searchAll(r)
+		search(m)
 	}
 
 	os.Exit(exit_code)
@@ -0,0 +1,199 @@
+package inetdata
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"strings"
+	"time"
+)
+
+// CTLogStateNames lists the log states defined by the v3 log list schema
+var CTLogStateNames = []string{"pending", "qualified", "usable", "readonly", "retired", "rejected"}
+
+// CTLogList is a certificate transparency log list in the v3 JSON schema
+type CTLogList struct {
+	Version          string          `json:"version"`
+	LogListTimestamp string          `json:"log_list_timestamp"`
+	Operators        []CTLogOperator `json:"operators"`
+}
+
+// CTLogOperator is an organization that runs one or more logs
+type CTLogOperator struct {
+	Name      string      `json:"name"`
+	Email     []string    `json:"email"`
+	Logs      []CTLogInfo `json:"logs"`
+	TiledLogs []CTLogInfo `json:"tiled_logs,omitempty"`
+}
+
+// CTLogInfo describes a single log in the log list. RFC 6962 logs have a URL
+// while tiled logs have submission and monitoring URLs.
+type CTLogInfo struct {
+	Description      string              `json:"description"`
+	LogID            string              `json:"log_id"`
+	Key              string              `json:"key"`
+	URL              string              `json:"url,omitempty"`
+	SubmissionURL    string              `json:"submission_url,omitempty"`
+	MonitoringURL    string              `json:"monitoring_url,omitempty"`
+	MMD              int                 `json:"mmd"`
+	State            CTLogStates         `json:"state"`
+	TemporalInterval *CTTemporalInterval `json:"temporal_interval,omitempty"`
+	LogType          string              `json:"log_type,omitempty"`
+}
+
+// CTLogStates holds the current state of a log, only one field is set
+type CTLogStates struct {
+	Pending   *CTLogState `json:"pending,omitempty"`
+	Qualified *CTLogState `json:"qualified,omitempty"`
+	Usable    *CTLogState `json:"usable,omitempty"`
+	ReadOnly  *CTLogState `json:"readonly,omitempty"`
+	Retired   *CTLogState `json:"retired,omitempty"`
+	Rejected  *CTLogState `json:"rejected,omitempty"`
+}
+
+// CTLogState is the time a log entered a state, along with the final tree head
+// for read-only logs
+type CTLogState struct {
+	Timestamp     time.Time      `json:"timestamp"`
+	FinalTreeHead *CTLogTreeHead `json:"final_tree_head,omitempty"`
+}
+
+// CTLogTreeHead is the final tree head of a frozen log
+type CTLogTreeHead struct {
+	TreeSize       int64  `json:"tree_size"`
+	SHA256RootHash string `json:"sha256_root_hash"`
+}
+
+// CTTemporalInterval is the range of certificate expiration times accepted by a shard
+type CTTemporalInterval struct {
+	StartInclusive time.Time `json:"start_inclusive"`
+	EndExclusive   time.Time `json:"end_exclusive"`
+}
+
+// CTListedLog is a log from the log list along with its operator name
+type CTListedLog struct {
+	Operator string
+	Tiled    bool
+	CTLogInfo
+}
+
+// CTLogFilter selects logs from a log list. Empty fields match every log.
+type CTLogFilter struct {
+	// States is the list of acceptable log states
+	States []string
+	// Operators is a list of case-insensitive substrings of the operator name
+	Operators []string
+	// Date only selects shards whose temporal interval contains this time
+	Date time.Time
+}
+
+// Name returns the name of the current state, or an empty string if no state is set
+func (s CTLogStates) Name() string {
+	switch {
+	case s.Pending != nil:
+		return "pending"
+	case s.Qualified != nil:
+		return "qualified"
+	case s.Usable != nil:
+		return "usable"
+	case s.ReadOnly != nil:
+		return "readonly"
+	case s.Retired != nil:
+		return "retired"
+	case s.Rejected != nil:
+		return "rejected"
+	}
+	return ""
+}
+
+// Contains checks whether a time falls within the interval
+func (t *CTTemporalInterval) Contains(ts time.Time) bool {
+	return !ts.Before(t.StartInclusive) && ts.Before(t.EndExclusive)
+}
+
+// LoadCTLogList reads a v3 JSON log list from a file
+func LoadCTLogList(path string) (*CTLogList, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var list CTLogList
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, err
+	}
+
+	if len(list.Operators) == 0 {
+		return nil, errors.New("log list has no operators")
+	}
+
+	return &list, nil
+}
+
+// SelectLogs returns the logs that match the filter
+func (l *CTLogList) SelectLogs(f CTLogFilter) []CTListedLog {
+	logs := []CTListedLog{}
+
+	for _, op := range l.Operators {
+		if !matchCTOperator(op.Name, f.Operators) {
+			continue
+		}
+
+		for _, log := range op.Logs {
+			if f.match(log) {
+				logs = append(logs, CTListedLog{Operator: op.Name, CTLogInfo: log})
+			}
+		}
+
+		for _, log := range op.TiledLogs {
+			if f.match(log) {
+				logs = append(logs, CTListedLog{Operator: op.Name, Tiled: true, CTLogInfo: log})
+			}
+		}
+	}
+	return logs
+}
+
+func (f CTLogFilter) match(log CTLogInfo) bool {
+	if len(f.States) > 0 && !matchCTState(log.State.Name(), f.States) {
+		return false
+	}
+
+	// Logs without a temporal interval accept any certificate
+	if !f.Date.IsZero() && log.TemporalInterval != nil && !log.TemporalInterval.Contains(f.Date) {
+		return false
+	}
+
+	return true
+}
+
+// ReadURL returns the URL prefix used to read entries from the log
+func (l CTListedLog) ReadURL() string {
+	if l.Tiled {
+		return l.MonitoringURL
+	}
+	return l.URL
+}
+
+func matchCTOperator(name string, operators []string) bool {
+	if len(operators) == 0 {
+		return true
+	}
+
+	name = strings.ToLower(name)
+	for _, op := range operators {
+		if strings.Contains(name, strings.ToLower(op)) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchCTState(state string, states []string) bool {
+	for _, s := range states {
+		if strings.ToLower(s) == state {
+			return true
+		}
+	}
+	return false
+}
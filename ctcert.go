@@ -0,0 +1,238 @@
+package inetdata
+
+import (
+	"crypto/dsa"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+
+	ct "github.com/google/certificate-transparency-go"
+	"github.com/google/certificate-transparency-go/tls"
+	"github.com/google/certificate-transparency-go/x509"
+	"github.com/google/certificate-transparency-go/x509/pkix"
+)
+
+// CTCertRecord describes the certificate in a single log entry, or an issuer
+// certificate from a chain. For precertificates the fingerprints cover the
+// TBSCertificate stored in the log entry.
+type CTCertRecord struct {
+	Log                string     `json:"log,omitempty"`
+	Index              *int64     `json:"index,omitempty"`
+	Timestamp          uint64     `json:"timestamp,omitempty"`
+	EntryType          string     `json:"entry_type,omitempty"`
+	SHA1               string     `json:"sha1"`
+	SHA256             string     `json:"sha256"`
+	SPKISHA256         string     `json:"spki_sha256"`
+	Serial             string     `json:"serial"`
+	Issuer             CTCertName `json:"issuer"`
+	Subject            CTCertName `json:"subject"`
+	NotBefore          time.Time  `json:"not_before"`
+	NotAfter           time.Time  `json:"not_after"`
+	KeyAlgorithm       string     `json:"key_algorithm"`
+	KeySize            int        `json:"key_size,omitempty"`
+	SignatureAlgorithm string     `json:"signature_algorithm"`
+	SANs               CTCertSANs `json:"sans"`
+	IsCA               bool       `json:"is_ca"`
+	IssuerSHA256       string     `json:"issuer_sha256,omitempty"`
+	RootSHA256         string     `json:"root_sha256,omitempty"`
+	DER                []byte     `json:"der,omitempty"`
+}
+
+// CTCertName is a distinguished name along with its most useful attributes
+type CTCertName struct {
+	DN                 string   `json:"dn"`
+	CommonName         string   `json:"cn,omitempty"`
+	Organization       []string `json:"o,omitempty"`
+	OrganizationalUnit []string `json:"ou,omitempty"`
+	Country            []string `json:"c,omitempty"`
+}
+
+// CTCertSANs holds the subject alternative names of a certificate by type
+type CTCertSANs struct {
+	DNS   []string `json:"dns,omitempty"`
+	Email []string `json:"email,omitempty"`
+	IP    []string `json:"ip,omitempty"`
+	URI   []string `json:"uri,omitempty"`
+}
+
+// ParseCTEntry decodes the certificate or precertificate in the leaf input of a
+// log entry. Non-fatal certificate parsing errors are ignored.
+func ParseCTEntry(leafInput []byte) (*ct.MerkleTreeLeaf, *x509.Certificate, error) {
+	var leaf ct.MerkleTreeLeaf
+
+	if rest, err := tls.Unmarshal(leafInput, &leaf); err != nil {
+		return nil, nil, fmt.Errorf("failed to unmarshal MerkleTreeLeaf: %v", err)
+	} else if len(rest) > 0 {
+		return nil, nil, fmt.Errorf("trailing data (%d bytes) after MerkleTreeLeaf: %q", len(rest), rest)
+	}
+
+	var cert *x509.Certificate
+	var err error
+
+	switch leaf.TimestampedEntry.EntryType {
+	case ct.X509LogEntryType:
+		cert, err = x509.ParseCertificate(leaf.TimestampedEntry.X509Entry.Data)
+		if err != nil && !strings.Contains(err.Error(), "NonFatalErrors:") {
+			return nil, nil, fmt.Errorf("failed to parse cert: %s", err)
+		}
+
+	case ct.PrecertLogEntryType:
+		cert, err = x509.ParseTBSCertificate(leaf.TimestampedEntry.PrecertEntry.TBSCertificate)
+		if err != nil && !strings.Contains(err.Error(), "NonFatalErrors:") {
+			return nil, nil, fmt.Errorf("failed to parse precert: %s", err)
+		}
+
+	default:
+		return nil, nil, fmt.Errorf("unknown entry type: %v", leaf.TimestampedEntry.EntryType)
+	}
+
+	return &leaf, cert, nil
+}
+
+// ParseCTChain decodes the certificate chain in the extra_data of a log entry,
+// starting with the issuer of the entry and ending with the root
+func ParseCTChain(leaf *ct.MerkleTreeLeaf, extraData []byte) ([][]byte, error) {
+	var certs []ct.ASN1Cert
+
+	// Some sources leave out the extra data entirely
+	if len(extraData) == 0 {
+		return [][]byte{}, nil
+	}
+
+	switch leaf.TimestampedEntry.EntryType {
+	case ct.X509LogEntryType:
+		var chain ct.CertificateChain
+		if rest, err := tls.Unmarshal(extraData, &chain); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal certificate chain: %v", err)
+		} else if len(rest) > 0 {
+			return nil, fmt.Errorf("trailing data (%d bytes) after certificate chain", len(rest))
+		}
+		certs = chain.Entries
+
+	case ct.PrecertLogEntryType:
+		var chain ct.PrecertChainEntry
+		if rest, err := tls.Unmarshal(extraData, &chain); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal precert chain: %v", err)
+		} else if len(rest) > 0 {
+			return nil, fmt.Errorf("trailing data (%d bytes) after precert chain", len(rest))
+		}
+		certs = chain.CertificateChain
+
+	default:
+		return nil, fmt.Errorf("unknown entry type: %v", leaf.TimestampedEntry.EntryType)
+	}
+
+	chain := [][]byte{}
+	for i := range certs {
+		chain = append(chain, certs[i].Data)
+	}
+	return chain, nil
+}
+
+// CTChainFingerprints returns the SHA-256 fingerprints of the immediate issuer
+// and the root of a chain, or empty strings for an empty chain
+func CTChainFingerprints(chain [][]byte) (string, string) {
+	if len(chain) == 0 {
+		return "", ""
+	}
+
+	issuer := sha256.Sum256(chain[0])
+	root := sha256.Sum256(chain[len(chain)-1])
+	return hex.EncodeToString(issuer[:]), hex.EncodeToString(root[:])
+}
+
+// NewCTCertRecord summarizes a parsed log entry
+func NewCTCertRecord(leaf *ct.MerkleTreeLeaf, cert *x509.Certificate) *CTCertRecord {
+	r := newCTCertRecord(cert)
+	r.Timestamp = leaf.TimestampedEntry.Timestamp
+	r.EntryType = "cert"
+
+	if leaf.TimestampedEntry.EntryType == ct.PrecertLogEntryType {
+		r.EntryType = "precert"
+	}
+	return r
+}
+
+// NewCTIssuerRecord summarizes an issuer certificate from a chain, including
+// the certificate itself
+func NewCTIssuerRecord(der []byte) (*CTCertRecord, error) {
+	cert, err := x509.ParseCertificate(der)
+	if err != nil && !strings.Contains(err.Error(), "NonFatalErrors:") {
+		return nil, fmt.Errorf("failed to parse issuer: %s", err)
+	}
+
+	r := newCTCertRecord(cert)
+	r.DER = der
+	return r, nil
+}
+
+// SetChain records the issuer and root fingerprints of the chain
+func (r *CTCertRecord) SetChain(chain [][]byte) {
+	r.IssuerSHA256, r.RootSHA256 = CTChainFingerprints(chain)
+}
+
+func newCTCertRecord(cert *x509.Certificate) *CTCertRecord {
+	r := &CTCertRecord{
+		Serial:             fmt.Sprintf("%x", cert.SerialNumber),
+		Issuer:             newCTCertName(cert.Issuer),
+		Subject:            newCTCertName(cert.Subject),
+		NotBefore:          cert.NotBefore.UTC(),
+		NotAfter:           cert.NotAfter.UTC(),
+		KeyAlgorithm:       cert.PublicKeyAlgorithm.String(),
+		KeySize:            publicKeySize(cert),
+		SignatureAlgorithm: cert.SignatureAlgorithm.String(),
+		IsCA:               cert.IsCA,
+	}
+
+	s1 := sha1.Sum(cert.Raw)
+	r.SHA1 = hex.EncodeToString(s1[:])
+
+	s256 := sha256.Sum256(cert.Raw)
+	r.SHA256 = hex.EncodeToString(s256[:])
+
+	spki := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	r.SPKISHA256 = hex.EncodeToString(spki[:])
+
+	r.SANs.DNS = cert.DNSNames
+	r.SANs.Email = cert.EmailAddresses
+	for _, ip := range cert.IPAddresses {
+		r.SANs.IP = append(r.SANs.IP, ip.String())
+	}
+	for _, uri := range cert.URIs {
+		r.SANs.URI = append(r.SANs.URI, uri.String())
+	}
+
+	return r
+}
+
+func newCTCertName(n pkix.Name) CTCertName {
+	return CTCertName{
+		DN:                 n.String(),
+		CommonName:         n.CommonName,
+		Organization:       n.Organization,
+		OrganizationalUnit: n.OrganizationalUnit,
+		Country:            n.Country,
+	}
+}
+
+// publicKeySize returns the size of the public key in bits, or zero if unknown
+func publicKeySize(cert *x509.Certificate) int {
+	switch k := cert.PublicKey.(type) {
+	case *rsa.PublicKey:
+		return k.N.BitLen()
+	case *ecdsa.PublicKey:
+		return k.Curve.Params().BitSize
+	case *dsa.PublicKey:
+		return k.P.BitLen()
+	}
+
+	if cert.PublicKeyAlgorithm == x509.Ed25519 {
+		return 256
+	}
+	return 0
+}
@@ -0,0 +1,229 @@
+package inetdata
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	ct "github.com/google/certificate-transparency-go"
+	"github.com/google/certificate-transparency-go/tls"
+)
+
+// CTTileWidth is the number of entries or hashes in a full tile
+const CTTileWidth = 256
+
+// CTTileHeight is the number of tree levels covered by a single tile
+const CTTileHeight = 8
+
+// CTCheckpoint is the signed tree head of a tiled (static CT API) log
+type CTCheckpoint struct {
+	Origin     string
+	TreeSize   int64
+	RootHash   []byte
+	Signatures []CTNoteSignature
+}
+
+// CTNoteSignature is a signature line from a checkpoint. For the log's own
+// signature, Timestamp and Signature hold the RFC 6962 tree head signature.
+type CTNoteSignature struct {
+	Name      string
+	KeyID     []byte
+	Timestamp uint64
+	Signature []byte
+}
+
+// CTTileLeaf is a single entry from a data tile
+type CTTileLeaf struct {
+	// LeafInput is the entry in RFC 6962 MerkleTreeLeaf form
+	LeafInput []byte
+	// EntryType is the type of the timestamped entry
+	EntryType ct.LogEntryType
+	// PreCertificate is the submitted precertificate for precert entries
+	PreCertificate []byte
+	// Chain holds the SHA-256 fingerprints of the issuer chain
+	Chain [][]byte
+}
+
+// ParseCTCheckpoint parses a checkpoint in the signed note format
+func ParseCTCheckpoint(data []byte) (*CTCheckpoint, error) {
+	parts := strings.SplitN(string(data), "\n\n", 2)
+	if len(parts) != 2 {
+		return nil, errors.New("checkpoint is missing signatures")
+	}
+
+	lines := strings.Split(parts[0], "\n")
+	if len(lines) < 3 {
+		return nil, errors.New("checkpoint is truncated")
+	}
+
+	size, err := strconv.ParseInt(lines[1], 10, 64)
+	if err != nil || size < 0 {
+		return nil, fmt.Errorf("invalid checkpoint tree size: %q", lines[1])
+	}
+
+	root, err := base64.StdEncoding.DecodeString(lines[2])
+	if err != nil || len(root) != 32 {
+		return nil, fmt.Errorf("invalid checkpoint root hash: %q", lines[2])
+	}
+
+	cp := &CTCheckpoint{Origin: lines[0], TreeSize: size, RootHash: root}
+
+	for _, line := range strings.Split(parts[1], "\n") {
+		if len(line) == 0 {
+			continue
+		}
+
+		if !strings.HasPrefix(line, "— ") {
+			return nil, fmt.Errorf("invalid checkpoint signature line: %q", line)
+		}
+
+		bits := strings.SplitN(strings.TrimPrefix(line, "— "), " ", 2)
+		if len(bits) != 2 {
+			return nil, fmt.Errorf("invalid checkpoint signature line: %q", line)
+		}
+
+		raw, err := base64.StdEncoding.DecodeString(bits[1])
+		if err != nil || len(raw) < 4 {
+			return nil, fmt.Errorf("invalid checkpoint signature: %q", bits[1])
+		}
+
+		sig := CTNoteSignature{Name: bits[0], KeyID: raw[0:4]}
+		if len(raw) >= 12 {
+			sig.Timestamp = binary.BigEndian.Uint64(raw[4:12])
+			sig.Signature = raw[12:]
+		}
+		cp.Signatures = append(cp.Signatures, sig)
+	}
+
+	if len(cp.Signatures) == 0 {
+		return nil, errors.New("checkpoint has no signatures")
+	}
+
+	return cp, nil
+}
+
+// CTTilePath returns the path of a hash tile, relative to the log prefix. A width
+// below CTTileWidth selects a partial tile.
+func CTTilePath(level int, index int64, width int) string {
+	return ctTilePath(strconv.Itoa(level), index, width)
+}
+
+// CTDataTilePath returns the path of a data tile, relative to the log prefix
+func CTDataTilePath(index int64, width int) string {
+	return ctTilePath("data", index, width)
+}
+
+func ctTilePath(level string, index int64, width int) string {
+	// The index is written in groups of three digits, all but the last prefixed with x
+	n := fmt.Sprintf("%03d", index%1000)
+	for index >= 1000 {
+		index /= 1000
+		n = fmt.Sprintf("x%03d/%s", index%1000, n)
+	}
+
+	path := "tile/" + level + "/" + n
+	if width > 0 && width < CTTileWidth {
+		path += fmt.Sprintf(".p/%d", width)
+	}
+	return path
+}
+
+// ParseCTDataTile decodes the entries of a data tile
+func ParseCTDataTile(data []byte) ([]CTTileLeaf, error) {
+	leaves := []CTTileLeaf{}
+
+	for len(data) > 0 {
+		var entry ct.TimestampedEntry
+
+		rest, err := tls.Unmarshal(data, &entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid tile leaf %d: %s", len(leaves), err)
+		}
+
+		// Entries are hashed in MerkleTreeLeaf form, a version and leaf type followed
+		// by the timestamped entry
+		raw := data[0 : len(data)-len(rest)]
+		leaf := CTTileLeaf{
+			LeafInput: append([]byte{byte(ct.V1), byte(ct.TimestampedEntryLeafType)}, raw...),
+			EntryType: entry.EntryType,
+		}
+
+		if entry.EntryType == ct.PrecertLogEntryType {
+			var pre []byte
+			if pre, rest, err = readTLSVector(rest, 3); err != nil {
+				return nil, fmt.Errorf("invalid tile leaf %d precertificate: %s", len(leaves), err)
+			}
+			leaf.PreCertificate = pre
+		}
+
+		var chain []byte
+		if chain, rest, err = readTLSVector(rest, 2); err != nil {
+			return nil, fmt.Errorf("invalid tile leaf %d chain: %s", len(leaves), err)
+		}
+
+		if len(chain)%32 != 0 {
+			return nil, fmt.Errorf("invalid tile leaf %d chain length %d", len(leaves), len(chain))
+		}
+
+		for i := 0; i < len(chain); i += 32 {
+			leaf.Chain = append(leaf.Chain, chain[i:i+32])
+		}
+
+		leaves = append(leaves, leaf)
+		data = rest
+	}
+
+	return leaves, nil
+}
+
+// CTExtraData builds the RFC 6962 extra_data for a tile leaf from its issuer chain
+func CTExtraData(leaf CTTileLeaf, chain [][]byte) ([]byte, error) {
+	certs := []ct.ASN1Cert{}
+	for i := range chain {
+		certs = append(certs, ct.ASN1Cert{Data: chain[i]})
+	}
+
+	if leaf.EntryType == ct.PrecertLogEntryType {
+		return tls.Marshal(ct.PrecertChainEntry{
+			PreCertificate:   ct.ASN1Cert{Data: leaf.PreCertificate},
+			CertificateChain: certs,
+		})
+	}
+
+	return tls.Marshal(ct.CertificateChain{Entries: certs})
+}
+
+// CTTileHashes splits a hash tile into individual hashes
+func CTTileHashes(data []byte) ([][]byte, error) {
+	if len(data)%32 != 0 || len(data) > 32*CTTileWidth {
+		return nil, fmt.Errorf("invalid hash tile length %d", len(data))
+	}
+
+	hashes := [][]byte{}
+	for i := 0; i < len(data); i += 32 {
+		hashes = append(hashes, data[i:i+32])
+	}
+	return hashes, nil
+}
+
+// readTLSVector reads a variable-length vector with a length prefix of n bytes
+func readTLSVector(data []byte, n int) ([]byte, []byte, error) {
+	if len(data) < n {
+		return nil, nil, errors.New("truncated length")
+	}
+
+	var l int
+	for _, b := range data[0:n] {
+		l = l<<8 | int(b)
+	}
+
+	data = data[n:]
+	if len(data) < l {
+		return nil, nil, errors.New("truncated data")
+	}
+
+	return data[0:l], data[l:], nil
+}
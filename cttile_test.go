@@ -0,0 +1,94 @@
+package inetdata
+
+import (
+	"bytes"
+	"encoding/base64"
+	"strings"
+	"testing"
+)
+
+func TestParseCTCheckpoint(t *testing.T) {
+	root := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{0xab}, 32))
+	sig := base64.StdEncoding.EncodeToString(append([]byte{1, 2, 3, 4, 0, 0, 1, 0x8b, 0xcf, 0xe5, 0x68, 0x00}, "sig"...))
+	cosig := base64.StdEncoding.EncodeToString([]byte{9, 9, 9, 9, 1})
+
+	data := "log.example.com/test\n1234\n" + root + "\nextension line\n\n" +
+		"— witness.example.com " + cosig + "\n" +
+		"— log.example.com/test " + sig + "\n"
+
+	cp, err := ParseCTCheckpoint([]byte(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cp.Origin != "log.example.com/test" || cp.TreeSize != 1234 || !bytes.Equal(cp.RootHash, bytes.Repeat([]byte{0xab}, 32)) {
+		t.Fatalf("unexpected checkpoint %+v", cp)
+	}
+
+	if len(cp.Signatures) != 2 {
+		t.Fatalf("read %d signatures, expected 2", len(cp.Signatures))
+	}
+
+	// Cosignatures too short for a tree head signature only have a key ID
+	if s := cp.Signatures[0]; s.Name != "witness.example.com" || !bytes.Equal(s.KeyID, []byte{9, 9, 9, 9}) || s.Signature != nil {
+		t.Fatalf("unexpected cosignature %+v", s)
+	}
+
+	s := cp.Signatures[1]
+	if s.Name != cp.Origin || !bytes.Equal(s.KeyID, []byte{1, 2, 3, 4}) || s.Timestamp != 1700000000000 || string(s.Signature) != "sig" {
+		t.Fatalf("unexpected signature %+v", s)
+	}
+
+	invalid := []struct {
+		data string
+		err  string
+	}{
+		{"log\n1234\n" + root + "\n", "missing signatures"},
+		{"log\n1234\n\n— log " + sig + "\n", "truncated"},
+		{"log\n-1\n" + root + "\n\n— log " + sig + "\n", "tree size"},
+		{"log\n1234\nAAAA\n\n— log " + sig + "\n", "root hash"},
+		{"log\n1234\n" + root + "\n\n- log " + sig + "\n", "signature line"},
+		{"log\n1234\n" + root + "\n\n— log\n", "signature line"},
+		{"log\n1234\n" + root + "\n\n— log AAA=\n", "invalid checkpoint signature"},
+		{"log\n1234\n" + root + "\n\n\n", "no signatures"},
+	}
+
+	for _, tt := range invalid {
+		if _, err := ParseCTCheckpoint([]byte(tt.data)); err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%q: expected an error containing %q, got %v", tt.data, tt.err, err)
+		}
+	}
+}
+
+func TestCTTilePath(t *testing.T) {
+	tests := []struct {
+		path string
+		exp  string
+	}{
+		{CTTilePath(0, 0, CTTileWidth), "tile/0/000"},
+		{CTTilePath(1, 7, 12), "tile/1/007.p/12"},
+		{CTTilePath(0, 1234, CTTileWidth), "tile/0/x001/234"},
+		{CTTilePath(2, 1234067, 0), "tile/2/x001/x234/067"},
+		{CTDataTilePath(1000, 255), "tile/data/x001/000.p/255"},
+		{CTDataTilePath(5, CTTileWidth), "tile/data/005"},
+	}
+
+	for _, tt := range tests {
+		if tt.path != tt.exp {
+			t.Errorf("got %s, expected %s", tt.path, tt.exp)
+		}
+	}
+}
+
+func TestCTTileHashes(t *testing.T) {
+	hashes, err := CTTileHashes(bytes.Repeat([]byte{1}, 32*3))
+	if err != nil || len(hashes) != 3 {
+		t.Fatalf("got %d hashes, %v", len(hashes), err)
+	}
+
+	for _, n := range []int{31, 32*CTTileWidth + 32} {
+		if _, err := CTTileHashes(make([]byte, n)); err == nil {
+			t.Errorf("expected an error for a tile of %d bytes", n)
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package inetdata
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// DelegatedRecord is an entry from a RIR delegated or delegated-extended
+// statistics file. Value is the number of addresses for IPv4, the prefix
+// length for IPv6, and the number of AS numbers for ASNs.
+type DelegatedRecord struct {
+	Registry   string
+	CC         string
+	Type       string
+	Start      string
+	Value      string
+	Date       string
+	Status     string
+	OpaqueID   string
+	Extensions []string
+}
+
+// ParseDelegatedLine parses a line of a delegated statistics file. The version
+// header, summary lines, and comments return a nil record.
+func ParseDelegatedLine(line string) (*DelegatedRecord, error) {
+	line = strings.TrimSpace(line)
+	if len(line) == 0 || line[0] == '#' {
+		return nil, nil
+	}
+
+	bits := strings.Split(line, "|")
+
+	// The version header starts with the format version, summaries end in "summary"
+	if _, err := strconv.ParseFloat(bits[0], 64); err == nil {
+		return nil, nil
+	}
+	if bits[len(bits)-1] == "summary" {
+		return nil, nil
+	}
+
+	if len(bits) < 7 {
+		return nil, fmt.Errorf("expected at least 7 fields, got %d", len(bits))
+	}
+
+	rec := &DelegatedRecord{
+		Registry: strings.ToLower(bits[0]),
+		CC:       strings.ToUpper(bits[1]),
+		Type:     strings.ToLower(bits[2]),
+		Start:    bits[3],
+		Value:    bits[4],
+		Date:     bits[5],
+		Status:   strings.ToLower(bits[6]),
+	}
+
+	// Unassigned space uses ZZ and an empty or zero date
+	if rec.CC == "ZZ" {
+		rec.CC = ""
+	}
+	if strings.Trim(rec.Date, "0") == "" {
+		rec.Date = ""
+	}
+
+	if len(bits) > 7 {
+		rec.OpaqueID = bits[7]
+		rec.Extensions = bits[8:]
+	}
+
+	return rec, nil
+}
+
+// CIDRs returns the network blocks of an IPv4 or IPv6 record. IPv4 counts that
+// are not a power of two are split into multiple blocks.
+func (r *DelegatedRecord) CIDRs() ([]string, error) {
+	switch r.Type {
+	case "ipv4":
+		start, err := IPv42UInt(r.Start)
+		if err != nil {
+			return nil, err
+		}
+
+		count, err := strconv.ParseUint(r.Value, 10, 32)
+		if err != nil || count == 0 || uint64(start)+count-1 > 0xffffffff {
+			return nil, fmt.Errorf("invalid address count %s for %s", r.Value, r.Start)
+		}
+
+		return IPv4UIntRange2CIDRs(start, start+uint32(count-1)), nil
+
+	case "ipv6":
+		_, ipnet, err := net.ParseCIDR(r.Start + "/" + r.Value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid network %s/%s", r.Start, r.Value)
+		}
+		return []string{ipnet.String()}, nil
+	}
+
+	return nil, fmt.Errorf("unsupported record type %s", r.Type)
+}
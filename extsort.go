@@ -0,0 +1,529 @@
+package inetdata
+
+import (
+	"bufio"
+	"compress/gzip"
+	"container/heap"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// SortMergeFanIn is the maximum number of runs merged in a single pass
+const SortMergeFanIn = 64
+
+// SortOptions configures an ExternalSort
+type SortOptions struct {
+	// TempDir is the parent directory for temporary runs (defaults to the system temp directory)
+	TempDir string
+	// MaxMemory is the approximate number of bytes buffered across all run generators
+	MaxMemory uint64
+	// Workers is the number of runs that can be sorted and written in parallel
+	Workers int
+	// Unique drops duplicate lines, similar to sort -u
+	Unique bool
+	// CompressionLevel is the gzip level used for temporary runs
+	CompressionLevel int
+}
+
+// ExternalSort is a disk-backed merge sort for newline-delimited records. Lines are
+// ordered by their raw bytes, matching the output of sort with LC_ALL=C.
+type ExternalSort struct {
+	opts    SortOptions
+	dir     string
+	buf     []string
+	bufSize uint64
+	runID   int
+	runs    []string
+	sem     chan bool
+	wg      sync.WaitGroup
+	mu      sync.Mutex
+	err     error
+}
+
+// NewExternalSort creates a sorter with a private temporary directory
+func NewExternalSort(opts SortOptions) (*ExternalSort, error) {
+	if opts.Workers < 1 {
+		opts.Workers = runtime.NumCPU()
+	}
+
+	if opts.MaxMemory == 0 {
+		opts.MaxMemory = 1024 * 1024 * 1024
+	}
+
+	if opts.CompressionLevel == 0 {
+		opts.CompressionLevel = gzip.BestSpeed
+	}
+
+	dir, err := ioutil.TempDir(opts.TempDir, "inetdata-sort-")
+	if err != nil {
+		return nil, err
+	}
+
+	return &ExternalSort{
+		opts: opts,
+		dir:  dir,
+		sem:  make(chan bool, opts.Workers),
+	}, nil
+}
+
+// Add queues a line for sorting. A trailing newline is ignored and empty lines are
+// dropped. Add is not safe for concurrent use.
+func (s *ExternalSort) Add(line string) error {
+	line = strings.TrimSuffix(line, "\n")
+	if len(line) == 0 {
+		return nil
+	}
+
+	if err := s.getErr(); err != nil {
+		return err
+	}
+
+	s.buf = append(s.buf, line)
+
+	// Account for the string header as well as the data
+	s.bufSize += uint64(len(line)) + 16
+
+	// Each worker gets an equal share of the memory limit
+	if s.bufSize >= s.opts.MaxMemory/uint64(s.opts.Workers) {
+		s.spill()
+	}
+	return nil
+}
+
+// Sort merges all queued lines and sends them to out in sorted order. The output
+// channel is closed on completion, even when an error is returned.
+func (s *ExternalSort) Sort(out chan<- string) error {
+	defer close(out)
+
+	s.wg.Wait()
+	if err := s.getErr(); err != nil {
+		return err
+	}
+
+	// Everything fit in memory, skip the disk entirely
+	if len(s.runs) == 0 {
+		sort.Strings(s.buf)
+		last := ""
+		for i, line := range s.buf {
+			if s.opts.Unique && i > 0 && line == last {
+				continue
+			}
+			out <- line
+			last = line
+		}
+		s.buf = nil
+		return nil
+	}
+
+	if len(s.buf) > 0 {
+		s.spill()
+		s.wg.Wait()
+		if err := s.getErr(); err != nil {
+			return err
+		}
+	}
+
+	runs := s.runs
+	s.runs = nil
+
+	// Reduce the number of runs until they can be merged in a single pass
+	for len(runs) > SortMergeFanIn {
+		next := []string{}
+		for i := 0; i < len(runs); i += SortMergeFanIn {
+			end := i + SortMergeFanIn
+			if end > len(runs) {
+				end = len(runs)
+			}
+
+			name, err := s.mergeToRun(runs[i:end])
+			if err != nil {
+				return err
+			}
+			next = append(next, name)
+		}
+		runs = next
+	}
+
+	return s.mergeRuns(runs, func(line string) error {
+		out <- line
+		return nil
+	})
+}
+
+// SortRollup sorts the queued lines, merges the values of lines that share the same
+// key, and sends the merged lines to out. The output channel is closed on completion.
+func (s *ExternalSort) SortRollup(out chan<- string) error {
+	sorted := make(chan string, 1000)
+	done := make(chan bool, 1)
+
+	go func() {
+		RollupCSV(sorted, out)
+		done <- true
+	}()
+
+	err := s.Sort(sorted)
+	<-done
+	return err
+}
+
+// Close removes all temporary files
+func (s *ExternalSort) Close() error {
+	s.wg.Wait()
+	return os.RemoveAll(s.dir)
+}
+
+func (s *ExternalSort) getErr() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+func (s *ExternalSort) setErr(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err == nil {
+		s.err = err
+	}
+}
+
+func (s *ExternalSort) nextRunName() string {
+	s.runID++
+	return filepath.Join(s.dir, fmt.Sprintf("run-%08d.gz", s.runID))
+}
+
+// spill hands the current buffer to a background worker that sorts it and writes
+// it out as a compressed run
+func (s *ExternalSort) spill() {
+	buf := s.buf
+	name := s.nextRunName()
+
+	s.buf = nil
+	s.bufSize = 0
+
+	s.sem <- true
+	s.wg.Add(1)
+	go func() {
+		defer func() {
+			<-s.sem
+			s.wg.Done()
+		}()
+
+		sort.Strings(buf)
+
+		if err := s.writeRun(name, buf); err != nil {
+			s.setErr(err)
+			return
+		}
+
+		s.mu.Lock()
+		s.runs = append(s.runs, name)
+		s.mu.Unlock()
+	}()
+}
+
+func (s *ExternalSort) writeRun(name string, lines []string) error {
+	return s.createRun(name, func(emit func(string) error) error {
+		last := ""
+		for i, line := range lines {
+			if s.opts.Unique && i > 0 && line == last {
+				continue
+			}
+			if err := emit(line); err != nil {
+				return err
+			}
+			last = line
+		}
+		return nil
+	})
+}
+
+func (s *ExternalSort) mergeToRun(runs []string) (string, error) {
+	name := s.nextRunName()
+	err := s.createRun(name, func(emit func(string) error) error {
+		return s.mergeRuns(runs, emit)
+	})
+	if err != nil {
+		return "", err
+	}
+
+	for i := range runs {
+		os.Remove(runs[i])
+	}
+	return name, nil
+}
+
+func (s *ExternalSort) createRun(name string, fill func(func(string) error) error) error {
+	fd, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+
+	gz, err := gzip.NewWriterLevel(fd, s.opts.CompressionLevel)
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriterSize(gz, 1024*1024)
+
+	err = fill(func(line string) error {
+		if _, err := w.WriteString(line); err != nil {
+			return err
+		}
+		return w.WriteByte('\n')
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	if err := gz.Close(); err != nil {
+		return err
+	}
+
+	return fd.Close()
+}
+
+// mergeRuns performs a k-way merge of sorted runs and calls emit for each line
+func (s *ExternalSort) mergeRuns(names []string, emit func(string) error) error {
+	h := &sortRunHeap{}
+
+	defer func() {
+		for _, r := range *h {
+			r.close()
+		}
+	}()
+
+	for i := range names {
+		r, err := openSortRun(names[i])
+		if err != nil {
+			return err
+		}
+
+		ok, err := r.next()
+		if err != nil {
+			r.close()
+			return err
+		}
+
+		if !ok {
+			r.close()
+			continue
+		}
+		*h = append(*h, r)
+	}
+
+	heap.Init(h)
+
+	first := true
+	last := ""
+
+	for h.Len() > 0 {
+		r := (*h)[0]
+		line := r.line
+
+		if !(s.opts.Unique && !first && line == last) {
+			if err := emit(line); err != nil {
+				return err
+			}
+		}
+		first = false
+		last = line
+
+		ok, err := r.next()
+		if err != nil {
+			return err
+		}
+
+		if ok {
+			heap.Fix(h, 0)
+		} else {
+			heap.Pop(h)
+			r.close()
+		}
+	}
+	return nil
+}
+
+type sortRun struct {
+	fd   *os.File
+	gz   *gzip.Reader
+	r    *bufio.Reader
+	line string
+}
+
+func openSortRun(name string) (*sortRun, error) {
+	fd, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+
+	gz, err := gzip.NewReader(fd)
+	if err != nil {
+		fd.Close()
+		return nil, err
+	}
+
+	return &sortRun{fd: fd, gz: gz, r: bufio.NewReaderSize(gz, 256*1024)}, nil
+}
+
+func (r *sortRun) next() (bool, error) {
+	line, err := r.r.ReadString('\n')
+	if err == io.EOF && len(line) == 0 {
+		return false, nil
+	}
+	if err != nil && err != io.EOF {
+		return false, err
+	}
+	r.line = strings.TrimSuffix(line, "\n")
+	return true, nil
+}
+
+func (r *sortRun) close() {
+	r.gz.Close()
+	r.fd.Close()
+}
+
+type sortRunHeap []*sortRun
+
+func (h sortRunHeap) Len() int            { return len(h) }
+func (h sortRunHeap) Less(i, j int) bool  { return h[i].line < h[j].line }
+func (h sortRunHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *sortRunHeap) Push(x interface{}) { *h = append(*h, x.(*sortRun)) }
+func (h *sortRunHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	x := old[n-1]
+	*h = old[0 : n-1]
+	return x
+}
+
+// allowedIdentical checks to see if the record type is one of the few
+// DNS record types allowed to point to itself (name=value)
+func allowedIdentical(recordType string) bool {
+	switch recordType {
+	case
+		"ns",
+		"r-ns",
+		"mx",
+		"r-mx":
+		return true
+	}
+	return false
+}
+
+// CleanRollupValue removes common scan artifacts from a CSV value before it is
+// merged, returning false if the value should be dropped. Observation times added
+// by AddTimestamp are kept.
+func CleanRollupValue(key string, val string) (string, bool) {
+	if v, ts := SplitTimestamp(val); ts != 0 {
+		v, ok := cleanRollupValue(key, v)
+		return AddTimestamp(v, ts), ok
+	}
+	return cleanRollupValue(key, val)
+}
+
+func cleanRollupValue(key string, val string) (string, bool) {
+
+	// Ignore any records where key is empty or identical to the value
+	// (with the exception of certain types)
+	if len(val) >= len(key) {
+		parts := strings.SplitN(val, ",", 2)
+		if len(parts) == 2 && !allowedIdentical(parts[0]) {
+			if len(parts[1]) == 0 || key == parts[1] {
+				return val, false
+			}
+		}
+	}
+
+	// TXT records start with an erroneous pipe character
+	if len(val) > 5 && val[0:5] == "txt,|" {
+		val = "txt," + val[5:]
+	}
+
+	// DNSSEC-related TXT records often have trailing bytes
+	if len(val) >= 38 && (val[0:6] == "txt,31" || val[0:6] == "txt,00" || val[0:6] == "txt,aa") {
+		val = val[0:38]
+	}
+
+	// Mangled TXT value, ignore
+	if len(val) >= 5 && len(val) <= 10 && val[0:5] == "txt,~" {
+		return val, false
+	}
+
+	return val, true
+}
+
+// RollupCSV reads sorted "key,value" lines and merges the values of each key into
+// a single "key,value\x00value" line, the same as inetdata-csvrollup. Since input
+// is sorted, the output is sorted as well. The output channel is closed on completion.
+func RollupCSV(in <-chan string, out chan<- string) {
+
+	ckey := ""
+	cval := []string{}
+
+	emit := func() {
+		if len(ckey) == 0 || len(cval) == 0 {
+			return
+		}
+
+		unique := map[string]bool{}
+		vals := []string{}
+		for i := range cval {
+			for _, v := range strings.Split(cval[i], "\x00") {
+				if !unique[v] {
+					unique[v] = true
+					vals = append(vals, v)
+				}
+			}
+		}
+		sort.Strings(vals)
+		out <- ckey + "," + strings.Join(vals, "\x00")
+	}
+
+	for r := range in {
+
+		raw := strings.TrimSpace(r)
+		if len(raw) == 0 {
+			continue
+		}
+
+		bits := strings.SplitN(raw, ",", 2)
+
+		if len(bits) < 2 || len(bits[0]) == 0 {
+			fmt.Fprintf(os.Stderr, "[-] Invalid line: %q\n", raw)
+			continue
+		}
+
+		// Tons of records with a blank (".") DNS response, just ignore
+		if len(bits[1]) == 0 {
+			continue
+		}
+
+		key := bits[0]
+
+		// Next key hit
+		if ckey != key {
+			emit()
+			ckey = key
+			cval = []string{}
+		}
+
+		if val, ok := CleanRollupValue(key, bits[1]); ok {
+			cval = append(cval, val)
+		}
+	}
+
+	emit()
+	close(out)
+}
@@ -0,0 +1,239 @@
+package inetdata
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func sortAll(t *testing.T, s *ExternalSort) []string {
+	out := make(chan string, 100)
+	done := make(chan error, 1)
+	go func() {
+		done <- s.Sort(out)
+	}()
+
+	lines := []string{}
+	for line := range out {
+		lines = append(lines, line)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("Sort: %s", err)
+	}
+	return lines
+}
+
+func TestExternalSortSpillAndMerge(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "extsort-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	// A tiny memory limit spills every few lines, creating more runs than can
+	// be merged in a single pass
+	s, err := NewExternalSort(SortOptions{TempDir: tmp, MaxMemory: 256, Workers: 2, Unique: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	rnd := rand.New(rand.NewSource(1))
+	want := map[string]bool{}
+	for i := 0; i < 2000; i++ {
+		line := fmt.Sprintf("host%04d.example.com,a,10.0.%d.%d", rnd.Intn(700), rnd.Intn(4), rnd.Intn(4))
+		want[line] = true
+		if err := s.Add(line + "\n"); err != nil {
+			t.Fatalf("Add: %s", err)
+		}
+	}
+	s.Add("")
+
+	s.wg.Wait()
+	if len(s.runs) <= SortMergeFanIn {
+		t.Fatalf("expected more than %d runs, got %d", SortMergeFanIn, len(s.runs))
+	}
+
+	got := sortAll(t, s)
+
+	exp := []string{}
+	for line := range want {
+		exp = append(exp, line)
+	}
+	sort.Strings(exp)
+
+	if !reflect.DeepEqual(got, exp) {
+		t.Fatalf("got %d sorted lines, expected %d", len(got), len(exp))
+	}
+}
+
+func TestExternalSortInMemory(t *testing.T) {
+	s, err := NewExternalSort(SortOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	for _, line := range []string{"b", "a", "c", "a", "B"} {
+		s.Add(line)
+	}
+
+	got := sortAll(t, s)
+	exp := []string{"B", "a", "a", "b", "c"}
+	if !reflect.DeepEqual(got, exp) {
+		t.Fatalf("got %q, expected %q", got, exp)
+	}
+
+	if len(s.runs) != 0 {
+		t.Fatalf("expected no runs on disk, got %d", len(s.runs))
+	}
+}
+
+func TestExternalSortRollup(t *testing.T) {
+	s, err := NewExternalSort(SortOptions{MaxMemory: 128, Workers: 1, Unique: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	for _, line := range []string{
+		"b.com,a,1.1.1.1",
+		"a.com,ns,ns1.a.com",
+		"a.com,a,2.2.2.2",
+		"b.com,a,1.1.1.1",
+		"a.com,a,1.1.1.1",
+		"c.com,cname,c.com",
+		"a.com,ns,ns1.a.com",
+		"a.com,txt,|v=spf1",
+		"a.com,ns,a.com",
+		"d.com,",
+	} {
+		s.Add(line)
+	}
+
+	out := make(chan string, 100)
+	done := make(chan error, 1)
+	go func() {
+		done <- s.SortRollup(out)
+	}()
+
+	got := []string{}
+	for line := range out {
+		got = append(got, line)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	exp := []string{
+		"a.com," + strings.Join([]string{"a,1.1.1.1", "a,2.2.2.2", "ns,a.com", "ns,ns1.a.com", "txt,v=spf1"}, "\x00"),
+		"b.com,a,1.1.1.1",
+	}
+	if !reflect.DeepEqual(got, exp) {
+		t.Fatalf("got %q, expected %q", got, exp)
+	}
+}
+
+func TestRollupCSVMergesValues(t *testing.T) {
+	in := make(chan string, 10)
+	out := make(chan string, 10)
+
+	// Values that were already merged are split and deduplicated again
+	in <- "a.com,a,1.1.1.1\x00a,2.2.2.2"
+	in <- "a.com,a,2.2.2.2"
+	in <- "a.com,a,3.3.3.3"
+	in <- "b.com,ptr,b.com"
+	in <- "c.com,a,1.1.1.1"
+	close(in)
+
+	RollupCSV(in, out)
+
+	got := []string{}
+	for line := range out {
+		got = append(got, line)
+	}
+
+	exp := []string{
+		"a.com,a,1.1.1.1\x00a,2.2.2.2\x00a,3.3.3.3",
+		"c.com,a,1.1.1.1",
+	}
+	if !reflect.DeepEqual(got, exp) {
+		t.Fatalf("got %q, expected %q", got, exp)
+	}
+}
+
+func TestCleanRollupValue(t *testing.T) {
+	tests := []struct {
+		key string
+		val string
+		exp string
+		ok  bool
+	}{
+		{"a.com", "a,1.1.1.1", "a,1.1.1.1", true},
+		{"a.com", "cname,a.com", "cname,a.com", false},
+		{"a.com", "ns,a.com", "ns,a.com", true},
+		{"a", "mx,", "mx,", true},
+		{"a", "a,", "a,", false},
+		{"a.com", "txt,|hello", "txt,hello", true},
+		{"a.com", "txt,~x", "txt,~x", false},
+		{"a.com", "txt,31" + strings.Repeat("0", 40), "txt,31" + strings.Repeat("0", 32), true},
+		{"a.com", AddTimestamp("txt,|hello", 1500000000), AddTimestamp("txt,hello", 1500000000), true},
+		{"a.com", AddTimestamp("cname,a.com", 1500000000), AddTimestamp("cname,a.com", 1500000000), false},
+	}
+
+	for _, tt := range tests {
+		val, ok := CleanRollupValue(tt.key, tt.val)
+		if val != tt.exp || ok != tt.ok {
+			t.Errorf("CleanRollupValue(%q, %q) = %q, %v, expected %q, %v", tt.key, tt.val, val, ok, tt.exp, tt.ok)
+		}
+	}
+}
+
+func TestExternalSortCloseRemovesTempDir(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "extsort-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	s, err := NewExternalSort(SortOptions{TempDir: tmp, MaxMemory: 64, Workers: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 100; i++ {
+		s.Add(fmt.Sprintf("line-%03d", i))
+	}
+	s.wg.Wait()
+
+	runs, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(runs) == 0 {
+		t.Fatal("expected runs in the temporary directory")
+	}
+
+	// Close without sorting, as when a caller fails part way through
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	left, err := ioutil.ReadDir(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(left) != 0 {
+		t.Fatalf("expected an empty directory after Close, found %d entries", len(left))
+	}
+
+	// Close is safe to call more than once
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -1,10 +1,13 @@
 package inetdata
 
 import (
+	"bufio"
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"io"
 	"math"
+	"math/big"
 	"net"
 	"os"
 	"regexp"
@@ -107,6 +110,92 @@ func UInt2IPv4(ipi uint32) string {
 	return ip.String()
 }
 
+// IPv62BigInt converts IPv6 addresses to big integers
+func IPv62BigInt(ips string) (*big.Int, error) {
+	ip := net.ParseIP(ips)
+	if ip == nil || ip.To4() != nil {
+		return nil, errors.New("Invalid IPv6 address")
+	}
+	return new(big.Int).SetBytes(ip.To16()), nil
+}
+
+// BigInt2IPv6 converts big integers to IPv6 addresses
+func BigInt2IPv6(ipi *big.Int) string {
+	ipb := make([]byte, 16)
+	b := ipi.Bytes()
+	if len(b) > 16 {
+		b = b[len(b)-16:]
+	}
+	copy(ipb[16-len(b):], b)
+	ip := net.IP(ipb)
+	return ip.String()
+}
+
+// IPKeyTagIPv4 is the leading byte of a binary-encoded IPv4 key
+const IPKeyTagIPv4 = 0x04
+
+// IPKeyTagIPv6 is the leading byte of a binary-encoded IPv6 key
+const IPKeyTagIPv6 = 0x06
+
+// EncodeIPKey converts an IP address to a family tag followed by the address in
+// big-endian form, so that keys sort in numeric order. Returns false if the
+// string is not an IP address.
+func EncodeIPKey(ips string) ([]byte, bool) {
+	ip := net.ParseIP(ips)
+	if ip == nil {
+		return nil, false
+	}
+
+	if ip4 := ip.To4(); ip4 != nil && !strings.Contains(ips, ":") {
+		return append([]byte{IPKeyTagIPv4}, ip4...), true
+	}
+
+	return append([]byte{IPKeyTagIPv6}, ip.To16()...), true
+}
+
+// DecodeIPKey converts a binary-encoded IP key back to an address string.
+// Returns false if the key is not an encoded IP address.
+func DecodeIPKey(key []byte) (string, bool) {
+	switch {
+	case len(key) == 5 && key[0] == IPKeyTagIPv4:
+		return net.IP(key[1:5]).String(), true
+
+	case len(key) == 17 && key[0] == IPKeyTagIPv6:
+		ip := net.IP(key[1:17])
+		// Keep IPv4-mapped addresses in IPv6 form
+		if ip4 := ip.To4(); ip4 != nil {
+			return "::ffff:" + ip4.String(), true
+		}
+		return ip.String(), true
+	}
+	return "", false
+}
+
+// IPKeyRange returns the first and last binary-encoded keys within a network, or
+// nil if the mask does not match the address family
+func IPKeyRange(ipnet *net.IPNet) ([]byte, []byte) {
+	tag := byte(IPKeyTagIPv6)
+	ip := ipnet.IP.To16()
+	mask := ipnet.Mask
+
+	if ip4 := ipnet.IP.To4(); ip4 != nil && len(mask) == net.IPv4len {
+		tag = IPKeyTagIPv4
+		ip = ip4
+	}
+
+	if len(mask) != len(ip) {
+		return nil, nil
+	}
+
+	first := []byte{tag}
+	last := []byte{tag}
+	for i := range ip {
+		first = append(first, ip[i]&mask[i])
+		last = append(last, ip[i]|^mask[i])
+	}
+	return first, last
+}
+
 // IPv4Range2CIDRs converts a start and stop IPv4 range to a list of CIDRs
 func IPv4Range2CIDRs(sIP string, eIP string) ([]string, error) {
 
@@ -127,7 +216,9 @@ func IPv4Range2CIDRs(sIP string, eIP string) ([]string, error) {
 	return IPv4UIntRange2CIDRs(sI, eI), nil
 }
 
-// IPv4UIntRange2CIDRs converts a range of insigned integers into IPv4 CIDRs
+// IPv4UIntRange2CIDRs converts a range of insigned integers into IPv4 CIDRs.
+// Each block is aligned to its size, so ranges that do not start on a block
+// boundary are split into smaller blocks.
 func IPv4UIntRange2CIDRs(sI uint32, eI uint32) []string {
 	cidrs := []string{}
 
@@ -142,7 +233,7 @@ func IPv4UIntRange2CIDRs(sI uint32, eI uint32) []string {
 
 		maskSize := IPv4MaskSizes[i]
 
-		if maskSize > size {
+		if maskSize > size || sI%maskSize != 0 {
 			continue
 		}
 
@@ -169,6 +260,50 @@ func IPv4UIntRange2CIDRs(sI uint32, eI uint32) []string {
 	return cidrs
 }
 
+// IPv6Range2CIDRs converts a start and stop IPv6 range to a list of CIDRs
+func IPv6Range2CIDRs(sIP string, eIP string) ([]string, error) {
+
+	sI, sE := IPv62BigInt(sIP)
+	if sE != nil {
+		return []string{}, sE
+	}
+
+	eI, eE := IPv62BigInt(eIP)
+	if eE != nil {
+		return []string{}, eE
+	}
+
+	if sI.Cmp(eI) > 0 {
+		return []string{}, errors.New("Start address is bigger than end address")
+	}
+
+	cidrs := []string{}
+	one := big.NewInt(1)
+
+	for sI.Cmp(eI) <= 0 {
+		// The largest block that starts at this address
+		bits := uint(128)
+		if sI.Sign() != 0 {
+			bits = sI.TrailingZeroBits()
+		}
+
+		// Shrink it until it ends within the range
+		for {
+			last := new(big.Int).Lsh(one, bits)
+			last.Add(last, sI).Sub(last, one)
+			if last.Cmp(eI) <= 0 {
+				break
+			}
+			bits--
+		}
+
+		cidrs = append(cidrs, fmt.Sprintf("%s/%d", BigInt2IPv6(sI), 128-bits))
+		sI = new(big.Int).Add(sI, new(big.Int).Lsh(one, bits))
+	}
+
+	return cidrs, nil
+}
+
 //AddressesFromCIDR parses a CIDR and writes individual IPs to a channel
 func AddressesFromCIDR(cidr string, o chan<- string) {
 	if len(cidr) == 0 {
@@ -219,3 +354,473 @@ func AddressesFromCIDR(cidr string, o chan<- string) {
 
 	return
 }
+
+// PrefixTrieEntry is a prefix stored in a PrefixTrie and its value
+type PrefixTrieEntry struct {
+	Prefix *net.IPNet
+	Value  interface{}
+}
+
+// PrefixTrie is a path-compressed binary trie of IPv4 and IPv6 prefixes with a
+// value for each prefix. IPv4 and IPv6 prefixes are kept in separate trees, with
+// IPv4-mapped IPv6 addresses and prefixes longer than /96 treated as IPv4. The
+// ::ffff:0:0/96 prefix and anything shorter stay IPv6 and never match IPv4
+// addresses. It is not safe for concurrent writes.
+type PrefixTrie struct {
+	roots [2]*prefixTrieNode
+	size  int
+}
+
+type prefixTrieNode struct {
+	addr  [net.IPv6len]byte
+	bits  int
+	child [2]*prefixTrieNode
+	value interface{}
+	set   bool
+}
+
+// prefixTrieMagic starts the serialized form of a PrefixTrie
+const prefixTrieMagic = "IPTRIE\x00\x01"
+
+// prefixTrieMaxValue limits the size of a serialized value
+const prefixTrieMaxValue = 64 * 1024 * 1024
+
+// NewPrefixTrie returns an empty prefix trie
+func NewPrefixTrie() *PrefixTrie {
+	return &PrefixTrie{}
+}
+
+// Len returns the number of prefixes in the trie
+func (t *PrefixTrie) Len() int {
+	return t.size
+}
+
+// Insert stores a value for a prefix, replacing any existing value
+func (t *PrefixTrie) Insert(prefix *net.IPNet, value interface{}) {
+	family, addr, bits, ok := prefixTrieKey(prefix.IP, prefix.Mask)
+	if !ok {
+		return
+	}
+
+	leaf := &prefixTrieNode{addr: addr, bits: bits, value: value, set: true}
+	slot := &t.roots[family]
+
+	for {
+		n := *slot
+		if n == nil {
+			*slot = leaf
+			t.size++
+			return
+		}
+
+		common := prefixTrieCommon(&n.addr, &addr, prefixTrieMin(n.bits, bits))
+
+		// The new prefix is within this node
+		if common == n.bits {
+			if bits == n.bits {
+				if !n.set {
+					t.size++
+				}
+				n.value = value
+				n.set = true
+				return
+			}
+			slot = &n.child[prefixTrieBit(&addr, n.bits)]
+			continue
+		}
+
+		// The new prefix covers this node
+		if common == bits {
+			leaf.child[prefixTrieBit(&n.addr, bits)] = n
+			*slot = leaf
+			t.size++
+			return
+		}
+
+		// The prefixes diverge, join them under their common prefix
+		glue := &prefixTrieNode{addr: prefixTrieMask(&addr, common), bits: common}
+		glue.child[prefixTrieBit(&n.addr, common)] = n
+		glue.child[prefixTrieBit(&addr, common)] = leaf
+		*slot = glue
+		t.size++
+		return
+	}
+}
+
+// Delete removes a prefix, returning false if it was not in the trie
+func (t *PrefixTrie) Delete(prefix *net.IPNet) bool {
+	family, addr, bits, ok := prefixTrieKey(prefix.IP, prefix.Mask)
+	if !ok {
+		return false
+	}
+
+	root, deleted := prefixTrieDelete(t.roots[family], &addr, bits)
+	t.roots[family] = root
+	if deleted {
+		t.size--
+	}
+	return deleted
+}
+
+func prefixTrieDelete(n *prefixTrieNode, addr *[net.IPv6len]byte, bits int) (*prefixTrieNode, bool) {
+	if n == nil || n.bits > bits || prefixTrieCommon(&n.addr, addr, n.bits) < n.bits {
+		return n, false
+	}
+
+	if n.bits == bits {
+		if !n.set {
+			return n, false
+		}
+		n.set = false
+		n.value = nil
+		return prefixTrieCompact(n), true
+	}
+
+	b := prefixTrieBit(addr, n.bits)
+	c, deleted := prefixTrieDelete(n.child[b], addr, bits)
+	n.child[b] = c
+	if deleted {
+		return prefixTrieCompact(n), true
+	}
+	return n, false
+}
+
+// prefixTrieCompact removes a node without a value that has less than two children
+func prefixTrieCompact(n *prefixTrieNode) *prefixTrieNode {
+	if n.set {
+		return n
+	}
+	switch {
+	case n.child[0] == nil:
+		return n.child[1]
+	case n.child[1] == nil:
+		return n.child[0]
+	}
+	return n
+}
+
+// Get returns the value of an exact prefix
+func (t *PrefixTrie) Get(prefix *net.IPNet) (interface{}, bool) {
+	family, addr, bits, ok := prefixTrieKey(prefix.IP, prefix.Mask)
+	if !ok {
+		return nil, false
+	}
+
+	n := t.roots[family]
+	for n != nil && n.bits <= bits && prefixTrieCommon(&n.addr, &addr, n.bits) == n.bits {
+		if n.bits == bits {
+			return n.value, n.set
+		}
+		n = n.child[prefixTrieBit(&addr, n.bits)]
+	}
+	return nil, false
+}
+
+// LongestMatch returns the most specific prefix that contains an IP address
+func (t *PrefixTrie) LongestMatch(ip net.IP) (*net.IPNet, interface{}, bool) {
+	family := prefixTrieFamily(ip)
+	if family < 0 {
+		return nil, nil, false
+	}
+
+	var addr [net.IPv6len]byte
+	bits := 128
+	if family == 0 {
+		copy(addr[:], ip.To4())
+		bits = 32
+	} else {
+		copy(addr[:], ip.To16())
+	}
+
+	nodes := t.covering(family, &addr, bits)
+	if len(nodes) == 0 {
+		return nil, nil, false
+	}
+	n := nodes[len(nodes)-1]
+	return n.ipnet(family), n.value, true
+}
+
+// Covering returns every prefix that contains a network, including the network
+// itself, from the least to the most specific
+func (t *PrefixTrie) Covering(prefix *net.IPNet) []PrefixTrieEntry {
+	entries := []PrefixTrieEntry{}
+
+	family, addr, bits, ok := prefixTrieKey(prefix.IP, prefix.Mask)
+	if !ok {
+		return entries
+	}
+
+	for _, n := range t.covering(family, &addr, bits) {
+		entries = append(entries, PrefixTrieEntry{Prefix: n.ipnet(family), Value: n.value})
+	}
+	return entries
+}
+
+// covering returns the nodes with values that contain the first bits of an address
+func (t *PrefixTrie) covering(family int, addr *[net.IPv6len]byte, bits int) []*prefixTrieNode {
+	nodes := []*prefixTrieNode{}
+	n := t.roots[family]
+	for n != nil && n.bits <= bits && prefixTrieCommon(&n.addr, addr, n.bits) == n.bits {
+		if n.set {
+			nodes = append(nodes, n)
+		}
+		if n.bits == bits {
+			break
+		}
+		n = n.child[prefixTrieBit(addr, n.bits)]
+	}
+	return nodes
+}
+
+// WalkSubtree calls fn for every prefix within a network, including the network
+// itself, in address order with covering prefixes first. The walk stops when fn
+// returns false.
+func (t *PrefixTrie) WalkSubtree(prefix *net.IPNet, fn func(*net.IPNet, interface{}) bool) {
+	family, addr, bits, ok := prefixTrieKey(prefix.IP, prefix.Mask)
+	if !ok {
+		return
+	}
+
+	// Find the first node within the network
+	n := t.roots[family]
+	for n != nil && n.bits < bits {
+		if prefixTrieCommon(&n.addr, &addr, n.bits) < n.bits {
+			return
+		}
+		n = n.child[prefixTrieBit(&addr, n.bits)]
+	}
+
+	if n == nil || prefixTrieCommon(&n.addr, &addr, bits) < bits {
+		return
+	}
+
+	prefixTrieWalk(n, func(n *prefixTrieNode) bool {
+		return fn(n.ipnet(family), n.value)
+	})
+}
+
+// Walk calls fn for every prefix in the trie, IPv4 first and in address order.
+// The walk stops when fn returns false.
+func (t *PrefixTrie) Walk(fn func(*net.IPNet, interface{}) bool) {
+	for family := range t.roots {
+		ok := prefixTrieWalk(t.roots[family], func(n *prefixTrieNode) bool {
+			return fn(n.ipnet(family), n.value)
+		})
+		if !ok {
+			return
+		}
+	}
+}
+
+// prefixTrieWalk calls fn for each node with a value, returning false if fn stopped the walk
+func prefixTrieWalk(n *prefixTrieNode, fn func(*prefixTrieNode) bool) bool {
+	if n == nil {
+		return true
+	}
+	if n.set && !fn(n) {
+		return false
+	}
+	return prefixTrieWalk(n.child[0], fn) && prefixTrieWalk(n.child[1], fn)
+}
+
+// Encode writes the trie in a compact binary form, using enc to convert each
+// value to bytes. A nil enc stores prefixes without values. Each prefix is
+// written as a family tag, prefix length, the significant bytes of the address,
+// and the length and bytes of the value.
+func (t *PrefixTrie) Encode(w io.Writer, enc func(interface{}) ([]byte, error)) error {
+	bw := bufio.NewWriterSize(w, 1024*1024)
+	bw.WriteString(prefixTrieMagic)
+
+	buf := make([]byte, binary.MaxVarintLen64)
+	bw.Write(buf[0:binary.PutUvarint(buf, uint64(t.size))])
+
+	var err error
+	for family := range t.roots {
+		tag := byte(IPKeyTagIPv4)
+		if family == 1 {
+			tag = IPKeyTagIPv6
+		}
+
+		prefixTrieWalk(t.roots[family], func(n *prefixTrieNode) bool {
+			var val []byte
+			if enc != nil {
+				if val, err = enc(n.value); err != nil {
+					return false
+				}
+			}
+
+			bw.WriteByte(tag)
+			bw.WriteByte(byte(n.bits))
+			bw.Write(n.addr[0 : (n.bits+7)/8])
+			bw.Write(buf[0:binary.PutUvarint(buf, uint64(len(val)))])
+			bw.Write(val)
+			return true
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return bw.Flush()
+}
+
+// DecodePrefixTrie reads a trie written by Encode, using dec to convert each
+// value. A nil dec keeps the raw bytes of each value.
+func DecodePrefixTrie(r io.Reader, dec func([]byte) (interface{}, error)) (*PrefixTrie, error) {
+	br := bufio.NewReaderSize(r, 1024*1024)
+
+	magic := make([]byte, len(prefixTrieMagic))
+	if _, err := io.ReadFull(br, magic); err != nil || string(magic) != prefixTrieMagic {
+		return nil, errors.New("not a prefix trie")
+	}
+
+	count, err := binary.ReadUvarint(br)
+	if err != nil {
+		return nil, errors.New("truncated prefix trie")
+	}
+
+	t := NewPrefixTrie()
+	hdr := make([]byte, 2)
+	for i := uint64(0); i < count; i++ {
+		if _, err := io.ReadFull(br, hdr); err != nil {
+			return nil, errors.New("truncated prefix trie")
+		}
+
+		alen := net.IPv4len
+		if hdr[0] == IPKeyTagIPv6 {
+			alen = net.IPv6len
+		} else if hdr[0] != IPKeyTagIPv4 {
+			return nil, fmt.Errorf("invalid address family %d in prefix trie", hdr[0])
+		}
+
+		bits := int(hdr[1])
+		if bits > alen*8 {
+			return nil, fmt.Errorf("invalid prefix length %d in prefix trie", bits)
+		}
+
+		ip := make(net.IP, alen)
+		if _, err := io.ReadFull(br, ip[0:(bits+7)/8]); err != nil {
+			return nil, errors.New("truncated prefix trie")
+		}
+
+		vlen, err := binary.ReadUvarint(br)
+		if err != nil || vlen > prefixTrieMaxValue {
+			return nil, errors.New("truncated prefix trie")
+		}
+
+		var val []byte
+		if vlen > 0 {
+			val = make([]byte, vlen)
+			if _, err := io.ReadFull(br, val); err != nil {
+				return nil, errors.New("truncated prefix trie")
+			}
+		}
+
+		var value interface{} = val
+		if dec != nil {
+			if value, err = dec(val); err != nil {
+				return nil, err
+			}
+		}
+
+		t.Insert(&net.IPNet{IP: ip, Mask: net.CIDRMask(bits, alen*8)}, value)
+	}
+
+	return t, nil
+}
+
+// prefixTrieFamily returns 0 for IPv4 addresses, 1 for IPv6, and -1 otherwise
+func prefixTrieFamily(ip net.IP) int {
+	switch {
+	case ip.To4() != nil:
+		return 0
+	case len(ip) == net.IPv6len:
+		return 1
+	}
+	return -1
+}
+
+// prefixTrieKey returns the family, masked address, and length of a prefix
+func prefixTrieKey(ip net.IP, mask net.IPMask) (int, [net.IPv6len]byte, int, bool) {
+	var addr [net.IPv6len]byte
+
+	family := prefixTrieFamily(ip)
+	bits, total := mask.Size()
+	if family < 0 || total == 0 {
+		return 0, addr, 0, false
+	}
+
+	switch {
+	case family == 0 && total == 128 && bits > 96:
+		// IPv4 prefixes in IPv6 form, such as from ParseCIDR("::ffff:1.2.3.0/120")
+		bits -= 96
+		copy(addr[:], ip.To4())
+	case family == 0 && total == 128:
+		// Folding ::ffff:0:0/96 would turn it into 0.0.0.0/0
+		family = 1
+		copy(addr[:], ip.To16())
+	case family == 0:
+		copy(addr[:], ip.To4())
+	case total == 128:
+		copy(addr[:], ip.To16())
+	default:
+		return 0, addr, 0, false
+	}
+
+	return family, prefixTrieMask(&addr, bits), bits, true
+}
+
+func (n *prefixTrieNode) ipnet(family int) *net.IPNet {
+	if family == 0 {
+		ip := make(net.IP, net.IPv4len)
+		copy(ip, n.addr[0:net.IPv4len])
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(n.bits, 32)}
+	}
+	ip := make(net.IP, net.IPv6len)
+	copy(ip, n.addr[:])
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(n.bits, 128)}
+}
+
+// prefixTrieBit returns the bit of an address at an offset from the most significant bit
+func prefixTrieBit(addr *[net.IPv6len]byte, i int) int {
+	return int(addr[i/8]>>(7-uint(i%8))) & 1
+}
+
+// prefixTrieCommon returns the number of leading bits two addresses share, up to max
+func prefixTrieCommon(a *[net.IPv6len]byte, b *[net.IPv6len]byte, max int) int {
+	n := 0
+	for i := 0; n < max; i++ {
+		x := a[i] ^ b[i]
+		if x == 0 {
+			n += 8
+			continue
+		}
+		for x&0x80 == 0 {
+			n++
+			x <<= 1
+		}
+		break
+	}
+	return prefixTrieMin(n, max)
+}
+
+// prefixTrieMask clears the bits of an address after the prefix length
+func prefixTrieMask(addr *[net.IPv6len]byte, bits int) [net.IPv6len]byte {
+	var masked [net.IPv6len]byte
+	for i := range masked {
+		switch {
+		case bits >= (i+1)*8:
+			masked[i] = addr[i]
+		case bits > i*8:
+			masked[i] = addr[i] & (0xff << uint(8-(bits-i*8)))
+		}
+	}
+	return masked
+}
+
+func prefixTrieMin(a int, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
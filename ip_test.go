@@ -0,0 +1,340 @@
+package inetdata
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"net"
+	"reflect"
+	"sort"
+	"strconv"
+	"testing"
+)
+
+func TestIPv4UIntRange2CIDRs(t *testing.T) {
+	tests := []struct {
+		start string
+		count uint32
+		exp   []string
+	}{
+		{"10.0.0.0", 256, []string{"10.0.0.0/24"}},
+		{"10.0.0.0", 768, []string{"10.0.0.0/23", "10.0.2.0/24"}},
+		{"10.0.0.128", 256, []string{"10.0.0.128/25", "10.0.1.0/25"}},
+		{"10.0.0.1", 4, []string{"10.0.0.1/32", "10.0.0.2/31", "10.0.0.4/32"}},
+		{"192.0.2.255", 1, []string{"192.0.2.255/32"}},
+		{"192.168.0.0", 65536, []string{"192.168.0.0/16"}},
+		{"192.167.255.0", 65536, []string{"192.167.255.0/24", "192.168.0.0/17", "192.168.128.0/18",
+			"192.168.192.0/19", "192.168.224.0/20", "192.168.240.0/21", "192.168.248.0/22",
+			"192.168.252.0/23", "192.168.254.0/24"}},
+	}
+
+	for _, tt := range tests {
+		start, err := IPv42UInt(tt.start)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		got := IPv4UIntRange2CIDRs(start, start+tt.count-1)
+		if !reflect.DeepEqual(got, tt.exp) {
+			t.Errorf("%s+%d: got %v, expected %v", tt.start, tt.count, got, tt.exp)
+		}
+	}
+}
+
+func TestIPv4Range2CIDRs(t *testing.T) {
+	got, err := IPv4Range2CIDRs("10.0.0.128", "10.0.1.127")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exp := []string{"10.0.0.128/25", "10.0.1.0/25"}
+	if !reflect.DeepEqual(got, exp) {
+		t.Fatalf("got %v, expected %v", got, exp)
+	}
+
+	if _, err := IPv4Range2CIDRs("10.0.1.0", "10.0.0.0"); err == nil {
+		t.Fatal("expected an error for a reversed range")
+	}
+}
+
+// randomTriePrefix returns a prefix from a small address space so that many of
+// the generated prefixes overlap
+func randomTriePrefix(rnd *rand.Rand) *net.IPNet {
+	if rnd.Intn(2) == 0 {
+		ip := net.IPv4(10, byte(rnd.Intn(4)), byte(rnd.Intn(4)), byte(rnd.Intn(256))).To4()
+		mask := net.CIDRMask(8+rnd.Intn(25), 32)
+		return &net.IPNet{IP: ip.Mask(mask), Mask: mask}
+	}
+
+	ip := net.ParseIP("2001:db8::")
+	ip[4], ip[5], ip[15] = byte(rnd.Intn(4)), byte(rnd.Intn(4)), byte(rnd.Intn(256))
+	mask := net.CIDRMask(24+rnd.Intn(105), 128)
+	return &net.IPNet{IP: ip.Mask(mask), Mask: mask}
+}
+
+// triePrefixCovers checks whether p contains q in a brute-force reference
+func triePrefixCovers(p *net.IPNet, q *net.IPNet) bool {
+	pb, _ := p.Mask.Size()
+	qb, _ := q.Mask.Size()
+	return len(p.IP) == len(q.IP) && pb <= qb && p.Contains(q.IP)
+}
+
+// sortTriePrefixes orders prefixes by address with covering prefixes first,
+// the order of Walk and WalkSubtree
+func sortTriePrefixes(prefixes []*net.IPNet) {
+	sort.Slice(prefixes, func(i, j int) bool {
+		if len(prefixes[i].IP) != len(prefixes[j].IP) {
+			return len(prefixes[i].IP) < len(prefixes[j].IP)
+		}
+		if c := bytes.Compare(prefixes[i].IP, prefixes[j].IP); c != 0 {
+			return c < 0
+		}
+		bi, _ := prefixes[i].Mask.Size()
+		bj, _ := prefixes[j].Mask.Size()
+		return bi < bj
+	})
+}
+
+func triePrefixStrings(prefixes []*net.IPNet, ref map[string]int) []string {
+	out := []string{}
+	for _, p := range prefixes {
+		out = append(out, fmt.Sprintf("%s=%d", p, ref[p.String()]))
+	}
+	return out
+}
+
+func walkTrieStrings(walk func(func(*net.IPNet, interface{}) bool)) []string {
+	out := []string{}
+	walk(func(p *net.IPNet, v interface{}) bool {
+		out = append(out, fmt.Sprintf("%s=%d", p, v.(int)))
+		return true
+	})
+	return out
+}
+
+func checkPrefixTrie(t *testing.T, rnd *rand.Rand, trie *PrefixTrie, ref map[string]int, prefixes map[string]*net.IPNet) {
+	if trie.Len() != len(ref) {
+		t.Fatalf("Len() = %d, expected %d", trie.Len(), len(ref))
+	}
+
+	all := []*net.IPNet{}
+	for k, p := range prefixes {
+		all = append(all, p)
+		if v, ok := trie.Get(p); !ok || v.(int) != ref[k] {
+			t.Fatalf("Get(%s) = %v, %v, expected %d", p, v, ok, ref[k])
+		}
+	}
+	sortTriePrefixes(all)
+
+	if got, exp := walkTrieStrings(trie.Walk), triePrefixStrings(all, ref); !reflect.DeepEqual(got, exp) {
+		t.Fatalf("Walk() = %v, expected %v", got, exp)
+	}
+
+	for i := 0; i < 50; i++ {
+		q := randomTriePrefix(rnd)
+		qbits, qtotal := q.Mask.Size()
+
+		if _, ok := prefixes[q.String()]; !ok {
+			if v, ok := trie.Get(q); ok {
+				t.Fatalf("Get(%s) = %v for a missing prefix", q, v)
+			}
+		}
+
+		covering := []*net.IPNet{}
+		inside := []*net.IPNet{}
+		for _, p := range all {
+			if triePrefixCovers(p, q) {
+				covering = append(covering, p)
+			}
+			if triePrefixCovers(q, p) {
+				inside = append(inside, p)
+			}
+		}
+		sort.SliceStable(covering, func(i, j int) bool {
+			bi, _ := covering[i].Mask.Size()
+			bj, _ := covering[j].Mask.Size()
+			return bi < bj
+		})
+
+		got := []string{}
+		for _, e := range trie.Covering(q) {
+			got = append(got, fmt.Sprintf("%s=%d", e.Prefix, e.Value.(int)))
+		}
+		if exp := triePrefixStrings(covering, ref); !reflect.DeepEqual(got, exp) {
+			t.Fatalf("Covering(%s) = %v, expected %v", q, got, exp)
+		}
+
+		walk := func(fn func(*net.IPNet, interface{}) bool) { trie.WalkSubtree(q, fn) }
+		if got, exp := walkTrieStrings(walk), triePrefixStrings(inside, ref); !reflect.DeepEqual(got, exp) {
+			t.Fatalf("WalkSubtree(%s) = %v, expected %v", q, got, exp)
+		}
+
+		// Use the prefix as a single address for the longest match
+		if qbits == qtotal {
+			p, v, ok := trie.LongestMatch(q.IP)
+			if len(covering) == 0 {
+				if ok {
+					t.Fatalf("LongestMatch(%s) = %s, expected no match", q.IP, p)
+				}
+				continue
+			}
+			best := covering[len(covering)-1]
+			if !ok || p.String() != best.String() || v.(int) != ref[best.String()] {
+				t.Fatalf("LongestMatch(%s) = %s, %v, expected %s", q.IP, p, v, best)
+			}
+		}
+	}
+}
+
+func TestPrefixTrieRandom(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	trie := NewPrefixTrie()
+	ref := map[string]int{}
+	prefixes := map[string]*net.IPNet{}
+
+	for i := 0; i < 4000; i++ {
+		p := randomTriePrefix(rnd)
+		k := p.String()
+
+		// Insert twice as often as deleting so that the trie grows
+		if rnd.Intn(3) == 0 {
+			_, exists := ref[k]
+			if deleted := trie.Delete(p); deleted != exists {
+				t.Fatalf("Delete(%s) = %v, expected %v", p, deleted, exists)
+			}
+			delete(ref, k)
+			delete(prefixes, k)
+		} else {
+			trie.Insert(p, i)
+			ref[k] = i
+			prefixes[k] = p
+		}
+
+		if i%200 == 0 {
+			checkPrefixTrie(t, rnd, trie, ref, prefixes)
+		}
+	}
+	checkPrefixTrie(t, rnd, trie, ref, prefixes)
+
+	// Removing every prefix leaves an empty trie
+	for k, p := range prefixes {
+		if !trie.Delete(p) {
+			t.Fatalf("Delete(%s) failed", p)
+		}
+		delete(ref, k)
+		delete(prefixes, k)
+	}
+	checkPrefixTrie(t, rnd, trie, ref, prefixes)
+
+	if trie.roots[0] != nil || trie.roots[1] != nil {
+		t.Fatal("expected no nodes after deleting every prefix")
+	}
+}
+
+func TestPrefixTrieEncode(t *testing.T) {
+	rnd := rand.New(rand.NewSource(2))
+	trie := NewPrefixTrie()
+	for i := 0; i < 500; i++ {
+		trie.Insert(randomTriePrefix(rnd), i)
+	}
+
+	enc := func(v interface{}) ([]byte, error) {
+		return []byte(strconv.Itoa(v.(int))), nil
+	}
+	dec := func(b []byte) (interface{}, error) {
+		return strconv.Atoi(string(b))
+	}
+
+	var buf bytes.Buffer
+	if err := trie.Encode(&buf, enc); err != nil {
+		t.Fatal(err)
+	}
+
+	decoded, err := DecodePrefixTrie(bytes.NewReader(buf.Bytes()), dec)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if decoded.Len() != trie.Len() {
+		t.Fatalf("decoded %d prefixes, expected %d", decoded.Len(), trie.Len())
+	}
+	if got, exp := walkTrieStrings(decoded.Walk), walkTrieStrings(trie.Walk); !reflect.DeepEqual(got, exp) {
+		t.Fatalf("decoded trie differs from the original")
+	}
+
+	// Every truncated copy is rejected
+	data := buf.Bytes()
+	for i := 0; i < len(data); i++ {
+		if _, err := DecodePrefixTrie(bytes.NewReader(data[0:i]), dec); err == nil {
+			t.Fatalf("decoded a trie truncated to %d of %d bytes", i, len(data))
+		}
+	}
+}
+
+func TestPrefixTrieIPv4Mapped(t *testing.T) {
+	trie := NewPrefixTrie()
+
+	_, mapped, _ := net.ParseCIDR("::ffff:10.0.0.0/104")
+	trie.Insert(mapped, 1)
+
+	// IPv4 prefixes in IPv6 form are stored as IPv4
+	_, v4, _ := net.ParseCIDR("10.0.0.0/8")
+	if v, ok := trie.Get(v4); !ok || v.(int) != 1 {
+		t.Fatalf("Get(%s) = %v, %v", v4, v, ok)
+	}
+
+	for _, ip := range []string{"10.1.2.3", "::ffff:10.1.2.3"} {
+		p, _, ok := trie.LongestMatch(net.ParseIP(ip))
+		if !ok || p.String() != "10.0.0.0/8" {
+			t.Fatalf("LongestMatch(%s) = %v, %v", ip, p, ok)
+		}
+	}
+
+	// The IPv4-mapped range itself is not folded into 0.0.0.0/0
+	_, all, _ := net.ParseCIDR("::ffff:0:0/96")
+	trie.Insert(all, 2)
+
+	if p, _, ok := trie.LongestMatch(net.ParseIP("192.0.2.1")); ok {
+		t.Fatalf("LongestMatch(192.0.2.1) = %s, expected no match", p)
+	}
+
+	_, zero, _ := net.ParseCIDR("0.0.0.0/0")
+	if v, ok := trie.Get(zero); ok {
+		t.Fatalf("Get(%s) = %v for a missing prefix", zero, v)
+	}
+
+	if v, ok := trie.Get(all); !ok || v.(int) != 2 {
+		t.Fatalf("Get(%s) = %v, %v", all, v, ok)
+	}
+
+	enc := func(v interface{}) ([]byte, error) {
+		return []byte(strconv.Itoa(v.(int))), nil
+	}
+	dec := func(b []byte) (interface{}, error) {
+		return strconv.Atoi(string(b))
+	}
+
+	var buf bytes.Buffer
+	if err := trie.Encode(&buf, enc); err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := DecodePrefixTrie(&buf, dec)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// IP and IPNet strings show IPv4-mapped addresses as IPv4, so compare the bytes
+	for _, tr := range []*PrefixTrie{trie, decoded} {
+		got := []string{}
+		tr.Walk(func(p *net.IPNet, v interface{}) bool {
+			bits, total := p.Mask.Size()
+			got = append(got, fmt.Sprintf("%x/%d/%d=%d", []byte(p.IP), bits, total, v.(int)))
+			return true
+		})
+
+		exp := []string{"0a000000/8/32=1", "00000000000000000000ffff00000000/96/128=2"}
+		if !reflect.DeepEqual(got, exp) {
+			t.Fatalf("Walk() = %v, expected %v", got, exp)
+		}
+	}
+}
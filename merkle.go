@@ -0,0 +1,225 @@
+package inetdata
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+)
+
+// MerkleLeafHash returns the RFC 6962 hash of a log entry
+func MerkleLeafHash(leaf []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{0x00})
+	h.Write(leaf)
+	return h.Sum(nil)
+}
+
+// MerkleNodeHash returns the RFC 6962 hash of an interior node
+func MerkleNodeHash(left []byte, right []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{0x01})
+	h.Write(left)
+	h.Write(right)
+	return h.Sum(nil)
+}
+
+// MerkleFrontier is a compact form of the first Size leaves of a Merkle tree. It
+// holds the roots of the perfect subtrees that cover those leaves, largest first.
+type MerkleFrontier struct {
+	Size  uint64
+	Nodes [][]byte
+}
+
+// Append adds the next leaf hash to the frontier
+func (f *MerkleFrontier) Append(leafHash []byte) {
+	h := leafHash
+	for size := f.Size; size&1 == 1; size >>= 1 {
+		h = MerkleNodeHash(f.Nodes[len(f.Nodes)-1], h)
+		f.Nodes = f.Nodes[:len(f.Nodes)-1]
+	}
+	f.Nodes = append(f.Nodes, h)
+	f.Size++
+}
+
+// Root returns the root hash of a tree containing Size leaves
+func (f *MerkleFrontier) Root() []byte {
+	if len(f.Nodes) == 0 {
+		h := sha256.Sum256(nil)
+		return h[:]
+	}
+
+	h := f.Nodes[len(f.Nodes)-1]
+	for i := len(f.Nodes) - 2; i >= 0; i-- {
+		h = MerkleNodeHash(f.Nodes[i], h)
+	}
+	return h
+}
+
+// MerkleFrontierFromProof verifies an inclusion proof for the leaf at index in a
+// tree of the given size and returns the frontier of the leaves before it. The
+// left siblings along the audit path are exactly the subtrees that cover them.
+func MerkleFrontierFromProof(index uint64, size uint64, leafHash []byte, root []byte, proof [][]byte) (*MerkleFrontier, error) {
+	if index >= size {
+		return nil, fmt.Errorf("leaf index %d is beyond tree size %d", index, size)
+	}
+
+	fn := index
+	sn := size - 1
+	r := leafHash
+	left := [][]byte{}
+
+	for _, p := range proof {
+		if sn == 0 {
+			return nil, errors.New("inclusion proof is too long")
+		}
+
+		if fn&1 == 1 || fn == sn {
+			r = MerkleNodeHash(p, r)
+			left = append(left, p)
+			for fn&1 == 0 && fn != 0 {
+				fn >>= 1
+				sn >>= 1
+			}
+		} else {
+			r = MerkleNodeHash(r, p)
+		}
+		fn >>= 1
+		sn >>= 1
+	}
+
+	if sn != 0 {
+		return nil, errors.New("inclusion proof is too short")
+	}
+
+	if !bytes.Equal(r, root) {
+		return nil, errors.New("inclusion proof does not match the root hash")
+	}
+
+	f := &MerkleFrontier{Size: index}
+	for i := len(left) - 1; i >= 0; i-- {
+		f.Nodes = append(f.Nodes, left[i])
+	}
+	return f, nil
+}
+
+// VerifyMerkleConsistency verifies that a tree of size first with root hash
+// firstRoot is a prefix of a tree of size second with root hash secondRoot
+func VerifyMerkleConsistency(first uint64, second uint64, firstRoot []byte, secondRoot []byte, proof [][]byte) error {
+	if first > second {
+		return fmt.Errorf("tree size %d is larger than %d", first, second)
+	}
+
+	if first == second {
+		if len(proof) > 0 {
+			return errors.New("consistency proof for identical trees is not empty")
+		}
+		if !bytes.Equal(firstRoot, secondRoot) {
+			return errors.New("root hashes differ for the same tree size")
+		}
+		return nil
+	}
+
+	// Every tree is consistent with the empty tree
+	if first == 0 {
+		return nil
+	}
+
+	if len(proof) == 0 {
+		return errors.New("consistency proof is empty")
+	}
+
+	// The first tree is a complete subtree, so its root is part of the path
+	if first&(first-1) == 0 {
+		proof = append([][]byte{firstRoot}, proof...)
+	}
+
+	fn := first - 1
+	sn := second - 1
+	for fn&1 == 1 {
+		fn >>= 1
+		sn >>= 1
+	}
+
+	fr := proof[0]
+	sr := proof[0]
+
+	for _, c := range proof[1:] {
+		if sn == 0 {
+			return errors.New("consistency proof is too long")
+		}
+
+		if fn&1 == 1 || fn == sn {
+			fr = MerkleNodeHash(c, fr)
+			sr = MerkleNodeHash(c, sr)
+			for fn&1 == 0 && fn != 0 {
+				fn >>= 1
+				sn >>= 1
+			}
+		} else {
+			sr = MerkleNodeHash(sr, c)
+		}
+		fn >>= 1
+		sn >>= 1
+	}
+
+	if sn != 0 {
+		return errors.New("consistency proof is too short")
+	}
+
+	if !bytes.Equal(fr, firstRoot) {
+		return errors.New("consistency proof does not match the first root hash")
+	}
+
+	if !bytes.Equal(sr, secondRoot) {
+		return errors.New("consistency proof does not match the second root hash")
+	}
+
+	return nil
+}
+
+// AppendSubtree adds the root hash of a perfect subtree with 2^level leaves to the
+// frontier. The frontier size must be a multiple of the subtree size.
+func (f *MerkleFrontier) AppendSubtree(level uint, hash []byte) error {
+	if f.Size&(1<<level-1) != 0 {
+		return fmt.Errorf("subtree at level %d is not aligned with size %d", level, f.Size)
+	}
+
+	h := hash
+	for size := f.Size >> level; size&1 == 1; size >>= 1 {
+		h = MerkleNodeHash(f.Nodes[len(f.Nodes)-1], h)
+		f.Nodes = f.Nodes[:len(f.Nodes)-1]
+	}
+	f.Nodes = append(f.Nodes, h)
+	f.Size += 1 << level
+	return nil
+}
+
+// Clone returns a copy of the frontier
+func (f *MerkleFrontier) Clone() *MerkleFrontier {
+	c := &MerkleFrontier{Size: f.Size, Nodes: make([][]byte, len(f.Nodes))}
+	copy(c.Nodes, f.Nodes)
+	return c
+}
+
+// ExtendMerkleFrontier grows the frontier to size using the largest aligned
+// subtrees available. The nodeHash callback returns the root hash of the perfect
+// subtree at the given level and index.
+func ExtendMerkleFrontier(f *MerkleFrontier, size uint64, nodeHash func(level uint, index uint64) ([]byte, error)) error {
+	for f.Size < size {
+		var level uint
+		for f.Size&(1<<(level+1)-1) == 0 && f.Size+1<<(level+1) <= size {
+			level++
+		}
+
+		h, err := nodeHash(level, f.Size>>level)
+		if err != nil {
+			return err
+		}
+
+		if err := f.AppendSubtree(level, h); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,241 @@
+package inetdata
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+)
+
+// The 8-leaf tree used by the RFC 6962 test vectors of the Go CT and Trillian
+// test suites
+var merkleTestLeaves = []string{
+	"",
+	"00",
+	"10",
+	"2021",
+	"3031",
+	"40414243",
+	"5051525354555657",
+	"606162636465666768696a6b6c6d6e6f",
+}
+
+// Root hashes of the trees of the first 1 to 8 leaves
+var merkleTestRoots = []string{
+	"6e340b9cffb37a989ca544e6bb780a2c78901d3fb33738768511a30617afa01d",
+	"fac54203e7cc696cf0dfcb42c92a1d9dbaf70ad9e621f4bd8d98662f00e3c125",
+	"aeb6bcfe274b70a14fb067a5e5578264db0fa9b51af5e0ba159158f329e06e77",
+	"d37ee418976dd95753c1c73862b9398fa2a2cf9b4ff0fdfe8b30cd95209614b7",
+	"4e3bbb1f7b478dcfe71fb631631519a3bca12c9aefca1612bfce4c13a86264d4",
+	"76e67dadbcdf1e10e1b74ddc608abd2f98dfb16fbce75277b5232a127f2087ef",
+	"ddb89be403809e325750d3d263cd78929c2942b7942a34b77e122c9594a74c8c",
+	"5dc9da79a70659a9ad559cb701ded9a2ab9d823aad2f4960cfe370eff4604328",
+}
+
+var merkleTestInclusionProofs = []struct {
+	index uint64
+	size  uint64
+	proof []string
+}{
+	{0, 8, []string{
+		"96a296d224f285c67bee93c30f8a309157f0daa35dc5b87e410b78630a09cfc7",
+		"5f083f0a1a33ca076a95279832580db3e0ef4584bdff1f54c8a360f50de3031e",
+		"6b47aaf29ee3c2af9af889bc1fb9254dabd31177f16232dd6aab035ca39bf6e4",
+	}},
+	{5, 8, []string{
+		"bc1a0643b12e4d2d7c77918f44e0f4f79a838b6cf9ec5b5c283e1f4d88599e6b",
+		"ca854ea128ed050b41b35ffc1b87b8eb2bde461e9e3b5596ece6b9d5975a0ae0",
+		"d37ee418976dd95753c1c73862b9398fa2a2cf9b4ff0fdfe8b30cd95209614b7",
+	}},
+	{2, 3, []string{
+		"fac54203e7cc696cf0dfcb42c92a1d9dbaf70ad9e621f4bd8d98662f00e3c125",
+	}},
+	{1, 5, []string{
+		"6e340b9cffb37a989ca544e6bb780a2c78901d3fb33738768511a30617afa01d",
+		"5f083f0a1a33ca076a95279832580db3e0ef4584bdff1f54c8a360f50de3031e",
+		"bc1a0643b12e4d2d7c77918f44e0f4f79a838b6cf9ec5b5c283e1f4d88599e6b",
+	}},
+	{0, 1, []string{}},
+}
+
+var merkleTestConsistencyProofs = []struct {
+	first  uint64
+	second uint64
+	proof  []string
+}{
+	{8, 8, []string{}},
+	{1, 1, []string{}},
+	{1, 8, []string{
+		"96a296d224f285c67bee93c30f8a309157f0daa35dc5b87e410b78630a09cfc7",
+		"5f083f0a1a33ca076a95279832580db3e0ef4584bdff1f54c8a360f50de3031e",
+		"6b47aaf29ee3c2af9af889bc1fb9254dabd31177f16232dd6aab035ca39bf6e4",
+	}},
+	{6, 8, []string{
+		"0ebc5d3437fbe2db158b9f126a1d118e308181031d0a949f8dededebc558ef6a",
+		"ca854ea128ed050b41b35ffc1b87b8eb2bde461e9e3b5596ece6b9d5975a0ae0",
+		"d37ee418976dd95753c1c73862b9398fa2a2cf9b4ff0fdfe8b30cd95209614b7",
+	}},
+	{2, 5, []string{
+		"5f083f0a1a33ca076a95279832580db3e0ef4584bdff1f54c8a360f50de3031e",
+		"bc1a0643b12e4d2d7c77918f44e0f4f79a838b6cf9ec5b5c283e1f4d88599e6b",
+	}},
+	{4, 8, []string{
+		"6b47aaf29ee3c2af9af889bc1fb9254dabd31177f16232dd6aab035ca39bf6e4",
+	}},
+}
+
+func merkleTestHashes(t *testing.T, vals []string) [][]byte {
+	hashes := [][]byte{}
+	for _, v := range vals {
+		h, err := hex.DecodeString(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		hashes = append(hashes, h)
+	}
+	return hashes
+}
+
+func merkleTestLeafHashes(t *testing.T) [][]byte {
+	hashes := [][]byte{}
+	for _, l := range merkleTestHashes(t, merkleTestLeaves) {
+		hashes = append(hashes, MerkleLeafHash(l))
+	}
+	return hashes
+}
+
+// merkleTestRoot returns the root of the tree of the first size leaves
+func merkleTestRoot(t *testing.T, size uint64) []byte {
+	if size == 0 {
+		return (&MerkleFrontier{}).Root()
+	}
+	return merkleTestHashes(t, merkleTestRoots[size-1:size])[0]
+}
+
+// tamperedProofs returns copies of a proof with each node altered in turn, one
+// node dropped, and one node added
+func tamperedProofs(proof [][]byte) [][][]byte {
+	out := [][][]byte{}
+	for i := range proof {
+		p := append([][]byte{}, proof...)
+		p[i] = append([]byte{}, p[i]...)
+		p[i][0] ^= 1
+		out = append(out, p)
+	}
+	if len(proof) > 0 {
+		out = append(out, proof[:len(proof)-1])
+	}
+	return append(out, append(append([][]byte{}, proof...), make([]byte, 32)))
+}
+
+func TestMerkleFrontierRoots(t *testing.T) {
+	f := &MerkleFrontier{}
+	if hex.EncodeToString(f.Root()) != "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855" {
+		t.Fatalf("got empty root %x", f.Root())
+	}
+
+	for i, h := range merkleTestLeafHashes(t) {
+		f.Append(h)
+		if got := hex.EncodeToString(f.Root()); got != merkleTestRoots[i] {
+			t.Fatalf("size %d: got root %s, expected %s", i+1, got, merkleTestRoots[i])
+		}
+	}
+}
+
+func TestMerkleFrontierFromProof(t *testing.T) {
+	leaves := merkleTestLeafHashes(t)
+
+	for _, tt := range merkleTestInclusionProofs {
+		proof := merkleTestHashes(t, tt.proof)
+		root := merkleTestRoot(t, tt.size)
+
+		f, err := MerkleFrontierFromProof(tt.index, tt.size, leaves[tt.index], root, proof)
+		if err != nil {
+			t.Errorf("leaf %d of %d: %s", tt.index, tt.size, err)
+			continue
+		}
+
+		// The frontier covers the leaves before the proven one
+		if f.Size != tt.index || !bytes.Equal(f.Root(), merkleTestRoot(t, tt.index)) {
+			t.Errorf("leaf %d of %d: got frontier of size %d with root %x", tt.index, tt.size, f.Size, f.Root())
+		}
+
+		for _, p := range tamperedProofs(proof) {
+			if _, err := MerkleFrontierFromProof(tt.index, tt.size, leaves[tt.index], root, p); err == nil {
+				t.Errorf("leaf %d of %d: accepted tampered proof %x", tt.index, tt.size, p)
+			}
+		}
+
+		if _, err := MerkleFrontierFromProof(tt.index, tt.size, leaves[(tt.index+1)%8], root, proof); err == nil {
+			t.Errorf("leaf %d of %d: accepted the wrong leaf", tt.index, tt.size)
+		}
+	}
+
+	if _, err := MerkleFrontierFromProof(8, 8, leaves[0], merkleTestRoot(t, 8), nil); err == nil {
+		t.Errorf("accepted a leaf index beyond the tree size")
+	}
+}
+
+func TestVerifyMerkleConsistency(t *testing.T) {
+	for _, tt := range merkleTestConsistencyProofs {
+		proof := merkleTestHashes(t, tt.proof)
+		first, second := merkleTestRoot(t, tt.first), merkleTestRoot(t, tt.second)
+
+		if err := VerifyMerkleConsistency(tt.first, tt.second, first, second, proof); err != nil {
+			t.Errorf("%d to %d: %s", tt.first, tt.second, err)
+		}
+
+		for _, p := range tamperedProofs(proof) {
+			if err := VerifyMerkleConsistency(tt.first, tt.second, first, second, p); err == nil {
+				t.Errorf("%d to %d: accepted tampered proof %x", tt.first, tt.second, p)
+			}
+		}
+
+		// A proof only holds for the roots it was made for
+		wrongFirst := append([]byte{}, first...)
+		wrongFirst[31] ^= 1
+		if err := VerifyMerkleConsistency(tt.first, tt.second, wrongFirst, second, proof); err == nil {
+			t.Errorf("%d to %d: accepted the wrong first root", tt.first, tt.second)
+		}
+		wrongSecond := append([]byte{}, second...)
+		wrongSecond[31] ^= 1
+		if err := VerifyMerkleConsistency(tt.first, tt.second, first, wrongSecond, proof); err == nil {
+			t.Errorf("%d to %d: accepted the wrong second root", tt.first, tt.second)
+		}
+	}
+
+	if err := VerifyMerkleConsistency(0, 8, nil, merkleTestRoot(t, 8), nil); err != nil {
+		t.Errorf("empty tree: %s", err)
+	}
+
+	if err := VerifyMerkleConsistency(8, 6, merkleTestRoot(t, 8), merkleTestRoot(t, 6), nil); err == nil {
+		t.Errorf("accepted a first tree larger than the second")
+	}
+}
+
+func TestExtendMerkleFrontier(t *testing.T) {
+	leaves := merkleTestLeafHashes(t)
+
+	// Subtree hashes are computed from the leaves they cover
+	nodeHash := func(level uint, index uint64) ([]byte, error) {
+		f := &MerkleFrontier{}
+		for _, h := range leaves[index<<level : (index+1)<<level] {
+			f.Append(h)
+		}
+		return f.Root(), nil
+	}
+
+	for start := uint64(0); start <= 8; start++ {
+		for size := start; size <= 8; size++ {
+			f := &MerkleFrontier{}
+			for _, h := range leaves[:start] {
+				f.Append(h)
+			}
+			if err := ExtendMerkleFrontier(f, size, nodeHash); err != nil {
+				t.Fatalf("%d to %d: %s", start, size, err)
+			}
+			if f.Size != size || !bytes.Equal(f.Root(), merkleTestRoot(t, size)) {
+				t.Errorf("%d to %d: got size %d with root %x", start, size, f.Size, f.Root())
+			}
+		}
+	}
+}
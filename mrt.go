@@ -0,0 +1,434 @@
+package inetdata
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"time"
+)
+
+// MRT record types and TABLE_DUMP_V2 subtypes (RFC 6396, RFC 8050)
+const (
+	MRTTypeTableDumpV2 = 13
+
+	MRTSubtypePeerIndexTable          = 1
+	MRTSubtypeRIBIPv4Unicast          = 2
+	MRTSubtypeRIBIPv4Multicast        = 3
+	MRTSubtypeRIBIPv6Unicast          = 4
+	MRTSubtypeRIBIPv6Multicast        = 5
+	MRTSubtypeRIBIPv4UnicastAddPath   = 8
+	MRTSubtypeRIBIPv4MulticastAddPath = 9
+	MRTSubtypeRIBIPv6UnicastAddPath   = 10
+	MRTSubtypeRIBIPv6MulticastAddPath = 11
+)
+
+// BGP AS_PATH segment types
+const (
+	BGPASSet            = 1
+	BGPASSequence       = 2
+	BGPASConfedSequence = 3
+	BGPASConfedSet      = 4
+)
+
+// MRTMulticastKeyPrefix starts the keys of routes from the multicast RIB in the
+// output of inetdata-mrt2mtbl, keeping them apart from unicast routes
+const MRTMulticastKeyPrefix = "multicast:"
+
+// mrtMaxRecord limits the size of a single MRT record
+const mrtMaxRecord = 16 * 1024 * 1024
+
+// MRTPeer is an entry of the PEER_INDEX_TABLE of a RIB dump
+type MRTPeer struct {
+	BGPID   net.IP
+	Address net.IP
+	AS      uint32
+}
+
+// MRTASPathSegment is a segment of a BGP AS_PATH attribute
+type MRTASPathSegment struct {
+	Type uint8
+	ASNs []uint32
+}
+
+// MRTRIBEntry is the route of a single peer for a prefix
+type MRTRIBEntry struct {
+	PeerIndex  uint16
+	Originated time.Time
+	PathID     uint32
+	ASPath     []MRTASPathSegment
+}
+
+// MRTRIB is a prefix and the routes of every peer that announced it
+type MRTRIB struct {
+	Subtype  uint16
+	Sequence uint32
+	Prefix   *net.IPNet
+	Entries  []MRTRIBEntry
+}
+
+// MRTReader reads the RIB records of an MRT TABLE_DUMP_V2 file, as published
+// by RouteViews and RIPE RIS. Other record types are skipped.
+type MRTReader struct {
+	r     *bufio.Reader
+	Peers []MRTPeer
+}
+
+// NewMRTReader returns a reader for an uncompressed MRT stream
+func NewMRTReader(r io.Reader) *MRTReader {
+	return &MRTReader{r: bufio.NewReaderSize(r, 1024*1024)}
+}
+
+// Next returns the next RIB record, or io.EOF at the end of the stream. The
+// peer index table is read as it is found and kept in Peers.
+func (m *MRTReader) Next() (*MRTRIB, error) {
+	hdr := make([]byte, 12)
+	for {
+		if _, err := io.ReadFull(m.r, hdr); err != nil {
+			if err == io.ErrUnexpectedEOF {
+				return nil, errors.New("truncated MRT header")
+			}
+			return nil, err
+		}
+
+		rtype := binary.BigEndian.Uint16(hdr[4:6])
+		subtype := binary.BigEndian.Uint16(hdr[6:8])
+		length := binary.BigEndian.Uint32(hdr[8:12])
+
+		if length > mrtMaxRecord {
+			return nil, fmt.Errorf("MRT record too large: %d bytes", length)
+		}
+
+		data := make([]byte, length)
+		if _, err := io.ReadFull(m.r, data); err != nil {
+			return nil, errors.New("truncated MRT record")
+		}
+
+		if rtype != MRTTypeTableDumpV2 {
+			continue
+		}
+
+		var rib *MRTRIB
+		var err error
+
+		switch subtype {
+		case MRTSubtypePeerIndexTable:
+			peers, err := parseMRTPeerIndex(data)
+			if err != nil {
+				return nil, err
+			}
+			m.Peers = peers
+			continue
+
+		case MRTSubtypeRIBIPv4Unicast, MRTSubtypeRIBIPv4Multicast:
+			rib, err = parseMRTRIB(data, net.IPv4len, false)
+
+		case MRTSubtypeRIBIPv6Unicast, MRTSubtypeRIBIPv6Multicast:
+			rib, err = parseMRTRIB(data, net.IPv6len, false)
+
+		case MRTSubtypeRIBIPv4UnicastAddPath, MRTSubtypeRIBIPv4MulticastAddPath:
+			rib, err = parseMRTRIB(data, net.IPv4len, true)
+
+		case MRTSubtypeRIBIPv6UnicastAddPath, MRTSubtypeRIBIPv6MulticastAddPath:
+			rib, err = parseMRTRIB(data, net.IPv6len, true)
+
+		default:
+			continue
+		}
+
+		if err != nil {
+			return nil, err
+		}
+		rib.Subtype = subtype
+		return rib, nil
+	}
+}
+
+// IsMulticast returns true for routes from the multicast RIB
+func (rib *MRTRIB) IsMulticast() bool {
+	switch rib.Subtype {
+	case MRTSubtypeRIBIPv4Multicast, MRTSubtypeRIBIPv6Multicast,
+		MRTSubtypeRIBIPv4MulticastAddPath, MRTSubtypeRIBIPv6MulticastAddPath:
+		return true
+	}
+	return false
+}
+
+// mrtBuffer reads big-endian fields and records the first short read
+type mrtBuffer struct {
+	data []byte
+	err  error
+}
+
+func (b *mrtBuffer) bytes(n int) []byte {
+	if b.err != nil || n < 0 || n > len(b.data) {
+		if b.err == nil {
+			b.err = errors.New("truncated MRT record")
+		}
+		return make([]byte, n)
+	}
+	v := b.data[0:n]
+	b.data = b.data[n:]
+	return v
+}
+
+func (b *mrtBuffer) uint8() uint8 {
+	return b.bytes(1)[0]
+}
+
+func (b *mrtBuffer) uint16() uint16 {
+	return binary.BigEndian.Uint16(b.bytes(2))
+}
+
+func (b *mrtBuffer) uint32() uint32 {
+	return binary.BigEndian.Uint32(b.bytes(4))
+}
+
+func parseMRTPeerIndex(data []byte) ([]MRTPeer, error) {
+	b := &mrtBuffer{data: data}
+
+	// Collector BGP ID and view name
+	b.bytes(4)
+	b.bytes(int(b.uint16()))
+
+	count := int(b.uint16())
+	peers := make([]MRTPeer, 0, count)
+
+	for i := 0; i < count && b.err == nil; i++ {
+		ptype := b.uint8()
+		peer := MRTPeer{BGPID: net.IP(b.bytes(4))}
+
+		if ptype&0x01 != 0 {
+			peer.Address = net.IP(b.bytes(net.IPv6len))
+		} else {
+			peer.Address = net.IP(b.bytes(net.IPv4len))
+		}
+
+		if ptype&0x02 != 0 {
+			peer.AS = b.uint32()
+		} else {
+			peer.AS = uint32(b.uint16())
+		}
+		peers = append(peers, peer)
+	}
+
+	if b.err != nil {
+		return nil, fmt.Errorf("invalid peer index table: %s", b.err)
+	}
+	return peers, nil
+}
+
+func parseMRTRIB(data []byte, addrLen int, addPath bool) (*MRTRIB, error) {
+	b := &mrtBuffer{data: data}
+	rib := &MRTRIB{Sequence: b.uint32()}
+
+	plen := int(b.uint8())
+	if plen > addrLen*8 {
+		return nil, fmt.Errorf("invalid prefix length %d in RIB record %d", plen, rib.Sequence)
+	}
+
+	ip := make(net.IP, addrLen)
+	copy(ip, b.bytes((plen+7)/8))
+	rib.Prefix = &net.IPNet{IP: ip, Mask: net.CIDRMask(plen, addrLen*8)}
+	rib.Prefix.IP = rib.Prefix.IP.Mask(rib.Prefix.Mask)
+
+	count := int(b.uint16())
+	for i := 0; i < count && b.err == nil; i++ {
+		entry := MRTRIBEntry{
+			PeerIndex:  b.uint16(),
+			Originated: time.Unix(int64(b.uint32()), 0).UTC(),
+		}
+		if addPath {
+			entry.PathID = b.uint32()
+		}
+
+		attrs := b.bytes(int(b.uint16()))
+		if b.err != nil {
+			break
+		}
+
+		path, err := parseBGPASPath(attrs)
+		if err != nil {
+			return nil, fmt.Errorf("invalid RIB record %d for %s: %s", rib.Sequence, rib.Prefix, err)
+		}
+		entry.ASPath = path
+		rib.Entries = append(rib.Entries, entry)
+	}
+
+	if b.err != nil {
+		return nil, fmt.Errorf("invalid RIB record %d: %s", rib.Sequence, b.err)
+	}
+	return rib, nil
+}
+
+// parseBGPASPath returns the AS_PATH from a list of BGP path attributes. RIB
+// dumps always encode AS numbers in four bytes.
+func parseBGPASPath(attrs []byte) ([]MRTASPathSegment, error) {
+	b := &mrtBuffer{data: attrs}
+
+	for len(b.data) > 0 && b.err == nil {
+		flags := b.uint8()
+		code := b.uint8()
+
+		var alen int
+		if flags&0x10 != 0 {
+			alen = int(b.uint16())
+		} else {
+			alen = int(b.uint8())
+		}
+		val := b.bytes(alen)
+
+		if code != 2 || b.err != nil {
+			continue
+		}
+
+		path := []MRTASPathSegment{}
+		seg := &mrtBuffer{data: val}
+		for len(seg.data) > 0 && seg.err == nil {
+			s := MRTASPathSegment{Type: seg.uint8()}
+			n := int(seg.uint8())
+			for i := 0; i < n; i++ {
+				s.ASNs = append(s.ASNs, seg.uint32())
+			}
+			path = append(path, s)
+		}
+
+		if seg.err != nil {
+			return nil, errors.New("truncated AS_PATH")
+		}
+		return path, nil
+	}
+
+	if b.err != nil {
+		return nil, errors.New("truncated path attributes")
+	}
+	return nil, nil
+}
+
+// Origins returns the origin AS of the route, or every AS of a trailing AS_SET
+func (e *MRTRIBEntry) Origins() ([]uint32, bool) {
+	for i := len(e.ASPath) - 1; i >= 0; i-- {
+		s := e.ASPath[i]
+		if len(s.ASNs) == 0 || s.Type == BGPASConfedSequence || s.Type == BGPASConfedSet {
+			continue
+		}
+		if s.Type == BGPASSet {
+			return s.ASNs, true
+		}
+		return s.ASNs[len(s.ASNs)-1:], false
+	}
+	return nil, false
+}
+
+// PathLength returns the AS path length used by BGP route selection, where an
+// AS_SET counts as one hop and confederation segments are not counted
+func (e *MRTRIBEntry) PathLength() int {
+	n := 0
+	for _, s := range e.ASPath {
+		switch s.Type {
+		case BGPASSequence:
+			n += len(s.ASNs)
+		case BGPASSet:
+			n++
+		}
+	}
+	return n
+}
+
+// MRTPrefixRoute summarizes the routes of a prefix across every peer
+type MRTPrefixRoute struct {
+	Origins       []uint32 `json:"origins"`
+	ASSet         bool     `json:"as_set,omitempty"`
+	Peers         int      `json:"peers"`
+	MinPathLength int      `json:"min_path_length"`
+	MaxPathLength int      `json:"max_path_length"`
+}
+
+// Summary returns the origins, peer count, and AS path lengths of a RIB record.
+// Routes from the same peer, as found in add-path dumps, count as one peer.
+func (rib *MRTRIB) Summary() *MRTPrefixRoute {
+	route := &MRTPrefixRoute{Origins: []uint32{}}
+	origins := make(map[uint32]bool)
+	peers := make(map[uint16]bool)
+
+	for i := range rib.Entries {
+		e := &rib.Entries[i]
+		peers[e.PeerIndex] = true
+
+		asns, set := e.Origins()
+		for _, asn := range asns {
+			origins[asn] = true
+		}
+		if set {
+			route.ASSet = true
+		}
+
+		plen := e.PathLength()
+		if i == 0 || plen < route.MinPathLength {
+			route.MinPathLength = plen
+		}
+		if plen > route.MaxPathLength {
+			route.MaxPathLength = plen
+		}
+	}
+
+	for asn := range origins {
+		route.Origins = append(route.Origins, asn)
+	}
+	sort.Slice(route.Origins, func(i, j int) bool { return route.Origins[i] < route.Origins[j] })
+	route.Peers = len(peers)
+	return route
+}
+
+// Merge combines the summary of the same prefix from another collector. Peer
+// counts are added, since collectors do not share peer indexes, so both summaries
+// must come from the same RIB of distinct collectors. Merging two dumps of one
+// collector counts its peers twice.
+func (r *MRTPrefixRoute) Merge(o *MRTPrefixRoute) {
+	seen := make(map[uint32]bool)
+	for _, asn := range r.Origins {
+		seen[asn] = true
+	}
+	for _, asn := range o.Origins {
+		if !seen[asn] {
+			r.Origins = append(r.Origins, asn)
+		}
+	}
+	sort.Slice(r.Origins, func(i, j int) bool { return r.Origins[i] < r.Origins[j] })
+
+	r.ASSet = r.ASSet || o.ASSet
+	if o.MinPathLength < r.MinPathLength {
+		r.MinPathLength = o.MinPathLength
+	}
+	if o.MaxPathLength > r.MaxPathLength {
+		r.MaxPathLength = o.MaxPathLength
+	}
+	r.Peers += o.Peers
+}
+
+// MTBLMergePrefixRoutes combines two JSON prefix route summaries
+func MTBLMergePrefixRoutes(key []byte, val0 []byte, val1 []byte) []byte {
+	var r0, r1 MRTPrefixRoute
+
+	if e := json.Unmarshal(val0, &r0); e != nil {
+		return val1
+	}
+
+	if e := json.Unmarshal(val1, &r1); e != nil {
+		return val0
+	}
+
+	r0.Merge(&r1)
+
+	d, e := json.Marshal(r0)
+	if e != nil {
+		fmt.Fprintf(os.Stderr, "JSON merge error: %v -> %v + %v\n", e, val0, val1)
+		return val0
+	}
+	return d
+}
@@ -0,0 +1,363 @@
+package inetdata
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func mrtUint16(v uint16) []byte {
+	b := make([]byte, 2)
+	binary.BigEndian.PutUint16(b, v)
+	return b
+}
+
+func mrtUint32(v uint32) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, v)
+	return b
+}
+
+func mrtSequence(asns ...uint32) MRTASPathSegment {
+	return MRTASPathSegment{Type: BGPASSequence, ASNs: asns}
+}
+
+func mrtSet(asns ...uint32) MRTASPathSegment {
+	return MRTASPathSegment{Type: BGPASSet, ASNs: asns}
+}
+
+func mrtRecord(rtype uint16, subtype uint16, data []byte) []byte {
+	rec := mrtUint32(1700000000)
+	rec = append(rec, mrtUint16(rtype)...)
+	rec = append(rec, mrtUint16(subtype)...)
+	rec = append(rec, mrtUint32(uint32(len(data)))...)
+	return append(rec, data...)
+}
+
+// mrtPeerIndex returns a peer index table with an IPv4 peer using a 2-byte AS,
+// an IPv6 peer using a 4-byte AS, and an IPv4 peer using a 4-byte AS
+func mrtPeerIndex() []byte {
+	d := []byte{10, 0, 0, 1}
+	d = append(d, mrtUint16(4)...)
+	d = append(d, "view"...)
+	d = append(d, mrtUint16(3)...)
+
+	d = append(d, 0, 1, 1, 1, 1, 198, 51, 100, 1)
+	d = append(d, mrtUint16(64500)...)
+
+	d = append(d, 3, 2, 2, 2, 2)
+	d = append(d, net.ParseIP("2001:db8::1")...)
+	d = append(d, mrtUint32(4200000000)...)
+
+	d = append(d, 2, 3, 3, 3, 3, 198, 51, 100, 3)
+	d = append(d, mrtUint32(64502)...)
+	return d
+}
+
+// mrtAttributes returns the ORIGIN, AS_PATH, and NEXT_HOP attributes of a route
+func mrtAttributes(path []MRTASPathSegment) []byte {
+	val := []byte{}
+	for _, s := range path {
+		val = append(val, s.Type, byte(len(s.ASNs)))
+		for _, asn := range s.ASNs {
+			val = append(val, mrtUint32(asn)...)
+		}
+	}
+
+	attrs := []byte{0x40, 1, 1, 0}
+	if len(val) > 255 {
+		attrs = append(attrs, 0x50, 2)
+		attrs = append(attrs, mrtUint16(uint16(len(val)))...)
+	} else {
+		attrs = append(attrs, 0x40, 2, byte(len(val)))
+	}
+	attrs = append(attrs, val...)
+	return append(attrs, 0x40, 3, 4, 192, 0, 2, 1)
+}
+
+type mrtTestEntry struct {
+	peer uint16
+	path []MRTASPathSegment
+}
+
+func mrtRIB(seq uint32, cidr string, addPath bool, entries ...mrtTestEntry) []byte {
+	_, n, err := net.ParseCIDR(cidr)
+	if err != nil {
+		panic(err)
+	}
+	bits, _ := n.Mask.Size()
+
+	d := mrtUint32(seq)
+	d = append(d, byte(bits))
+	d = append(d, n.IP[0:(bits+7)/8]...)
+	d = append(d, mrtUint16(uint16(len(entries)))...)
+
+	for i, e := range entries {
+		attrs := mrtAttributes(e.path)
+		d = append(d, mrtUint16(e.peer)...)
+		d = append(d, mrtUint32(1690000000)...)
+		if addPath {
+			d = append(d, mrtUint32(uint32(7+i))...)
+		}
+		d = append(d, mrtUint16(uint16(len(attrs)))...)
+		d = append(d, attrs...)
+	}
+	return d
+}
+
+// mrtFixture returns the records of a RIB dump, which are concatenated to form
+// the stream
+func mrtFixture() [][]byte {
+	long := []uint32{}
+	for i := 0; i < 70; i++ {
+		long = append(long, 64512+uint32(i))
+	}
+
+	return [][]byte{
+		mrtRecord(MRTTypeTableDumpV2, MRTSubtypePeerIndexTable, mrtPeerIndex()),
+
+		// Records of other types are skipped
+		mrtRecord(16, 4, []byte("junkjunk")),
+
+		mrtRecord(MRTTypeTableDumpV2, MRTSubtypeRIBIPv4Unicast, mrtRIB(0, "1.0.0.0/24", false,
+			mrtTestEntry{0, []MRTASPathSegment{mrtSequence(64500, 13335)}},
+			mrtTestEntry{1, []MRTASPathSegment{mrtSequence(4200000000, 3356, 174, 13335)}})),
+
+		mrtRecord(MRTTypeTableDumpV2, MRTSubtypeRIBIPv4Unicast, mrtRIB(1, "192.0.2.0/24", false,
+			mrtTestEntry{0, []MRTASPathSegment{mrtSequence(64500, 701), mrtSet(65002, 65001)}})),
+
+		mrtRecord(MRTTypeTableDumpV2, MRTSubtypeRIBIPv4Multicast, mrtRIB(2, "224.0.0.0/4", false,
+			mrtTestEntry{0, []MRTASPathSegment{mrtSequence(64500, 9)}})),
+
+		mrtRecord(MRTTypeTableDumpV2, MRTSubtypeRIBIPv6Unicast, mrtRIB(3, "2001:db8::/32", false,
+			mrtTestEntry{1, []MRTASPathSegment{mrtSequence(4200000000, 3, 3, 3, 6939)}},
+			mrtTestEntry{2, []MRTASPathSegment{mrtSequence(long...)}})),
+
+		mrtRecord(MRTTypeTableDumpV2, MRTSubtypeRIBIPv4UnicastAddPath, mrtRIB(4, "1.0.0.0/24", true,
+			mrtTestEntry{2, []MRTASPathSegment{mrtSequence(64502, 13335)}},
+			mrtTestEntry{2, []MRTASPathSegment{mrtSequence(64502, 99, 13335)}})),
+
+		mrtRecord(MRTTypeTableDumpV2, MRTSubtypeRIBIPv4Unicast, mrtRIB(5, "0.0.0.0/0", false)),
+	}
+}
+
+func readMRT(t *testing.T, data []byte) (*MRTReader, []*MRTRIB) {
+	m := NewMRTReader(bytes.NewReader(data))
+	ribs := []*MRTRIB{}
+	for {
+		rib, err := m.Next()
+		if err == io.EOF {
+			return m, ribs
+		}
+		if err != nil {
+			t.Fatalf("Next: %s", err)
+		}
+		ribs = append(ribs, rib)
+	}
+}
+
+func TestMRTReaderPeerIndex(t *testing.T) {
+	m, _ := readMRT(t, bytes.Join(mrtFixture(), nil))
+
+	exp := []MRTPeer{
+		{BGPID: net.IP{1, 1, 1, 1}, Address: net.IP{198, 51, 100, 1}, AS: 64500},
+		{BGPID: net.IP{2, 2, 2, 2}, Address: net.ParseIP("2001:db8::1"), AS: 4200000000},
+		{BGPID: net.IP{3, 3, 3, 3}, Address: net.IP{198, 51, 100, 3}, AS: 64502},
+	}
+
+	if len(m.Peers) != len(exp) {
+		t.Fatalf("read %d peers, expected %d", len(m.Peers), len(exp))
+	}
+	for i := range exp {
+		p := m.Peers[i]
+		if !p.BGPID.Equal(exp[i].BGPID) || !p.Address.Equal(exp[i].Address) || p.AS != exp[i].AS {
+			t.Errorf("peer %d is %+v, expected %+v", i, p, exp[i])
+		}
+	}
+}
+
+func TestMRTReaderRIBs(t *testing.T) {
+	_, ribs := readMRT(t, bytes.Join(mrtFixture(), nil))
+
+	exp := []struct {
+		subtype   uint16
+		prefix    string
+		entries   int
+		multicast bool
+	}{
+		{MRTSubtypeRIBIPv4Unicast, "1.0.0.0/24", 2, false},
+		{MRTSubtypeRIBIPv4Unicast, "192.0.2.0/24", 1, false},
+		{MRTSubtypeRIBIPv4Multicast, "224.0.0.0/4", 1, true},
+		{MRTSubtypeRIBIPv6Unicast, "2001:db8::/32", 2, false},
+		{MRTSubtypeRIBIPv4UnicastAddPath, "1.0.0.0/24", 2, false},
+		{MRTSubtypeRIBIPv4Unicast, "0.0.0.0/0", 0, false},
+	}
+
+	if len(ribs) != len(exp) {
+		t.Fatalf("read %d RIB records, expected %d", len(ribs), len(exp))
+	}
+
+	for i, e := range exp {
+		rib := ribs[i]
+		if rib.Sequence != uint32(i) || rib.Subtype != e.subtype || rib.Prefix.String() != e.prefix ||
+			len(rib.Entries) != e.entries || rib.IsMulticast() != e.multicast {
+			t.Errorf("record %d is %d/%d %s with %d entries, expected %d/%d %s with %d entries",
+				i, rib.Sequence, rib.Subtype, rib.Prefix, len(rib.Entries), i, e.subtype, e.prefix, e.entries)
+		}
+	}
+
+	e := ribs[0].Entries[1]
+	if e.PeerIndex != 1 || !e.Originated.Equal(time.Unix(1690000000, 0)) || e.PathID != 0 {
+		t.Errorf("unexpected IPv4 entry %+v", e)
+	}
+	if !reflect.DeepEqual(e.ASPath, []MRTASPathSegment{mrtSequence(4200000000, 3356, 174, 13335)}) {
+		t.Errorf("unexpected AS path %+v", e.ASPath)
+	}
+
+	// The second IPv6 route has an extended-length AS_PATH attribute
+	if n := len(ribs[3].Entries[1].ASPath[0].ASNs); n != 70 {
+		t.Errorf("read %d AS numbers from the extended-length path, expected 70", n)
+	}
+
+	for i, e := range ribs[4].Entries {
+		if e.PeerIndex != 2 || e.PathID != uint32(7+i) {
+			t.Errorf("add-path entry %d has peer %d and path %d", i, e.PeerIndex, e.PathID)
+		}
+	}
+}
+
+func TestMRTRIBEntryOrigins(t *testing.T) {
+	tests := []struct {
+		path    []MRTASPathSegment
+		origins []uint32
+		set     bool
+		length  int
+	}{
+		{[]MRTASPathSegment{mrtSequence(64500, 13335)}, []uint32{13335}, false, 2},
+		{[]MRTASPathSegment{mrtSequence(64500, 701), mrtSet(65002, 65001)}, []uint32{65002, 65001}, true, 3},
+		{[]MRTASPathSegment{mrtSequence(4200000000, 3, 3, 3, 6939)}, []uint32{6939}, false, 5},
+		{[]MRTASPathSegment{{Type: BGPASConfedSequence, ASNs: []uint32{65100}}, mrtSequence(701, 13335)}, []uint32{13335}, false, 2},
+		{[]MRTASPathSegment{mrtSequence(701, 13335), {Type: BGPASConfedSet, ASNs: []uint32{65100, 65101}}}, []uint32{13335}, false, 2},
+		{[]MRTASPathSegment{mrtSequence(701), mrtSet()}, []uint32{701}, false, 2},
+		{nil, nil, false, 0},
+	}
+
+	for i, tt := range tests {
+		e := MRTRIBEntry{ASPath: tt.path}
+		origins, set := e.Origins()
+		if !reflect.DeepEqual(origins, tt.origins) || set != tt.set {
+			t.Errorf("path %d has origins %v (set %v), expected %v (set %v)", i, origins, set, tt.origins, tt.set)
+		}
+		if n := e.PathLength(); n != tt.length {
+			t.Errorf("path %d has length %d, expected %d", i, n, tt.length)
+		}
+	}
+}
+
+func TestMRTRIBSummary(t *testing.T) {
+	_, ribs := readMRT(t, bytes.Join(mrtFixture(), nil))
+
+	tests := []struct {
+		rib int
+		exp MRTPrefixRoute
+	}{
+		{0, MRTPrefixRoute{Origins: []uint32{13335}, Peers: 2, MinPathLength: 2, MaxPathLength: 4}},
+		{1, MRTPrefixRoute{Origins: []uint32{65001, 65002}, ASSet: true, Peers: 1, MinPathLength: 3, MaxPathLength: 3}},
+		{3, MRTPrefixRoute{Origins: []uint32{6939, 64581}, Peers: 2, MinPathLength: 5, MaxPathLength: 70}},
+
+		// Both add-path routes come from the same peer
+		{4, MRTPrefixRoute{Origins: []uint32{13335}, Peers: 1, MinPathLength: 2, MaxPathLength: 3}},
+		{5, MRTPrefixRoute{Origins: []uint32{}, Peers: 0}},
+	}
+
+	for _, tt := range tests {
+		if got := ribs[tt.rib].Summary(); !reflect.DeepEqual(*got, tt.exp) {
+			t.Errorf("summary of %s is %+v, expected %+v", ribs[tt.rib].Prefix, *got, tt.exp)
+		}
+	}
+}
+
+func TestMRTReaderTruncated(t *testing.T) {
+	records := mrtFixture()
+	data := bytes.Join(records, nil)
+
+	boundaries := map[int]bool{}
+	offset := 0
+	for _, rec := range records {
+		boundaries[offset] = true
+		offset += len(rec)
+	}
+
+	// Streams cut between records end cleanly, any other cut is an error
+	for i := 0; i < len(data); i++ {
+		m := NewMRTReader(bytes.NewReader(data[0:i]))
+		var err error
+		for err == nil {
+			_, err = m.Next()
+		}
+
+		if boundaries[i] && err != io.EOF {
+			t.Fatalf("stream cut at record boundary %d returned %s", i, err)
+		}
+		if !boundaries[i] && err == io.EOF {
+			t.Fatalf("stream cut at %d of %d bytes was read without an error", i, len(data))
+		}
+	}
+}
+
+func TestMRTReaderInvalidRecords(t *testing.T) {
+	rib := mrtRIB(0, "1.0.0.0/24", false, mrtTestEntry{0, []MRTASPathSegment{mrtSequence(64500, 13335)}})
+
+	// A segment that claims more AS numbers than the attribute holds
+	bad := append([]byte{}, rib...)
+	idx := bytes.Index(bad, []byte{0x40, 2, 10, BGPASSequence, 2})
+	bad[idx+4] = 5
+
+	// A prefix longer than the address
+	long := append([]byte{}, rib...)
+	long[4] = 33
+
+	tests := []struct {
+		data []byte
+		err  string
+	}{
+		{mrtRecord(MRTTypeTableDumpV2, MRTSubtypeRIBIPv4Unicast, bad), "truncated AS_PATH"},
+		{mrtRecord(MRTTypeTableDumpV2, MRTSubtypeRIBIPv4Unicast, long), "invalid prefix length 33"},
+		{mrtRecord(MRTTypeTableDumpV2, MRTSubtypeRIBIPv4Unicast, rib[0:len(rib)-3]), "truncated MRT record"},
+		{mrtRecord(MRTTypeTableDumpV2, MRTSubtypePeerIndexTable, mrtPeerIndex()[0:20]), "invalid peer index table"},
+		{append(mrtUint32(0), 0, 13, 0, 2, 0xff, 0xff, 0xff, 0xff), "MRT record too large"},
+	}
+
+	for _, tt := range tests {
+		_, err := NewMRTReader(bytes.NewReader(tt.data)).Next()
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("expected an error containing %q, got %v", tt.err, err)
+		}
+	}
+}
+
+func TestMTBLMergePrefixRoutes(t *testing.T) {
+	r0, _ := json.Marshal(MRTPrefixRoute{Origins: []uint32{13335}, Peers: 2, MinPathLength: 2, MaxPathLength: 4})
+	r1, _ := json.Marshal(MRTPrefixRoute{Origins: []uint32{7, 13335}, ASSet: true, Peers: 3, MinPathLength: 1, MaxPathLength: 3})
+
+	var got MRTPrefixRoute
+	if err := json.Unmarshal(MTBLMergePrefixRoutes(nil, r0, r1), &got); err != nil {
+		t.Fatal(err)
+	}
+
+	exp := MRTPrefixRoute{Origins: []uint32{7, 13335}, ASSet: true, Peers: 5, MinPathLength: 1, MaxPathLength: 4}
+	if !reflect.DeepEqual(got, exp) {
+		t.Fatalf("merged %+v, expected %+v", got, exp)
+	}
+
+	// Values that fail to decode are replaced by the other side
+	if v := MTBLMergePrefixRoutes(nil, []byte("junk"), r1); !bytes.Equal(v, r1) {
+		t.Fatalf("merged %s, expected %s", v, r1)
+	}
+}
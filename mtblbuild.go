@@ -0,0 +1,379 @@
+package inetdata
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	mtbl "github.com/hdm/golang-mtbl"
+	"github.com/peterbourgon/mergemap"
+)
+
+// MTBLMergeFunc combines two values stored under the same key
+type MTBLMergeFunc func(key []byte, val0 []byte, val1 []byte) []byte
+
+// MTBLKeyFunc transforms a key before it is stored
+type MTBLKeyFunc func(key []byte) []byte
+
+// MTBLProgressFunc reports the state of a build, elapsed is measured from the
+// first record
+type MTBLProgressFunc func(stats MTBLBuilderStats, elapsed time.Duration)
+
+// MTBLBuilderOptions configures a MTBLBuilder
+type MTBLBuilderOptions struct {
+	// Compression is a name from MTBLCompressionTypes (defaults to snappy)
+	Compression string
+	// TempDir is the directory used by the sorter for temporary files
+	TempDir string
+	// MaxMemory is the number of bytes the sorter buffers before spilling to disk
+	MaxMemory uint64
+	// Merge combines values with the same key (defaults to MTBLMergeFirst)
+	Merge MTBLMergeFunc
+	// Key transforms each key before it is stored, such as MTBLReverseKey
+	Key MTBLKeyFunc
+	// Presorted skips the sorter and writes records directly, keys must be added
+	// in order and without duplicates
+	Presorted bool
+	// Progress is called once a second until the builder is closed
+	Progress MTBLProgressFunc
+}
+
+// MTBLBuilderStats holds the record counters of a build
+type MTBLBuilderStats struct {
+	Input   int64
+	Output  int64
+	Merged  int64
+	Invalid int64
+}
+
+// MTBLBuilder sorts and merges records into a MTBL file. Add is safe for
+// concurrent use.
+type MTBLBuilder struct {
+	opts   MTBLBuilderOptions
+	sorter *mtbl.Sorter
+	writer *mtbl.Writer
+	mu     sync.Mutex
+	stats  MTBLBuilderStats
+	quit   chan bool
+	done   chan bool
+}
+
+// NewMTBLBuilder creates the output file and starts the progress hook, if any
+func NewMTBLBuilder(path string, opts MTBLBuilderOptions) (*MTBLBuilder, error) {
+	if len(opts.Compression) == 0 {
+		opts.Compression = "snappy"
+	}
+
+	if opts.Merge == nil {
+		opts.Merge = MTBLMergeFirst
+	}
+
+	if opts.MaxMemory == 0 {
+		opts.MaxMemory = 1024 * 1024 * 1024
+	}
+
+	compression, ok := MTBLCompressionTypes[opts.Compression]
+	if !ok {
+		return nil, fmt.Errorf("invalid compression algorithm: %s", opts.Compression)
+	}
+
+	w, err := mtbl.WriterInit(path, &mtbl.WriterOptions{Compression: compression})
+	if err != nil {
+		return nil, err
+	}
+
+	b := &MTBLBuilder{opts: opts, writer: w}
+
+	if !opts.Presorted {
+		b.sorter = mtbl.SorterInit(&mtbl.SorterOptions{
+			Merge:     b.merge,
+			MaxMemory: opts.MaxMemory,
+			TempDir:   opts.TempDir,
+		})
+	}
+
+	if opts.Progress != nil {
+		b.quit = make(chan bool)
+		b.done = make(chan bool)
+		go b.showProgress()
+	}
+
+	return b, nil
+}
+
+// Add stores a record, applying the key transform. Keys and values over the
+// MTBL limits are rejected and counted as invalid.
+func (b *MTBLBuilder) Add(key []byte, val []byte) error {
+	if b.opts.Key != nil {
+		key = b.opts.Key(key)
+	}
+
+	if len(key) > MTBL_KEY_LIMIT {
+		atomic.AddInt64(&b.stats.Invalid, 1)
+		return fmt.Errorf("key larger than %d: %s... (%d bytes)", MTBL_KEY_LIMIT, string(key[0:1024]), len(key))
+	}
+
+	if len(val) > MTBL_VAL_LIMIT {
+		atomic.AddInt64(&b.stats.Invalid, 1)
+		return fmt.Errorf("value larger than %d for key %s: %s... (%d bytes)", MTBL_VAL_LIMIT, string(key), string(val[0:1024]), len(val))
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var err error
+	if b.opts.Presorted {
+		err = b.writer.Add(key, val)
+	} else {
+		err = b.sorter.Add(key, val)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	atomic.AddInt64(&b.stats.Output, 1)
+	return nil
+}
+
+// CountInput records that an input record was read
+func (b *MTBLBuilder) CountInput() {
+	atomic.AddInt64(&b.stats.Input, 1)
+}
+
+// CountInvalid records that an input record was skipped
+func (b *MTBLBuilder) CountInvalid() {
+	atomic.AddInt64(&b.stats.Invalid, 1)
+}
+
+// MergeFunc returns the merge function of the builder, which counts each merge.
+// It can be passed to an mtbl.Merger feeding a presorted builder.
+func (b *MTBLBuilder) MergeFunc() MTBLMergeFunc {
+	return b.merge
+}
+
+// Stats returns a snapshot of the record counters
+func (b *MTBLBuilder) Stats() MTBLBuilderStats {
+	return MTBLBuilderStats{
+		Input:   atomic.LoadInt64(&b.stats.Input),
+		Output:  atomic.LoadInt64(&b.stats.Output),
+		Merged:  atomic.LoadInt64(&b.stats.Merged),
+		Invalid: atomic.LoadInt64(&b.stats.Invalid),
+	}
+}
+
+// Close writes out the sorted records, stops the progress hook, and releases
+// the sorter and writer
+func (b *MTBLBuilder) Close() error {
+	var err error
+	if b.sorter != nil {
+		err = b.sorter.Write(b.writer)
+		b.sorter.Destroy()
+	}
+	b.writer.Destroy()
+
+	if b.quit != nil {
+		close(b.quit)
+		<-b.done
+	}
+
+	return err
+}
+
+func (b *MTBLBuilder) merge(key []byte, val0 []byte, val1 []byte) []byte {
+	atomic.AddInt64(&b.stats.Merged, 1)
+	return b.opts.Merge(key, val0, val1)
+}
+
+func (b *MTBLBuilder) showProgress() {
+	defer close(b.done)
+
+	start := time.Now()
+	for {
+		select {
+		case <-b.quit:
+			return
+		case <-time.After(time.Second * 1):
+			stats := b.Stats()
+
+			if stats.Input == 0 && stats.Output == 0 {
+				// Reset start, so that we show stats only from our first input
+				start = time.Now()
+				continue
+			}
+
+			b.opts.Progress(stats, time.Since(start))
+		}
+	}
+}
+
+// MTBLProgressPrinter returns a progress hook that writes the standard status
+// line for the named tool to stderr
+func MTBLProgressPrinter(app string) MTBLProgressFunc {
+	return func(stats MTBLBuilderStats, elapsed time.Duration) {
+		if elapsed.Seconds() <= 1.0 {
+			return
+		}
+		fmt.Fprintf(os.Stderr, "[*] [%s] Read %d and wrote %d records in %d seconds (%d/s in, %d/s out) (merged: %d, invalid: %d)\n",
+			app,
+			stats.Input,
+			stats.Output,
+			int(elapsed.Seconds()),
+			int(float64(stats.Input)/elapsed.Seconds()),
+			int(float64(stats.Output)/elapsed.Seconds()),
+			stats.Merged, stats.Invalid)
+	}
+}
+
+// MTBLMergeFirst keeps the first value
+func MTBLMergeFirst(key []byte, val0 []byte, val1 []byte) []byte {
+	return val0
+}
+
+// MTBLMergeLast keeps the last value
+func MTBLMergeLast(key []byte, val0 []byte, val1 []byte) []byte {
+	return val1
+}
+
+// MTBLMergeAppend joins values with a separator
+func MTBLMergeAppend(sep string) MTBLMergeFunc {
+	return func(key []byte, val0 []byte, val1 []byte) []byte {
+		return []byte(string(val0) + sep + string(val1))
+	}
+}
+
+// MTBLMergePairs combines two JSON arrays of [type, value] pairs, dropping
+// duplicates and sorting the result. A value that fails to decode is replaced
+// by the other.
+func MTBLMergePairs(key []byte, val0 []byte, val1 []byte) []byte {
+	var unique = make(map[string]bool)
+	var v0, v1, m [][]string
+
+	if e := json.Unmarshal(val0, &v0); e != nil {
+		return val1
+	}
+
+	if e := json.Unmarshal(val1, &v1); e != nil {
+		return val0
+	}
+
+	for i := range v0 {
+		if len(v0[i]) == 0 {
+			continue
+		}
+		unique[strings.Join(v0[i], "\x00")] = true
+	}
+
+	for i := range v1 {
+		if len(v1[i]) == 0 {
+			continue
+		}
+		unique[strings.Join(v1[i], "\x00")] = true
+	}
+
+	keys := make([]string, 0, len(unique))
+	for i := range unique {
+		keys = append(keys, i)
+	}
+	sort.Strings(keys)
+
+	for _, i := range keys {
+		m = append(m, strings.SplitN(i, "\x00", 2))
+	}
+
+	d, e := json.Marshal(m)
+	if e != nil {
+		fmt.Fprintf(os.Stderr, "JSON merge error: %v -> %v + %v\n", e, val0, val1)
+		return val0
+	}
+
+	return d
+}
+
+// MTBLMergeTimeline combines two JSON timelines, widening the observation
+// window of each pair
+func MTBLMergeTimeline(key []byte, val0 []byte, val1 []byte) []byte {
+	d, e := MergeTimelineValues(val0, val1)
+	if e != nil {
+		fmt.Fprintf(os.Stderr, "Timeline merge error: %v -> %v + %v\n", e, val0, val1)
+		return val0
+	}
+	return d
+}
+
+// MTBLMergeJSON deep merges two JSON objects, the last value wins for fields
+// present in both
+func MTBLMergeJSON(key []byte, val0 []byte, val1 []byte) []byte {
+	var v0, v1 map[string]interface{}
+
+	if e := json.Unmarshal(val0, &v0); e != nil {
+		return val1
+	}
+
+	if e := json.Unmarshal(val1, &v1); e != nil {
+		return val0
+	}
+
+	d, e := json.Marshal(mergemap.Merge(v0, v1))
+	if e != nil {
+		fmt.Fprintf(os.Stderr, "JSON merge error: %v -> %v + %v\n", e, val0, val1)
+		return val0
+	}
+
+	return d
+}
+
+// MTBLMergeAuto combines two values based on their JSON form. Pair arrays are
+// unioned, timelines are widened, and objects are deep merged. The first value
+// is kept if the values can not be combined.
+func MTBLMergeAuto(key []byte, val0 []byte, val1 []byte) []byte {
+	var p0, p1 [][]string
+	if json.Unmarshal(val0, &p0) == nil && json.Unmarshal(val1, &p1) == nil {
+		return MTBLMergePairs(key, val0, val1)
+	}
+
+	// Timelines also accept plain pairs, so a mix of both is widened
+	if d, e := MergeTimelineValues(val0, val1); e == nil {
+		return d
+	}
+
+	var o0, o1 map[string]interface{}
+	if json.Unmarshal(val0, &o0) == nil && json.Unmarshal(val1, &o1) == nil {
+		return MTBLMergeJSON(key, val0, val1)
+	}
+
+	return val0
+}
+
+// MTBLReverseKey reverses the bytes of a key, for domain name lookups by suffix
+func MTBLReverseKey(key []byte) []byte {
+	return ReverseKeyBytes(key)
+}
+
+// MTBLEncodeIPKey converts IP address keys to binary form and leaves other
+// keys as-is
+func MTBLEncodeIPKey(key []byte) []byte {
+	if ipKey, ok := EncodeIPKey(string(key)); ok {
+		return ipKey
+	}
+	return key
+}
+
+// MTBLHostnameKey reverses hostname keys and leaves IP address keys as-is,
+// optionally converting them to binary form
+func MTBLHostnameKey(ipEncode bool) MTBLKeyFunc {
+	return func(key []byte) []byte {
+		if MatchIPv4.Match(key) || MatchIPv6.Match(key) {
+			if ipEncode {
+				return MTBLEncodeIPKey(key)
+			}
+			return key
+		}
+		return ReverseKeyBytes(key)
+	}
+}
@@ -0,0 +1,265 @@
+package inetdata
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	mtbl "github.com/hdm/golang-mtbl"
+)
+
+// PrefixInfo is the routed prefix, origin AS numbers, and registry of an address
+type PrefixInfo struct {
+	Prefix string
+	ASNs   []string
+	RIR    string
+}
+
+type prefixEntry struct {
+	prefix string
+	asns   []string
+	rir    string
+}
+
+// PrefixTable finds the network of IP addresses by longest prefix match. Routes
+// and registry blocks are matched separately, so the origin of an address comes
+// from the most specific route and the registry from the most specific block.
+type PrefixTable struct {
+	trie *PrefixTrie
+}
+
+// NewPrefixTable returns an empty prefix table
+func NewPrefixTable() *PrefixTable {
+	return &PrefixTable{trie: NewPrefixTrie()}
+}
+
+// LoadPrefixTable reads prefixes from MTBL files created by inetdata-mrt2mtbl or
+// from inetdata-delegated2csv output, and from CSV files of prefix and AS number
+// or prefix and registry. Files ending in .gz are decompressed. Routes from the
+// multicast RIB are ignored.
+func LoadPrefixTable(paths []string) (*PrefixTable, error) {
+	t := NewPrefixTable()
+	for _, path := range paths {
+		var err error
+		if strings.HasSuffix(path, ".mtbl") {
+			err = t.loadMTBL(path)
+		} else {
+			err = t.loadCSV(path)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", path, err)
+		}
+	}
+	return t, nil
+}
+
+// Len returns the number of prefixes in the table
+func (t *PrefixTable) Len() int {
+	return t.trie.Len()
+}
+
+// Add stores the origin AS numbers or registry of a prefix, either may be empty.
+// Values for a prefix that already exists are combined.
+func (t *PrefixTable) Add(cidr string, asns []string, rir string) error {
+	_, ipnet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return err
+	}
+
+	var entry *prefixEntry
+	if val, ok := t.trie.Get(ipnet); ok {
+		entry = val.(*prefixEntry)
+	} else {
+		entry = &prefixEntry{prefix: ipnet.String()}
+		t.trie.Insert(ipnet, entry)
+	}
+
+	for _, asn := range asns {
+		found := false
+		for _, existing := range entry.asns {
+			if existing == asn {
+				found = true
+				break
+			}
+		}
+		if !found {
+			entry.asns = append(entry.asns, asn)
+		}
+	}
+
+	if len(rir) > 0 {
+		entry.rir = rir
+	}
+	return nil
+}
+
+// Lookup returns the network of an IP address, or nil if no prefix matches
+func (t *PrefixTable) Lookup(ips string) *PrefixInfo {
+	ip := net.ParseIP(ips)
+	if ip == nil {
+		return nil
+	}
+
+	bits := 128
+	if ip4 := ip.To4(); ip4 != nil && !strings.Contains(ips, ":") {
+		bits, ip = 32, ip4
+	}
+
+	// Covering prefixes are returned from the least to the most specific
+	covering := t.trie.Covering(&net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+
+	var info *PrefixInfo
+	for i := len(covering) - 1; i >= 0; i-- {
+		entry := covering[i].Value.(*prefixEntry)
+
+		if info == nil {
+			info = &PrefixInfo{}
+		}
+
+		if len(info.ASNs) == 0 && len(entry.asns) > 0 {
+			info.Prefix = entry.prefix
+			info.ASNs = entry.asns
+		}
+
+		if len(info.RIR) == 0 && len(entry.rir) > 0 {
+			info.RIR = entry.rir
+			if len(info.Prefix) == 0 {
+				info.Prefix = entry.prefix
+			}
+		}
+
+		if len(info.ASNs) > 0 && len(info.RIR) > 0 {
+			break
+		}
+	}
+	return info
+}
+
+// Pairs returns the asn, prefix, and rir of an IP address as [type, value]
+// pairs, or nil if no prefix matches
+func (t *PrefixTable) Pairs(ips string) [][]string {
+	info := t.Lookup(ips)
+	if info == nil {
+		return nil
+	}
+
+	pairs := [][]string{}
+	for _, asn := range info.ASNs {
+		pairs = append(pairs, []string{"asn", asn})
+	}
+	if len(info.Prefix) > 0 {
+		pairs = append(pairs, []string{"prefix", info.Prefix})
+	}
+	if len(info.RIR) > 0 {
+		pairs = append(pairs, []string{"rir", info.RIR})
+	}
+	return pairs
+}
+
+func (t *PrefixTable) loadMTBL(path string) error {
+	r, err := mtbl.ReaderInit(path, &mtbl.ReaderOptions{VerifyChecksums: true})
+	if err != nil {
+		return err
+	}
+	defer r.Destroy()
+
+	it := mtbl.IterAll(r)
+	defer it.Destroy()
+
+	for {
+		key, val, ok := it.Next()
+		if !ok {
+			break
+		}
+
+		if bytes.HasPrefix(key, []byte(MRTMulticastKeyPrefix)) {
+			continue
+		}
+
+		var route MRTPrefixRoute
+		if len(val) > 0 && val[0] == '{' {
+			if json.Unmarshal(val, &route) != nil {
+				continue
+			}
+			asns := make([]string, 0, len(route.Origins))
+			for _, asn := range route.Origins {
+				asns = append(asns, strconv.FormatUint(uint64(asn), 10))
+			}
+			t.Add(string(key), asns, "")
+			continue
+		}
+
+		// Registry records from inetdata-delegated2csv start with the registry name
+		t.Add(string(key), nil, strings.SplitN(string(val), ",", 2)[0])
+	}
+	return nil
+}
+
+func (t *PrefixTable) loadCSV(path string) error {
+	fd, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+
+	var r io.Reader = fd
+	if strings.HasSuffix(path, ".gz") {
+		gz, err := gzip.NewReader(fd)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		r = gz
+	}
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+
+		bits := strings.FieldsFunc(line, func(c rune) bool { return c == ',' || c == '\t' })
+		if len(bits) < 2 {
+			continue
+		}
+
+		// Tab-separated prefix, length, and origin lines as used by CAIDA pfx2as
+		if !strings.Contains(bits[0], "/") && len(bits) >= 3 {
+			bits = append([]string{bits[0] + "/" + bits[1]}, bits[2:]...)
+		}
+
+		if asns := parsePrefixASNs(bits[1]); len(asns) > 0 {
+			t.Add(bits[0], asns, "")
+		} else {
+			t.Add(bits[0], nil, strings.ToLower(bits[1]))
+		}
+	}
+	return scanner.Err()
+}
+
+// parsePrefixASNs returns the AS numbers of a field such as "13335", "AS13335",
+// or multiple origins joined by _ or spaces. Returns nil if the field is not a
+// list of AS numbers.
+func parsePrefixASNs(field string) []string {
+	asns := []string{}
+	for _, bit := range strings.FieldsFunc(field, func(c rune) bool { return c == '_' || c == ' ' }) {
+		bit = strings.TrimPrefix(strings.ToUpper(bit), "AS")
+		asn, err := strconv.ParseUint(bit, 10, 32)
+		if err != nil {
+			return nil
+		}
+		asns = append(asns, strconv.FormatUint(asn, 10))
+	}
+	if len(asns) == 0 {
+		return nil
+	}
+	return asns
+}
@@ -0,0 +1,518 @@
+package inetdata
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+)
+
+// RPSL classes that map to ARIN record types
+var RPSLClassTypes = map[string]string{
+	"inetnum":      ARINTypeNet,
+	"inet6num":     ARINTypeNet,
+	"aut-num":      ARINTypeASN,
+	"organisation": ARINTypeOrg,
+	"role":         ARINTypePOC,
+	"person":       ARINTypePOC,
+}
+
+// RPSLClasses are the classes read from database dumps, other objects are skipped
+var RPSLClasses = map[string]bool{
+	"inetnum":      true,
+	"inet6num":     true,
+	"aut-num":      true,
+	"organisation": true,
+	"role":         true,
+	"person":       true,
+	"route":        true,
+	"route6":       true,
+	"mntner":       true,
+}
+
+// rpslFreeText are attributes where # does not start a comment
+var rpslFreeText = map[string]bool{
+	"descr":    true,
+	"remarks":  true,
+	"address":  true,
+	"org-name": true,
+	"person":   true,
+	"role":     true,
+	"owner":    true,
+}
+
+// rpslPOCFunctions maps contact attributes to ARIN POC link functions
+var rpslPOCFunctions = []struct {
+	Attribute   string
+	Function    string
+	Description string
+}{
+	{"admin-c", "AD", "Admin"},
+	{"owner-c", "AD", "Admin"},
+	{"tech-c", "T", "Tech"},
+	{"abuse-c", "AB", "Abuse"},
+}
+
+// RPSLAttribute is a single attribute of an RPSL object
+type RPSLAttribute struct {
+	Name  string
+	Value string
+}
+
+// RPSLObject is an object from an RPSL database dump, with its attributes in
+// the order they appear. The class is the name of the first attribute and the
+// key is its value.
+type RPSLObject struct {
+	Class      string
+	Key        string
+	Attributes []RPSLAttribute
+}
+
+// Get returns the first value of an attribute, or an empty string
+func (o *RPSLObject) Get(name string) string {
+	for _, a := range o.Attributes {
+		if a.Name == name {
+			return a.Value
+		}
+	}
+	return ""
+}
+
+// GetAll returns every value of a multi-valued attribute
+func (o *RPSLObject) GetAll(name string) []string {
+	vals := []string{}
+	for _, a := range o.Attributes {
+		if a.Name == name && len(a.Value) > 0 {
+			vals = append(vals, a.Value)
+		}
+	}
+	return vals
+}
+
+// ReadRPSL calls fn for each object in an RPSL database dump. Objects are
+// separated by blank lines, lines starting with % or # are comments, and lines
+// starting with whitespace or + continue the previous attribute. Only objects
+// of the RPSLClasses are returned.
+func ReadRPSL(r io.Reader, fn func(*RPSLObject)) error {
+	scanner := bufio.NewScanner(r)
+	buf := make([]byte, 0, 1024*1024)
+	scanner.Buffer(buf, 1024*1024*8)
+
+	var obj *RPSLObject
+
+	flush := func() {
+		if obj != nil && RPSLClasses[obj.Class] {
+			fn(obj)
+		}
+		obj = nil
+	}
+
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+
+		if len(strings.TrimSpace(line)) == 0 {
+			flush()
+			continue
+		}
+
+		if line[0] == '%' || line[0] == '#' {
+			continue
+		}
+
+		// Continuation lines are joined to the previous value with a space
+		if line[0] == ' ' || line[0] == '\t' || line[0] == '+' {
+			if obj == nil || len(obj.Attributes) == 0 {
+				continue
+			}
+			last := &obj.Attributes[len(obj.Attributes)-1]
+			more := rpslValue(last.Name, line[1:])
+			if len(more) > 0 {
+				if len(last.Value) > 0 {
+					last.Value += " "
+				}
+				last.Value += more
+			}
+			continue
+		}
+
+		idx := strings.Index(line, ":")
+		if idx < 1 {
+			continue
+		}
+
+		name := strings.ToLower(strings.TrimSpace(line[0:idx]))
+		attr := RPSLAttribute{Name: name, Value: rpslValue(name, line[idx+1:])}
+
+		if obj == nil {
+			obj = &RPSLObject{Class: name, Key: attr.Value}
+		}
+		obj.Attributes = append(obj.Attributes, attr)
+	}
+
+	flush()
+	return scanner.Err()
+}
+
+// rpslValue trims a value and removes end-of-line comments
+func rpslValue(name string, val string) string {
+	if !rpslFreeText[name] {
+		if idx := strings.Index(val, "#"); idx >= 0 {
+			val = val[0:idx]
+		}
+	}
+	return strings.TrimSpace(val)
+}
+
+// RPSLSource returns the registry of an object, or def if it has none
+func RPSLSource(o *RPSLObject, def string) string {
+	if src := o.Get("source"); len(src) > 0 {
+		return strings.ToUpper(strings.Fields(src)[0])
+	}
+	return def
+}
+
+// RPSLDates returns the creation and last update dates of an object. Older
+// dumps only record updates as "changed: <email> <yyyymmdd>" lines.
+func RPSLDates(o *RPSLObject) (string, string) {
+	created := o.Get("created")
+	updated := o.Get("last-modified")
+
+	if len(updated) == 0 {
+		changes := o.GetAll("changed")
+		if len(changes) > 0 {
+			bits := strings.Fields(changes[len(changes)-1])
+			updated = bits[len(bits)-1]
+		}
+	}
+	return created, updated
+}
+
+// RPSLPocLinks returns the contacts of an object as ARIN POC links
+func RPSLPocLinks(o *RPSLObject) []ARINPocLink {
+	links := []ARINPocLink{}
+	for _, f := range rpslPOCFunctions {
+		for _, h := range o.GetAll(f.Attribute) {
+			links = append(links, ARINPocLink{Description: f.Description, Function: f.Function, Handle: h})
+		}
+	}
+	return links
+}
+
+// RPSLNetRange returns the first and last addresses and the CIDRs of an inetnum
+// or inet6num object. Keys may be ranges ("192.0.2.0 - 192.0.2.255") or prefixes,
+// including the abbreviated IPv4 prefixes used by LACNIC ("200.3.0/20").
+func RPSLNetRange(o *RPSLObject) (string, string, []string, error) {
+	key := strings.Replace(o.Key, " ", "", -1)
+
+	if bits := strings.SplitN(key, "-", 2); len(bits) == 2 {
+		start, end := NormalizeARINAddress(bits[0]), NormalizeARINAddress(bits[1])
+		cidrs, err := arinRangeCIDRs(start, end)
+		if err != nil {
+			return "", "", nil, err
+		}
+		return start, end, cidrs, nil
+	}
+
+	prefix := key
+	if idx := strings.Index(prefix, "/"); idx > 0 && !strings.Contains(prefix, ":") {
+		// Fill in the missing octets of abbreviated prefixes
+		octets := strings.Split(prefix[0:idx], ".")
+		for len(octets) < 4 {
+			octets = append(octets, "0")
+		}
+		prefix = strings.Join(octets, ".") + prefix[idx:]
+	}
+
+	_, ipnet, err := net.ParseCIDR(prefix)
+	if err != nil {
+		return "", "", nil, fmt.Errorf("invalid network %s", o.Key)
+	}
+
+	first, last := IPKeyRange(ipnet)
+	start, _ := DecodeIPKey(first)
+	end, _ := DecodeIPKey(last)
+	return start, end, []string{ipnet.String()}, nil
+}
+
+// RPSLRecord converts an object to the JSON shape of inetdata-arin-xml2json.
+// Classes without an ARIN equivalent keep their attributes as fields, with
+// multi-valued attributes as arrays. Every record has the RPSL class and source.
+func RPSLRecord(o *RPSLObject, source string) (map[string]interface{}, error) {
+	rec := map[string]interface{}{
+		"class":  o.Class,
+		"source": RPSLSource(o, source),
+	}
+
+	created, updated := RPSLDates(o)
+	setString(rec, "registrationDate", created)
+	setString(rec, "updateDate", updated)
+
+	links := RPSLPocLinks(o)
+	if len(links) > 0 {
+		rec["pocLinks"] = map[string]interface{}{"pocLink": links}
+	}
+
+	switch o.Class {
+	case "inetnum", "inet6num":
+		start, end, cidrs, err := RPSLNetRange(o)
+		if err != nil {
+			return nil, err
+		}
+
+		rec["handle"] = rpslNetHandle(o, cidrs)
+		rec["startAddress"] = start
+		rec["endAddress"] = end
+		rec["version"] = "4"
+		if o.Class == "inet6num" {
+			rec["version"] = "6"
+		}
+		setString(rec, "name", firstOf(o, "netname", "owner"))
+		setString(rec, "orgHandle", firstOf(o, "org", "ownerid"))
+		setString(rec, "parentNetHandle", o.Get("parent"))
+
+		// Only a single block fits the xml2json shape, the range covers the rest
+		if len(cidrs) == 1 {
+			bits := strings.SplitN(cidrs[0], "/", 2)
+			block := map[string]interface{}{
+				"cidrLength":   bits[1],
+				"startAddress": start,
+				"endAddress":   end,
+			}
+			setString(block, "type", o.Get("status"))
+			rec["netBlocks"] = map[string]interface{}{"netBlock": block}
+		}
+
+	case "aut-num":
+		num := strings.TrimPrefix(strings.ToUpper(o.Key), "AS")
+		rec["handle"] = "AS" + num
+		rec["startAsNumber"] = num
+		rec["endAsNumber"] = num
+		setString(rec, "name", firstOf(o, "as-name", "owner"))
+		setString(rec, "orgHandle", firstOf(o, "org", "ownerid"))
+
+		if lines := rpslLines(o, "descr", "remarks"); len(lines) > 0 {
+			rec["comment"] = map[string]interface{}{"line": lines}
+		}
+
+	case "organisation":
+		rec["handle"] = o.Key
+		setString(rec, "name", o.Get("org-name"))
+		rpslLocation(o, rec)
+
+	case "role", "person":
+		rec["handle"] = firstOf(o, "nic-hdl", "nic-hdl-br")
+		if len(rec["handle"].(string)) == 0 {
+			rec["handle"] = o.Key
+		}
+
+		rec["isRoleAccount"] = "N"
+		if o.Class == "role" {
+			rec["isRoleAccount"] = "Y"
+			setString(rec, "lastName", o.Key)
+		} else {
+			// Names are split at the last space, like the ARIN first and last names
+			name := o.Key
+			if idx := strings.LastIndex(name, " "); idx > 0 {
+				setString(rec, "firstName", name[0:idx])
+				name = name[idx+1:]
+			}
+			setString(rec, "lastName", name)
+		}
+
+		if emails := o.GetAll("e-mail"); len(emails) > 0 {
+			rec["emails"] = map[string]interface{}{"email": emails[0]}
+		}
+		if phones := o.GetAll("phone"); len(phones) > 0 {
+			rec["phones"] = map[string]interface{}{
+				"phone": map[string]interface{}{
+					"number": map[string]string{"phoneNumber": phones[0]},
+				},
+			}
+		}
+		rpslLocation(o, rec)
+
+	default:
+		rec["handle"] = o.Key
+		for _, a := range o.Attributes {
+			if _, ok := rec[a.Name]; ok {
+				continue
+			}
+			vals := o.GetAll(a.Name)
+			if len(vals) == 1 {
+				rec[a.Name] = vals[0]
+			} else {
+				rec[a.Name] = vals
+			}
+		}
+	}
+
+	return rec, nil
+}
+
+// RPSLCSVRecord converts an object to the CSV columns of inetdata-arin-xml2csv.
+// Routes have prefix, origin, name, maintainer, and date columns. Other classes
+// without an ARIN equivalent return nil.
+func RPSLCSVRecord(o *RPSLObject) ([]string, error) {
+	created, updated := RPSLDates(o)
+
+	// POC columns are admin, noc, tech, and abuse
+	pocs := make([]string, 4)
+	for _, l := range RPSLPocLinks(o) {
+		idx := map[string]int{"AD": 0, "T": 2, "AB": 3}[l.Function]
+		if len(pocs[idx]) == 0 {
+			pocs[idx] = l.Handle
+		}
+	}
+
+	switch o.Class {
+	case "inetnum", "inet6num":
+		start, end, cidrs, err := RPSLNetRange(o)
+		if err != nil {
+			return nil, err
+		}
+		version := "4"
+		if o.Class == "inet6num" {
+			version = "6"
+		}
+		record := []string{
+			rpslNetHandle(o, cidrs),
+			o.Get("parent"),
+			firstOf(o, "org", "ownerid"),
+			firstOf(o, "netname", "owner"),
+			start,
+			end,
+		}
+		record = append(record, pocs...)
+		return append(record, created, updated, version), nil
+
+	case "aut-num":
+		num := strings.TrimPrefix(strings.ToUpper(o.Key), "AS")
+		record := []string{
+			"AS" + num,
+			firstOf(o, "org", "ownerid"),
+			firstOf(o, "as-name", "owner"),
+			num,
+			num,
+		}
+		record = append(record, pocs...)
+		comments := []string{}
+		for _, l := range rpslLines(o, "descr", "remarks") {
+			comments = append(comments, l["Text"])
+		}
+		return append(record, strings.Join(comments, "\t"), created, updated), nil
+
+	case "organisation":
+		record := []string{
+			o.Key,
+			o.Get("org-name"),
+			"", // Customer
+			strings.Join(o.GetAll("address"), "\t"),
+			"", // City
+			"", // State
+			"", // Postal code
+			"", // Country name
+			o.Get("country"),
+			"", // Country code3
+			"", // E164
+		}
+		record = append(record, pocs...)
+		return append(record, created, updated), nil
+
+	case "role", "person":
+		rec, err := RPSLRecord(o, "")
+		if err != nil {
+			return nil, err
+		}
+		emails := append(o.GetAll("e-mail"), "", "", "")
+		phones := append(o.GetAll("phone"), "", "", "")
+		return []string{
+			rec["handle"].(string),
+			emails[0], emails[1], emails[2],
+			stringField(rec, "firstName"),
+			stringField(rec, "lastName"),
+			rec["isRoleAccount"].(string),
+			strings.Join(o.GetAll("address"), "\t"),
+			"", // City
+			"", // State
+			"", // Postal code
+			"", // Country name
+			o.Get("country"),
+			"", // Country code3
+			"", // E164
+			phones[0], phones[1], phones[2],
+			created,
+			updated,
+		}, nil
+
+	case "route", "route6":
+		return []string{
+			o.Key,
+			o.Get("origin"),
+			o.Get("descr"),
+			strings.Join(o.GetAll("mnt-by"), " "),
+			created,
+			updated,
+		}, nil
+	}
+
+	return nil, nil
+}
+
+// rpslNetHandle returns the handle of a net, the range or prefix it covers
+func rpslNetHandle(o *RPSLObject, cidrs []string) string {
+	if strings.Contains(o.Key, "-") || len(cidrs) != 1 {
+		return strings.Replace(o.Key, " ", "", -1)
+	}
+	return cidrs[0]
+}
+
+// firstOf returns the first value of the first attribute that is present
+func firstOf(o *RPSLObject, names ...string) string {
+	for _, name := range names {
+		if v := o.Get(name); len(v) > 0 {
+			return v
+		}
+	}
+	return ""
+}
+
+// rpslLines returns attribute values as numbered lines, like ARIN comments and
+// street addresses
+func rpslLines(o *RPSLObject, names ...string) []map[string]string {
+	lines := []map[string]string{}
+	for _, a := range o.Attributes {
+		for _, name := range names {
+			if a.Name == name {
+				lines = append(lines, map[string]string{
+					"Number": fmt.Sprintf("%d", len(lines)+1),
+					"Text":   a.Value,
+				})
+			}
+		}
+	}
+	return lines
+}
+
+// rpslLocation sets the street address and country of an org or POC
+func rpslLocation(o *RPSLObject, rec map[string]interface{}) {
+	if lines := rpslLines(o, "address"); len(lines) > 0 {
+		rec["streetAddress"] = map[string]interface{}{"line": lines}
+	}
+	if country := o.Get("country"); len(country) > 0 {
+		rec["iso3166-1"] = map[string]string{"code2": strings.ToUpper(country)}
+	}
+}
+
+func setString(rec map[string]interface{}, name string, val string) {
+	if len(val) > 0 {
+		rec[name] = val
+	}
+}
+
+func stringField(rec map[string]interface{}, name string) string {
+	if v, ok := rec[name].(string); ok {
+		return v
+	}
+	return ""
+}
@@ -0,0 +1,238 @@
+package inetdata
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const rpslTestDump = `% This is the RIPE Database query service.
+# Another comment
+
+inetnum:        192.0.2.0 - 192.0.2.255 # documentation
+netname:        TEST-NET # name
+descr:          Example network # not a comment
+                second line
++               third line
++
+remarks:        see #1
+mnt-by:         MNT-A # first
+                MNT-B
+admin-c:        AA1-RIPE
+tech-c:         TT1-RIPE
+abuse-c:        AB1-RIPE
+status:         ASSIGNED PA
+created:        2001-01-01T00:00:00Z
+last-modified:  2020-01-01T00:00:00Z
+source:         RIPE # Filtered
+
+domain:         2.0.192.in-addr.arpa
+source:         RIPE
+
+inetnum:     200.3.0/20
+status:      allocated
+owner:       Example Telecom
+ownerid:     BR-EXTE-LACNIC
+owner-c:     EXT
+tech-c:      EXT
+changed:     hm@example.br 20040101
+changed:     hm@example.br 20100315
+source:      LACNIC
+
+route:          192.0.2.0/24
+descr:          Example route
+origin:         AS64500
+mnt-by:         MNT-A
+mnt-by:         MNT-B
+source:         RIPE
+
+aut-num:        AS64500
+as-name:        EXAMPLE-AS
+descr:          Example AS
+remarks:        peering # policy
+org:            ORG-EX1-RIPE
+source:         RIPE
+
+person:         Jane Q Doe
+address:        1 Example Street # Suite 2
+phone:          +31 20 000 0000
+e-mail:         jane@example.com
+nic-hdl:        JD1-RIPE
+source:         RIPE
+
+mntner:         MNT-A
+source:         RIPE
+`
+
+func readRPSLTestDump(t *testing.T) []*RPSLObject {
+	objs := []*RPSLObject{}
+	if err := ReadRPSL(strings.NewReader(rpslTestDump), func(o *RPSLObject) { objs = append(objs, o) }); err != nil {
+		t.Fatal(err)
+	}
+	return objs
+}
+
+func TestReadRPSL(t *testing.T) {
+	objs := readRPSLTestDump(t)
+
+	// The domain object is not one of the RPSLClasses
+	classes := []string{}
+	for _, o := range objs {
+		classes = append(classes, o.Class)
+	}
+	exp := []string{"inetnum", "inetnum", "route", "aut-num", "person", "mntner"}
+	if !reflect.DeepEqual(classes, exp) {
+		t.Fatalf("got %v, expected %v", classes, exp)
+	}
+
+	net := objs[0]
+	tests := []struct {
+		got string
+		exp string
+	}{
+		{net.Key, "192.0.2.0 - 192.0.2.255"},
+		{net.Get("netname"), "TEST-NET"},
+		// Free-text attributes keep # and join continuation and + lines
+		{net.Get("descr"), "Example network # not a comment second line third line"},
+		{net.Get("remarks"), "see #1"},
+		{net.Get("mnt-by"), "MNT-A MNT-B"},
+		{net.Get("source"), "RIPE"},
+		{net.Get("missing"), ""},
+		{objs[1].Key, "200.3.0/20"},
+		{objs[4].Get("address"), "1 Example Street # Suite 2"},
+	}
+
+	for _, tt := range tests {
+		if tt.got != tt.exp {
+			t.Errorf("got %q, expected %q", tt.got, tt.exp)
+		}
+	}
+
+	if got := objs[2].GetAll("mnt-by"); !reflect.DeepEqual(got, []string{"MNT-A", "MNT-B"}) {
+		t.Errorf("got %v, expected both maintainers", got)
+	}
+}
+
+func TestReadRPSLLineEndings(t *testing.T) {
+	objs := []*RPSLObject{}
+	dump := "+ orphaned\r\nperson: A B\r\naddress: x\r\n y\r\n\r\n\r\nrole: R\r\n"
+	if err := ReadRPSL(strings.NewReader(dump), func(o *RPSLObject) { objs = append(objs, o) }); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(objs) != 2 || objs[0].Get("address") != "x y" || objs[1].Key != "R" {
+		t.Fatalf("unexpected objects %+v", objs)
+	}
+}
+
+func TestRPSLNetRange(t *testing.T) {
+	tests := []struct {
+		key   string
+		start string
+		end   string
+		cidrs []string
+	}{
+		{"192.0.2.0 - 192.0.2.255", "192.0.2.0", "192.0.2.255", []string{"192.0.2.0/24"}},
+		{"192.0.2.0 - 192.0.3.127", "192.0.2.0", "192.0.3.127", []string{"192.0.2.0/24", "192.0.3.0/25"}},
+		{"192.0.2.0/24", "192.0.2.0", "192.0.2.255", []string{"192.0.2.0/24"}},
+		{"200.3.0/20", "200.3.0.0", "200.3.15.255", []string{"200.3.0.0/20"}},
+		{"200/8", "200.0.0.0", "200.255.255.255", []string{"200.0.0.0/8"}},
+		{"2001:db8::/32", "2001:db8::", "2001:db8:ffff:ffff:ffff:ffff:ffff:ffff", []string{"2001:db8::/32"}},
+	}
+
+	for _, tt := range tests {
+		start, end, cidrs, err := RPSLNetRange(&RPSLObject{Class: "inetnum", Key: tt.key})
+		if err != nil {
+			t.Errorf("%s: %s", tt.key, err)
+			continue
+		}
+		if start != tt.start || end != tt.end || !reflect.DeepEqual(cidrs, tt.cidrs) {
+			t.Errorf("%s: got %s - %s %v, expected %s - %s %v", tt.key, start, end, cidrs, tt.start, tt.end, tt.cidrs)
+		}
+	}
+
+	for _, key := range []string{"bogus", "200.3.0/33", "192.0.2.255 - 192.0.2.0"} {
+		if _, _, _, err := RPSLNetRange(&RPSLObject{Class: "inetnum", Key: key}); err == nil {
+			t.Errorf("%s: expected an error", key)
+		}
+	}
+}
+
+func TestRPSLRecord(t *testing.T) {
+	exp := []string{
+		`{"class":"inetnum","endAddress":"192.0.2.255","handle":"192.0.2.0-192.0.2.255","name":"TEST-NET","netBlocks":{"netBlock":{"cidrLength":"24","endAddress":"192.0.2.255","startAddress":"192.0.2.0","type":"ASSIGNED PA"}},"pocLinks":{"pocLink":[{"Description":"Admin","Function":"AD","Handle":"AA1-RIPE"},{"Description":"Tech","Function":"T","Handle":"TT1-RIPE"},{"Description":"Abuse","Function":"AB","Handle":"AB1-RIPE"}]},"registrationDate":"2001-01-01T00:00:00Z","source":"RIPE","startAddress":"192.0.2.0","updateDate":"2020-01-01T00:00:00Z","version":"4"}`,
+		`{"class":"inetnum","endAddress":"200.3.15.255","handle":"200.3.0.0/20","name":"Example Telecom","netBlocks":{"netBlock":{"cidrLength":"20","endAddress":"200.3.15.255","startAddress":"200.3.0.0","type":"allocated"}},"orgHandle":"BR-EXTE-LACNIC","pocLinks":{"pocLink":[{"Description":"Admin","Function":"AD","Handle":"EXT"},{"Description":"Tech","Function":"T","Handle":"EXT"}]},"source":"LACNIC","startAddress":"200.3.0.0","updateDate":"20100315","version":"4"}`,
+		`{"class":"route","descr":"Example route","handle":"192.0.2.0/24","mnt-by":["MNT-A","MNT-B"],"origin":"AS64500","route":"192.0.2.0/24","source":"RIPE"}`,
+		`{"class":"aut-num","comment":{"line":[{"Number":"1","Text":"Example AS"},{"Number":"2","Text":"peering # policy"}]},"endAsNumber":"64500","handle":"AS64500","name":"EXAMPLE-AS","orgHandle":"ORG-EX1-RIPE","source":"RIPE","startAsNumber":"64500"}`,
+		`{"class":"person","emails":{"email":"jane@example.com"},"firstName":"Jane Q","handle":"JD1-RIPE","isRoleAccount":"N","lastName":"Doe","phones":{"phone":{"number":{"phoneNumber":"+31 20 000 0000"}}},"source":"RIPE","streetAddress":{"line":[{"Number":"1","Text":"1 Example Street # Suite 2"}]}}`,
+		`{"class":"mntner","handle":"MNT-A","mntner":"MNT-A","source":"RIPE"}`,
+	}
+
+	for i, o := range readRPSLTestDump(t) {
+		rec, err := RPSLRecord(o, "DEFAULT")
+		if err != nil {
+			t.Fatalf("%s %s: %s", o.Class, o.Key, err)
+		}
+		data, _ := json.Marshal(rec)
+		if string(data) != exp[i] {
+			t.Errorf("got %s, expected %s", data, exp[i])
+		}
+	}
+
+	// Objects without a source are labeled with the registry of the dump
+	rec, _ := RPSLRecord(&RPSLObject{Class: "mntner", Key: "M"}, "APNIC")
+	if rec["source"] != "APNIC" {
+		t.Errorf("got source %v, expected APNIC", rec["source"])
+	}
+}
+
+func TestRPSLCSVRecord(t *testing.T) {
+	exp := [][]string{
+		{"192.0.2.0-192.0.2.255", "", "", "TEST-NET", "192.0.2.0", "192.0.2.255", "AA1-RIPE", "", "TT1-RIPE", "AB1-RIPE", "2001-01-01T00:00:00Z", "2020-01-01T00:00:00Z", "4"},
+		{"200.3.0.0/20", "", "BR-EXTE-LACNIC", "Example Telecom", "200.3.0.0", "200.3.15.255", "EXT", "", "EXT", "", "", "20100315", "4"},
+		{"192.0.2.0/24", "AS64500", "Example route", "MNT-A MNT-B", "", ""},
+		{"AS64500", "ORG-EX1-RIPE", "EXAMPLE-AS", "64500", "64500", "", "", "", "", "Example AS\tpeering # policy", "", ""},
+		{"JD1-RIPE", "jane@example.com", "", "", "Jane Q", "Doe", "N", "1 Example Street # Suite 2", "", "", "", "", "", "", "", "+31 20 000 0000", "", "", "", ""},
+		nil,
+	}
+
+	for i, o := range readRPSLTestDump(t) {
+		record, err := RPSLCSVRecord(o)
+		if err != nil {
+			t.Fatalf("%s %s: %s", o.Class, o.Key, err)
+		}
+		if !reflect.DeepEqual(record, exp[i]) {
+			t.Errorf("got %q, expected %q", record, exp[i])
+		}
+	}
+}
+
+func TestParseARINRecordRPSL(t *testing.T) {
+	types := []string{ARINTypeNet, ARINTypeNet, "", ARINTypeASN, ARINTypePOC, ""}
+
+	for i, o := range readRPSLTestDump(t) {
+		rec, _ := RPSLRecord(o, "")
+		data, _ := json.Marshal(rec)
+
+		parsed, err := ParseARINRecord(data)
+		if err != nil {
+			t.Fatalf("%s: %s", data, err)
+		}
+
+		// Routes and maintainers have no ARIN record type and are skipped
+		if len(types[i]) == 0 {
+			if parsed != nil {
+				t.Errorf("%s: got a %s record, expected none", o.Class, parsed.Type)
+			}
+			continue
+		}
+		if parsed == nil || parsed.Type != types[i] {
+			t.Errorf("%s: got %+v, expected a %s record", o.Class, parsed, types[i])
+		}
+	}
+
+	if _, err := ParseARINRecord([]byte(`{"class":"domain","handle":"x"}`)); err == nil {
+		t.Errorf("expected an error for an unsupported class")
+	}
+}
@@ -0,0 +1,168 @@
+package inetdata
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// TimelineSep separates a CSV value from the unix time it was observed, as in
+// "a,192.0.2.1\x011510000000"
+const TimelineSep = "\x01"
+
+// TimelineEntry is a [type, value] pair along with the window in which it was
+// observed. Times are in unix seconds and zero when unknown. Entries are stored
+// as [type, value, first_seen, last_seen, count] arrays.
+type TimelineEntry struct {
+	Type      string
+	Value     string
+	FirstSeen int64
+	LastSeen  int64
+	Count     int64
+}
+
+// MarshalJSON encodes the entry as an array
+func (e TimelineEntry) MarshalJSON() ([]byte, error) {
+	return json.Marshal([]interface{}{e.Type, e.Value, e.FirstSeen, e.LastSeen, e.Count})
+}
+
+// UnmarshalJSON decodes the entry from an array, accepting plain pairs as
+// entries seen once at an unknown time
+func (e *TimelineEntry) UnmarshalJSON(data []byte) error {
+	var raw []json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+
+	// Plain [type, value] pairs and untyped [value] entries from other merge
+	// modes have unknown times and count as a single observation
+	switch len(raw) {
+	case 1:
+		e.Count = 1
+		return json.Unmarshal(raw[0], &e.Value)
+	case 2:
+		e.Count = 1
+		if err := json.Unmarshal(raw[0], &e.Type); err != nil {
+			return err
+		}
+		return json.Unmarshal(raw[1], &e.Value)
+	}
+
+	if len(raw) != 5 {
+		return fmt.Errorf("timeline entry has %d fields", len(raw))
+	}
+
+	if err := json.Unmarshal(raw[0], &e.Type); err != nil {
+		return err
+	}
+	if err := json.Unmarshal(raw[1], &e.Value); err != nil {
+		return err
+	}
+	if err := json.Unmarshal(raw[2], &e.FirstSeen); err != nil {
+		return err
+	}
+	if err := json.Unmarshal(raw[3], &e.LastSeen); err != nil {
+		return err
+	}
+	return json.Unmarshal(raw[4], &e.Count)
+}
+
+// Merge widens the window of the entry to include another observation of the same pair
+func (e *TimelineEntry) Merge(o TimelineEntry) {
+	if o.FirstSeen != 0 && (e.FirstSeen == 0 || o.FirstSeen < e.FirstSeen) {
+		e.FirstSeen = o.FirstSeen
+	}
+	if o.LastSeen > e.LastSeen {
+		e.LastSeen = o.LastSeen
+	}
+	e.Count += o.Count
+}
+
+// AddTimestamp appends an observation time to a CSV value
+func AddTimestamp(val string, ts int64) string {
+	return val + TimelineSep + strconv.FormatInt(ts, 10)
+}
+
+// SplitTimestamp separates a CSV value from its observation time, which is zero
+// if the value has none
+func SplitTimestamp(val string) (string, int64) {
+	idx := strings.LastIndex(val, TimelineSep)
+	if idx < 0 {
+		return val, 0
+	}
+
+	ts, err := strconv.ParseInt(val[idx+1:], 10, 64)
+	if err != nil {
+		return val, 0
+	}
+	return val[0:idx], ts
+}
+
+// TimelineFromValues builds timeline entries from "type,value" CSV values with
+// optional observation times. Values without a type have an empty type.
+func TimelineFromValues(vals []string) []TimelineEntry {
+	entries := []TimelineEntry{}
+	for _, v := range vals {
+		if len(v) == 0 {
+			continue
+		}
+
+		v, ts := SplitTimestamp(v)
+		e := TimelineEntry{FirstSeen: ts, LastSeen: ts, Count: 1}
+
+		if bits := strings.SplitN(v, ",", 2); len(bits) == 2 {
+			e.Type, e.Value = bits[0], bits[1]
+		} else {
+			e.Value = v
+		}
+		entries = append(entries, e)
+	}
+	return MergeTimelines(entries, nil)
+}
+
+// MergeTimelines combines two sets of entries, widening the windows of pairs that
+// appear in both. The result is sorted by type and value.
+func MergeTimelines(a []TimelineEntry, b []TimelineEntry) []TimelineEntry {
+	merged := map[[2]string]*TimelineEntry{}
+	for _, set := range [][]TimelineEntry{a, b} {
+		for i := range set {
+			k := [2]string{set[i].Type, set[i].Value}
+			if e, ok := merged[k]; ok {
+				e.Merge(set[i])
+				continue
+			}
+			e := set[i]
+			merged[k] = &e
+		}
+	}
+
+	out := make([]TimelineEntry, 0, len(merged))
+	for _, e := range merged {
+		out = append(out, *e)
+	}
+
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Type != out[j].Type {
+			return out[i].Type < out[j].Type
+		}
+		return out[i].Value < out[j].Value
+	})
+	return out
+}
+
+// MergeTimelineValues merges two JSON-encoded timelines
+func MergeTimelineValues(val0 []byte, val1 []byte) ([]byte, error) {
+	var v0, v1 []TimelineEntry
+
+	if err := json.Unmarshal(val0, &v0); err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(val1, &v1); err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(MergeTimelines(v0, v1))
+}
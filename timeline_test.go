@@ -0,0 +1,78 @@
+package inetdata
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestTimelineEntryUnmarshal(t *testing.T) {
+	tests := []struct {
+		data string
+		exp  TimelineEntry
+	}{
+		{`["a","192.0.2.1",1500000000,1510000000,4]`, TimelineEntry{"a", "192.0.2.1", 1500000000, 1510000000, 4}},
+		{`["a","192.0.2.1"]`, TimelineEntry{Type: "a", Value: "192.0.2.1", Count: 1}},
+		{`["192.0.2.1"]`, TimelineEntry{Value: "192.0.2.1", Count: 1}},
+	}
+
+	for _, tt := range tests {
+		var e TimelineEntry
+		if err := json.Unmarshal([]byte(tt.data), &e); err != nil {
+			t.Fatalf("%s: %s", tt.data, err)
+		}
+		if e != tt.exp {
+			t.Errorf("%s decoded as %+v, expected %+v", tt.data, e, tt.exp)
+		}
+	}
+
+	for _, data := range []string{`[]`, `["a","b",1]`, `{"a":1}`} {
+		var e TimelineEntry
+		if err := json.Unmarshal([]byte(data), &e); err == nil {
+			t.Errorf("%s decoded without an error", data)
+		}
+	}
+}
+
+func TestMergeTimelineValuesWithPairs(t *testing.T) {
+	// Values written by the combine merge mode count once each when merged
+	// into a timeline
+	pairs := []byte(`[["a","192.0.2.1"],["a","192.0.2.2"]]`)
+	timeline := []byte(`[["a","192.0.2.1",1500000000,1510000000,3]]`)
+
+	merged, err := MergeTimelineValues(pairs, timeline)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got []TimelineEntry
+	if err := json.Unmarshal(merged, &got); err != nil {
+		t.Fatal(err)
+	}
+
+	exp := []TimelineEntry{
+		{"a", "192.0.2.1", 1500000000, 1510000000, 4},
+		{"a", "192.0.2.2", 0, 0, 1},
+	}
+	if !reflect.DeepEqual(got, exp) {
+		t.Fatalf("got %+v, expected %+v", got, exp)
+	}
+}
+
+func TestTimelineFromValues(t *testing.T) {
+	got := TimelineFromValues([]string{
+		AddTimestamp("a,192.0.2.1", 1510000000),
+		AddTimestamp("a,192.0.2.1", 1500000000),
+		"a,192.0.2.1",
+		"192.0.2.9",
+		"",
+	})
+
+	exp := []TimelineEntry{
+		{"", "192.0.2.9", 0, 0, 1},
+		{"a", "192.0.2.1", 1500000000, 1510000000, 3},
+	}
+	if !reflect.DeepEqual(got, exp) {
+		t.Fatalf("got %+v, expected %+v", got, exp)
+	}
+}
@@ -26,6 +26,18 @@ const MTBL_VAL_LIMIT = 1024 * 1024 * 1024
 
 var Split_WS = regexp.MustCompile(`\s+`)
 
+// HasEncodedIPKeys checks whether a MTBL contains binary-encoded IP address keys
+func HasEncodedIPKeys(s mtbl.Source) bool {
+	for _, tag := range []byte{IPKeyTagIPv4, IPKeyTagIPv6} {
+		it := mtbl.IterPrefix(s, []byte{tag})
+		defer it.Destroy()
+		if _, _, ok := it.Next(); ok {
+			return true
+		}
+	}
+	return false
+}
+
 func PrintVersion(app string) {
 	fmt.Fprintf(os.Stderr, "%s v%s\n", app, Version)
 }